@@ -0,0 +1,204 @@
+// Command browse is an interactive file browser for a gopher-fs server: it
+// finds a server, lists its files and downloads the one picked with the
+// arrow keys. All networking goes through internal/client.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopher-fs/internal/client"
+	"gopher-fs/internal/discovery"
+	"gopher-fs/internal/logging"
+	"gopher-fs/internal/protocol"
+	"gopher-fs/internal/security"
+)
+
+func main() {
+	addr := flag.String("addr", "", "Browse this server (host:port) instead of using discovery")
+	glob := flag.String("glob", "", "Only show files matching this pattern (e.g. 'logs/*')")
+	dest := flag.String("output", ".", "Directory downloads are saved in")
+	discoveryToken := flag.String("discovery-token", os.Getenv(discovery.TokenEnv), "Only discover servers using this token (or "+discovery.TokenEnv+")")
+	discoveryTimeout := flag.Duration("discovery-timeout", discovery.DefaultTimeout, "How long to wait for servers to answer discovery")
+	mdns := flag.Bool("mdns", false, "Look for servers advertised over mDNS ("+discovery.MDNSService+") first, falling back to broadcast discovery")
+	pin := flag.String("pin", "", "Only trust a server whose certificate has this SHA-256 fingerprint (hex)")
+	psk := flag.String("psk", os.Getenv(protocol.PSKEnv), "Authenticate to the server with this pre-shared key (or "+protocol.PSKEnv+")")
+	logLevel := flag.String("log-level", "warn", logging.LevelUsage)
+	flag.Parse()
+	if err := logging.Setup(*logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	tlsConfig, err := security.GenerateTLSConfig()
+	if *pin != "" {
+		tlsConfig, err = security.TLSConfigWithPin(*pin)
+	}
+	if err != nil {
+		logging.Fatal("Error configuring TLS", "err", err)
+	}
+	c := client.New(tlsConfig)
+	if *psk != "" {
+		c.PSK = []byte(*psk)
+	}
+	if err := os.MkdirAll(*dest, 0755); err != nil {
+		logging.Fatal("Error creating output directory", "err", err)
+	}
+
+	serverAddr := *addr
+	if serverAddr != "" {
+		if _, _, err := net.SplitHostPort(serverAddr); err != nil {
+			serverAddr = net.JoinHostPort(serverAddr, strings.TrimPrefix(protocol.DefaultTCPPort, ":"))
+		}
+	} else if serverAddr = findServer(*discoveryTimeout, *discoveryToken, *mdns); serverAddr == "" {
+		fmt.Println("No gopher-fs servers found on this network.")
+		fmt.Println("Is one running? If UDP broadcast is blocked, pass its address with -addr host:port.")
+		os.Exit(1)
+	}
+
+	b := &browser{client: c, addr: serverAddr, pattern: *glob, dest: *dest, interactive: isTerminal()}
+	if err := b.run(); err != nil {
+		logging.Fatal("Error browsing server", "addr", serverAddr, "err", err)
+	}
+}
+
+// findServer returns the address of a server found by mDNS if asked to,
+// then by broadcast or, failing that, by its announcements. When several
+// answer the user picks one. It returns "" if there are none.
+func findServer(timeout time.Duration, token string, mdns bool) string {
+	fmt.Println("Looking for servers...")
+	var servers []discovery.Server
+	var err error
+	if mdns {
+		if servers, err = discovery.BrowseMDNS(timeout); err != nil {
+			slog.Warn("mDNS discovery failed", "err", err)
+		}
+	}
+	if len(servers) == 0 {
+		if servers, err = discovery.FindServers(timeout, token); err != nil {
+			slog.Warn("Discovery failed", "err", err)
+		}
+	}
+	if len(servers) == 0 {
+		if servers, err = discovery.ListenForAnnouncements(timeout, token); err != nil {
+			slog.Warn("Passive discovery failed", "err", err)
+		}
+	}
+	switch len(servers) {
+	case 0:
+		return ""
+	case 1:
+		return servers[0].Addr
+	}
+
+	labels := make([]string, len(servers))
+	for i, s := range servers {
+		labels[i] = s.Addr
+		if s.Name != "" {
+			labels[i] = s.Name + " (" + s.Addr + ")"
+		}
+	}
+	if !isTerminal() {
+		return servers[0].Addr
+	}
+	choice, k, err := pick("Several servers answered; pick one", labels, 0)
+	if err != nil || k != keyEnter {
+		os.Exit(0)
+	}
+	return servers[choice].Addr
+}
+
+// browser is one browsing session against a server
+type browser struct {
+	client      *client.Client
+	addr        string
+	pattern     string
+	dest        string
+	interactive bool // stdin is a terminal the picker can drive
+}
+
+// run lists the server's files and downloads picked ones until the user
+// quits
+func (b *browser) run() error {
+	cursor := 0
+	for {
+		entries, err := b.client.List(context.Background(), b.addr, b.pattern)
+		if err != nil {
+			return err
+		}
+		if !b.interactive {
+			return b.runPlain(entries)
+		}
+
+		title := fmt.Sprintf("%s — %d files (↑/↓ to move, Enter to download, r to refresh, q to quit)", b.addr, len(entries))
+		if len(entries) == 0 {
+			title = fmt.Sprintf("%s — no files yet (r to refresh, q to quit)", b.addr)
+		}
+		choice, k, err := pick(title, describe(entries), cursor)
+		if err != nil {
+			return err
+		}
+		switch k {
+		case keyQuit:
+			return nil
+		case keyRefresh:
+			continue
+		}
+		cursor = choice
+		b.download(entries[choice])
+		waitForEnter()
+	}
+}
+
+// runPlain lists the files once without a picker, for when stdin isn't a
+// terminal: the chosen file's number is read as a line of input
+func (b *browser) runPlain(entries []protocol.FileEntry) error {
+	if len(entries) == 0 {
+		fmt.Printf("No files on %s\n", b.addr)
+		return nil
+	}
+	for i, line := range describe(entries) {
+		fmt.Printf("%3d) %s\n", i+1, line)
+	}
+	fmt.Print("Download which file? ")
+	var n int
+	if _, err := fmt.Scanln(&n); err != nil || n < 1 || n > len(entries) {
+		return errors.New("no valid file number given")
+	}
+	b.download(entries[n-1])
+	return nil
+}
+
+// download fetches one listed file into the output directory, showing
+// the progress bar
+func (b *browser) download(e protocol.FileEntry) {
+	target := filepath.Join(b.dest, path.Base(e.Name))
+	fmt.Printf("Downloading %s to %s\n", e.Name, target)
+	b.client.ShowProgress = true
+	start := time.Now()
+	err := b.client.DownloadFile(context.Background(), b.addr, e.Name, target)
+	fmt.Println() // end the progress bar line
+	if err != nil {
+		fmt.Printf("❌ %s: %v\n", e.Name, err)
+		return
+	}
+	fmt.Printf("✅ %s (%d bytes, verified) in %v\n", target, e.Size, time.Since(start).Round(time.Millisecond))
+}
+
+// describe formats entries as picker lines
+func describe(entries []protocol.FileEntry) []string {
+	lines := make([]string, len(entries))
+	for i, e := range entries {
+		lines[i] = fmt.Sprintf("%12d  %s  %s", e.Size, time.Unix(0, e.ModTime).Format("2006-01-02 15:04"), e.Name)
+	}
+	return lines
+}
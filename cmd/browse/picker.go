@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// key is a keypress the picker acts on
+type key int
+
+const (
+	keyNone key = iota
+	keyUp
+	keyDown
+	keyPageUp
+	keyPageDown
+	keyEnter
+	keyRefresh
+	keyQuit
+)
+
+// decodeKey maps the bytes of one read from a raw-mode terminal to a key
+func decodeKey(b []byte) key {
+	switch string(b) {
+	case "\x1b[A", "\x1bOA", "k":
+		return keyUp
+	case "\x1b[B", "\x1bOB", "j":
+		return keyDown
+	case "\x1b[5~":
+		return keyPageUp
+	case "\x1b[6~":
+		return keyPageDown
+	case "\r", "\n":
+		return keyEnter
+	case "r":
+		return keyRefresh
+	case "q", "\x1b", "\x03": // q, Esc, Ctrl-C
+		return keyQuit
+	}
+	return keyNone
+}
+
+func isTerminal() bool {
+	return term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// pick draws title and items full-screen and lets the user move a cursor,
+// starting at cursor, until they choose an item with Enter (returned with
+// its index) or press r or q (keyRefresh or keyQuit). Enter does nothing
+// while there are no items.
+func pick(title string, items []string, cursor int) (int, key, error) {
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return 0, keyNone, err
+	}
+	defer func() {
+		term.Restore(fd, state)
+		fmt.Print("\x1b[?25h\x1b[H\x1b[2J") // show the cursor, clear
+	}()
+	fmt.Print("\x1b[?25l") // hide the cursor while picking
+
+	cursor = min(max(cursor, 0), max(len(items)-1, 0))
+	buf := make([]byte, 8)
+	for {
+		rows := pageSize()
+		draw(title, items, cursor, rows)
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return 0, keyNone, err
+		}
+		switch k := decodeKey(buf[:n]); k {
+		case keyUp:
+			cursor = max(cursor-1, 0)
+		case keyDown:
+			cursor = min(cursor+1, max(len(items)-1, 0))
+		case keyPageUp:
+			cursor = max(cursor-rows, 0)
+		case keyPageDown:
+			cursor = min(cursor+rows, max(len(items)-1, 0))
+		case keyEnter:
+			if len(items) > 0 {
+				return cursor, k, nil
+			}
+		case keyRefresh, keyQuit:
+			return cursor, k, nil
+		}
+	}
+}
+
+// pageSize is how many items fit on screen below the title
+func pageSize() int {
+	_, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || height < 4 {
+		return 20
+	}
+	return height - 3
+}
+
+// draw renders the window of rows items that keeps cursor in view, with
+// the cursor's item in reverse video. The terminal is in raw mode, so
+// lines end in \r\n.
+func draw(title string, items []string, cursor, rows int) {
+	var sb strings.Builder
+	sb.WriteString("\x1b[H\x1b[2J")
+	sb.WriteString(title + "\r\n\r\n")
+	first := 0
+	if cursor >= rows {
+		first = cursor - rows + 1
+	}
+	for i := first; i < len(items) && i < first+rows; i++ {
+		if i == cursor {
+			sb.WriteString("\x1b[7m> " + items[i] + "\x1b[0m\r\n")
+		} else {
+			sb.WriteString("  " + items[i] + "\r\n")
+		}
+	}
+	fmt.Print(sb.String())
+}
+
+// waitForEnter pauses after a download so its outcome can be read before
+// the list is redrawn
+func waitForEnter() {
+	fmt.Print("Press Enter to return to the list")
+	bufio.NewReader(os.Stdin).ReadString('\n')
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopher-fs/internal/protocol"
+)
+
+// printChecksums prints the SHA-256 of every file named in paths, and of
+// every regular file below those that are directories, one per line in
+// the format sha256sum -c reads. The digest comes from
+// protocol.ComputeChecksum, as for a transfer. Files that can't be read
+// are reported on stderr; it returns false if there were any.
+func printChecksums(paths []string) bool {
+	ok := true
+	fail := func(path string, err error) {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		ok = false
+	}
+	for _, root := range paths {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				fail(path, err)
+				return nil
+			}
+			if d.IsDir() || !d.Type().IsRegular() && path != root {
+				return nil // symlinks are only followed when named directly
+			}
+			sum, err := fileChecksum(path)
+			if err != nil {
+				fail(path, err)
+				return nil
+			}
+			fmt.Println(checksumLine(sum, path))
+			return nil
+		})
+		if err != nil {
+			fail(root, err)
+		}
+	}
+	return ok
+}
+
+func fileChecksum(path string) ([32]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	defer f.Close()
+	return protocol.ComputeChecksum(f)
+}
+
+// checksumLine formats one sha256sum line: the hex digest, two spaces and
+// the name. Like sha256sum, a name containing a backslash or newline is
+// escaped and the line marked with a leading backslash.
+func checksumLine(sum [32]byte, name string) string {
+	line := hex.EncodeToString(sum[:]) + "  "
+	if strings.ContainsAny(name, "\\\n") {
+		name = strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(name)
+		line = "\\" + line
+	}
+	return line + name
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"gopher-fs/internal/client"
+)
+
+// Results of one file's upload to one target
+const (
+	targetUploaded = "uploaded"
+	targetSkipped  = "skipped"
+	targetFailed   = "failed"
+)
+
+// uploadToTargets uploads the local file or directory filename to every
+// server in addrs, working on at most workers servers at once. Each server
+// gets the files one at a time, skipping those it already holds, and a
+// failure on one server never stops the others. Once all are done the
+// results are reported as a file×target matrix, and the client exits
+// non-zero if any upload failed.
+func uploadToTargets(addrs []string, filename string, workers int) {
+	files, names := uploadSet(filename)
+
+	// Bars and progress milestones from several uploads would interleave
+	transferClient.ShowProgress = false
+	transferClient.OnUploadProgress = nil
+
+	results := make([][]string, len(names)) // [file][target]
+	for i := range results {
+		results[i] = make([]string, len(addrs))
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < min(workers, len(addrs)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range jobs {
+				for f, result := range uploadToTarget(addrs[t], files, names) {
+					results[f][t] = result
+				}
+			}
+		}()
+	}
+	for t := range addrs {
+		jobs <- t
+	}
+	close(jobs)
+	wg.Wait()
+
+	matrix := matrixEvent{Targets: addrs}
+	for f, name := range names {
+		matrix.Files = append(matrix.Files, matrixRow{Name: name, Results: results[f]})
+		for _, result := range results[f] {
+			if result == targetFailed {
+				exitCode = 1
+			}
+		}
+	}
+	out.report(matrix)
+}
+
+// uploadToTarget uploads each of names (files maps them to local paths)
+// to serverAddr, returning their results in order. Once the server can't
+// be reached, the files left are failed without trying it again.
+func uploadToTarget(serverAddr string, files map[string]string, names []string) []string {
+	results := make([]string, len(names))
+	var down error
+	for i, name := range names {
+		if down != nil {
+			results[i] = targetFailed
+			out.report(fileEvent{Name: name, Target: serverAddr, Action: "uploaded", Error: down.Error()})
+			continue
+		}
+		skipped, err := uploadTo(serverAddr, files[name], name)
+		switch {
+		case err != nil:
+			results[i] = targetFailed
+			out.report(fileEvent{Name: name, Target: serverAddr, Action: "uploaded", Error: err.Error()})
+			// A refusal is about this file; anything else is the server
+			if !errors.As(err, new(*client.AckError)) {
+				slog.Warn("Giving up on target", "server", serverAddr, "err", err)
+				down = fmt.Errorf("not sent after an earlier failure: %w", err)
+			}
+		case skipped:
+			results[i] = targetSkipped
+			out.report(fileEvent{Name: name, Target: serverAddr, Action: "skipped"})
+		default:
+			results[i] = targetUploaded
+			out.report(fileEvent{Name: name, Target: serverAddr, Action: "uploaded"})
+		}
+	}
+	return results
+}
+
+// uploadTo sends the local file filename to serverAddr as remoteName,
+// unless the server already holds the same copy
+func uploadTo(serverAddr, filename, remoteName string) (skipped bool, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if alreadyOnServer(serverAddr, remoteName, file, info.Size()) {
+		return true, nil
+	}
+	slog.Info("Uploading", "file", filename, "server", serverAddr, "size", info.Size())
+	return false, transferClient.Upload(ctx, serverAddr, remoteName, file, info.Size())
+}
+
+// uploadSet lists what an upload of the local file or directory filename
+// sends, as server names in walk order and a map of them to local paths,
+// exiting if it can't be read
+func uploadSet(filename string) (map[string]string, []string) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		fatal("Error opening file", "file", filename, "err", err)
+	}
+	if !info.IsDir() {
+		if !info.Mode().IsRegular() {
+			fatal("Only regular files and directories can be uploaded", "file", filename, "type", info.Mode().Type().String())
+		}
+		name := remotePath(filepath.Base(filename))
+		return map[string]string{name: filename}, []string{name}
+	}
+	target, err := filepath.EvalSymlinks(filename)
+	if err != nil {
+		fatal("Error resolving file", "file", filename, "err", err)
+	}
+	files, names, err := walkUploads(target, remotePath(filepath.Base(filepath.Clean(filename))))
+	if err != nil {
+		fatal("Error walking directory", "dir", filename, "err", err)
+	}
+	return files, names
+}
+
+// matrixEvent sums up an upload to several targets: the result of every
+// file on every target
+type matrixEvent struct {
+	Targets []string    `json:"targets"`
+	Files   []matrixRow `json:"files"`
+}
+
+// matrixRow is one file's results, in the order of the targets
+type matrixRow struct {
+	Name    string   `json:"name"`
+	Results []string `json:"results"` // uploaded, skipped or failed
+}
+
+func (matrixEvent) kind() string { return "matrix" }
+func (e matrixEvent) text() string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "\t%s\n", strings.Join(e.Targets, "\t"))
+	failed := 0
+	for _, row := range e.Files {
+		fmt.Fprintf(w, "%s\t%s\n", row.Name, strings.Join(row.Results, "\t"))
+		for _, result := range row.Results {
+			if result == targetFailed {
+				failed++
+			}
+		}
+	}
+	w.Flush()
+	total := len(e.Files) * len(e.Targets)
+	fmt.Fprintf(&b, "%d of %d uploads to %d targets succeeded", total-failed, total, len(e.Targets))
+	return b.String()
+}
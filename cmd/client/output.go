@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"gopher-fs/internal/logging"
+	"gopher-fs/internal/protocol"
+)
+
+// Everything the client tells the user on stdout is an event, reported
+// through out. Events print as the familiar human-readable lines; -json
+// swaps the encoder for one that prints each event as a JSON object on a
+// line of its own, named by its "event" field, so scripts can follow a
+// transfer without scraping messages. Logs stay on stderr either way.
+type event interface {
+	kind() string // the "event" field in JSON
+	text() string // the human-readable form, "" for nothing
+}
+
+// output writes events to w, encoded by encode. Empty encodings are
+// skipped.
+type output struct {
+	w      io.Writer
+	encode func(event) string
+
+	// errW, when set (by -quiet), takes the failures, and every other
+	// event but listings, which were asked for, is dropped
+	errW io.Writer
+}
+
+var out = &output{w: os.Stdout, encode: event.text}
+
+func (o *output) report(e event) {
+	w := o.w
+	if o.errW != nil {
+		switch {
+		case failure(e):
+			w = o.errW
+		case e.kind() != "entry":
+			return
+		}
+	}
+	if s := o.encode(e); s != "" {
+		fmt.Fprintln(w, s)
+	}
+}
+
+// failure reports whether e tells of something that went wrong
+func failure(e event) bool {
+	switch e := e.(type) {
+	case errorEvent:
+		return true
+	case checksumEvent:
+		return e.Result == checksumMismatch
+	case fileEvent:
+		return e.Error != "" || e.Action == "missing"
+	case verifyEvent:
+		return e.Result != checksumMatch
+	case stageEvent:
+		return e.Result == stageFail
+	}
+	return false
+}
+
+// jsonEvent encodes e as a JSON object with its kind in an "event" field
+// ahead of its own fields
+func jsonEvent(e event) string {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return jsonEvent(errorEvent{Message: "Error encoding " + e.kind() + " event: " + err.Error()})
+	}
+	head := fmt.Sprintf(`{"event":%q`, e.kind())
+	if len(data) > 2 {
+		head += ","
+	}
+	return head + string(data[1:])
+}
+
+// fatal reports msg and the key-value pairs in args as an error event,
+// then logs them and exits like logging.Fatal
+func fatal(msg string, args ...any) {
+	e := errorEvent{Message: msg}
+	for i := 0; i+1 < len(args); i += 2 {
+		if e.Details == nil {
+			e.Details = make(map[string]any)
+		}
+		v := args[i+1]
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		e.Details[fmt.Sprint(args[i])] = v
+	}
+	out.report(e)
+	logging.Fatal(msg, args...)
+}
+
+// progressStep is how far (in percent) a transfer must advance before
+// another progress event is reported
+const progressStep = 10
+
+// progressEvents returns a client progress callback reporting every
+// progressStep percent of a transfer. A count that goes back down is the
+// next transfer, which is reported from the start again. An empty
+// transfer is reported at 100%.
+func progressEvents(op string) func(current, total int64) {
+	next, last := progressStep, int64(0)
+	return func(current, total int64) {
+		if total <= 0 {
+			out.report(progressEvent{Op: op, Percent: 100})
+			return
+		}
+		if current < last {
+			next = progressStep
+		}
+		last = current
+		percent := int(current * 100 / total)
+		if percent < next {
+			return
+		}
+		out.report(progressEvent{Op: op, Bytes: current, Total: total, Percent: percent})
+		next = (percent/progressStep + 1) * progressStep
+	}
+}
+
+// discoveryEvent names the server discovery found
+type discoveryEvent struct {
+	Addr string `json:"addr"`
+}
+
+func (discoveryEvent) kind() string   { return "discovery" }
+func (e discoveryEvent) text() string { return "" }
+
+// headerEvent describes a file the server is about to send
+type headerEvent struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Algo     string    `json:"algo"`
+	Checksum string    `json:"checksum"`
+	ModTime  time.Time `json:"mod_time,omitempty"`
+}
+
+func newHeaderEvent(h protocol.FileHeader) headerEvent {
+	e := headerEvent{Name: h.Name, Size: h.Size, Algo: h.Algo.String(), Checksum: hex.EncodeToString(h.Checksum)}
+	if h.ModTime != 0 {
+		e.ModTime = time.Unix(0, h.ModTime)
+	}
+	return e
+}
+
+func (headerEvent) kind() string { return "header" }
+func (e headerEvent) text() string {
+	return fmt.Sprintf("File Found: %s (%d bytes)\nServer Checksum (%s): %s", e.Name, e.Size, e.Algo, e.Checksum)
+}
+
+// progressEvent is a milestone of a transfer; the text form draws a bar
+// instead
+type progressEvent struct {
+	Op      string `json:"op"` // "upload" or "download"
+	Bytes   int64  `json:"bytes"`
+	Total   int64  `json:"total"`
+	Percent int    `json:"percent"`
+}
+
+func (progressEvent) kind() string   { return "progress" }
+func (e progressEvent) text() string { return "" }
+
+// reconnectEvent reports a download reconnecting after its connection
+// dropped, to carry on from Offset
+type reconnectEvent struct {
+	Attempt  int    `json:"attempt"`
+	Attempts int    `json:"attempts"`
+	Offset   int64  `json:"offset"`
+	Error    string `json:"error"`
+}
+
+func (reconnectEvent) kind() string { return "reconnect" }
+func (e reconnectEvent) text() string {
+	return fmt.Sprintf("Connection lost (%s); resuming from byte %d, attempt %d of %d", e.Error, e.Offset, e.Attempt, e.Attempts)
+}
+
+// Results of a checksumEvent
+const (
+	checksumMatch      = "match"
+	checksumMismatch   = "mismatch"
+	checksumUnverified = "unverified"
+)
+
+// checksumEvent is the integrity check of a transfer, made by the client
+// for downloads and by the server for uploads
+type checksumEvent struct {
+	Name     string `json:"name"`
+	Verifier string `json:"verifier"` // "client" or "server"
+	Result   string `json:"result"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+	KeptAs   string `json:"kept_as,omitempty"` // where a mismatching download was kept
+}
+
+func (checksumEvent) kind() string { return "checksum" }
+func (e checksumEvent) text() string {
+	switch {
+	case e.Verifier == "server" && e.Result == checksumMatch:
+		return "✅ Server verified integrity"
+	case e.Verifier == "server":
+		return "❌ Server reported checksum mismatch"
+	case e.Result == checksumUnverified:
+		return "⚠️  Integrity not verified (-no-verify)"
+	case e.Result == checksumMatch:
+		return "✅ Integrity Verified: Checksum matches!"
+	}
+	s := "❌ Integrity Failure: Checksum mismatch!"
+	if e.Actual != "" {
+		s = "Client Checksum: " + e.Actual + "\n" + s
+	}
+	if e.KeptAs != "" {
+		s += "\nKept the received data as " + e.KeptAs
+	}
+	return s
+}
+
+// entryEvent is one server file of a listing. A partial one is an upload
+// still in progress, of which Received of Size bytes have arrived.
+type entryEvent struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	Partial  bool      `json:"partial,omitempty"`
+	Received int64     `json:"received,omitempty"`
+}
+
+func (entryEvent) kind() string { return "entry" }
+func (e entryEvent) text() string {
+	s := fmt.Sprintf("%12d  %s  %s", e.Size, e.ModTime.Format("2006-01-02 15:04"), e.Name)
+	if e.Partial {
+		percent := 100
+		if e.Size > 0 {
+			percent = int(e.Received * 100 / e.Size)
+		}
+		s += fmt.Sprintf("  (uploading: %d bytes, %d%%)", e.Received, percent)
+	}
+	return s
+}
+
+// fileEvent is the outcome for one file of a multi-file operation
+type fileEvent struct {
+	Name   string `json:"name"`
+	Target string `json:"target,omitempty"` // the server, when uploading to several
+	Action string `json:"action"`           // downloaded, uploaded, deleted, skipped or missing
+	Bytes  int64  `json:"bytes,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (fileEvent) kind() string { return "file" }
+func (e fileEvent) text() string {
+	name := e.Name
+	if e.Target != "" {
+		name += " on " + e.Target
+	}
+	switch {
+	case e.Error != "":
+		return fmt.Sprintf("❌ %s: %s", name, e.Error)
+	case e.Action == "downloaded":
+		return fmt.Sprintf("✅ %s (%d bytes)", name, e.Bytes)
+	case e.Action == "skipped":
+		return name + " already present, skipped"
+	case e.Action == "missing":
+		return "❌ " + name + " is missing on the server"
+	}
+	return "✅ " + e.Action + " " + name
+}
+
+// manifestEvent is the server's answer to a directory upload's manifest:
+// which of its files still need sending
+type manifestEvent struct {
+	Missing []string `json:"missing"`
+	Files   int      `json:"files"`
+}
+
+func (manifestEvent) kind() string { return "manifest" }
+func (e manifestEvent) text() string {
+	return fmt.Sprintf("%d of %d files to upload", len(e.Missing), e.Files)
+}
+
+// verifyEvent is the check of one local file against a manifest. Files
+// that match only show up in JSON.
+type verifyEvent struct {
+	Name     string `json:"name"`
+	Result   string `json:"result"` // match, mismatch, missing, extra or error
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (verifyEvent) kind() string { return "verify" }
+func (e verifyEvent) text() string {
+	switch e.Result {
+	case checksumMatch:
+		return ""
+	case verifyMissing:
+		return "❌ " + e.Name + " is missing"
+	case verifyExtra:
+		return "❌ " + e.Name + " is not in the manifest"
+	case verifyError:
+		return fmt.Sprintf("❌ %s: %s", e.Name, e.Error)
+	}
+	return fmt.Sprintf("❌ %s doesn't match: %s, want %s", e.Name, e.Actual, e.Expected)
+}
+
+// stageEvent is the outcome of one stage of -selftest
+type stageEvent struct {
+	Stage   string  `json:"stage"`
+	Result  string  `json:"result"` // pass, fail or skipped
+	Bytes   int64   `json:"bytes,omitempty"`
+	Seconds float64 `json:"seconds"`
+	Error   string  `json:"error,omitempty"`
+}
+
+func (stageEvent) kind() string { return "selftest" }
+func (e stageEvent) text() string {
+	switch e.Result {
+	case stageSkipped:
+		return fmt.Sprintf("⏭️  %-8s skipped", e.Stage)
+	case stageFail:
+		return fmt.Sprintf("❌ %-8s failed after %v: %s", e.Stage, seconds(e.Seconds), e.Error)
+	}
+	s := fmt.Sprintf("✅ %-8s %v", e.Stage, seconds(e.Seconds))
+	if e.Bytes > 0 && e.Seconds > 0 {
+		s += fmt.Sprintf(" (%.1f MB/s)", float64(e.Bytes)/e.Seconds/1e6)
+	}
+	return s
+}
+
+// seconds is s as a duration rounded for display
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second)).Round(time.Microsecond)
+}
+
+// planEvent lists the changes a sync is about to make
+type planEvent struct {
+	Add    []string `json:"add"`
+	Update []string `json:"update"`
+	Delete []string `json:"delete"`
+	Kept   int      `json:"kept"` // server-only files left alone without -delete
+}
+
+func (planEvent) kind() string { return "plan" }
+func (e planEvent) text() string {
+	var b strings.Builder
+	for _, group := range []struct {
+		mark  string
+		names []string
+	}{{"+", e.Add}, {"~", e.Update}, {"-", e.Delete}} {
+		for _, name := range group.names {
+			fmt.Fprintf(&b, "%s %s\n", group.mark, name)
+		}
+	}
+	fmt.Fprintf(&b, "Plan: %d to add, %d to update, %d to delete", len(e.Add), len(e.Update), len(e.Delete))
+	if e.Kept > 0 {
+		fmt.Fprintf(&b, "\n%d server files not present locally are kept (pass -delete to remove them)", e.Kept)
+	}
+	return b.String()
+}
+
+// doneEvent is the final status of an operation, or of each file of a
+// -glob download. An empty Message only shows up in JSON.
+type doneEvent struct {
+	Message string  `json:"message,omitempty"`
+	Op      string  `json:"op"`
+	Path    string  `json:"path,omitempty"`
+	Files   int     `json:"files,omitempty"`
+	Failed  int     `json:"failed,omitempty"`
+	Bytes   int64   `json:"bytes,omitempty"`
+	Seconds float64 `json:"seconds,omitempty"`
+}
+
+func (doneEvent) kind() string   { return "done" }
+func (e doneEvent) text() string { return e.Message }
+
+// errorEvent reports what made the client give up. The text form is
+// empty since the same error is logged to stderr.
+type errorEvent struct {
+	Message string         `json:"message"`
+	Details map[string]any `json:"details,omitempty"`
+}
+
+func (errorEvent) kind() string   { return "error" }
+func (e errorEvent) text() string { return "" }
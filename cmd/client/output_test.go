@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestJSONEvent(t *testing.T) {
+	line := jsonEvent(fileEvent{Name: "a.txt", Action: "uploaded", Bytes: 3})
+	if !strings.HasPrefix(line, `{"event":"file",`) {
+		t.Errorf("event name isn't first: %s", line)
+	}
+	var got map[string]any
+	if err := json.Unmarshal([]byte(line), &got); err != nil {
+		t.Fatalf("invalid JSON %s: %v", line, err)
+	}
+	if got["name"] != "a.txt" || got["action"] != "uploaded" || got["bytes"] != 3.0 {
+		t.Errorf("decoded %v", got)
+	}
+	if _, ok := got["error"]; ok {
+		t.Error("empty error field was encoded")
+	}
+
+	// An event with no fields set still encodes to a valid object
+	if line := jsonEvent(errorEvent{}); line != `{"event":"error","message":""}` {
+		t.Errorf("jsonEvent(errorEvent{}) = %s", line)
+	}
+	if line := jsonEvent(planEvent{}); json.Unmarshal([]byte(line), &got) != nil {
+		t.Errorf("invalid JSON %s", line)
+	}
+}
+
+func TestProgressEventsMilestones(t *testing.T) {
+	var buf bytes.Buffer
+	saved := *out
+	defer func() { *out = saved }()
+	*out = output{w: &buf, encode: jsonEvent}
+
+	progress := progressEvents("download")
+	for _, n := range []int64{5, 15, 18, 55, 100} {
+		progress(n, 100)
+	}
+	progress(0, 0)                      // an empty file
+	progress(50, 100)                   // and the next
+	want := []int{15, 55, 100, 100, 50} // where each 10% step was crossed
+
+	var got []int
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var e progressEvent
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("invalid JSON %s: %v", line, err)
+		}
+		got = append(got, e.Percent)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("reported %v percent, want %v", got, want)
+	}
+}
+
+func TestQuietOutputOnlyReportsFailures(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	o := output{w: &stdout, encode: event.text, errW: &stderr}
+
+	o.report(headerEvent{Name: "a.txt", Size: 1})
+	o.report(checksumEvent{Name: "a.txt", Verifier: "client", Result: checksumMatch})
+	o.report(fileEvent{Name: "a.txt", Action: "uploaded"})
+	o.report(doneEvent{Message: "Downloaded 1 bytes", Op: "download"})
+	o.report(entryEvent{Name: "listed.txt"})
+	o.report(fileEvent{Name: "b.txt", Action: "uploaded", Error: "refused"})
+	o.report(checksumEvent{Name: "c.txt", Verifier: "client", Result: checksumMismatch})
+
+	if got := stdout.String(); !strings.Contains(got, "listed.txt") || strings.Count(got, "\n") != 1 {
+		t.Errorf("stdout = %q, want only the listing", got)
+	}
+	if got := stderr.String(); !strings.Contains(got, "b.txt: refused") || !strings.Contains(got, "mismatch") || strings.Contains(got, "a.txt") {
+		t.Errorf("stderr = %q, want only the two failures", got)
+	}
+}
+
+func TestMatrixEventText(t *testing.T) {
+	e := matrixEvent{
+		Targets: []string{"a:9000", "b:9000"},
+		Files: []matrixRow{
+			{Name: "x.txt", Results: []string{targetUploaded, targetFailed}},
+			{Name: "dir/y.txt", Results: []string{targetSkipped, targetUploaded}},
+		},
+	}
+	lines := strings.Split(e.text(), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("text has %d lines, want 4:\n%s", len(lines), e.text())
+	}
+	// Columns line up under their target
+	col := strings.Index(lines[0], "b:9000")
+	if col < 0 || !strings.HasPrefix(lines[1][col:], targetFailed) || !strings.HasPrefix(lines[2][col:], targetUploaded) {
+		t.Errorf("misaligned matrix:\n%s", e.text())
+	}
+	if lines[3] != "3 of 4 uploads to 2 targets succeeded" {
+		t.Errorf("summary = %q", lines[3])
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "gopher-fs/internal/ui"
+
+// watchPause does nothing: there is no SIGTSTP on this platform
+func watchPause(p *ui.Pauser) {}
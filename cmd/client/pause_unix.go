@@ -0,0 +1,28 @@
+//go:build unix
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"gopher-fs/internal/ui"
+)
+
+// watchPause toggles p on every SIGTSTP, so Ctrl-Z pauses a transfer and
+// pressing it again resumes it, instead of the shell suspending the client
+func watchPause(p *ui.Pauser) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTSTP)
+	go func() {
+		for range sig {
+			if p.Toggle() {
+				slog.Info("Transfer paused; press Ctrl-Z again to resume")
+			} else {
+				slog.Info("Transfer resumed")
+			}
+		}
+	}()
+}
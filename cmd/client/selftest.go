@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// selfTestSize is the size of the file -selftest sends round trip
+const selfTestSize = 1 << 20
+
+// Stages of -selftest, in the order they run
+const (
+	stageUpload   = "upload"
+	stageStat     = "stat"
+	stageDownload = "download"
+	stageCompare  = "compare"
+	stageDelete   = "delete"
+)
+
+// Results of a stage
+const (
+	stagePass    = "pass"
+	stageFail    = "fail"
+	stageSkipped = "skipped"
+)
+
+// selfTest checks a deployment end to end: it runs runSelfTest against
+// serverAddr, reports every stage and a summary, and makes the client
+// exit non-zero if any stage failed
+func selfTest(serverAddr string) {
+	// A bar for a 1 MiB file would only get in the way of the stages
+	transferClient.ShowProgress = false
+	transferClient.OnUploadProgress = nil
+	transferClient.OnDownloadProgress = nil
+
+	start := time.Now()
+	stages := runSelfTest(serverAddr, remotePath(fmt.Sprintf("gopher-selftest-%d.bin", start.UnixNano())))
+	failed := 0
+	for _, s := range stages {
+		out.report(s)
+		if s.Result == stageFail {
+			failed++
+		}
+	}
+	elapsed := time.Since(start)
+	done := doneEvent{Op: "selftest", Path: serverAddr, Failed: failed, Bytes: selfTestSize, Seconds: elapsed.Seconds()}
+	if failed > 0 {
+		done.Message = fmt.Sprintf("❌ Self-test of %s failed: %d of %d stages failed", serverAddr, failed, len(stages))
+		exitCode = 1
+	} else {
+		done.Message = fmt.Sprintf("✅ Self-test of %s passed in %v", serverAddr, elapsed.Round(time.Millisecond))
+	}
+	out.report(done)
+}
+
+// runSelfTest uploads a generated file as name with transferClient, asks
+// the server for its checksum, downloads it back into memory, compares it
+// with what was sent and deletes it again. Once a stage fails the rest are
+// skipped, but a file that was uploaded is still deleted.
+func runSelfTest(serverAddr, name string) []stageEvent {
+	var stages []stageEvent
+	failed := false
+	run := func(stage string, n int64, f func() error) {
+		e := stageEvent{Stage: stage, Result: stageSkipped}
+		if !failed {
+			start := time.Now()
+			err := f()
+			e.Seconds = time.Since(start).Seconds()
+			if err != nil {
+				e.Result, e.Error, failed = stageFail, err.Error(), true
+			} else {
+				e.Result, e.Bytes = stagePass, n
+			}
+		}
+		stages = append(stages, e)
+	}
+
+	data := make([]byte, selfTestSize)
+	if _, err := rand.Read(data); err != nil {
+		return []stageEvent{{Stage: stageUpload, Result: stageFail, Error: "generating data: " + err.Error()}}
+	}
+	sum, err := transferClient.Checksum.Compute(bytes.NewReader(data))
+	if err != nil {
+		return []stageEvent{{Stage: stageUpload, Result: stageFail, Error: err.Error()}}
+	}
+
+	uploaded := false
+	run(stageUpload, selfTestSize, func() error {
+		err := transferClient.Upload(ctx, serverAddr, name, bytes.NewReader(data), selfTestSize)
+		uploaded = err == nil
+		return err
+	})
+	run(stageStat, 0, func() error {
+		h, found, err := transferClient.Stat(ctx, serverAddr, name)
+		switch {
+		case err != nil:
+			return err
+		case !found:
+			return errors.New("uploaded file not found on the server")
+		case h.Size != selfTestSize:
+			return fmt.Errorf("server holds %d bytes, sent %d", h.Size, selfTestSize)
+		case h.Algo == transferClient.Checksum && !bytes.Equal(h.Checksum, sum):
+			return fmt.Errorf("server checksum %s, sent %s", hex.EncodeToString(h.Checksum), hex.EncodeToString(sum))
+		}
+		return nil
+	})
+	var received bytes.Buffer
+	run(stageDownload, selfTestSize, func() error {
+		return transferClient.Download(ctx, serverAddr, name, &received)
+	})
+	run(stageCompare, 0, func() error {
+		got, err := transferClient.Checksum.Compute(bytes.NewReader(received.Bytes()))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got, sum) || !bytes.Equal(received.Bytes(), data) {
+			return fmt.Errorf("downloaded %d bytes with checksum %s, sent %d with %s", received.Len(), hex.EncodeToString(got), len(data), hex.EncodeToString(sum))
+		}
+		return nil
+	})
+
+	// Clean up even after a failure, but only what this run left behind
+	failed = failed && !uploaded
+	run(stageDelete, 0, func() error {
+		return transferClient.Delete(ctx, serverAddr, name)
+	})
+	return stages
+}
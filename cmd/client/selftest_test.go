@@ -0,0 +1,62 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"gopher-fs/internal/client"
+	"gopher-fs/internal/security"
+	"gopher-fs/internal/server"
+)
+
+func TestRunSelfTest(t *testing.T) {
+	tlsConfig, err := security.GenerateTLSConfig()
+	if err != nil {
+		t.Fatalf("GenerateTLSConfig: %v", err)
+	}
+	srv := server.New("", tlsConfig)
+	store := server.NewMemoryStore(0)
+	srv.Store = store
+	l, err := srv.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	go srv.Serve(l)
+
+	pinned, err := security.TLSConfigWithPin(security.Fingerprint(tlsConfig.Certificates[0].Certificate[0]))
+	if err != nil {
+		t.Fatalf("TLSConfigWithPin: %v", err)
+	}
+	saved := transferClient
+	defer func() { transferClient = saved }()
+	transferClient = client.New(pinned)
+	transferClient.DialAttempts = 1
+
+	check := func(stages []stageEvent, want []string) {
+		t.Helper()
+		var got []string
+		for _, s := range stages {
+			got = append(got, s.Stage+" "+s.Result)
+		}
+		if !slices.Equal(got, want) {
+			t.Fatalf("stages = %v, want %v", got, want)
+		}
+	}
+
+	check(runSelfTest(l.Addr().String(), "selftest.bin"), []string{
+		"upload pass", "stat pass", "download pass", "compare pass", "delete pass",
+	})
+	if files, err := store.List(); err != nil || len(files) != 0 {
+		t.Errorf("store after the self-test = %v, %v; want it empty", files, err)
+	}
+
+	// A refused upload leaves nothing to delete
+	stages := runSelfTest(l.Addr().String(), "../selftest.bin")
+	check(stages, []string{
+		"upload fail", "stat skipped", "download skipped", "compare skipped", "delete skipped",
+	})
+	if stages[0].Error == "" {
+		t.Error("failed upload stage has no error")
+	}
+}
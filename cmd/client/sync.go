@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopher-fs/internal/client"
+)
+
+// localFile is a file of the tree being synced
+type localFile struct {
+	path string
+	size int64
+}
+
+// syncDir mirrors the local directory dir to the server directory of the
+// same base name, inside -dest if given: files that are new or whose checksum differs are
+// uploaded and, with deleteExtra, server files missing locally are
+// removed. The plan is printed before anything changes.
+func syncDir(serverAddr, dir string, deleteExtra bool) {
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		fatal("-sync needs a local directory", "file", dir)
+	}
+	newHash, err := transferClient.Checksum.Hasher()
+	if err != nil {
+		fatal("Invalid -hash", "err", err)
+	}
+	if newHash().Size() != 32 {
+		fatal("-sync compares 32-byte checksums; use -hash sha256 or blake3")
+	}
+
+	root := filepath.Clean(dir)
+	base := remotePath(filepath.Base(root))
+	local, files, err := localChecksums(root, base)
+	if err != nil {
+		fatal("Error reading local directory", "dir", dir, "err", err)
+	}
+	remote, err := remoteChecksums(serverAddr, base, files)
+	if err != nil {
+		fatal("Error reading server directory", "dir", base, "err", err)
+	}
+
+	plan := client.DiffTrees(local, remote)
+	kept := 0
+	if !deleteExtra {
+		kept, plan.Delete = len(plan.Delete), nil
+	}
+	out.report(planEvent{Add: plan.Add, Update: plan.Update, Delete: plan.Delete, Kept: kept})
+	if plan.Empty() {
+		out.report(doneEvent{Message: "✅ Server is up to date", Op: "sync", Path: base})
+		return
+	}
+
+	startTime := time.Now()
+	failed := 0
+	for _, name := range append(plan.Add, plan.Update...) {
+		if err := syncUpload(serverAddr, files[name].path, name, files[name].size); err != nil {
+			failed++
+			out.report(fileEvent{Name: name, Action: "uploaded", Error: err.Error()})
+			continue
+		}
+		out.report(fileEvent{Name: name, Action: "uploaded", Bytes: files[name].size})
+	}
+	for _, name := range plan.Delete {
+		if err := transferClient.Delete(ctx, serverAddr, name); err != nil {
+			failed++
+			out.report(fileEvent{Name: name, Action: "deleted", Error: err.Error()})
+			continue
+		}
+		out.report(fileEvent{Name: name, Action: "deleted"})
+	}
+	changes := len(plan.Add) + len(plan.Update) + len(plan.Delete)
+	elapsed := time.Since(startTime)
+	out.report(doneEvent{
+		Message: fmt.Sprintf("Synced %s: %d of %d changes applied in %v", base, changes-failed, changes, elapsed),
+		Op:      "sync", Path: base, Files: changes, Failed: failed, Seconds: elapsed.Seconds(),
+	})
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// localChecksums checksums every regular file under root, keyed by its
+// server name (prefix/relative path), and records where each one lives
+func localChecksums(root, prefix string) (map[string][32]byte, map[string]localFile, error) {
+	sums := make(map[string][32]byte)
+	files := make(map[string]localFile)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		name := serverName(path.Join(prefix, filepath.ToSlash(rel)))
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		sum, err := transferClient.Checksum.Compute(f)
+		if err != nil {
+			return fmt.Errorf("checksumming %s: %w", p, err)
+		}
+		var s [32]byte
+		copy(s[:], sum)
+		sums[name] = s
+		files[name] = localFile{path: p, size: info.Size()}
+		return nil
+	})
+	return sums, files, err
+}
+
+// remoteChecksums returns the checksums of the server files below dir.
+// Only files whose size matches their local counterpart are asked for a
+// checksum; the rest are known to differ, or to be missing locally, and
+// get the zero checksum, which no local file has.
+func remoteChecksums(serverAddr, dir string, local map[string]localFile) (map[string][32]byte, error) {
+	entries, err := transferClient.List(ctx, serverAddr, "")
+	if err != nil {
+		return nil, err
+	}
+	sums := make(map[string][32]byte)
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name, dir+"/") {
+			continue
+		}
+		var sum [32]byte
+		if lf, ok := local[e.Name]; ok && lf.size == e.Size {
+			h, found, err := transferClient.Stat(ctx, serverAddr, e.Name)
+			if err != nil {
+				return nil, err
+			}
+			if found && h.Algo == transferClient.Checksum {
+				copy(sum[:], h.Checksum)
+			}
+		}
+		sums[e.Name] = sum
+	}
+	return sums, nil
+}
+
+// syncUpload sends one local file as remoteName
+func syncUpload(serverAddr, localPath, remoteName string, size int64) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return transferClient.Upload(ctx, serverAddr, remoteName, f, size)
+}
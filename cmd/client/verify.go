@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopher-fs/internal/protocol"
+)
+
+// Results of checking a local file against a manifest, beside
+// checksumMatch and checksumMismatch
+const (
+	verifyMissing = "missing"
+	verifyExtra   = "extra"
+	verifyError   = "error"
+)
+
+// verifyDir checks the local directory dir against the manifest in the
+// JSON file manifestPath without contacting a server, reporting every
+// file that is missing, not in the manifest, or doesn't match it, then a
+// summary. Any discrepancy makes the client exit non-zero.
+func verifyDir(manifestPath, dir string) {
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		fatal("Error reading manifest", "manifest", manifestPath, "err", err)
+	}
+	var m protocol.Manifest
+	if err := json.Unmarshal(data, &m); err == nil {
+		err = m.Validate()
+	}
+	if err != nil {
+		fatal("Invalid manifest", "manifest", manifestPath, "err", err)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		fatal("-verify-manifest needs -file to name a directory", "file", dir)
+	}
+	// A manifest kept in the directory it describes isn't an extra file
+	ignore, _ := filepath.Abs(manifestPath)
+
+	results, err := compareManifest(m, dir, ignore)
+	if err != nil {
+		fatal("Error walking directory", "dir", dir, "err", err)
+	}
+	failed, extra := 0, 0
+	for _, r := range results {
+		out.report(r)
+		switch r.Result {
+		case checksumMatch:
+		case verifyExtra:
+			extra++
+		default:
+			failed++
+		}
+	}
+	done := doneEvent{Op: "verify", Path: dir, Files: len(m.Files), Failed: failed + extra}
+	switch {
+	case failed > 0:
+		done.Message = fmt.Sprintf("❌ %d of %d files don't match manifest %s", failed, len(m.Files), m.ID)
+	case extra > 0:
+		done.Message = fmt.Sprintf("❌ All %d files match manifest %s", len(m.Files), m.ID)
+	default:
+		done.Message = fmt.Sprintf("✅ All %d files match manifest %s", len(m.Files), m.ID)
+	}
+	if extra > 0 {
+		done.Message += fmt.Sprintf(", but %d more files aren't in it", extra)
+	}
+	if done.Failed > 0 {
+		exitCode = 1
+	}
+	out.report(done)
+}
+
+// compareManifest checks each file of m under dir, by size and then by
+// checksum under the algorithm the manifest names (for SHA-256, the digest
+// of protocol.ComputeChecksum), and lists the regular files below dir it
+// doesn't name, skipping the file at the absolute path ignore. Results are
+// sorted by name.
+func compareManifest(m protocol.Manifest, dir, ignore string) ([]verifyEvent, error) {
+	results := make([]verifyEvent, 0, len(m.Files))
+	listed := make(map[string]bool, len(m.Files))
+	for _, f := range m.Files {
+		name, _ := protocol.CleanPath(f.Name) // checked by Validate
+		listed[name] = true
+		results = append(results, verifyFile(f, name, filepath.Join(dir, filepath.FromSlash(name))))
+	}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if abs, _ := filepath.Abs(path); listed[name] || abs == ignore {
+			return nil
+		}
+		results = append(results, verifyEvent{Name: name, Result: verifyExtra})
+		return nil
+	})
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+	return results, err
+}
+
+// verifyFile checks the local file path against its manifest entry f
+func verifyFile(f protocol.ManifestEntry, name, path string) verifyEvent {
+	e := verifyEvent{Name: name, Result: checksumMismatch}
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		e.Result = verifyMissing
+		return e
+	}
+	if err != nil {
+		e.Result, e.Error = verifyError, err.Error()
+		return e
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		e.Result, e.Error = verifyError, err.Error()
+		return e
+	}
+	if info.Size() != f.Size {
+		e.Expected, e.Actual = fmt.Sprintf("%d bytes", f.Size), fmt.Sprintf("%d bytes", info.Size())
+		return e
+	}
+	sum, err := f.Algo.Compute(file)
+	if err != nil {
+		e.Result, e.Error = verifyError, err.Error()
+		return e
+	}
+	e.Expected, e.Actual = hex.EncodeToString(f.Checksum), hex.EncodeToString(sum)
+	if e.Expected == e.Actual {
+		e.Result, e.Expected, e.Actual = checksumMatch, "", ""
+	}
+	return e
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopher-fs/internal/protocol"
+)
+
+func TestCompareManifest(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entry := func(name, content string) protocol.ManifestEntry {
+		sum, err := protocol.ChecksumSHA256.Compute(strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return protocol.ManifestEntry{Name: name, Size: int64(len(content)), Algo: protocol.ChecksumSHA256, Checksum: sum}
+	}
+	m := protocol.NewManifest([]protocol.ManifestEntry{
+		entry("same.txt", "hello"),
+		entry("sub/resized.txt", "hello"),
+		entry("sub/changed.txt", "hello"),
+		entry("gone.txt", "hello"),
+	})
+	write("same.txt", "hello")
+	write("sub/resized.txt", "hello, world")
+	write("sub/changed.txt", "jello")
+	write("sub/new.txt", "hello")
+	write("manifest.json", "{}")
+
+	got, err := compareManifest(m, dir, filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		t.Fatalf("compareManifest: %v", err)
+	}
+	for i := range got {
+		got[i].Expected, got[i].Actual = "", ""
+	}
+	want := []verifyEvent{
+		{Name: "gone.txt", Result: verifyMissing},
+		{Name: "same.txt", Result: checksumMatch},
+		{Name: "sub/changed.txt", Result: checksumMismatch},
+		{Name: "sub/new.txt", Result: verifyExtra},
+		{Name: "sub/resized.txt", Result: checksumMismatch},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("compareManifest = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDelay is how long a watched file must go without changing before
+// it is uploaded, so an editor's burst of writes makes one upload
+const watchDelay = 500 * time.Millisecond
+
+// watchFile uploads the local file filename, then uploads it again each
+// time it changes, until interrupted or -timeout expires. A change that
+// leaves the content as last uploaded isn't sent, and a failed upload is
+// reported and retried on the next change rather than ending the watch.
+//
+// The file's directory is watched rather than the file itself: editors
+// that save by writing a new file and renaming it over the old one
+// replace the inode a file watch would be holding, and the directory
+// sees the new one arrive under the same name.
+func watchFile(serverAddr, filename string) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		fatal("Error opening file", "file", filename, "err", err)
+	}
+	if !info.Mode().IsRegular() {
+		fatal("-watch needs a regular file", "file", filename)
+	}
+	// Through a symlink it's the target that editors change
+	target, err := filepath.EvalSymlinks(filename)
+	if err != nil {
+		fatal("Error resolving file", "file", filename, "err", err)
+	}
+	target = filepath.Clean(target)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		fatal("Error watching file", "err", err)
+	}
+	defer watcher.Close()
+	if err := watcher.Add(filepath.Dir(target)); err != nil {
+		fatal("Error watching file", "file", filename, "err", err)
+	}
+
+	remoteName := remotePath(filepath.Base(filename))
+	var last [32]byte
+	uploaded := false
+	upload := func() {
+		sum, err := fileChecksum(target)
+		if os.IsNotExist(err) {
+			slog.Info("Watched file is gone, waiting for it to reappear", "file", filename)
+			return
+		}
+		if err != nil {
+			out.report(fileEvent{Name: remoteName, Action: "uploaded", Error: err.Error()})
+			return
+		}
+		if uploaded && sum == last {
+			slog.Debug("Watched file unchanged, not uploading", "file", filename)
+			return
+		}
+		// The first upload is skipped if the server already has this copy
+		if err := sendFile(serverAddr, target, remoteName, !uploaded); err != nil {
+			out.report(fileEvent{Name: remoteName, Action: "uploaded", Error: err.Error()})
+			return
+		}
+		last, uploaded = sum, true
+	}
+
+	upload()
+	slog.Info("Watching for changes (Ctrl-C to stop)", "file", filename)
+	var settled <-chan time.Time // nil until a change is pending
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			// Renames and removals only matter once a file takes the name
+			// again, which arrives as Create
+			if filepath.Clean(event.Name) == target && event.Has(fsnotify.Write|fsnotify.Create) {
+				settled = time.After(watchDelay)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			slog.Warn("Error watching file", "file", filename, "err", err)
+		case <-settled:
+			settled = nil
+			upload()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
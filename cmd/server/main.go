@@ -2,187 +2,227 @@ package main
 
 import (
 	"crypto/tls"
-	"encoding/binary"
+	"flag"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"net"
 	"os"
-	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"gopher-fs/internal/discovery"
+	"gopher-fs/internal/logging"
+	"gopher-fs/internal/policy"
 	"gopher-fs/internal/protocol"
 	"gopher-fs/internal/security"
+	"gopher-fs/internal/server"
 )
 
-func main() {
-	// Start Discovery Listener
-	go discovery.Listen(protocol.DefaultTCPPort)
-
-	// Configure TLS
-	tlsConfig, err := security.GenerateTLSConfig()
-	if err != nil {
-		log.Fatalf("Error configuring TLS: %v", err)
-	}
-
-	// Start Secure TCP File Server
-	listener, err := tls.Listen("tcp", protocol.DefaultTCPPort, tlsConfig)
-	if err != nil {
-		log.Fatalf("Error starting TCP server: %v", err)
-	}
-	defer listener.Close()
+// defaultMemoryBytes caps a -memory store when no quota is given
+const defaultMemoryBytes = 256 << 20
 
-	fmt.Printf("Secure File Server listening on %s (TLS enabled)\n", protocol.DefaultTCPPort)
-
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Printf("Error accepting connection: %v", err)
-			continue
+func main() {
+	defaults := server.DefaultConfig()
+	configPath := flag.String("config", "", "Read settings from this JSON file; flags given explicitly override it")
+	announceInterval := flag.Duration("announce", 0, "Periodically broadcast a presence beacon at this interval (0 disables)")
+	mdns := flag.Bool("mdns", false, "Also advertise the server over mDNS/DNS-SD as "+discovery.MDNSService+", for networks where broadcast discovery doesn't get through")
+	mdnsName := flag.String("mdns-name", "", "Instance name to advertise with -mdns (default the hostname)")
+	quota := flag.Int64("quota", defaults.QuotaBytes, "Maximum total bytes stored under the storage root, or in memory with -memory (0 = unlimited)")
+	memory := flag.Bool("memory", false, "Keep uploads in memory instead of the storage directory; nothing is written to disk and everything is lost on exit")
+	maxFileSize := flag.Int64("max-file-size", defaults.MaxFileSize, "Reject uploads of files larger than this many bytes (0 = unlimited)")
+	blockExt := flag.String("block-ext", os.Getenv(policy.BlockedExtensionsEnv), "Comma-separated file extensions to refuse uploads of, e.g. .exe,.bat,.sh (or "+policy.BlockedExtensionsEnv+")")
+	normalizeNames := flag.Bool("normalize-names", false, "Store and look up files under the Unicode NFC form of the names clients send, with control characters dropped, so a name typed on macOS and on Linux is one file (recommended for mixed clients)")
+	onConflict := flag.String("on-conflict", string(server.ConflictOverwrite), "What an upload of a file that already exists does: overwrite it, reject the upload, or rename the upload to name-1.ext, name-2.ext, ...")
+	idleTimeout := flag.Duration("idle-timeout", time.Duration(defaults.IdleTimeout), "Disconnect clients that send or receive nothing for this long (0 = never)")
+	transferTimeout := flag.Duration("transfer-timeout", 0, "Abort any one file's upload or download that takes longer than this, even while it makes progress, e.g. 10m (0 = no limit)")
+	bufferSize := flag.Int("buffer-size", defaults.BufferSize, "Bytes of buffer each transfer copies file data through; larger suits multi-gigabyte files on fast links")
+	maxConns := flag.Int("max-conns", defaults.MaxConns, "Maximum connections served at once; further clients wait to be accepted")
+	port := flag.Int("port", defaults.Port, "TCP port to serve on and advertise through discovery (0 picks a free port)")
+	bind := flag.String("bind", "", "Only serve on this IP address, e.g. 127.0.0.1 or a VPN address, instead of every interface; IP:port also sets the port")
+	certFile := flag.String("cert", "", "Serve this PEM certificate instead of a generated one (needs -key)")
+	keyFile := flag.String("key", "", "Private key (PEM) for -cert")
+	useTLS := flag.Bool("tls", true, "Serve over TLS; -tls=false serves unencrypted TCP, only for trusted networks or devices too slow for the handshake (clients need -tls=false too)")
+	psk := flag.String("psk", os.Getenv(protocol.PSKEnv), "Require clients to authenticate with this pre-shared key before serving them (or "+protocol.PSKEnv+")")
+	certTTL := flag.Duration("cert-ttl", security.DefaultCertValidity, "Validity period of the generated TLS certificate")
+	certKey := flag.String("cert-key", string(security.KeyEd25519), "Key type of the generated TLS certificate: ed25519, or rsa (much slower to generate) for TLS stacks without Ed25519")
+	sans := flag.String("san", "", "Comma-separated extra hostnames or IPs for the certificate, e.g. a reverse proxy's public name")
+	discoveryToken := flag.String("discovery-token", os.Getenv(discovery.TokenEnv), "Only answer discovery from clients using this token, to keep separate groups apart (or "+discovery.TokenEnv+")")
+	logLevel := flag.String("log-level", "info", logging.LevelUsage)
+	flag.Parse()
+	if err := logging.Setup(*logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	cfg := &defaults
+	if *configPath != "" {
+		var err error
+		if cfg, err = server.LoadConfig(*configPath); err != nil {
+			logging.Fatal("Error loading config", "err", err)
 		}
-		go handleConnection(conn)
-	}
-}
-
-func handleConnection(conn net.Conn) {
-	defer conn.Close()
-	log.Printf("Accepted connection from %s", conn.RemoteAddr())
-
-	// 1. Read Operation Code (1 byte)
-	var opCode uint8
-	if err := binary.Read(conn, binary.LittleEndian, &opCode); err != nil {
-		log.Printf("Error reading operation code: %v", err)
-		return
-	}
-
-	switch opCode {
-	case protocol.OpDownload:
-		handleDownload(conn)
-	case protocol.OpUpload:
-		handleUpload(conn)
-	default:
-		log.Printf("Unknown operation code: %d", opCode)
 	}
-}
-
-func handleDownload(conn net.Conn) {
-	// 2. Read requested filename length
-	var nameLen uint32
-	if err := binary.Read(conn, binary.LittleEndian, &nameLen); err != nil {
-		log.Printf("Error reading filename length: %v", err)
-		return
+	// Flags given on the command line win over the config file
+	quotaSet := cfg.QuotaBytes != 0
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Port = *port
+		case "bind":
+			cfg.Bind = *bind
+		case "quota":
+			cfg.QuotaBytes, quotaSet = *quota, true
+		case "max-file-size":
+			cfg.MaxFileSize = *maxFileSize
+		case "block-ext":
+			cfg.BlockedExtensions = *blockExt
+		case "normalize-names":
+			cfg.NormalizeNames = *normalizeNames
+		case "on-conflict":
+			var err error
+			if cfg.OnConflict, err = server.ParseConflictPolicy(*onConflict); err != nil {
+				logging.Fatal("Invalid -on-conflict", "err", err)
+			}
+		case "idle-timeout":
+			cfg.IdleTimeout = server.Duration(*idleTimeout)
+		case "transfer-timeout":
+			cfg.TransferTimeout = server.Duration(*transferTimeout)
+		case "max-conns":
+			cfg.MaxConns = *maxConns
+		case "buffer-size":
+			cfg.BufferSize = *bufferSize
+		case "cert":
+			cfg.CertFile = *certFile
+		case "key":
+			cfg.KeyFile = *keyFile
+		case "psk":
+			cfg.PSK = *psk
+		case "tls":
+			cfg.Plaintext = !*useTLS
+		}
+	})
+	if cfg.BlockedExtensions == "" {
+		cfg.BlockedExtensions = *blockExt // from the environment
 	}
-
-	// 3. Read filename
-	nameBuf := make([]byte, nameLen)
-	if _, err := io.ReadFull(conn, nameBuf); err != nil {
-		log.Printf("Error reading filename: %v", err)
-		return
-	}
-	fileName := string(nameBuf)
-	
-	// Sanitize filename
-	cleanedFileName := filepath.Base(fileName)
-	log.Printf("Client requested file: %s", cleanedFileName)
-
-	// 4. Open File
-	file, err := os.Open(cleanedFileName)
-	if err != nil {
-		log.Printf("Error opening file %s: %v", cleanedFileName, err)
-		return
+	if cfg.PSK == "" {
+		cfg.PSK = *psk // from the environment
 	}
-	defer file.Close()
-
-	// 5. Get File Info (Size)
-	fileInfo, err := file.Stat()
-	if err != nil {
-		log.Printf("Error getting file info: %v", err)
-		return
+	// -bind may carry the port too
+	if host, p, err := net.SplitHostPort(cfg.Bind); err == nil {
+		if cfg.Port, err = strconv.Atoi(p); err != nil {
+			logging.Fatal("Invalid -bind port", "bind", cfg.Bind)
+		}
+		cfg.Bind = host
 	}
-
-	// 6. Compute Checksum
-	log.Println("Computing checksum...")
-	fChecksum, err := os.Open(cleanedFileName)
-	if err != nil {
-		log.Printf("Error opening file for checksum: %v", err)
-		return
+	if err := cfg.Validate(); err != nil {
+		logging.Fatal("Invalid configuration", "err", err)
 	}
-	defer fChecksum.Close()
 
-	checksum, err := protocol.ComputeChecksum(fChecksum)
-	if err != nil {
-		log.Printf("Error computing checksum: %v", err)
-		return
-	}
-
-	// 7. Send Header (File Metadata)
-	log.Printf("Sending file header (Size: %d bytes)", fileInfo.Size())
-	err = protocol.SendFileHeader(conn, cleanedFileName, fileInfo.Size(), checksum)
-	if err != nil {
-		log.Printf("Error sending file header: %v", err)
-		return
+	// Configure TLS
+	var tlsConfig *tls.Config
+	var err error
+	if cfg.Plaintext {
+		slog.Warn("TLS IS DISABLED: file contents, names and listings cross the network unencrypted, and anyone on it can read or alter them. Only use -tls=false on a network you trust.")
+	} else if cfg.CertFile != "" {
+		tlsConfig, err = security.LoadTLSConfig(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			logging.Fatal("Error loading TLS certificate", "err", err)
+		}
+		slog.Info("Loaded TLS certificate", "file", cfg.CertFile, "expires", tlsConfig.Certificates[0].Leaf.NotAfter.Format(time.RFC3339))
+	} else {
+		keyType, err := security.ParseKeyType(*certKey)
+		if err != nil {
+			logging.Fatal("Invalid -cert-key", "err", err)
+		}
+		certOpts := security.CertOptions{Validity: *certTTL, KeyType: keyType}
+		if *sans != "" {
+			certOpts.ExtraSANs = strings.Split(*sans, ",")
+		}
+		tlsConfig, err = security.GenerateTLSConfigOpts(certOpts)
+		if err != nil {
+			logging.Fatal("Error configuring TLS", "err", err)
+		}
+		slog.Info("Generated TLS certificate", "key", keyType, "expires", tlsConfig.Certificates[0].Leaf.NotAfter.Format(time.RFC3339))
 	}
 
-	// 8. Stream File Content
-	sentBytes, err := io.Copy(conn, file)
-	if err != nil {
-		log.Printf("Error sending file data: %v", err)
-		return
+	// Start Secure TCP File Server
+	srv := server.New(cfg.StorageDir, tlsConfig)
+	srv.QuotaBytes = cfg.QuotaBytes
+	srv.MaxFileSize = cfg.MaxFileSize
+	if srv.Blocklist = policy.ParseBlocklist(cfg.BlockedExtensions); srv.Blocklist != nil {
+		slog.Info("Refusing uploads by extension", "blocked", srv.Blocklist.String())
+	}
+	if srv.NormalizeNames = cfg.NormalizeNames; srv.NormalizeNames {
+		slog.Info("Normalizing file names to Unicode NFC")
+	}
+	if srv.OnConflict = cfg.OnConflict; srv.OnConflict != "" && srv.OnConflict != server.ConflictOverwrite {
+		slog.Info("Uploads never overwrite existing files", "on_conflict", srv.OnConflict)
+	}
+	srv.MaxConns = cfg.MaxConns
+	srv.IdleTimeout = time.Duration(cfg.IdleTimeout)
+	srv.TransferTimeout = time.Duration(cfg.TransferTimeout)
+	srv.BufferSize = cfg.BufferSize
+	srv.Plaintext = cfg.Plaintext
+	if cfg.PSK != "" {
+		srv.PSK = []byte(cfg.PSK)
+		slog.Info("Clients must authenticate with the pre-shared key")
+	}
+	if *memory {
+		// Memory is never unlimited unless asked for
+		limit := cfg.QuotaBytes
+		if limit == 0 && !quotaSet {
+			limit = defaultMemoryBytes
+		}
+		srv.Store = server.NewMemoryStore(limit)
+		slog.Info("Storing files in memory", "max_bytes", limit)
 	}
-	log.Printf("Sent %d bytes for file %s", sentBytes, cleanedFileName)
-}
-
-func handleUpload(conn net.Conn) {
-	log.Println("Client initiating upload...")
-
-	// 1. Read Header
-	fileName, fileSize, checksum, err := protocol.ReadFileHeader(conn) // Corrected: Receive header first
+	logTransfersOnSignal(srv)
+	listener, err := srv.Listen(cfg.ListenAddr())
 	if err != nil {
-		log.Printf("Error reading upload header: %v", err)
-		return
+		logging.Fatal("Error starting TCP server", "err", err)
 	}
-	log.Printf("Receiving file: %s (%d bytes)", fileName, fileSize)
+	defer listener.Close()
 
-	// 2. Create File
-	if err := os.MkdirAll("storage", 0755); err != nil {
-		log.Printf("Error ensuring storage directory: %v", err)
-		return
-	}
-	savePath := filepath.Join("storage", filepath.Base(fileName))
-	file, err := os.Create(savePath)
-	if err != nil {
-		log.Printf("Error creating file %s: %v", savePath, err)
-		return
+	// Advertise the port actually bound, which differs from cfg.Port when
+	// that is 0 (any free port)
+	boundPort := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	tcpPort := ":" + boundPort
+	if cfg.Plaintext {
+		fmt.Printf("File Server listening on %s (TLS DISABLED, traffic is unencrypted)\n", net.JoinHostPort(cfg.Bind, boundPort))
+	} else {
+		fmt.Printf("Secure File Server listening on %s (TLS enabled)\n", net.JoinHostPort(cfg.Bind, boundPort))
 	}
-	defer file.Close()
 
-	// 3. Stream Data
-	// In a real upload, we read exactly 'fileSize' bytes.
-	receivedBytes, err := io.CopyN(file, conn, fileSize)
-	if err != nil {
-		if err != io.EOF {
-			log.Printf("Error receiving file data: %v", err)
-			return
+	// Start Discovery Listener. Bound to one address, discovery answers
+	// from it, so clients dial what is being served.
+	bindIP := net.ParseIP(cfg.Bind)
+	go func() {
+		if err := discovery.Listen(bindIP, tcpPort, *discoveryToken); err != nil {
+			slog.Warn("UDP discovery disabled", "err", err)
+		}
+	}()
+	if *announceInterval > 0 {
+		go func() {
+			if err := discovery.Announce(*announceInterval, bindIP, tcpPort, *discoveryToken); err != nil {
+				slog.Warn("Discovery announcements disabled", "err", err)
+			}
+		}()
+	}
+	// mDNS advertises the addresses of every interface, which a bound
+	// server isn't serving
+	if *mdns && cfg.Bind != "" {
+		slog.Warn("mDNS advertisement disabled: it can't be limited to the -bind address")
+	} else if *mdns {
+		port, _ := strconv.Atoi(boundPort)
+		stop, err := discovery.AnnounceMDNS(port, *mdnsName)
+		if err != nil {
+			slog.Warn("mDNS advertisement disabled", "err", err)
+		} else {
+			defer stop()
 		}
 	}
 
-	// 4. Verify Checksum
-	fCheck, err := os.Open(savePath)
-	if err != nil {
-		log.Printf("Error opening checking file: %v", err)
-		return 
-	}
-	defer fCheck.Close()
-
-	localChecksum, err := protocol.ComputeChecksum(fCheck)
-	if err != nil {
-		log.Printf("Error computing local checksum: %v", err)
-		return
-	}
-
-	if localChecksum == checksum {
-		log.Printf("Successfully received %s (%d bytes). Integrity Verified.", savePath, receivedBytes)
-	} else {
-		log.Printf("WARNING: Checksum mismatch for %s", savePath)
+	if err := srv.Serve(listener); err != nil {
+		logging.Fatal("Server stopped", "err", err)
 	}
 }
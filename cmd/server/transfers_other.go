@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "gopher-fs/internal/server"
+
+// logTransfersOnSignal does nothing: there is no SIGUSR1 on this platform
+func logTransfersOnSignal(srv *server.Server) {}
@@ -0,0 +1,37 @@
+//go:build unix
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"gopher-fs/internal/server"
+)
+
+// logTransfersOnSignal logs the connections srv is serving each time the
+// server gets SIGUSR1 (kill -USR1 <pid>)
+func logTransfersOnSignal(srv *server.Server) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+	go func() {
+		for range sig {
+			active := srv.Metrics.Active()
+			slog.Info("Active transfers", "count", len(active))
+			for _, t := range active {
+				slog.Info("Active transfer",
+					"id", t.ID,
+					"remote", t.Remote,
+					"op", t.Op,
+					"file", t.File,
+					"bytes_in", t.BytesIn,
+					"bytes_out", t.BytesOut,
+					"started", t.Started.Format(time.RFC3339),
+					"duration", time.Since(t.Started).Round(time.Second))
+			}
+		}
+	}()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopher-fs/internal/logging"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// roomMetaFile holds per-room settings inside the room directory.
+// It is hidden from listings and can't be downloaded or deleted.
+const roomMetaFile = ".room.json"
+
+// RoomMeta is the on-disk metadata for a room
+type RoomMeta struct {
+	PasswordHash string `json:"password_hash,omitempty"`
+}
+
+// adminToken, from ADMIN_TOKEN, unlocks the /admin endpoints. They are
+// disabled while it is empty.
+var adminToken string
+
+// requireAdmin checks that r carries "Authorization: Bearer <ADMIN_TOKEN>",
+// answering 404 while no token is configured and 401 for a missing or
+// wrong one
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if adminToken == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || !hmac.Equal([]byte(token), []byte(adminToken)) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// sessionSecret signs room access cookies. It is generated per process,
+// so unlocking must be repeated after a restart.
+var sessionSecret = func() []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		logging.Fatal("Error generating session secret", "err", err)
+	}
+	return b
+}()
+
+func loadRoomMeta(roomID string) (RoomMeta, error) {
+	var meta RoomMeta
+	data, err := os.ReadFile(filepath.Join(storageRoot, roomID, roomMetaFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return meta, nil
+	}
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+// setRoomPassword hashes password with bcrypt and stores it in the room metadata
+func setRoomPassword(roomID, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	roomDir := filepath.Join(storageRoot, roomID)
+	if err := os.MkdirAll(roomDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(RoomMeta{PasswordHash: string(hash)})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(roomDir, roomMetaFile), data, 0600)
+}
+
+func roomCookieName(roomID string) string {
+	return "gopherfs_room_" + roomID
+}
+
+// roomToken proves the holder entered the password for roomID
+func roomToken(roomID string) string {
+	mac := hmac.New(sha256.New, sessionSecret)
+	mac.Write([]byte(roomID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func grantRoomAccess(w http.ResponseWriter, roomID string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     roomCookieName(roomID),
+		Value:    roomToken(roomID),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// requireRoomAccess reports whether the request may use roomID. Rooms
+// without a password are open; otherwise the client is redirected to the
+// unlock page and false is returned.
+func requireRoomAccess(w http.ResponseWriter, r *http.Request, roomID string) bool {
+	// Dot-directories under the storage root (e.g. the object store) aren't
+	// rooms, and nor is anything outside it
+	if strings.HasPrefix(roomID, ".") || !validFileName(roomID) {
+		http.NotFound(w, r)
+		return false
+	}
+
+	meta, err := loadRoomMeta(roomID)
+	if err != nil {
+		slog.Error("Error reading room metadata", "room", roomID, "err", err)
+		http.Error(w, "Room Error", http.StatusInternalServerError)
+		return false
+	}
+	if meta.PasswordHash == "" {
+		return true
+	}
+
+	if c, err := r.Cookie(roomCookieName(roomID)); err == nil {
+		if hmac.Equal([]byte(c.Value), []byte(roomToken(roomID))) {
+			return true
+		}
+	}
+
+	http.Redirect(w, r, "/room/"+roomID+"/unlock", http.StatusSeeOther)
+	return false
+}
+
+// checkRoomPassword compares password against the stored bcrypt hash
+func checkRoomPassword(roomID, password string) bool {
+	meta, err := loadRoomMeta(roomID)
+	if err != nil || meta.PasswordHash == "" {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(meta.PasswordHash), []byte(password)) == nil
+}
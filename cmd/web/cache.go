@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileCache remembers a value worked out from each file's content, such as
+// its content type or checksum, so room views don't re-read every file.
+// Entries are keyed by path and invalidated when the file's size or
+// modification time changes. It is safe for concurrent use.
+type fileCache[V any] struct {
+	mu      sync.Mutex
+	entries map[string]fileCacheEntry[V]
+}
+
+type fileCacheEntry[V any] struct {
+	size    int64
+	modTime time.Time
+	value   V
+}
+
+func newFileCache[V any]() *fileCache[V] {
+	return &fileCache[V]{entries: make(map[string]fileCacheEntry[V])}
+}
+
+// get returns the value for the file at path, described by info. compute
+// is only called on a miss; its errors are returned and not cached.
+func (c *fileCache[V]) get(path string, info fs.FileInfo, compute func() (V, error)) (V, error) {
+	c.mu.Lock()
+	e, ok := c.entries[path]
+	c.mu.Unlock()
+	if ok && e.size == info.Size() && e.modTime.Equal(info.ModTime()) {
+		return e.value, nil
+	}
+
+	value, err := compute()
+	if err != nil {
+		return value, err
+	}
+	c.mu.Lock()
+	c.entries[path] = fileCacheEntry[V]{size: info.Size(), modTime: info.ModTime(), value: value}
+	c.mu.Unlock()
+	return value, nil
+}
+
+// forget drops every cached entry under dir, e.g. when a room is deleted
+func (c *fileCache[V]) forget(dir string) {
+	prefix := dir + string(filepath.Separator)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for path := range c.entries {
+		if strings.HasPrefix(path, prefix) {
+			delete(c.entries, path)
+		}
+	}
+}
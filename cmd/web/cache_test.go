@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopher-fs/internal/store"
+)
+
+func TestFileCacheInvalidates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "f.txt")
+	write := func(content string, modTime time.Time) os.FileInfo {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+	c := newFileCache[string]()
+	computed := 0
+	get := func(info os.FileInfo) string {
+		v, _ := c.get(path, info, func() (string, error) {
+			computed++
+			data, err := os.ReadFile(path)
+			return string(data), err
+		})
+		return v
+	}
+
+	start := time.Now().Add(-time.Hour)
+	info := write("one", start)
+	if get(info) != "one" || get(info) != "one" || computed != 1 {
+		t.Fatalf("unchanged file computed %d times, want once", computed)
+	}
+	// Same size, later modification time
+	if info = write("two", start.Add(time.Minute)); get(info) != "two" || computed != 2 {
+		t.Errorf("after a rewrite got %q with %d computations, want two and 2", get(info), computed)
+	}
+	// Same modification time, different size
+	if info = write("three", start.Add(time.Minute)); get(info) != "three" || computed != 3 {
+		t.Errorf("after growing got %q with %d computations, want three and 3", get(info), computed)
+	}
+
+	c.forget(filepath.Dir(path))
+	get(info)
+	if computed != 4 {
+		t.Errorf("forgotten entry computed %d times in all, want 4", computed)
+	}
+}
+
+func TestRoomFileHashCachesPlainFiles(t *testing.T) {
+	root := t.TempDir()
+	blobs := store.New(root)
+	path := filepath.Join(root, "room", "plain.txt")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("before"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if h, err := roomFileHash(blobs, root, "room", "plain.txt"); err != nil || h != sha256.Sum256([]byte("before")) {
+		t.Fatalf("roomFileHash = %x, %v", h, err)
+	}
+
+	// A modified file is hashed again
+	later := time.Now().Add(time.Minute)
+	if err := os.WriteFile(path, []byte("after!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if h, err := roomFileHash(blobs, root, "room", "plain.txt"); err != nil || h != sha256.Sum256([]byte("after!")) {
+		t.Errorf("roomFileHash after modifying = %x, %v; want the new content's hash", h, err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopher-fs/internal/store"
+)
+
+// runRoomSweeper removes expired rooms every interval until the process exits
+func runRoomSweeper(blobs *store.Store, root string, ttl, interval time.Duration) {
+	for {
+		cleanupExpiredRooms(blobs, root, ttl)
+		time.Sleep(interval)
+	}
+}
+
+// cleanupExpiredRooms deletes every room under root whose most recent change
+// is older than ttl. A room's age is taken from the newest modification time
+// of the room directory or anything in it, so an empty room expires ttl after
+// it was created or last emptied. It returns the IDs of the removed rooms.
+func cleanupExpiredRooms(blobs *store.Store, root string, ttl time.Duration) []string {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		slog.Error("Room cleanup failed", "err", err)
+		return nil
+	}
+
+	cutoff := time.Now().Add(-ttl)
+	var removed []string
+	for _, e := range entries {
+		// Dot-directories (e.g. the object store) aren't rooms
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		roomID := e.Name()
+		last, err := lastModified(filepath.Join(root, roomID))
+		if err != nil {
+			slog.Error("Room cleanup: checking room", "room", roomID, "err", err)
+			continue
+		}
+		if last.After(cutoff) {
+			continue
+		}
+		if err := blobs.RemoveRoom(roomID); err != nil {
+			slog.Error("Room cleanup: removing room", "room", roomID, "err", err)
+			continue
+		}
+		mimeTypes.forget(filepath.Join(root, roomID))
+		checksums.forget(filepath.Join(root, roomID))
+		slog.Info("Room cleanup: removed room", "room", roomID, "idle_since", last.Format(time.RFC3339))
+		removed = append(removed, roomID)
+	}
+	return removed
+}
+
+// lastModified returns the newest modification time of dir and everything
+// below it. Symlinks are not followed: a store link's own time is when the
+// file was added to the room.
+func lastModified(dir string) (time.Time, error) {
+	var last time.Time
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+		return nil
+	})
+	return last, err
+}
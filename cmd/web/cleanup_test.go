@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"gopher-fs/internal/store"
+)
+
+func TestCleanupExpiredRooms(t *testing.T) {
+	root := t.TempDir()
+	const ttl = time.Hour
+	old := time.Now().Add(-2 * ttl)
+
+	// mkRoom creates dir under root holding files, everything last changed
+	// at mtime
+	mkRoom := func(dir string, mtime time.Time, files ...string) {
+		t.Helper()
+		path := filepath.Join(root, dir)
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range files {
+			p := filepath.Join(path, name)
+			if err := os.WriteFile(p, []byte(name), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(p, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mkRoom("expired", old, "a.txt", "b.txt")
+	mkRoom("fresh", time.Now(), "a.txt")
+	mkRoom("empty-old", old)
+	mkRoom(".uploads", old, "stale.part")
+
+	// An old room with one file added since is still in use
+	mkRoom("revived", old, "a.txt")
+	if err := os.WriteFile(filepath.Join(root, "revived", "new.txt"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(root, "revived"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	removed := cleanupExpiredRooms(store.New(root), root, ttl)
+	slices.Sort(removed)
+	if want := []string{"empty-old", "expired"}; !slices.Equal(removed, want) {
+		t.Errorf("removed %v, want %v", removed, want)
+	}
+	for dir, kept := range map[string]bool{
+		"expired":   false,
+		"empty-old": false,
+		"fresh":     true,
+		"revived":   true,
+		".uploads":  true,
+	} {
+		if _, err := os.Stat(filepath.Join(root, dir)); (err == nil) != kept {
+			t.Errorf("%s: stat = %v, want kept %v", dir, err, kept)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"gopher-fs/internal/store"
+)
+
+// handleDownload serves GET /download/{id}/{file}. A file name that could
+// reach outside the room is refused before the store sees it.
+func handleDownload(blobs *store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		if !requireRoomAccess(w, r, vars["id"]) {
+			return
+		}
+		if !validFileName(vars["file"]) {
+			http.Error(w, "Invalid file name", http.StatusBadRequest)
+			return
+		}
+		if vars["file"] == roomMetaFile {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		serveRoomFile(w, r, blobs, vars["id"], vars["file"])
+	}
+}
+
+// handleDelete serves POST /delete/{id}/{file}, removing the file from the
+// room, telling the room's live views and sending the browser back to it.
+// Like handleDownload it refuses names that could reach outside the room.
+func handleDelete(blobs *store.Store, hub *RoomHub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		roomID := vars["id"]
+		fileName := vars["file"]
+		if !requireRoomAccess(w, r, roomID) {
+			return
+		}
+		if !validFileName(fileName) {
+			http.Error(w, "Invalid file name", http.StatusBadRequest)
+			return
+		}
+		if fileName == roomMetaFile {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		if err := blobs.Unlink(roomID, fileName); err == nil { // Delete file (and blob if unreferenced)
+			hub.Broadcast(roomID, RoomEvent{Type: "deleted", File: fileName})
+		}
+
+		http.Redirect(w, r, "/room/"+roomID, http.StatusSeeOther)
+	}
+}
+
+// serveRoomFile sends name from the room through http.ServeContent, which
+// answers Range requests with 206 Partial Content, so browsers can scrub
+// through videos and resume interrupted downloads. The file's SHA-256 is its
+// ETag, so along with its modification time repeat views get a 304.
+func serveRoomFile(w http.ResponseWriter, r *http.Request, blobs *store.Store, roomID, name string) {
+	f, info, err := blobs.Open(roomID, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		slog.Error("Error opening download", "room", roomID, "file", name, "err", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	if hash, ok := blobs.Hash(roomID, name); ok {
+		w.Header().Set("ETag", `"`+hex.EncodeToString(hash[:])+`"`)
+	}
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
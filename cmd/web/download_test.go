@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"gopher-fs/internal/store"
+)
+
+func TestServeRoomFileRange(t *testing.T) {
+	blobs := store.New(t.TempDir())
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	hash := sha256.Sum256(data)
+	if err := blobs.Put(hash, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := blobs.Link("room1", "clip.mp4", hash); err != nil {
+		t.Fatalf("Link: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/download/room1/clip.mp4", nil)
+	req.Header.Set("Range", "bytes=100-149")
+	rec := httptest.NewRecorder()
+	serveRoomFile(rec, req, blobs, "room1", "clip.mp4")
+
+	resp := rec.Result()
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("status = %d, want 206", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Accept-Ranges"); got != "bytes" {
+		t.Errorf("Accept-Ranges = %q, want bytes", got)
+	}
+	if got := resp.Header.Get("Content-Range"); got != "bytes 100-149/1000" {
+		t.Errorf("Content-Range = %q, want bytes 100-149/1000", got)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !bytes.Equal(body, data[100:150]) {
+		t.Errorf("body = %q, want %q", body, data[100:150])
+	}
+
+	rec = httptest.NewRecorder()
+	serveRoomFile(rec, httptest.NewRequest("GET", "/download/room1/missing", nil), blobs, "room1", "missing")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("missing file status = %d, want 404", rec.Code)
+	}
+}
+
+func TestServeRoomFileConditional(t *testing.T) {
+	blobs := store.New(t.TempDir())
+	data := []byte("a large media file")
+	hash := sha256.Sum256(data)
+	if err := blobs.Put(hash, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := blobs.Link("room1", "clip.mp4", hash); err != nil {
+		t.Fatalf("Link: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	serveRoomFile(rec, httptest.NewRequest("GET", "/download/room1/clip.mp4", nil), blobs, "room1", "clip.mp4")
+	etag := rec.Header().Get("ETag")
+	if want := `"` + hex.EncodeToString(hash[:]) + `"`; etag != want {
+		t.Fatalf("ETag = %q, want %q", etag, want)
+	}
+	lastModified := rec.Header().Get("Last-Modified")
+	if lastModified == "" {
+		t.Fatal("no Last-Modified header")
+	}
+
+	for header, value := range map[string]string{"If-None-Match": etag, "If-Modified-Since": lastModified} {
+		req := httptest.NewRequest("GET", "/download/room1/clip.mp4", nil)
+		req.Header.Set(header, value)
+		rec := httptest.NewRecorder()
+		serveRoomFile(rec, req, blobs, "room1", "clip.mp4")
+		if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+			t.Errorf("with %s: status %d and %d body bytes, want 304 and none", header, rec.Code, rec.Body.Len())
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/download/room1/clip.mp4", nil)
+	req.Header.Set("If-None-Match", `"stale"`)
+	rec = httptest.NewRecorder()
+	serveRoomFile(rec, req, blobs, "room1", "clip.mp4")
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), data) {
+		t.Errorf("with a stale ETag: status %d, want 200 and the file", rec.Code)
+	}
+}
+
+func TestRoomFileRoutesRefuseTraversal(t *testing.T) {
+	root := t.TempDir()
+	blobs := store.New(root)
+	secret := filepath.Join(root, "secret.txt")
+	if err := os.WriteFile(secret, []byte("outside the room"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "room1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/download/{id}/{file}", handleDownload(blobs)).Methods("GET")
+	r.HandleFunc("/delete/{id}/{file}", handleDelete(blobs, NewRoomHub())).Methods("POST")
+	check := func(rec *httptest.ResponseRecorder, what string) {
+		t.Helper()
+		if rec.Code == http.StatusOK || strings.Contains(rec.Body.String(), "outside the room") {
+			t.Errorf("%s: status %d, body %q", what, rec.Code, rec.Body)
+		}
+		if _, err := os.Stat(secret); err != nil {
+			t.Fatalf("%s removed the file outside the room: %v", what, err)
+		}
+	}
+
+	// Through the router, which cleans dot segments out of the path
+	for _, target := range []string{
+		"/room1/../secret.txt",
+		"/room1/..%2fsecret.txt",
+		"/room1/%2e%2e%2fsecret.txt",
+		"/room1/..%5csecret.txt",
+		"/room1/..",
+		"/../secret.txt",
+	} {
+		for _, method := range []string{"GET", "POST"} {
+			path := "/download" + target
+			if method == "POST" {
+				path = "/delete" + target
+			}
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+			check(rec, method+" "+path)
+		}
+	}
+
+	// Straight to the handlers, in case a name gets past routing
+	for _, vars := range []map[string]string{
+		{"id": "room1", "file": "../secret.txt"},
+		{"id": "room1", "file": ".."},
+		{"id": "room1", "file": "."},
+		{"id": "room1", "file": `..\secret.txt`},
+		{"id": "room1", "file": ""},
+		{"id": "..", "file": "secret.txt"},
+		{"id": "room1/..", "file": "secret.txt"},
+	} {
+		what := vars["id"] + " " + vars["file"]
+		rec := httptest.NewRecorder()
+		handleDownload(blobs)(rec, mux.SetURLVars(httptest.NewRequest("GET", "/", nil), vars))
+		check(rec, "download of "+what)
+		rec = httptest.NewRecorder()
+		handleDelete(blobs, NewRoomHub())(rec, mux.SetURLVars(httptest.NewRequest("POST", "/", nil), vars))
+		check(rec, "delete of "+what)
+		if rec.Code != http.StatusBadRequest && rec.Code != http.StatusNotFound {
+			t.Errorf("delete of %s: status %d, want 400 or 404", what, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"gopher-fs/internal/server"
+	"gopher-fs/internal/storage"
+)
+
+// backendDialTimeout bounds the reachability check against the TCP backend
+const backendDialTimeout = 2 * time.Second
+
+var startTime = time.Now()
+
+// HealthStatus is the JSON body served by /healthz
+type HealthStatus struct {
+	Status           string  `json:"status"` // "ok" or "degraded"
+	BackendReachable bool    `json:"backend_reachable"`
+	FreeBytes        *uint64 `json:"free_bytes,omitempty"` // omitted if it couldn't be read
+	UptimeSeconds    int64   `json:"uptime_seconds"`
+}
+
+// handleHealthz reports liveness for container orchestrators. It answers 503
+// when the TCP backend can't be dialed, since uploads would fail anyway.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	status := HealthStatus{
+		Status:        "ok",
+		UptimeSeconds: int64(time.Since(startTime).Seconds()),
+	}
+
+	if conn, err := net.DialTimeout("tcp", tcpServerAddr, backendDialTimeout); err == nil {
+		conn.Close()
+		status.BackendReachable = true
+	}
+	if free, err := storage.FreeBytes(storageRoot); err == nil {
+		status.FreeBytes = &free
+	}
+
+	code := http.StatusOK
+	if !status.BackendReachable {
+		status.Status = "degraded"
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
+
+// backend is the internal TCP file server uploads pass through; its
+// Metrics total the backend traffic
+var backend *server.Server
+
+// handleMetrics exposes the backend's Metrics in the Prometheus text format
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Header().Set("Cache-Control", "no-store")
+	backend.Metrics.WritePrometheus(w)
+}
+
+// handleTransfers lists the connections the backend is serving as JSON,
+// for diagnostics. It needs the ADMIN_TOKEN (see requireAdmin), and only
+// knows about the backend this process runs.
+func handleTransfers(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(backend.Metrics.Active())
+}
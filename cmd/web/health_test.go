@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gopher-fs/internal/server"
+)
+
+func TestHandleTransfers(t *testing.T) {
+	savedBackend, savedToken := backend, adminToken
+	defer func() { backend, adminToken = savedBackend, savedToken }()
+	backend = &server.Server{}
+	a, b := net.Pipe()
+	defer b.Close()
+	_, finish := backend.Metrics.Track(a)
+	defer finish()
+
+	get := func(auth string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/admin/transfers", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		handleTransfers(w, r)
+		return w
+	}
+
+	adminToken = ""
+	if w := get("Bearer anything"); w.Code != http.StatusNotFound {
+		t.Errorf("without ADMIN_TOKEN: %d, want 404", w.Code)
+	}
+	adminToken = "secret"
+	for _, auth := range []string{"", "Bearer wrong", "secret"} {
+		if w := get(auth); w.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: %d, want 401", auth, w.Code)
+		}
+	}
+
+	w := get("Bearer secret")
+	var transfers []server.Transfer
+	if err := json.Unmarshal(w.Body.Bytes(), &transfers); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("with the token: %d %q, %v", w.Code, w.Body.String(), err)
+	}
+	if len(transfers) != 1 || transfers[0].Remote != "pipe" {
+		t.Errorf("transfers = %+v, want the one tracked connection", transfers)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = (wsPongWait * 9) / 10
+)
+
+// RoomEvent is pushed to every subscriber of a room when its contents change
+type RoomEvent struct {
+	Type string `json:"type"` // "added" or "deleted"
+	File string `json:"file"`
+}
+
+// subscriber is a single WebSocket client watching a room
+type subscriber struct {
+	conn *websocket.Conn
+	send chan RoomEvent
+}
+
+// RoomHub fans out room events to the WebSocket clients subscribed to each room
+type RoomHub struct {
+	mu    sync.Mutex
+	rooms map[string]map[*subscriber]struct{}
+}
+
+func NewRoomHub() *RoomHub {
+	return &RoomHub{rooms: make(map[string]map[*subscriber]struct{})}
+}
+
+func (h *RoomHub) subscribe(roomID string, s *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	subs, ok := h.rooms[roomID]
+	if !ok {
+		subs = make(map[*subscriber]struct{})
+		h.rooms[roomID] = subs
+	}
+	subs[s] = struct{}{}
+}
+
+// unsubscribe removes s from the room and closes its send channel exactly once
+func (h *RoomHub) unsubscribe(roomID string, s *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	subs, ok := h.rooms[roomID]
+	if !ok {
+		return
+	}
+	if _, ok := subs[s]; !ok {
+		return
+	}
+	delete(subs, s)
+	close(s.send)
+	if len(subs) == 0 {
+		delete(h.rooms, roomID)
+	}
+}
+
+// Broadcast sends ev to every subscriber of roomID. Slow subscribers whose
+// buffer is full are dropped rather than blocking the uploader.
+func (h *RoomHub) Broadcast(roomID string, ev RoomEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.rooms[roomID] {
+		select {
+		case s.send <- ev:
+		default:
+			delete(h.rooms[roomID], s)
+			close(s.send)
+		}
+	}
+	if len(h.rooms[roomID]) == 0 {
+		delete(h.rooms, roomID)
+	}
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// ServeRoom upgrades the request and streams events for the room in the URL
+func (h *RoomHub) ServeRoom(w http.ResponseWriter, r *http.Request) {
+	roomID := mux.Vars(r)["id"]
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Error("WebSocket upgrade error", "err", err)
+		return
+	}
+
+	s := &subscriber{conn: conn, send: make(chan RoomEvent, 16)}
+	h.subscribe(roomID, s)
+
+	go s.writeLoop()
+	s.readLoop()
+
+	// Reader exited: the client is gone, so drop it from the hub.
+	// Closing send also stops the write loop.
+	h.unsubscribe(roomID, s)
+}
+
+// readLoop discards incoming messages and returns when the connection dies
+func (s *subscriber) readLoop() {
+	s.conn.SetReadLimit(512)
+	s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	s.conn.SetPongHandler(func(string) error {
+		s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		return nil
+	})
+	for {
+		if _, _, err := s.conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// writeLoop delivers queued events and keeps the connection alive with pings
+func (s *subscriber) writeLoop() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		s.conn.Close()
+	}()
+
+	for {
+		select {
+		case ev, ok := <-s.send:
+			s.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				s.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := s.conn.WriteJSON(ev); err != nil {
+				return
+			}
+		case <-ticker.C:
+			s.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := s.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -1,25 +1,35 @@
 package main
 
 import (
-	"crypto/tls"
-	"encoding/binary"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
-	"log"
+	"flag"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"embed"
+	"strconv"
 	"time"
 
+	"gopher-fs/internal/client"
 	"gopher-fs/internal/protocol"
 	"gopher-fs/internal/security"
-	"gopher-fs/internal/discovery"
+	"gopher-fs/internal/server"
+	"gopher-fs/internal/logging"
+	"gopher-fs/internal/policy"
+	"gopher-fs/internal/storage"
+	"gopher-fs/internal/store"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/skip2/go-qrcode"
 )
 
 //go:embed templates/*
@@ -32,10 +42,44 @@ const (
 // TCP Server address - configurable via Env or defaults to localhost
 var tcpServerAddr = "127.0.0.1:9000"
 
+// Total bytes the storage root may hold - configurable via STORAGE_QUOTA_BYTES, defaults to unlimited
+var quotaBytes int64
+
+// HTTP port the gateway listens on - configurable via PORT
+var webPort = "8080"
+
+// Rooms idle for longer than this are deleted - configurable via ROOM_TTL, defaults to never
+var roomTTL time.Duration
+
+// Resumable uploads that receive no data for this long are discarded - configurable via UPLOAD_TTL
+var uploadTTL = 24 * time.Hour
+
+// How often expired rooms are swept - configurable via ROOM_SWEEP_INTERVAL
+var roomSweepInterval = 10 * time.Minute
+
+// Backend TCP clients idle for longer than this are disconnected - configurable via -idle-timeout or IDLE_TIMEOUT
+var idleTimeout = 2 * time.Minute
+
+// Key the gateway authenticates to the backend with (see startInternalTCPServer)
+var backendPSK []byte
+
+// Maximum accepted upload body - configurable via MAX_UPLOAD_BYTES, defaults to 500MB
+var maxUploadBytes int64 = 500 << 20
+
+// Uploads with these extensions are refused - configurable via -block-ext or BLOCKED_EXTENSIONS
+var uploadBlocklist policy.Blocklist
+
+// Requests per minute each client IP may make to the create, upload and delete routes - configurable via RATE_LIMIT, 0 = unlimited
+var rateLimit float64 = 60
+
+// How many of those requests may come at once - configurable via RATE_BURST
+var rateBurst = 20
+
 type FileInfo struct {
-	Name string
-	Size string
-	Hash string
+	Name     string
+	Size     string
+	Hash     string
+	MimeType string
 }
 
 // GetLocalIP returns the non-loopback local IP of the host
@@ -55,6 +99,15 @@ func GetLocalIP() string {
 	return ""
 }
 
+// roomURL is the address other devices on the LAN can use to reach a room
+func roomURL(roomID string) string {
+	host := GetLocalIP()
+	if host == "" {
+		host = "localhost"
+	}
+	return fmt.Sprintf("http://%s/room/%s", net.JoinHostPort(host, webPort), roomID)
+}
+
 type PageData struct {
 	RoomID   string
 	Files    []FileInfo
@@ -62,42 +115,191 @@ type PageData struct {
 	ShowLogs bool
 	Error    string
     LocalIP  string
+	Port     string
+	Locked   bool
 }
 
 func main() {
-    // 0. Start the Backend TCP Server (if enabled)
+	logLevel := flag.String("log-level", envOr("LOG_LEVEL", "info"), logging.LevelUsage+" (or LOG_LEVEL)")
+	blockExt := flag.String("block-ext", os.Getenv(policy.BlockedExtensionsEnv), "Comma-separated file extensions to refuse uploads of, e.g. .exe,.bat,.sh (or "+policy.BlockedExtensionsEnv+")")
+	idleTimeoutFlag := flag.String("idle-timeout", envOr("IDLE_TIMEOUT", "2m"), "Disconnect backend clients that send or receive nothing for this long, 0 = never (or IDLE_TIMEOUT)")
+	flag.Parse()
+	if err := logging.Setup(*logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	d, err := time.ParseDuration(*idleTimeoutFlag)
+	if err != nil || d < 0 {
+		logging.Fatal("Invalid -idle-timeout", "value", *idleTimeoutFlag)
+	}
+	idleTimeout = d
+
+	// 0. Determine TCP Server Address
+	if envAddr := os.Getenv("TCP_SERVER_ADDR"); envAddr != "" {
+		tcpServerAddr = envAddr
+	}
+
+    // 1. Start the Backend TCP Server (if enabled). It only ever sees the
+    // staging directory, never the rooms.
+	backend = server.New(filepath.Join(storageRoot, incomingDir), nil)
+	backend.IdleTimeout = idleTimeout
+	uploadBlocklist = policy.ParseBlocklist(*blockExt)
+	backend.Blocklist = uploadBlocklist
     if os.Getenv("RUN_TCP_SERVER") != "false" {
+		backendPSK = make([]byte, 32)
+		if _, err := rand.Read(backendPSK); err != nil {
+			logging.Fatal("Error generating backend key", "err", err)
+		}
+		backend.PSK = backendPSK
         go startInternalTCPServer()
-    }
+    } else {
+		// A backend run separately needs the key it was started with
+		backendPSK = []byte(os.Getenv(protocol.PSKEnv))
+	}
 
-	// 1. Ensure storage root exists
+	// 2. Ensure storage root exists
 	if err := os.MkdirAll(storageRoot, 0755); err != nil {
-		log.Fatal(err)
+		logging.Fatal("Error creating storage root", "err", err)
+	}
+	if envQuota := os.Getenv("STORAGE_QUOTA_BYTES"); envQuota != "" {
+		n, err := strconv.ParseInt(envQuota, 10, 64)
+		if err != nil || n < 0 {
+			logging.Fatal("Invalid STORAGE_QUOTA_BYTES", "value", envQuota)
+		}
+		quotaBytes = n
+	}
+	if envPort := os.Getenv("PORT"); envPort != "" {
+		webPort = envPort
+	}
+	if envMax := os.Getenv("MAX_UPLOAD_BYTES"); envMax != "" {
+		n, err := strconv.ParseInt(envMax, 10, 64)
+		if err != nil || n <= 0 {
+			logging.Fatal("Invalid MAX_UPLOAD_BYTES", "value", envMax)
+		}
+		maxUploadBytes = n
+	}
+	if envTTL := os.Getenv("ROOM_TTL"); envTTL != "" {
+		d, err := time.ParseDuration(envTTL)
+		if err != nil || d < 0 {
+			logging.Fatal("Invalid ROOM_TTL", "value", envTTL)
+		}
+		roomTTL = d
+	}
+	if envSweep := os.Getenv("ROOM_SWEEP_INTERVAL"); envSweep != "" {
+		d, err := time.ParseDuration(envSweep)
+		if err != nil || d <= 0 {
+			logging.Fatal("Invalid ROOM_SWEEP_INTERVAL", "value", envSweep)
+		}
+		roomSweepInterval = d
 	}
 
-	// 2. Determine TCP Server Address
-	if envAddr := os.Getenv("TCP_SERVER_ADDR"); envAddr != "" {
-		tcpServerAddr = envAddr
+	if envTTL := os.Getenv("UPLOAD_TTL"); envTTL != "" {
+		d, err := time.ParseDuration(envTTL)
+		if err != nil || d <= 0 {
+			logging.Fatal("Invalid UPLOAD_TTL", "value", envTTL)
+		}
+		uploadTTL = d
+	}
+	adminToken = os.Getenv("ADMIN_TOKEN")
+	if secret := os.Getenv("SIGNING_SECRET"); secret != "" {
+		signingSecret = []byte(secret)
+	}
+	if envTTL := os.Getenv("SIGNED_URL_TTL"); envTTL != "" {
+		d, err := time.ParseDuration(envTTL)
+		if err != nil || d <= 0 {
+			logging.Fatal("Invalid SIGNED_URL_TTL", "value", envTTL)
+		}
+		signedURLTTL = d
+	}
+	if envRate := os.Getenv("RATE_LIMIT"); envRate != "" {
+		n, err := strconv.ParseFloat(envRate, 64)
+		if err != nil || n < 0 {
+			logging.Fatal("Invalid RATE_LIMIT", "value", envRate)
+		}
+		rateLimit = n
+	}
+	if envBurst := os.Getenv("RATE_BURST"); envBurst != "" {
+		n, err := strconv.Atoi(envBurst)
+		if err != nil || n <= 0 {
+			logging.Fatal("Invalid RATE_BURST", "value", envBurst)
+		}
+		rateBurst = n
 	}
 
 	// 3. Parse Templates
 	tmpl, err := template.ParseFS(templates, "templates/*.html")
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("Error parsing templates", "err", err)
+	}
+
+	// The backend's certificate is self-signed; one client configuration
+	// serves every upload
+	backendTLSConfig, err := security.GenerateTLSConfig()
+	if err != nil {
+		logging.Fatal("Error configuring backend TLS", "err", err)
+	}
+
+	hub := NewRoomHub()
+	blobs := store.New(storageRoot)
+	storageKey, err := loadStorageKey(storageRoot, os.Getenv("STORAGE_KEY"))
+	if err != nil {
+		logging.Fatal("Error loading STORAGE_KEY", "err", err)
+	}
+	if storageKey != nil {
+		blobs = store.NewEncrypted(storageRoot, storageKey)
+		slog.Info("Encrypting stored files at rest")
+	}
+	if roomTTL > 0 {
+		go runRoomSweeper(blobs, storageRoot, roomTTL, roomSweepInterval)
+	}
+	uploads := newResumableUploads(storageRoot, blobs, hub)
+	go uploads.runSweeper(uploadTTL, roomSweepInterval)
+	limiter := newIPLimiter(rateLimit, rateBurst)
+	if limiter != nil {
+		go limiter.runSweeper(time.Minute)
 	}
 
 	r := mux.NewRouter()
 
 	// Landing Page
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		tmpl.Execute(w, PageData{})
+		renderPage(w, tmpl, http.StatusOK, PageData{})
 	}).Methods("GET")
 	
+	// Liveness Probe
+	r.HandleFunc("/healthz", handleHealthz).Methods("GET")
+	r.HandleFunc("/metrics", handleMetrics).Methods("GET")
+	r.HandleFunc("/admin/transfers", handleTransfers).Methods("GET")
+
 	// Create Room
-	r.HandleFunc("/create", func(w http.ResponseWriter, r *http.Request) {
+	r.HandleFunc("/create", limiter.wrap(func(w http.ResponseWriter, r *http.Request) {
 		roomID := uuid.New().String()[:8] // Short ID
+		if name := r.FormValue("name"); name != "" {
+			switch err := claimRoom(storageRoot, name); {
+			case errors.Is(err, errRoomName):
+				renderPage(w, tmpl, http.StatusBadRequest, PageData{Error: "Room names may only use letters, digits and single dashes between them, up to 64 characters."})
+				return
+			case errors.Is(err, errRoomTaken):
+				renderPage(w, tmpl, http.StatusConflict, PageData{Error: "A room named " + name + " already exists; pick another name or join it instead."})
+				return
+			case err != nil:
+				slog.Error("Error creating room", "room", name, "err", err)
+				http.Error(w, "Room Error", http.StatusInternalServerError)
+				return
+			}
+			slog.Info("Created named room", "room", name)
+			roomID = name
+		}
+		if password := r.FormValue("password"); password != "" {
+			if err := setRoomPassword(roomID, password); err != nil {
+				slog.Error("Error protecting room", "room", roomID, "err", err)
+				http.Error(w, "Room Error", http.StatusInternalServerError)
+				return
+			}
+			grantRoomAccess(w, roomID)
+		}
 		http.Redirect(w, r, "/room/"+roomID, http.StatusSeeOther)
-	}).Methods("POST")
+	})).Methods("POST")
 
 	// Join Room
 	r.HandleFunc("/join", func(w http.ResponseWriter, r *http.Request) {
@@ -109,262 +311,372 @@ func main() {
 		http.Redirect(w, r, "/room/"+roomID, http.StatusSeeOther)
 	}).Methods("POST")
 
+	// Unlock Password-Protected Room
+	r.HandleFunc("/room/{id}/unlock", func(w http.ResponseWriter, r *http.Request) {
+		roomID := mux.Vars(r)["id"]
+		renderPage(w, tmpl, http.StatusOK, PageData{RoomID: roomID, Locked: true})
+	}).Methods("GET")
+
+	r.HandleFunc("/room/{id}/unlock", func(w http.ResponseWriter, r *http.Request) {
+		roomID := mux.Vars(r)["id"]
+		if !checkRoomPassword(roomID, r.FormValue("password")) {
+			renderPage(w, tmpl, http.StatusUnauthorized, PageData{RoomID: roomID, Locked: true, Error: "Incorrect password."})
+			return
+		}
+		grantRoomAccess(w, roomID)
+		http.Redirect(w, r, "/room/"+roomID, http.StatusSeeOther)
+	}).Methods("POST")
+
 	// Room View
 	r.HandleFunc("/room/{id}", func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		roomID := vars["id"]
+		if !requireRoomAccess(w, r, roomID) {
+			return
+		}
 		
-		roomDir := filepath.Join(storageRoot, roomID)
-		os.MkdirAll(roomDir, 0755)
+		os.MkdirAll(filepath.Join(storageRoot, roomID), 0755)
 
-		files, err := os.ReadDir(roomDir)
+		fileInfos, err := listRoom(blobs, roomID)
 		if err != nil {
 			http.Error(w, "Room Error", http.StatusInternalServerError)
 			return
 		}
 
-		var fileInfos []FileInfo
-		for _, f := range files {
-			if !f.IsDir() {
-				info, _ := f.Info()
-				size := fmt.Sprintf("%.2f KB", float64(info.Size())/1024)
-				
-                // Basic hash display
-                fOpen, _ := os.Open(filepath.Join(roomDir, f.Name()))
-                hashStr := "Verified"
-                if fOpen != nil {
-                     h, _ := protocol.ComputeChecksum(fOpen)
-                     hashStr = fmt.Sprintf("%x", h)[:8] + "..."
-                     fOpen.Close()
-                }
-
-				fileInfos = append(fileInfos, FileInfo{
-					Name: f.Name(),
-					Size: size,
-                    Hash: hashStr,
-				})
-			}
-		}
-
-		tmpl.Execute(w, PageData{
+		renderPage(w, tmpl, http.StatusOK, PageData{
 			RoomID: roomID,
 			Files:  fileInfos,
             LocalIP: GetLocalIP(),
+			Port:    webPort,
 		})
 	}).Methods("GET")
 
+	// Room QR Code (rebuilt per request since the LAN IP can change)
+	r.HandleFunc("/room/{id}/qr", func(w http.ResponseWriter, r *http.Request) {
+		roomID := mux.Vars(r)["id"]
+		if !requireRoomAccess(w, r, roomID) {
+			return
+		}
+
+		png, err := qrcode.Encode(roomURL(roomID), qrcode.Medium, 256)
+		if err != nil {
+			slog.Error("QR error", "err", err)
+			http.Error(w, "QR Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(png)
+	}).Methods("GET")
+
 	// Upload Handler
-	r.HandleFunc("/upload/{id}", func(w http.ResponseWriter, r *http.Request) {
+	r.HandleFunc("/upload/{id}", limiter.wrap(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		roomID := vars["id"]
+		if !requireRoomAccess(w, r, roomID) {
+			return
+		}
 		
 		var logs []string
         logFn := func(msg string) {
             logs = append(logs, fmt.Sprintf("[%s] %s", time.Now().Format("15:04:05"), msg))
         }
 
-		// 1. Get File
-		file, header, err := r.FormFile("file")
-		if err != nil {
-			http.Error(w, "Bad Request", http.StatusBadRequest)
+		// 1. Get File as it streams in (bounded so a single upload can't
+		// fill the disk)
+		if r.ContentLength > maxUploadBytes {
+			http.Error(w, tooLargeMessage(), http.StatusRequestEntityTooLarge)
 			return
 		}
-		defer file.Close()
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
 
-		// 2. Buffer to Temp
-		tempFile, err := os.CreateTemp("", "upload-*")
+		part, file, size, err := uploadPart(r, "file")
 		if err != nil {
-			http.Error(w, "Server Error", 500); return
+			if uploadCancelled(r, roomID, "receiving") {
+				return
+			}
+			var maxErr *http.MaxBytesError
+			switch {
+			case errors.As(err, &maxErr):
+				http.Error(w, tooLargeMessage(), http.StatusRequestEntityTooLarge)
+			case errors.Is(err, errNoLength):
+				http.Error(w, "Length Required", http.StatusLengthRequired)
+			default:
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+			}
+			return
+		}
+		filename := part.FileName()
+		if !validFileName(filename) {
+			http.Error(w, "Invalid file name", http.StatusBadRequest)
+			return
+		}
+		if filename == roomMetaFile {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if err := uploadBlocklist.AllowUpload(filename); err != nil {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
 		}
-		defer func() { tempFile.Close(); os.Remove(tempFile.Name()) }()
-		
-		io.Copy(tempFile, file)
-		logFn("Buffered payload locally.")
 
-		// 3. Connect to TCP Backend
-		logFn(fmt.Sprintf("Dialing TCP %s", tcpServerAddr))
-		tlsConfig, err := security.GenerateTLSConfig()
-		conn, err := tls.Dial("tcp", tcpServerAddr, tlsConfig)
+		exceeded, err := storage.QuotaExceeded(storageRoot, quotaBytes, size)
 		if err != nil {
-            log.Printf("Dial Error: %v", err)
-			http.Error(w, "Backend Offline", 503); return
+			slog.Error("Quota check error", "err", err)
+			http.Error(w, "Server Error", 500); return
+		}
+		if exceeded {
+			http.Error(w, "Storage quota exceeded: no room for this upload", http.StatusInsufficientStorage)
+			return
 		}
-		// Defer Close removed here, we close manually after transfer to ensure flush
-
-		// 4. Protocol Handshake (Upload)
-		logFn("Sending Handshake (OpUpload)")
-		err = binary.Write(conn, binary.LittleEndian, uint8(protocol.OpUpload))
-        if err != nil {
-             http.Error(w, "Handshake Error", 500); conn.Close(); return 
-        }
 
-		// 5. Send Header & Checksum
-		tempFile.Seek(0, 0)
-		checksum, _ := protocol.ComputeChecksum(tempFile)
+		// 2. Stream it straight through the TCP backend, hashing it on the
+		// way. It lands in the staging directory: the room keeps its file
+		// of the same name until this one is known to be new and complete.
+		staged := uuid.NewString()
+		hasher := sha256.New()
+		logFn(fmt.Sprintf("Streaming to TCP backend %s", tcpServerAddr))
+		backendClient := client.New(backendTLSConfig)
+		backendClient.PSK = backendPSK
+		backendClient.OnUploadProgress = progressLogger(logFn)
+		// Cancelling the context drops the backend connection, and the
+		// backend discards what it received of the file. The backend is
+		// sent the file sealed, so with STORAGE_KEY set the staged copy is
+		// encrypted too.
+		src := sealStream(blobs, io.TeeReader(contextReader{r.Context(), file}, hasher))
+		defer src.Close()
+		if err := backendClient.Upload(r.Context(), tcpServerAddr, staged, src, blobs.SealedSize(size)); err != nil {
+			if uploadCancelled(r, roomID, "streaming to the backend") {
+				return
+			}
+			var maxErr *http.MaxBytesError
+			var ackErr *client.AckError
+			switch {
+			case errors.As(err, &maxErr):
+				http.Error(w, tooLargeMessage(), http.StatusRequestEntityTooLarge)
+			case errors.Is(err, errPartSize):
+				http.Error(w, "Bad Request: send the file as the form's only field", http.StatusBadRequest)
+			case errors.As(err, &ackErr):
+				slog.Error("Error uploading to backend", "addr", tcpServerAddr, "err", err)
+				http.Error(w, "Upload Rejected: "+ackErr.Message, http.StatusBadGateway)
+			default:
+				slog.Error("Error uploading to backend", "addr", tcpServerAddr, "err", err)
+				http.Error(w, "Backend Offline", 503)
+			}
+			return
+		}
+		logFn(fmt.Sprintf("Transfer Complete and Verified (%d bytes).", size))
+		var checksum [32]byte
+		copy(checksum[:], hasher.Sum(nil))
 		logFn(fmt.Sprintf("Computed Hash: %x", checksum))
-		
-		tempFile.Seek(0, 0)
-		info, _ := tempFile.Stat()
-		
-		// Hack: Send filename as "RoomID/Filename" so backend saves it correctly?
-		// No, TCP backend is simple.
-		// Instead: Send just filename, let TCP backend save to storage/
-		// THEN we move it. 
-		// Actually, if we want the TCP backend to be the source of truth, 
-		// we'd need to modify the protocol to support folders.
-		// For this demo "App Gateway", we will simulate the transfer to TCP
-		// but since we are running both, we can just save the file to the right directory manually
-		// to make the "Room" system work, effectively bypassing the server's storage logic but proving the transfer mechanism. 
-		
-		// Wait! The TCP server saves to "storage/". 
-		// If we want room support, we need to handle the file AFTER transfer.
-		
-		// Let's send the header normally via TCP to prove it works.
-		protocol.SendFileHeader(conn, header.Filename, info.Size(), checksum)
-
-		// 6. Stream Data
-		logFn("Streaming Encrypted Blocks...")
-		tempFile.Seek(0, 0)
-		sent, err := io.Copy(conn, tempFile)
-        if err != nil {
-            log.Printf("Error sending file: %v", err)
-            http.Error(w, "Upload Interrupted", 500)
-            return
-        }
-		logFn(fmt.Sprintf("Transfer Complete (%d bytes).", sent))
-        
-        // CRITICAL: Close the write side of the connection or the connection itself 
-        // to signal to the server that we are done sending.
-        // Since we don't expect a response payload (just a close), we can close here.
-        conn.Close()
-
-		// 7. Post-Process: Move file to correct Room (Simulated "Routing")
-		// The TCP server saved it in 'storage/'
-		// We move it to 'storage/roomID/'
-		time.Sleep(100 * time.Millisecond) // Give TCP server a moment to close file
-		src := filepath.Join("storage", header.Filename)
-		dst := filepath.Join(storageRoot, roomID, header.Filename)
-		
-		// Move/Rename
-		os.Rename(src, dst)
+		received := filepath.Join(storageRoot, incomingDir, staged)
+
+		// A file the room already holds isn't stored again
+		if existing, ok := findInRoom(blobs, storageRoot, roomID, checksum); ok {
+			os.Remove(received)
+			logFn(fmt.Sprintf("Already present in this room as %s; upload skipped.", existing))
+			slog.Info("Skipped duplicate upload", "room", roomID, "file", filename, "existing", existing)
+			fileInfos, _ := listRoom(blobs, roomID)
+			renderPage(w, tmpl, http.StatusOK, PageData{
+				RoomID:   roomID,
+				Files:    fileInfos,
+				Logs:     logs,
+				ShowLogs: true,
+				LocalIP:  GetLocalIP(),
+				Port:     webPort,
+			})
+			return
+		}
+
+		// 3. Move it into the content-addressed store, linked from the
+		// room in place of any file of that name. Until then the room
+		// keeps its old file, so a failure here loses nothing.
+		if err := storeReceived(blobs, received, roomID, filename, checksum); err != nil {
+			slog.Error("Error storing upload", "path", received, "err", err)
+			http.Error(w, "Storage Error", 500)
+			return
+		}
 		logFn("Routed artifact to secure room.")
+		slog.Info("Stored upload", "room", roomID, "file", filename, "bytes", size)
+		hub.Broadcast(roomID, RoomEvent{Type: "added", File: filename})
 
 		// Re-render page with logs
 		// (Same logic as GET /room/{id} but with logs)
-		roomDir := filepath.Join(storageRoot, roomID)
-		files, _ := os.ReadDir(roomDir)
-		var fileInfos []FileInfo
-		for _, f := range files {
-			if !f.IsDir() {
-				i, _ := f.Info()
-				fileInfos = append(fileInfos, FileInfo{
-					Name: f.Name(),
-					Size: fmt.Sprintf("%.2f KB", float64(i.Size())/1024),
-                    Hash: "Verified",
-				})
-			}
-		}
+		fileInfos, _ := listRoom(blobs, roomID)
 
-		tmpl.Execute(w, PageData{
+		renderPage(w, tmpl, http.StatusOK, PageData{
 			RoomID: roomID,
 			Files:  fileInfos,
 			Logs:   logs,
 			ShowLogs: true,
             LocalIP: GetLocalIP(),
+			Port:    webPort,
 		})
-	}).Methods("POST")
+	})).Methods("POST")
+
+	// Resumable Uploads (see resumable.go)
+	r.HandleFunc("/upload-init/{id}", limiter.wrap(uploads.handleInit)).Methods("POST")
+	r.HandleFunc("/upload/{upload}", uploads.handleHead).Methods("HEAD")
+	r.HandleFunc("/upload/{upload}", uploads.handlePatch).Methods("PATCH")
+	r.HandleFunc("/upload/{upload}/complete", uploads.handleComplete).Methods("POST")
 
 	// Delete Handler
-	r.HandleFunc("/delete/{id}/{file}", func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		roomID := vars["id"]
-		fileName := vars["file"] 
-		
-		path := filepath.Join(storageRoot, roomID, fileName)
-		os.Remove(path) // Delete file
-		
-		http.Redirect(w, r, "/room/"+roomID, http.StatusSeeOther)
-	}).Methods("POST")
+	r.HandleFunc("/delete/{id}/{file}", limiter.wrap(handleDelete(blobs, hub))).Methods("POST")
 
-	// Download Handler
-	r.HandleFunc("/download/{id}/{file}", func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		path := filepath.Join(storageRoot, vars["id"], vars["file"])
-		http.ServeFile(w, r, path)
+	// Live room updates
+	r.HandleFunc("/ws/room/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !requireRoomAccess(w, r, mux.Vars(r)["id"]) {
+			return
+		}
+		hub.ServeRoom(w, r)
 	}).Methods("GET")
+
+	// Download Handler
+	r.HandleFunc("/download/{id}/{file}", handleDownload(blobs)).Methods("GET")
+
+	// Signed download links to one file (see signed.go)
+	r.HandleFunc("/sign/{id}/{file}", handleSign(blobs)).Methods("GET")
+	r.HandleFunc("/d/{token}", handleSignedDownload(blobs)).Methods("GET")
     
     // Serve static assets if any
     r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("static/"))))
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
-
 	srv := &http.Server{
-		Addr:         ":" + port,
+		Addr:         ":" + webPort,
 		Handler:      r,
 		ReadTimeout:  30 * time.Second,
 		WriteTimeout: 30 * time.Second,
 	}
 
-	fmt.Printf("Web Gateway started at :%s\n", port)
-	log.Fatal(srv.ListenAndServe())
+	fmt.Printf("Web Gateway started at :%s\n", webPort)
+	logging.Fatal("Web gateway stopped", "err", srv.ListenAndServe())
 }
 
-// Internal Server Logic (Duplicated for simplicity)
-func startInternalTCPServer() {
-    log.Println("Internal TCP Service Active")
-	
-	// Start Discovery Service in background so it doesn't block TCP server startup
-	go discovery.Listen(protocol.DefaultTCPPort)
+// contextReader fails reads once ctx is done, so copying a request body
+// stops as soon as the browser goes away
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
 
-	tlsConfig, err := security.GenerateTLSConfig()
-	if err != nil {
-		log.Printf("Internal TCP Server TLS Generation Failed: %v", err)
-		return
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
 	}
-	
-	listener, err := tls.Listen("tcp", protocol.DefaultTCPPort, tlsConfig)
+	return c.r.Read(p)
+}
+
+// uploadCancelled reports whether r's client has gone away, logging that
+// its upload was abandoned while stage. Nothing can be sent back then.
+func uploadCancelled(r *http.Request, roomID, stage string) bool {
+	if r.Context().Err() == nil {
+		return false
+	}
+	slog.Info("Upload cancelled by the client", "room", roomID, "stage", stage)
+	return true
+}
+
+// incomingDir is where browser uploads land on their way through the TCP
+// backend, under the storage root; it is the backend's whole storage
+// directory. Like the object store it starts with a dot, so it is never
+// mistaken for a room.
+const incomingDir = ".incoming"
+
+// sealStream returns r as blobs.Seal writes it, read on another goroutine.
+// An error reading r comes out of the stream as it is. Close stops the
+// goroutine and waits for it, so r isn't read after Close returns.
+func sealStream(blobs *store.Store, r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sealed, err := blobs.Seal(pw)
+		if err == nil {
+			_, err = io.Copy(sealed, r)
+			err = errors.Join(err, sealed.Close())
+		}
+		pw.CloseWithError(err)
+	}()
+	return sealedStream{pr, done}
+}
+
+type sealedStream struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+func (s sealedStream) Close() error {
+	s.PipeReader.Close()
+	<-s.done
+	return nil
+}
+
+// storeReceived moves a file the TCP backend received, as sealStream sent
+// it, into the content store (verifying its checksum on the way) and links
+// it into the room
+func storeReceived(blobs *store.Store, src, roomID, name string, checksum [32]byte) error {
+	f, err := os.Open(src)
 	if err != nil {
-		log.Printf("Internal TCP Server Listen Failed: %v", err)
-		return
+		return err
 	}
-	log.Printf("Internal TCP Server listening on %s", protocol.DefaultTCPPort)
-	
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Printf("Accept error: %v", err)
-			continue
+	data, err := blobs.Unseal(f)
+	if err == nil {
+		err = blobs.PutLink(roomID, name, checksum, data)
+	}
+	f.Close()
+	os.Remove(src)
+	return err
+}
+
+// progressLogStep is how far (in percent) a transfer must advance before
+// another progress line is logged
+const progressLogStep = 10
+
+// progressLogger returns a ui.ProgressWriter callback that logs every
+// progressLogStep percent, so large uploads show they're still moving
+func progressLogger(logFn func(string)) func(current, total int64) {
+	next := progressLogStep
+	return func(current, total int64) {
+		if total <= 0 {
+			return
 		}
-		go handleConnection(conn)
+		percent := int(current * 100 / total)
+		if percent < next {
+			return
+		}
+		logFn(fmt.Sprintf("Sent %d%% (%d of %d bytes)", percent, current, total))
+		next = (percent/progressLogStep + 1) * progressLogStep
 	}
 }
 
-func handleConnection(conn net.Conn) {
-	defer conn.Close()
-	var opCode uint8
-	binary.Read(conn, binary.LittleEndian, &opCode)
+// envOr returns the environment variable key, or def when it's unset
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
 
-	if opCode == protocol.OpUpload {
-		fileName, _, _, _ := protocol.ReadFileHeader(conn)
-		
-		// Save directly to storage root first
-		os.MkdirAll("storage", 0755)
-		savePath := filepath.Join("storage", filepath.Base(fileName))
-		file, err := os.Create(savePath)
-        if err != nil {
-            log.Printf("Server create file error: %v", err)
-            return
-        }
-		defer file.Close()
-		
-        // Use Copy, not CopyN, so we just read until EOF (connection closed by client)
-        // This prevents hanging if sizes mismatch slightly
-		_, err = io.Copy(file, conn)
-        if err != nil {
-             log.Printf("Server copy error: %v", err)
-        }
+// tooLargeMessage explains an upload rejection in terms of the configured limit
+func tooLargeMessage() string {
+	return fmt.Sprintf("File too large: uploads are limited to %.2f MB", float64(maxUploadBytes)/(1024*1024))
+}
+
+// startInternalTCPServer runs the file server the gateway uploads through
+// on tcpServerAddr, loopback unless TCP_SERVER_ADDR says otherwise. It is
+// only for this process: it isn't advertised over discovery, and it serves
+// only clients holding backendPSK, which is made fresh at every start.
+func startInternalTCPServer() {
+	slog.Info("Internal TCP service active")
+
+	tlsConfig, err := security.GenerateTLSConfig()
+	if err != nil {
+		slog.Error("Internal TCP server TLS generation failed", "err", err)
+		return
+	}
+	backend.TLSConfig = tlsConfig
+	slog.Info("Internal TCP server listening", "addr", tcpServerAddr)
+	if err := backend.ListenAndServe(tcpServerAddr); err != nil {
+		slog.Error("Internal TCP server stopped", "err", err)
 	}
 }
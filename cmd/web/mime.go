@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sniffLen is how much of a file http.DetectContentType looks at
+const sniffLen = 512
+
+// mimeTypes caches each room file's detected content type
+var mimeTypes = newFileCache[string]()
+
+// mimeType returns the content type of the file at path, described by
+// info. open is only called on a cache miss, to read the start of the
+// content.
+func mimeType(path string, info os.FileInfo, open func() (io.ReadCloser, error)) string {
+	t, _ := mimeTypes.get(path, info, func() (string, error) {
+		return detectMimeType(path, info.Size(), open), nil
+	})
+	return t
+}
+
+// detectMimeType sniffs the start of the content open returns, falling
+// back to path's extension when the content is empty, unreadable or only
+// recognised as generic text or binary
+func detectMimeType(path string, size int64, open func() (io.ReadCloser, error)) string {
+	sniffed := ""
+	if size > 0 {
+		if f, err := open(); err == nil {
+			buf := make([]byte, sniffLen)
+			n, _ := io.ReadFull(f, buf)
+			f.Close()
+			if n > 0 {
+				sniffed = http.DetectContentType(buf[:n])
+			}
+		}
+	}
+
+	generic := sniffed == "" || sniffed == "application/octet-stream" || strings.HasPrefix(sniffed, "text/plain")
+	if generic {
+		if byExt := mime.TypeByExtension(filepath.Ext(path)); byExt != "" {
+			return byExt
+		}
+	}
+	if sniffed == "" {
+		return "application/octet-stream"
+	}
+	return sniffed
+}
+
+// Icon returns the Font Awesome icon class for the file's content type
+func (f FileInfo) Icon() string {
+	mediaType, _, _ := mime.ParseMediaType(f.MimeType)
+	switch {
+	case strings.HasPrefix(mediaType, "image/"):
+		return "fa-file-image"
+	case strings.HasPrefix(mediaType, "video/"):
+		return "fa-file-video"
+	case strings.HasPrefix(mediaType, "audio/"):
+		return "fa-file-audio"
+	case mediaType == "application/pdf":
+		return "fa-file-pdf"
+	case strings.Contains(mediaType, "zip"), strings.Contains(mediaType, "tar"),
+		strings.Contains(mediaType, "compressed"), mediaType == "application/vnd.rar":
+		return "fa-file-zipper"
+	case mediaType == "application/json", mediaType == "application/xml",
+		mediaType == "text/html", mediaType == "text/javascript", mediaType == "text/css":
+		return "fa-file-code"
+	case strings.HasPrefix(mediaType, "text/"):
+		return "fa-file-lines"
+	}
+	return "fa-file"
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+)
+
+// maxPartHeadBytes bounds the opening boundary and part headers read
+// ahead of an upload's data
+const maxPartHeadBytes = 16 << 10
+
+var (
+	// errNoLength rejects an upload without a Content-Length, from which
+	// its size can't be worked out
+	errNoLength = errors.New("upload has no Content-Length")
+
+	// errPartSize is returned while streaming an upload whose file turns
+	// out longer or shorter than the request's Content-Length implied,
+	// e.g. because the form had more than one field
+	errPartSize = errors.New("file doesn't match the request's length")
+)
+
+// uploadPart returns the file of a multipart/form-data upload whose only
+// field is field, to be read as it streams in, and the file's size, which
+// the backend protocol needs before the data. The size follows from the
+// request's Content-Length: all that surrounds the data is the opening
+// boundary and the part's headers, which are read here, and the closing
+// boundary. The returned reader fails with errPartSize if the data turns
+// out otherwise.
+func uploadPart(r *http.Request, field string) (*multipart.Part, io.Reader, int64, error) {
+	if r.ContentLength < 0 {
+		return nil, nil, 0, errNoLength
+	}
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return nil, nil, 0, http.ErrNotMultipart
+	}
+	boundary := params["boundary"]
+
+	// Everything up to the blank line ending the part's headers
+	body := bufio.NewReader(r.Body)
+	var head bytes.Buffer
+	for {
+		line, err := body.ReadSlice('\n')
+		head.Write(line)
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("reading part headers: %w", err)
+		}
+		if head.Len() > maxPartHeadBytes {
+			return nil, nil, 0, errors.New("part headers too long")
+		}
+		if string(line) == "\r\n" {
+			break
+		}
+	}
+	headLen := int64(head.Len())
+
+	part, err := multipart.NewReader(io.MultiReader(&head, body), boundary).NextPart()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if part.FormName() != field {
+		return nil, nil, 0, fmt.Errorf("expected the %q field first, got %q", field, part.FormName())
+	}
+	size := r.ContentLength - headLen - int64(len("\r\n--"+boundary+"--\r\n"))
+	if size < 0 {
+		return nil, nil, 0, errPartSize
+	}
+	e := &exactReader{r: part, n: size}
+	if size == 0 {
+		// Nothing to stream, but the part must really be empty
+		if _, err := e.Read(nil); err != io.EOF {
+			return nil, nil, 0, err
+		}
+	}
+	return part, e, size, nil
+}
+
+// exactReader reads the n bytes r should hold, failing with errPartSize if
+// it holds fewer or more. It checks for more along with the last bytes, so
+// a reader limited to n still sees the error.
+type exactReader struct {
+	r io.Reader
+	n int64
+}
+
+func (e *exactReader) Read(p []byte) (int, error) {
+	if e.n <= 0 {
+		return 0, e.end()
+	}
+	if int64(len(p)) > e.n {
+		p = p[:e.n]
+	}
+	n, err := e.r.Read(p)
+	e.n -= int64(n)
+	switch {
+	case err == io.EOF && e.n > 0:
+		return n, errPartSize
+	case err != nil && err != io.EOF:
+		return n, err
+	case e.n == 0 && err == nil:
+		if err := e.end(); err != io.EOF {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// end returns io.EOF if r has nothing left, as it should once n bytes are
+// read, or errPartSize if it does
+func (e *exactReader) end() error {
+	var more [1]byte
+	_, err := io.ReadAtLeast(e.r, more[:], 1)
+	if err == nil {
+		err = errPartSize
+	}
+	return err
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// formRequest builds a browser-style upload of data as the file field,
+// after any fields in before
+func formRequest(t *testing.T, data []byte, before ...string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, name := range before {
+		mw.WriteField(name, "x")
+	}
+	fw, err := mw.CreateFormFile("file", "notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(data)
+	mw.Close()
+	r := httptest.NewRequest("POST", "/upload/room", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestUploadPart(t *testing.T) {
+	for _, data := range [][]byte{
+		[]byte("hello, world"),
+		{},
+		bytes.Repeat([]byte("0123456789\r\n--"), 100000),
+	} {
+		r := formRequest(t, data)
+		part, file, size, err := uploadPart(r, "file")
+		if err != nil {
+			t.Fatalf("uploadPart of %d bytes: %v", len(data), err)
+		}
+		if part.FileName() != "notes.txt" || size != int64(len(data)) {
+			t.Errorf("uploadPart = %q, %d bytes; want notes.txt, %d", part.FileName(), size, len(data))
+		}
+		// Read just as the backend upload does, never past size
+		got, err := io.ReadAll(io.LimitReader(file, size))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("read %d bytes, %v; want the %d uploaded", len(got), err, len(data))
+		}
+	}
+
+	// The size is only right for a lone file field, and it is never
+	// trusted: a part that doesn't match fails the read
+	for _, off := range []int64{2, -2} {
+		r := formRequest(t, []byte("hello"))
+		r.ContentLength += off
+		_, file, size, err := uploadPart(r, "file")
+		if err != nil {
+			t.Fatalf("uploadPart with Content-Length off by %d: %v", off, err)
+		}
+		if _, err = io.ReadAll(io.LimitReader(file, size)); !errors.Is(err, errPartSize) {
+			t.Errorf("reading with Content-Length off by %d = %v, want errPartSize", off, err)
+		}
+	}
+	if _, _, _, err := uploadPart(formRequest(t, []byte("hello"), "comment"), "file"); err == nil {
+		t.Error("uploadPart accepted a form with a field before the file")
+	}
+	r := formRequest(t, []byte("hello"))
+	r.ContentLength = -1
+	if _, _, _, err := uploadPart(r, "file"); !errors.Is(err, errNoLength) {
+		t.Errorf("uploadPart without a Content-Length = %v, want errNoLength", err)
+	}
+}
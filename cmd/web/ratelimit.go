@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ipLimiter gives every client IP its own token bucket, so one client
+// hammering the write routes can't crowd out the rest. A nil *ipLimiter
+// lets everything through.
+type ipLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu      sync.Mutex
+	buckets map[string]*rate.Limiter
+}
+
+// newIPLimiter allows each IP perMinute requests a minute on average, in
+// bursts of up to burst. It returns nil, limiting nothing, when perMinute
+// is 0.
+func newIPLimiter(perMinute float64, burst int) *ipLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &ipLimiter{
+		limit:   rate.Limit(perMinute / 60),
+		burst:   burst,
+		buckets: make(map[string]*rate.Limiter),
+	}
+}
+
+// allow takes a token from ip's bucket, reporting false and how long until
+// the next one if it is empty
+func (l *ipLimiter) allow(ip string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = rate.NewLimiter(l.limit, l.burst)
+		l.buckets[ip] = b
+	}
+	if b.AllowN(now, 1) {
+		return true, 0
+	}
+	wait := time.Duration((1 - b.TokensAt(now)) / float64(l.limit) * float64(time.Second))
+	return false, wait
+}
+
+// sweep forgets the IPs whose buckets have refilled, which behave exactly
+// like the fresh bucket a returning client would get. It returns how many
+// remain.
+func (l *ipLimiter) sweep(now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ip, b := range l.buckets {
+		if b.TokensAt(now) >= float64(l.burst) {
+			delete(l.buckets, ip)
+		}
+	}
+	return len(l.buckets)
+}
+
+// runSweeper sweeps every interval, for the life of the process
+func (l *ipLimiter) runSweeper(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if n := l.sweep(time.Now()); n > 0 {
+			slog.Debug("Swept rate limiter", "tracked_ips", n)
+		}
+	}
+}
+
+// wrap rate-limits next by the client's IP, answering requests over the
+// limit with 429 Too Many Requests and a Retry-After header
+func (l *ipLimiter) wrap(next http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if ok, wait := l.allow(ip, time.Now()); !ok {
+			slog.Warn("Rate limit exceeded", "ip", ip, "path", r.URL.Path)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too many requests, slow down", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// clientIP is the host part of the request's remote address. Behind a
+// reverse proxy that is the proxy's, so every client shares one bucket.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIPLimiterThrottlesBursts(t *testing.T) {
+	l := newIPLimiter(60, 5) // one a second, five at once
+	h := l.wrap(func(w http.ResponseWriter, r *http.Request) {})
+
+	post := func(remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/create", nil)
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 5; i++ {
+		if rec := post("192.0.2.1:5000"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d of the burst = %d, want 200", i+1, rec.Code)
+		}
+	}
+	// Another port on the same host draws from the same bucket
+	rec := post("192.0.2.1:6000")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("request past the burst = %d, want 429", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want 1", got)
+	}
+	if rec := post("192.0.2.2:5000"); rec.Code != http.StatusOK {
+		t.Errorf("another IP = %d, want 200", rec.Code)
+	}
+}
+
+func TestIPLimiterSweepsRefilledBuckets(t *testing.T) {
+	l := newIPLimiter(60, 2)
+	now := time.Now()
+	l.allow("192.0.2.1", now)
+	l.allow("192.0.2.1", now)
+	l.allow("192.0.2.2", now)
+
+	if n := l.sweep(now); n != 2 {
+		t.Fatalf("sweep right away kept %d IPs, want 2", n)
+	}
+	// 192.0.2.2 is full again after a second, 192.0.2.1 after two
+	if n := l.sweep(now.Add(time.Second)); n != 1 {
+		t.Fatalf("sweep after 1s kept %d IPs, want 1", n)
+	}
+	if n := l.sweep(now.Add(2 * time.Second)); n != 0 {
+		t.Fatalf("sweep after 2s kept %d IPs, want 0", n)
+	}
+	if ok, _ := l.allow("192.0.2.1", now.Add(2*time.Second)); !ok {
+		t.Error("a swept IP was refused")
+	}
+}
+
+func TestIPLimiterDisabled(t *testing.T) {
+	if l := newIPLimiter(0, 5); l != nil {
+		t.Fatal("RATE_LIMIT=0 built a limiter")
+	}
+	var l *ipLimiter
+	called := false
+	l.wrap(func(w http.ResponseWriter, r *http.Request) { called = true })(httptest.NewRecorder(), httptest.NewRequest("POST", "/create", nil))
+	if !called {
+		t.Error("a nil limiter blocked the request")
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"log/slog"
+	"net/http"
+)
+
+// renderPage executes tmpl with data and sends the result with status.
+// The page is rendered into a buffer first, so a template error becomes a
+// logged 500 instead of a half-written page with the status already sent.
+func renderPage(w http.ResponseWriter, tmpl *template.Template, status int, data PageData) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		slog.Error("Error rendering page", "room", data.RoomID, "err", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
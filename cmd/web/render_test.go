@@ -0,0 +1,26 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRenderPage(t *testing.T) {
+	tmpl := template.Must(template.New("page").Parse(`<h1>{{.RoomID}}</h1>{{if .Error}}{{.Error.Missing}}{{end}}`))
+
+	w := httptest.NewRecorder()
+	renderPage(w, tmpl, http.StatusConflict, PageData{RoomID: "abc"})
+	if w.Code != http.StatusConflict || w.Body.String() != "<h1>abc</h1>" {
+		t.Errorf("renderPage = %d %q, want 409 <h1>abc</h1>", w.Code, w.Body.String())
+	}
+
+	// Execution fails after the heading was written; none of it is sent
+	w = httptest.NewRecorder()
+	renderPage(w, tmpl, http.StatusOK, PageData{RoomID: "abc", Error: "oops"})
+	if w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), "<h1>") {
+		t.Errorf("renderPage of a failing template = %d %q, want a 500 without the page", w.Code, w.Body.String())
+	}
+}
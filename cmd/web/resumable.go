@@ -0,0 +1,510 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopher-fs/internal/storage"
+	"gopher-fs/internal/store"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// uploadsDir holds partial resumable uploads under the storage root. Like
+// the object store it starts with a dot, so it is never mistaken for a room.
+const uploadsDir = ".uploads"
+
+// Resumable upload protocol:
+//
+//	POST  /upload-init/{room}         name, size and optionally sha256 (hex) form values;
+//	                                  replies {"upload_id", "offset"}
+//	HEAD  /upload/{upload}            current offset in the Upload-Offset header
+//	PATCH /upload/{upload}            appends the body at the Upload-Offset header
+//	POST  /upload/{upload}/complete   verifies the sha256 (given here or at init)
+//	                                  and moves the file into the room
+//
+// A chunk sent at the wrong offset gets 409 Conflict with the current
+// offset, so a client that lost a response just asks where to continue.
+
+// pendingUpload is the on-disk state of a resumable upload, stored as
+// <id>.json next to its data. The data is kept a file per chunk received,
+// <id>.<start>-<end>.part for the bytes from start to end, sealed under the
+// storage key if there is one (see store.Store.Seal), so a partial upload
+// is never on disk in the clear. A chunk is written under a temporary name
+// and only given its range once complete, so the offset, the end of the
+// last range, is always what arrived.
+type pendingUpload struct {
+	Room   string `json:"room"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// resumableUploads serves the resumable upload endpoints
+type resumableUploads struct {
+	root  string // the storage root holding the rooms
+	dir   string
+	blobs *store.Store
+	hub   *RoomHub
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex // serializes requests for one upload
+}
+
+func newResumableUploads(root string, blobs *store.Store, hub *RoomHub) *resumableUploads {
+	return &resumableUploads{
+		root:  root,
+		dir:   filepath.Join(root, uploadsDir),
+		blobs: blobs,
+		hub:   hub,
+		locks: make(map[string]*sync.Mutex),
+	}
+}
+
+// acquire takes the lock for the request's upload, answering the request
+// itself (and returning false) if there is no such upload
+func (u *resumableUploads) acquire(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	id := mux.Vars(r)["upload"]
+	if _, err := uuid.Parse(id); err != nil {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	if _, err := os.Stat(u.metaPath(id)); err != nil {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	return u.lock(id), true
+}
+
+// lock takes the lock for upload id and returns its unlock function
+func (u *resumableUploads) lock(id string) func() {
+	u.mu.Lock()
+	l, ok := u.locks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		u.locks[id] = l
+	}
+	u.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+func (u *resumableUploads) metaPath(id string) string { return filepath.Join(u.dir, id+".json") }
+
+func (u *resumableUploads) chunkPath(id string, start, end int64) string {
+	return filepath.Join(u.dir, fmt.Sprintf("%s.%d-%d.part", id, start, end))
+}
+
+// chunk is a received piece of an upload's data
+type chunk struct {
+	path       string
+	start, end int64
+}
+
+// chunks returns the pieces of upload id in order, failing unless they
+// run back to back from the start
+func (u *resumableUploads) chunks(id string) ([]chunk, error) {
+	paths, err := filepath.Glob(filepath.Join(u.dir, id+".*.part"))
+	if err != nil {
+		return nil, err
+	}
+	chunks := make([]chunk, 0, len(paths))
+	for _, p := range paths {
+		span := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(p), id+"."), ".part")
+		start, end, _ := strings.Cut(span, "-")
+		c := chunk{path: p}
+		if c.start, err = strconv.ParseInt(start, 10, 64); err != nil {
+			return nil, fmt.Errorf("bad chunk name %s", filepath.Base(p))
+		}
+		if c.end, err = strconv.ParseInt(end, 10, 64); err != nil {
+			return nil, fmt.Errorf("bad chunk name %s", filepath.Base(p))
+		}
+		chunks = append(chunks, c)
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].start < chunks[j].start })
+	var offset int64
+	for _, c := range chunks {
+		if c.start != offset || c.end <= c.start {
+			return nil, fmt.Errorf("chunk %d-%d doesn't follow offset %d", c.start, c.end, offset)
+		}
+		offset = c.end
+	}
+	return chunks, nil
+}
+
+// received is how much of an upload chunks holds
+func received(chunks []chunk) int64 {
+	if len(chunks) == 0 {
+		return 0
+	}
+	return chunks[len(chunks)-1].end
+}
+
+// chunkReader reads the data of an upload's chunks in order, opening each
+// only once it is reached
+type chunkReader struct {
+	blobs  *store.Store
+	chunks []chunk
+	f      *os.File
+	r      io.Reader
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.r == nil {
+			if len(c.chunks) == 0 {
+				return 0, io.EOF
+			}
+			f, err := os.Open(c.chunks[0].path)
+			if err != nil {
+				return 0, err
+			}
+			c.chunks = c.chunks[1:]
+			r, err := c.blobs.Unseal(f)
+			if err != nil {
+				f.Close()
+				return 0, err
+			}
+			c.f, c.r = f, r
+		}
+		n, err := c.r.Read(p)
+		if err == io.EOF {
+			c.Close()
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Close closes the chunk being read, if any
+func (c *chunkReader) Close() error {
+	if c.f == nil {
+		return nil
+	}
+	err := c.f.Close()
+	c.f, c.r = nil, nil
+	return err
+}
+
+// load returns the state and current offset of upload id, answering the
+// request itself (and returning false) if the upload is unknown or the
+// client may not use its room
+func (u *resumableUploads) load(w http.ResponseWriter, r *http.Request) (string, pendingUpload, int64, bool) {
+	var p pendingUpload
+	id := mux.Vars(r)["upload"]
+	if _, err := uuid.Parse(id); err != nil {
+		http.NotFound(w, r)
+		return "", p, 0, false
+	}
+	data, err := os.ReadFile(u.metaPath(id))
+	if err == nil {
+		err = json.Unmarshal(data, &p)
+	}
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("Error reading upload state", "upload", id, "err", err)
+		}
+		http.NotFound(w, r)
+		return "", p, 0, false
+	}
+	if !requireRoomAccess(w, r, p.Room) {
+		return "", p, 0, false
+	}
+	chunks, err := u.chunks(id)
+	if err != nil {
+		slog.Error("Error reading upload data", "upload", id, "err", err)
+		http.Error(w, "Upload Error", http.StatusInternalServerError)
+		return "", p, 0, false
+	}
+	return id, p, received(chunks), true
+}
+
+// handleInit starts a resumable upload into a room
+func (u *resumableUploads) handleInit(w http.ResponseWriter, r *http.Request) {
+	roomID := mux.Vars(r)["id"]
+	if !requireRoomAccess(w, r, roomID) {
+		return
+	}
+
+	name := filepath.Base(r.FormValue("name"))
+	if name == "." || name == string(filepath.Separator) || strings.HasPrefix(name, ".") {
+		http.Error(w, "Invalid file name", http.StatusBadRequest)
+		return
+	}
+	if err := uploadBlocklist.AllowUpload(name); err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	size, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
+	if err != nil || size < 0 {
+		http.Error(w, "Invalid size", http.StatusBadRequest)
+		return
+	}
+	sum := strings.ToLower(r.FormValue("sha256"))
+	if sum != "" {
+		if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+			http.Error(w, "Invalid sha256", http.StatusBadRequest)
+			return
+		}
+	}
+	if size > maxUploadBytes {
+		http.Error(w, tooLargeMessage(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	exceeded, err := storage.QuotaExceeded(storageRoot, quotaBytes, size)
+	if err != nil {
+		slog.Error("Quota check error", "err", err)
+		http.Error(w, "Server Error", http.StatusInternalServerError)
+		return
+	}
+	if exceeded {
+		http.Error(w, "Storage quota exceeded: no room for this upload", http.StatusInsufficientStorage)
+		return
+	}
+
+	id := uuid.New().String()
+	meta, _ := json.Marshal(pendingUpload{Room: roomID, Name: name, Size: size, SHA256: sum})
+	err = os.MkdirAll(u.dir, 0755)
+	if err == nil {
+		err = os.WriteFile(u.metaPath(id), meta, 0644)
+	}
+	if err != nil {
+		slog.Error("Error starting upload", "room", roomID, "err", err)
+		http.Error(w, "Upload Error", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Started resumable upload", "upload", id, "room", roomID, "file", name, "size", size)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/upload/"+id)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{"upload_id": id, "offset": 0})
+}
+
+// handleHead reports how much of an upload has arrived
+func (u *resumableUploads) handleHead(w http.ResponseWriter, r *http.Request) {
+	_, p, offset, ok := u.load(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(p.Size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// handlePatch appends a chunk at the client's Upload-Offset
+func (u *resumableUploads) handlePatch(w http.ResponseWriter, r *http.Request) {
+	unlock, ok := u.acquire(w, r)
+	if !ok {
+		return
+	}
+	defer unlock()
+	id, p, offset, ok := u.load(w, r)
+	if !ok {
+		return
+	}
+
+	claimed, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Missing or invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if claimed != offset {
+		http.Error(w, fmt.Sprintf("Upload is at offset %d", offset), http.StatusConflict)
+		return
+	}
+
+	// A chunk may not run past the declared size
+	if r.ContentLength > p.Size-offset {
+		http.Error(w, "Chunk exceeds the declared upload size", http.StatusRequestEntityTooLarge)
+		return
+	}
+	f, err := os.CreateTemp(u.dir, id+".*.tmp")
+	if err != nil {
+		slog.Error("Error creating upload chunk", "upload", id, "err", err)
+		http.Error(w, "Upload Error", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(f.Name()) // a no-op once renamed
+	sealed, err := u.blobs.Seal(f)
+	if err != nil {
+		f.Close()
+		slog.Error("Error creating upload chunk", "upload", id, "err", err)
+		http.Error(w, "Upload Error", http.StatusInternalServerError)
+		return
+	}
+	n, copyErr := io.Copy(sealed, http.MaxBytesReader(w, r.Body, p.Size-offset))
+	var maxErr *http.MaxBytesError
+	if errors.As(copyErr, &maxErr) {
+		// The oversized chunk is dropped with its temporary file
+		f.Close()
+		http.Error(w, "Chunk exceeds the declared upload size", http.StatusRequestEntityTooLarge)
+		return
+	}
+	closeErr := errors.Join(sealed.Close(), f.Close())
+	if closeErr == nil && n > 0 {
+		closeErr = os.Rename(f.Name(), u.chunkPath(id, offset, offset+n))
+	}
+	if closeErr == nil {
+		offset += n
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+
+	if copyErr != nil || closeErr != nil {
+		// Whatever arrived is kept; the client resumes from Upload-Offset
+		slog.Warn("Upload chunk interrupted", "upload", id, "offset", offset, "err", errors.Join(copyErr, closeErr))
+		http.Error(w, "Chunk interrupted", http.StatusInternalServerError)
+		return
+	}
+	slog.Debug("Received upload chunk", "upload", id, "bytes", n, "offset", offset)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleComplete verifies a fully received upload and moves it into its room
+func (u *resumableUploads) handleComplete(w http.ResponseWriter, r *http.Request) {
+	unlock, ok := u.acquire(w, r)
+	if !ok {
+		return
+	}
+	defer unlock()
+	id, p, offset, ok := u.load(w, r)
+	if !ok {
+		return
+	}
+	if offset != p.Size {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		http.Error(w, fmt.Sprintf("Upload incomplete: %d of %d bytes", offset, p.Size), http.StatusConflict)
+		return
+	}
+	want := strings.ToLower(r.FormValue("sha256"))
+	if want == "" {
+		want = p.SHA256
+	}
+	if want == "" {
+		http.Error(w, "sha256 is required to complete an upload", http.StatusBadRequest)
+		return
+	}
+
+	chunks, err := u.chunks(id)
+	if err != nil {
+		slog.Error("Error reading upload data", "upload", id, "err", err)
+		http.Error(w, "Upload Error", http.StatusInternalServerError)
+		return
+	}
+	data := &chunkReader{blobs: u.blobs, chunks: chunks}
+	defer data.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, data); err != nil {
+		slog.Error("Error hashing upload", "upload", id, "err", err)
+		http.Error(w, "Upload Error", http.StatusInternalServerError)
+		return
+	}
+	var sum [32]byte
+	copy(sum[:], hasher.Sum(nil))
+	if got := hex.EncodeToString(sum[:]); got != want {
+		// The data is wrong somewhere; resuming can't fix it
+		slog.Warn("Resumable upload checksum mismatch", "upload", id, "want", want, "got", got)
+		u.remove(id)
+		http.Error(w, "Checksum mismatch: upload discarded", http.StatusUnprocessableEntity)
+		return
+	}
+
+	// A file the room already holds isn't stored again, as with a form
+	// upload; relinking it could also only lose it
+	if existing, ok := findInRoom(u.blobs, u.root, p.Room, sum); ok {
+		u.remove(id)
+		slog.Info("Skipped duplicate upload", "room", p.Room, "file", p.Name, "existing", existing, "upload", id)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"name": existing, "size": p.Size, "sha256": want, "duplicate": true})
+		return
+	}
+
+	data = &chunkReader{blobs: u.blobs, chunks: chunks}
+	defer data.Close()
+	if err := u.blobs.PutLink(p.Room, p.Name, sum, data); err != nil {
+		slog.Error("Error storing upload", "upload", id, "err", err)
+		http.Error(w, "Storage Error", http.StatusInternalServerError)
+		return
+	}
+	u.remove(id)
+	slog.Info("Stored upload", "room", p.Room, "file", p.Name, "bytes", p.Size, "upload", id)
+	u.hub.Broadcast(p.Room, RoomEvent{Type: "added", File: p.Name})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"name": p.Name, "size": p.Size, "sha256": want})
+}
+
+// remove deletes an upload's state and data
+func (u *resumableUploads) remove(id string) {
+	paths, _ := filepath.Glob(filepath.Join(u.dir, id+".*"))
+	for _, p := range paths {
+		os.Remove(p)
+	}
+	u.mu.Lock()
+	delete(u.locks, id)
+	u.mu.Unlock()
+}
+
+// sweep removes uploads that haven't received data for longer than ttl
+func (u *resumableUploads) sweep(ttl time.Duration) {
+	entries, err := os.ReadDir(u.dir)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("Upload cleanup failed", "err", err)
+		}
+		return
+	}
+	cutoff := time.Now().Add(-ttl)
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		if u.lastActive(id).After(cutoff) {
+			continue
+		}
+		u.remove(id)
+		slog.Info("Upload cleanup: removed stale upload", "upload", id)
+	}
+}
+
+// lastActive returns when upload id last received data: the newest
+// modification time of its files, including a chunk still arriving
+func (u *resumableUploads) lastActive(id string) time.Time {
+	var last time.Time
+	paths, _ := filepath.Glob(filepath.Join(u.dir, id+".*"))
+	for _, p := range paths {
+		if info, err := os.Stat(p); err == nil && info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last
+}
+
+// runSweeper removes stale uploads every interval until the process exits
+func (u *resumableUploads) runSweeper(ttl, interval time.Duration) {
+	for {
+		u.sweep(ttl)
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"gopher-fs/internal/store"
+)
+
+// resumableServer serves the resumable upload endpoints over a fresh
+// storage root, routed as main does. Room passwords and the quota still
+// look under storageRoot, which holds no rooms in tests.
+func resumableServer(t *testing.T) (*resumableUploads, *store.Store, http.Handler) {
+	t.Helper()
+	return encryptedResumableServer(t, nil)
+}
+
+// encryptedResumableServer is resumableServer with its store encrypted
+// under key, if not nil
+func encryptedResumableServer(t *testing.T, key []byte) (*resumableUploads, *store.Store, http.Handler) {
+	t.Helper()
+	root := t.TempDir()
+	blobs := store.New(root)
+	if key != nil {
+		blobs = store.NewEncrypted(root, key)
+	}
+	uploads := newResumableUploads(root, blobs, NewRoomHub())
+	r := mux.NewRouter()
+	r.HandleFunc("/upload-init/{id}", uploads.handleInit).Methods("POST")
+	r.HandleFunc("/upload/{upload}", uploads.handleHead).Methods("HEAD")
+	r.HandleFunc("/upload/{upload}", uploads.handlePatch).Methods("PATCH")
+	r.HandleFunc("/upload/{upload}/complete", uploads.handleComplete).Methods("POST")
+	return uploads, blobs, r
+}
+
+// serve sends a request to h with the given headers
+func serve(h http.Handler, method, target string, body io.Reader, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, body)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func postForm(h http.Handler, target string, form url.Values) *httptest.ResponseRecorder {
+	return serve(h, "POST", target, strings.NewReader(form.Encode()),
+		http.Header{"Content-Type": {"application/x-www-form-urlencoded"}})
+}
+
+// initUpload starts a resumable upload of size bytes as name and returns
+// its ID
+func initUpload(t *testing.T, h http.Handler, room, name string, size int, sum string) string {
+	t.Helper()
+	rec := postForm(h, "/upload-init/"+room, url.Values{"name": {name}, "size": {strconv.Itoa(size)}, "sha256": {sum}})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("init %s = %d %s", name, rec.Code, rec.Body)
+	}
+	var resp struct {
+		UploadID string `json:"upload_id"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("init response: %v", err)
+	}
+	return resp.UploadID
+}
+
+func patch(h http.Handler, id string, offset int, chunk string) *httptest.ResponseRecorder {
+	return serve(h, "PATCH", "/upload/"+id, strings.NewReader(chunk),
+		http.Header{"Upload-Offset": {strconv.Itoa(offset)}})
+}
+
+func offsetOf(t *testing.T, h http.Handler, id string) string {
+	t.Helper()
+	rec := serve(h, "HEAD", "/upload/"+id, nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("HEAD = %d", rec.Code)
+	}
+	return rec.Header().Get("Upload-Offset")
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// uploadWhole sends data as name into room in one chunk and completes it
+func uploadWhole(t *testing.T, h http.Handler, room, name, data string) map[string]any {
+	t.Helper()
+	id := initUpload(t, h, room, name, len(data), sha256Hex(data))
+	if rec := patch(h, id, 0, data); rec.Code != http.StatusNoContent {
+		t.Fatalf("PATCH = %d %s", rec.Code, rec.Body)
+	}
+	rec := serve(h, "POST", "/upload/"+id+"/complete", nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("complete = %d %s", rec.Code, rec.Body)
+	}
+	var resp map[string]any
+	json.NewDecoder(rec.Body).Decode(&resp)
+	return resp
+}
+
+func readRoomFile(t *testing.T, blobs *store.Store, room, name string) string {
+	t.Helper()
+	f, _, err := blobs.Open(room, name)
+	if err != nil {
+		t.Fatalf("Open %s/%s: %v", room, name, err)
+	}
+	defer f.Close()
+	data, _ := io.ReadAll(f)
+	return string(data)
+}
+
+func TestResumableUpload(t *testing.T) {
+	uploads, blobs, h := resumableServer(t)
+	const data = "0123456789"
+	id := initUpload(t, h, "room", "digits.txt", len(data), "")
+	if got := offsetOf(t, h, id); got != "0" {
+		t.Errorf("offset of a new upload = %s, want 0", got)
+	}
+
+	if rec := patch(h, id, 0, data[:4]); rec.Code != http.StatusNoContent || rec.Header().Get("Upload-Offset") != "4" {
+		t.Fatalf("first chunk = %d at offset %s, want 204 at 4", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+	// A chunk resent after a lost response is refused with where to go on
+	if rec := patch(h, id, 0, data[:4]); rec.Code != http.StatusConflict || rec.Header().Get("Upload-Offset") != "4" {
+		t.Errorf("chunk at a stale offset = %d with offset %s, want 409 with 4", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+	if rec := serve(h, "PATCH", "/upload/"+id, strings.NewReader("x"), nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("chunk without Upload-Offset = %d, want 400", rec.Code)
+	}
+	if rec := serve(h, "POST", "/upload/"+id+"/complete", nil, nil); rec.Code != http.StatusConflict {
+		t.Errorf("completing a partial upload = %d, want 409", rec.Code)
+	}
+
+	if rec := patch(h, id, 4, data[4:]); rec.Code != http.StatusNoContent {
+		t.Fatalf("last chunk = %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(h, "POST", "/upload/"+id+"/complete", nil, nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("completing without any sha256 = %d, want 400", rec.Code)
+	}
+	rec := postForm(h, "/upload/"+id+"/complete", url.Values{"sha256": {sha256Hex(data)}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("complete = %d %s", rec.Code, rec.Body)
+	}
+	if got := readRoomFile(t, blobs, "room", "digits.txt"); got != data {
+		t.Errorf("room file = %q, want %q", got, data)
+	}
+	if left, _ := filepath.Glob(filepath.Join(uploads.dir, id+".*")); len(left) > 0 {
+		t.Errorf("upload files left behind: %v", left)
+	}
+	if rec := serve(h, "HEAD", "/upload/"+id, nil, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("HEAD of a completed upload = %d, want 404", rec.Code)
+	}
+}
+
+func TestResumableUploadInitRejects(t *testing.T) {
+	_, _, h := resumableServer(t)
+	saved := maxUploadBytes
+	defer func() { maxUploadBytes = saved }()
+	maxUploadBytes = 100
+
+	for _, tt := range []struct {
+		name string
+		form url.Values
+		code int
+	}{
+		{"dot file", url.Values{"name": {".env"}, "size": {"1"}}, http.StatusBadRequest},
+		{"negative size", url.Values{"name": {"a.txt"}, "size": {"-1"}}, http.StatusBadRequest},
+		{"bad sha256", url.Values{"name": {"a.txt"}, "size": {"1"}, "sha256": {"abc"}}, http.StatusBadRequest},
+		{"over the upload limit", url.Values{"name": {"a.txt"}, "size": {"101"}}, http.StatusRequestEntityTooLarge},
+	} {
+		if rec := postForm(h, "/upload-init/room", tt.form); rec.Code != tt.code {
+			t.Errorf("%s: init = %d, want %d", tt.name, rec.Code, tt.code)
+		}
+	}
+	if rec := postForm(h, "/upload-init/.objects", url.Values{"name": {"a.txt"}, "size": {"1"}}); rec.Code != http.StatusNotFound {
+		t.Errorf("init into a dot-directory = %d, want 404", rec.Code)
+	}
+	if rec := serve(h, "HEAD", "/upload/not-an-id", nil, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("HEAD of a bad ID = %d, want 404", rec.Code)
+	}
+}
+
+func TestResumableUploadOversizedChunk(t *testing.T) {
+	_, _, h := resumableServer(t)
+	id := initUpload(t, h, "room", "a.txt", 8, "")
+	if rec := patch(h, id, 0, "1234"); rec.Code != http.StatusNoContent {
+		t.Fatalf("PATCH = %d", rec.Code)
+	}
+
+	// Refused up front when the length says so
+	if rec := patch(h, id, 4, "567890"); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("chunk past the declared size = %d, want 413", rec.Code)
+	}
+	// and cut off, with what was written dropped, when it doesn't
+	req := httptest.NewRequest("PATCH", "/upload/"+id, strings.NewReader("567890"))
+	req.ContentLength = -1
+	req.Header.Set("Upload-Offset", "4")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("chunked chunk past the declared size = %d, want 413", rec.Code)
+	}
+	if got := offsetOf(t, h, id); got != "4" {
+		t.Errorf("offset after an oversized chunk = %s, want 4", got)
+	}
+}
+
+func TestResumableUploadChecksumMismatch(t *testing.T) {
+	uploads, blobs, h := resumableServer(t)
+	id := initUpload(t, h, "room", "a.txt", 5, sha256Hex("hello"))
+	patch(h, id, 0, "HELLO")
+	if rec := serve(h, "POST", "/upload/"+id+"/complete", nil, nil); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("complete with the wrong data = %d, want 422", rec.Code)
+	}
+	if _, err := os.Stat(uploads.metaPath(id)); !os.IsNotExist(err) {
+		t.Errorf("mismatched upload not discarded: %v", err)
+	}
+	if _, _, err := blobs.Open("room", "a.txt"); err == nil {
+		t.Error("mismatched upload reached the room")
+	}
+}
+
+func TestResumableUploadDuplicate(t *testing.T) {
+	_, blobs, h := resumableServer(t)
+	uploadWhole(t, h, "room", "a.txt", "same content")
+
+	// Identical content under the same name, then another, leaves the
+	// room's file as it was
+	for _, name := range []string{"a.txt", "copy.txt"} {
+		resp := uploadWhole(t, h, "room", name, "same content")
+		if resp["duplicate"] != true || resp["name"] != "a.txt" {
+			t.Errorf("re-uploading as %s = %v, want a duplicate of a.txt", name, resp)
+		}
+		if got := readRoomFile(t, blobs, "room", "a.txt"); got != "same content" {
+			t.Fatalf("a.txt after re-uploading it as %s = %q", name, got)
+		}
+	}
+	if _, _, err := blobs.Open("room", "copy.txt"); err == nil {
+		t.Error("duplicate stored under its new name")
+	}
+
+	// New content replaces the file of that name
+	if resp := uploadWhole(t, h, "room", "a.txt", "new content"); resp["duplicate"] == true {
+		t.Errorf("new content reported as a duplicate: %v", resp)
+	}
+	if got := readRoomFile(t, blobs, "room", "a.txt"); got != "new content" {
+		t.Errorf("a.txt = %q, want the new content", got)
+	}
+}
+
+func TestResumableUploadSweep(t *testing.T) {
+	uploads, _, h := resumableServer(t)
+	stale := initUpload(t, h, "room", "stale.txt", 10, "")
+	fresh := initUpload(t, h, "room", "fresh.txt", 10, "")
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(uploads.metaPath(stale), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	uploads.sweep(time.Hour)
+	if rec := serve(h, "HEAD", "/upload/"+stale, nil, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("HEAD of a swept upload = %d, want 404", rec.Code)
+	}
+	if got := offsetOf(t, h, fresh); got != "0" {
+		t.Errorf("fresh upload's offset = %s, want 0", got)
+	}
+}
+
+func TestResumableUploadEncrypted(t *testing.T) {
+	key := make([]byte, 32)
+	uploads, blobs, h := encryptedResumableServer(t, key)
+	data := strings.Repeat("secret chunked data ", 1000)
+	id := initUpload(t, h, "room", "secret.txt", len(data), sha256Hex(data))
+	for offset := 0; offset < len(data); offset += 7000 {
+		chunk := data[offset:min(offset+7000, len(data))]
+		if rec := patch(h, id, offset, chunk); rec.Code != http.StatusNoContent {
+			t.Fatalf("PATCH at %d = %d %s", offset, rec.Code, rec.Body)
+		}
+	}
+	if got := offsetOf(t, h, id); got != strconv.Itoa(len(data)) {
+		t.Errorf("offset = %s, want %d", got, len(data))
+	}
+
+	// No chunk of a partial upload is on disk in the clear
+	files, _ := filepath.Glob(filepath.Join(uploads.dir, id+".*.part"))
+	if len(files) < 2 {
+		t.Fatalf("upload chunks = %v, want one per PATCH", files)
+	}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(b), "secret") {
+			t.Errorf("%s holds plaintext", filepath.Base(f))
+		}
+	}
+
+	if rec := serve(h, "POST", "/upload/"+id+"/complete", nil, nil); rec.Code != http.StatusOK {
+		t.Fatalf("complete = %d %s", rec.Code, rec.Body)
+	}
+	if got := readRoomFile(t, blobs, "room", "secret.txt"); got != data {
+		t.Errorf("room file differs from what was uploaded (%d bytes, want %d)", len(got), len(data))
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopher-fs/internal/protocol"
+	"gopher-fs/internal/store"
+)
+
+// maxRoomNameLen bounds a custom room name, which also ends up in every
+// URL and cookie name for the room
+const maxRoomNameLen = 64
+
+// roomNamePattern is what a custom room name may look like: letters and
+// digits in dash-separated words, e.g. team-standup. Nothing in it can
+// step out of the storage root or collide with the store's dot
+// directories.
+var roomNamePattern = regexp.MustCompile(`^[A-Za-z0-9]+(-[A-Za-z0-9]+)*$`)
+
+var (
+	errRoomName  = errors.New("room names may only contain letters, digits and single dashes between them, up to 64 characters")
+	errRoomTaken = errors.New("that room name is already taken")
+)
+
+// checkRoomName reports why name can't be used for a custom room, if it can't
+func checkRoomName(name string) error {
+	if len(name) > maxRoomNameLen || !roomNamePattern.MatchString(name) {
+		return errRoomName
+	}
+	return nil
+}
+
+// validFileName reports whether name can only mean an entry directly
+// inside one directory: not empty, "." or "..", and without a slash or
+// backslash. Routing keeps slashes out of path variables but not the dot
+// names, and a backslash separates paths on Windows.
+func validFileName(name string) bool {
+	return name != "." && filepath.IsLocal(name) && !strings.ContainsAny(name, `/\`)
+}
+
+// claimRoom creates the directory for the custom room roomID under root,
+// returning errRoomTaken if a room by that name already exists. Creating
+// it with os.Mkdir makes the claim atomic, so two people racing for the
+// same name can't both get it.
+func claimRoom(root, roomID string) error {
+	if err := checkRoomName(roomID); err != nil {
+		return err
+	}
+	err := os.Mkdir(filepath.Join(root, roomID), 0755)
+	if errors.Is(err, fs.ErrExist) {
+		return errRoomTaken
+	}
+	return err
+}
+
+// listRoom describes the files in a room for the room view. Files are read
+// through the store, so an encrypted store shows their plaintext sizes and
+// types; files that can't be opened (e.g. one the backend is still
+// receiving into an encrypted store) are left out.
+func listRoom(blobs *store.Store, roomID string) ([]FileInfo, error) {
+	roomDir := filepath.Join(storageRoot, roomID)
+	entries, err := os.ReadDir(roomDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []FileInfo
+	for _, e := range entries {
+		if e.IsDir() || e.Name() == roomMetaFile {
+			continue
+		}
+		f, info, err := blobs.Open(roomID, e.Name())
+		if err != nil {
+			slog.Debug("Skipping unreadable room file", "room", roomID, "file", e.Name(), "err", err)
+			continue
+		}
+		hash, err := roomFileHash(blobs, storageRoot, roomID, e.Name())
+		hashStr := "Verified"
+		if err == nil {
+			hashStr = fmt.Sprintf("%x", hash)[:8] + "..."
+		}
+		files = append(files, FileInfo{
+			Name: e.Name(),
+			Size: fmt.Sprintf("%.2f KB", float64(info.Size())/1024),
+			Hash: hashStr,
+			MimeType: mimeType(filepath.Join(roomDir, e.Name()), info, func() (io.ReadCloser, error) {
+				_, err := f.Seek(0, io.SeekStart)
+				return io.NopCloser(f), err
+			}),
+		})
+		f.Close()
+	}
+	return files, nil
+}
+
+// findInRoom returns the name of a file in the room under root whose
+// content hashes to hash, if there is one
+func findInRoom(blobs *store.Store, root, roomID string, hash [32]byte) (string, bool) {
+	entries, err := os.ReadDir(filepath.Join(root, roomID))
+	if err != nil {
+		return "", false
+	}
+	for _, e := range entries {
+		if e.IsDir() || e.Name() == roomMetaFile {
+			continue
+		}
+		if h, err := roomFileHash(blobs, root, roomID, e.Name()); err == nil && h == hash {
+			return e.Name(), true
+		}
+	}
+	return "", false
+}
+
+// checksums caches the SHA-256 of room files that aren't links into the
+// store, which would otherwise be read in full on every room view
+var checksums = newFileCache[[32]byte]()
+
+// roomFileHash returns the SHA-256 of name in the room under root. A link
+// into the store names it; any other file is hashed, once per size and
+// modification time.
+func roomFileHash(blobs *store.Store, root, roomID, name string) ([32]byte, error) {
+	if hash, ok := blobs.Hash(roomID, name); ok {
+		return hash, nil
+	}
+	f, info, err := blobs.Open(roomID, name)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	defer f.Close()
+	return checksums.get(filepath.Join(root, roomID, name), info, func() ([32]byte, error) {
+		return protocol.ComputeChecksum(f)
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopher-fs/internal/store"
+)
+
+func TestClaimRoom(t *testing.T) {
+	root := t.TempDir()
+
+	for _, name := range []string{"", "-team", "team-", "team--standup", "../etc", "a/b", ".objects", "team standup", strings.Repeat("a", maxRoomNameLen+1)} {
+		if err := claimRoom(root, name); !errors.Is(err, errRoomName) {
+			t.Errorf("claimRoom(%q) = %v, want errRoomName", name, err)
+		}
+	}
+
+	if err := claimRoom(root, "team-standup"); err != nil {
+		t.Fatalf("claimRoom(team-standup) = %v", err)
+	}
+	if err := claimRoom(root, "team-standup"); !errors.Is(err, errRoomTaken) {
+		t.Errorf("second claimRoom(team-standup) = %v, want errRoomTaken", err)
+	}
+	if err := claimRoom(root, strings.Repeat("a", maxRoomNameLen)); err != nil {
+		t.Errorf("claimRoom of a %d-character name = %v", maxRoomNameLen, err)
+	}
+}
+
+func TestFindInRoom(t *testing.T) {
+	root := t.TempDir()
+	blobs := store.New(root)
+	if err := os.Mkdir(filepath.Join(root, "room"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	linked := sha256.Sum256([]byte("linked"))
+	if err := blobs.Put(linked, strings.NewReader("linked")); err != nil {
+		t.Fatal(err)
+	}
+	if err := blobs.Link("room", "a.txt", linked); err != nil {
+		t.Fatal(err)
+	}
+	// e.g. a file the backend wrote that hasn't been moved into the store
+	if err := os.WriteFile(filepath.Join(root, "room", "b.txt"), []byte("plain"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for content, want := range map[string]string{"linked": "a.txt", "plain": "b.txt", "other": ""} {
+		got, ok := findInRoom(blobs, root, "room", sha256.Sum256([]byte(content)))
+		if got != want || ok != (want != "") {
+			t.Errorf("findInRoom(%q) = %q, %v; want %q", content, got, ok, want)
+		}
+	}
+	if _, ok := findInRoom(blobs, root, "missing", linked); ok {
+		t.Error("findInRoom found a file in a missing room")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"gopher-fs/internal/store"
+)
+
+// Signed download links stay valid this long, and can be asked to expire
+// sooner but not later - configurable via SIGNED_URL_TTL, defaults to 24h
+var signedURLTTL = 24 * time.Hour
+
+// signingSecret signs download links. It is the per-process session secret
+// unless SIGNING_SECRET is set, in which case links survive a restart.
+var signingSecret = sessionSecret
+
+var (
+	errTokenInvalid = errors.New("invalid or tampered download token")
+	errTokenExpired = errors.New("download token expired")
+)
+
+// signToken returns a token granting a download of file from roomID until
+// expires: the room, file and expiry, then their HMAC-SHA256 under
+// signingSecret, each base64url-encoded and joined by a dot. Neither name
+// can contain a slash, so the slashes between them are unambiguous.
+func signToken(roomID, file string, expires time.Time) string {
+	payload := roomID + "/" + file + "/" + strconv.FormatInt(expires.Unix(), 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(tokenMAC(payload))
+}
+
+// verifyToken returns the room and file a token from signToken grants,
+// failing with errTokenInvalid if it wasn't signed with signingSecret or
+// was altered, and errTokenExpired once now is past its expiry
+func verifyToken(token string, now time.Time) (roomID, file string, err error) {
+	encPayload, encMAC, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", "", errTokenInvalid
+	}
+	payload, err := base64.RawURLEncoding.Strict().DecodeString(encPayload)
+	if err != nil {
+		return "", "", errTokenInvalid
+	}
+	mac, err := base64.RawURLEncoding.Strict().DecodeString(encMAC)
+	if err != nil || !hmac.Equal(mac, tokenMAC(string(payload))) {
+		return "", "", errTokenInvalid
+	}
+
+	parts := strings.Split(string(payload), "/")
+	if len(parts) != 3 {
+		return "", "", errTokenInvalid
+	}
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return "", "", errTokenInvalid
+	}
+	if now.Unix() > expires {
+		return "", "", errTokenExpired
+	}
+	return parts[0], parts[1], nil
+}
+
+func tokenMAC(payload string) []byte {
+	mac := hmac.New(sha256.New, signingSecret)
+	mac.Write([]byte("download\x00" + payload))
+	return mac.Sum(nil)
+}
+
+// handleSign serves GET /sign/{id}/{file}, which anyone with access to the
+// room can use to get a link to just that file: JSON with the "url" of
+// /d/{token} and when it "expires". It lasts signedURLTTL, or ?ttl= (a
+// duration such as 1h) if that is shorter.
+func handleSign(blobs *store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		roomID, fileName := vars["id"], vars["file"]
+		if !requireRoomAccess(w, r, roomID) {
+			return
+		}
+		if !validFileName(fileName) {
+			http.Error(w, "Invalid file name", http.StatusBadRequest)
+			return
+		}
+		if fileName == roomMetaFile {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		ttl := signedURLTTL
+		if s := r.URL.Query().Get("ttl"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 || d > signedURLTTL {
+				http.Error(w, fmt.Sprintf("ttl must be a duration up to %v", signedURLTTL), http.StatusBadRequest)
+				return
+			}
+			ttl = d
+		}
+		if _, ok := blobs.Hash(roomID, fileName); !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		expires := time.Now().Add(ttl).Truncate(time.Second)
+		link := url.URL{Scheme: "http", Host: r.Host, Path: "/d/" + signToken(roomID, fileName, expires)}
+		if r.TLS != nil {
+			link.Scheme = "https"
+		}
+		slog.Info("Signed download link", "room", roomID, "file", fileName, "expires", expires)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(map[string]any{"url": link.String(), "expires": expires.UTC()})
+	}
+}
+
+// handleSignedDownload serves GET /d/{token}: the file a token from
+// handleSign grants, with no room access needed, or 403 for a token that
+// is forged, altered or expired
+func handleSignedDownload(blobs *store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roomID, fileName, err := verifyToken(mux.Vars(r)["token"], time.Now())
+		if err == nil && (!validFileName(roomID) || !validFileName(fileName) || fileName == roomMetaFile) {
+			err = errTokenInvalid // only a leaked secret could sign these
+		}
+		if err != nil {
+			slog.Warn("Refused signed download", "remote", r.RemoteAddr, "err", err)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		serveRoomFile(w, r, blobs, roomID, fileName)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"gopher-fs/internal/store"
+)
+
+func TestSignedTokenRoundTrip(t *testing.T) {
+	now := time.Now()
+	token := signToken("room1", "report.pdf", now.Add(time.Hour))
+
+	room, file, err := verifyToken(token, now)
+	if err != nil || room != "room1" || file != "report.pdf" {
+		t.Fatalf("verifyToken = %q, %q, %v; want room1, report.pdf", room, file, err)
+	}
+	if _, _, err := verifyToken(token, now.Add(2*time.Hour)); !errors.Is(err, errTokenExpired) {
+		t.Errorf("after expiry: err = %v, want errTokenExpired", err)
+	}
+
+	// Another file, or a later expiry, under the original signature
+	payload, sig, _ := strings.Cut(token, ".")
+	forged := []string{
+		base64.RawURLEncoding.EncodeToString([]byte("room1/secret.txt/"+strings.Split(mustDecode(t, payload), "/")[2])) + "." + sig,
+		base64.RawURLEncoding.EncodeToString([]byte("room1/report.pdf/99999999999")) + "." + sig,
+		payload + "." + base64.RawURLEncoding.EncodeToString(make([]byte, sha256.Size)),
+		payload,
+		"",
+		"!!!.???",
+	}
+	for _, tok := range forged {
+		if _, _, err := verifyToken(tok, now); !errors.Is(err, errTokenInvalid) {
+			t.Errorf("verifyToken(%q) = %v, want errTokenInvalid", tok, err)
+		}
+	}
+
+	saved := signingSecret
+	defer func() { signingSecret = saved }()
+	signingSecret = []byte("another secret")
+	if _, _, err := verifyToken(token, now); !errors.Is(err, errTokenInvalid) {
+		t.Errorf("token checked under another secret: err = %v, want errTokenInvalid", err)
+	}
+}
+
+func mustDecode(t *testing.T, s string) string {
+	t.Helper()
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestSignedDownloadRoutes(t *testing.T) {
+	blobs := store.New(t.TempDir())
+	data := []byte("shared on its own")
+	hash := sha256.Sum256(data)
+	if err := blobs.Put(hash, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := blobs.Link("signroom", "shared.txt", hash); err != nil {
+		t.Fatal(err)
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/sign/{id}/{file}", handleSign(blobs)).Methods("GET")
+	r.HandleFunc("/d/{token}", handleSignedDownload(blobs)).Methods("GET")
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		return rec
+	}
+
+	rec := get("/sign/signroom/shared.txt?ttl=1h")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("sign status = %d: %s", rec.Code, rec.Body)
+	}
+	var signed struct {
+		URL     string    `json:"url"`
+		Expires time.Time `json:"expires"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&signed); err != nil {
+		t.Fatal(err)
+	}
+	if until := time.Until(signed.Expires); until <= 59*time.Minute || until > time.Hour {
+		t.Errorf("link expires in %v, want 1h", until)
+	}
+	link, err := url.Parse(signed.URL)
+	if err != nil || !strings.HasPrefix(link.Path, "/d/") {
+		t.Fatalf("signed URL %q isn't a /d/ link", signed.URL)
+	}
+
+	rec = get(link.Path)
+	if body, _ := io.ReadAll(rec.Body); rec.Code != http.StatusOK || !bytes.Equal(body, data) {
+		t.Fatalf("signed download = %d %q, want 200 %q", rec.Code, body, data)
+	}
+	// Flip the signature's first character, which is all signature bits
+	dot := strings.Index(link.Path, ".") + 1
+	flipped := byte('A')
+	if link.Path[dot] == 'A' {
+		flipped = 'B'
+	}
+	tampered := link.Path[:dot] + string(flipped) + link.Path[dot+1:]
+	expired := "/d/" + signToken("signroom", "shared.txt", time.Now().Add(-time.Minute))
+	for _, target := range []string{tampered, expired, "/d/garbage"} {
+		if rec := get(target); rec.Code != http.StatusForbidden {
+			t.Errorf("GET %s = %d, want 403", target, rec.Code)
+		}
+	}
+
+	for target, want := range map[string]int{
+		"/sign/signroom/missing.txt":          http.StatusNotFound,
+		"/sign/signroom/" + roomMetaFile:      http.StatusForbidden,
+		"/sign/signroom/shared.txt?ttl=1000h": http.StatusBadRequest,
+		"/sign/signroom/shared.txt?ttl=-1s":   http.StatusBadRequest,
+	} {
+		if rec := get(target); rec.Code != want {
+			t.Errorf("GET %s = %d, want %d", target, rec.Code, want)
+		}
+	}
+}
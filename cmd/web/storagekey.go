@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"gopher-fs/internal/security"
+)
+
+// storageKeyFile, in the storage root, records the salt STORAGE_KEY is
+// stretched with and a check value for the derived key. It holds nothing
+// that decrypts files on its own, and its leading dot keeps it clear of
+// room IDs.
+const storageKeyFile = ".storage-key"
+
+// storageKeyCheck is MACed with the derived key to recognise it again
+const storageKeyCheck = "gopher-fs storage key check"
+
+type storageKeyMeta struct {
+	Salt  []byte `json:"salt"`
+	Check []byte `json:"check"`
+}
+
+// loadStorageKey derives the key files under root are encrypted with from
+// secret. The first call for a storage root picks the salt and records it;
+// later calls fail if secret doesn't give the key recorded then, or if
+// secret is empty for a root that is encrypted. It returns nil, meaning
+// no encryption, for an empty secret on a root that never had one.
+func loadStorageKey(root, secret string) ([]byte, error) {
+	path := filepath.Join(root, storageKeyFile)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if secret == "" {
+			return nil, nil
+		}
+		return newStorageKey(path, secret)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var meta storageKeyMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	if secret == "" {
+		return nil, errors.New("storage is encrypted but no STORAGE_KEY is set")
+	}
+	key, err := security.DeriveStorageKey(secret, meta.Salt)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(keyCheck(key), meta.Check) {
+		return nil, errors.New("STORAGE_KEY does not match the key this storage was encrypted with")
+	}
+	return key, nil
+}
+
+func newStorageKey(path, secret string) ([]byte, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, err := security.DeriveStorageKey(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(storageKeyMeta{Salt: salt, Check: keyCheck(key)})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func keyCheck(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(storageKeyCheck))
+	return mac.Sum(nil)
+}
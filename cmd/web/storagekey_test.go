@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"gopher-fs/internal/store"
+)
+
+func TestLoadStorageKey(t *testing.T) {
+	root := t.TempDir()
+	if key, err := loadStorageKey(root, ""); key != nil || err != nil {
+		t.Fatalf("no secret on fresh storage = %x, %v; want no key", key, err)
+	}
+
+	key, err := loadStorageKey(root, "hunter2")
+	if err != nil || len(key) == 0 {
+		t.Fatalf("first load = %x, %v", key, err)
+	}
+	again, err := loadStorageKey(root, "hunter2")
+	if err != nil || !bytes.Equal(again, key) {
+		t.Fatalf("reload = %x, %v; want %x", again, err, key)
+	}
+
+	if _, err := loadStorageKey(root, "hunter3"); err == nil {
+		t.Error("a different secret was accepted")
+	}
+	if _, err := loadStorageKey(root, ""); err == nil {
+		t.Error("encrypted storage started without a secret")
+	}
+}
+
+// A browser upload is staged sealed, and unsealed again on its way into
+// the room
+func TestStagedUploadSealed(t *testing.T) {
+	for _, key := range [][]byte{nil, make([]byte, 32)} {
+		root := t.TempDir()
+		blobs := store.New(root)
+		if key != nil {
+			blobs = store.NewEncrypted(root, key)
+		}
+		data := strings.Repeat("staged secret ", 10000)
+		staged := filepath.Join(root, "staged")
+		src := sealStream(blobs, strings.NewReader(data))
+		sealed, err := io.ReadAll(src)
+		src.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(sealed)) != blobs.SealedSize(int64(len(data))) {
+			t.Errorf("key %v: sealed %d bytes, SealedSize says %d", key != nil, len(sealed), blobs.SealedSize(int64(len(data))))
+		}
+		if key != nil && bytes.Contains(sealed, []byte("secret")) {
+			t.Error("staged copy holds plaintext")
+		}
+		if err := os.WriteFile(staged, sealed, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := storeReceived(blobs, staged, "room", "a.txt", sha256.Sum256([]byte(data))); err != nil {
+			t.Fatalf("key %v: storeReceived: %v", key != nil, err)
+		}
+		f, _, err := blobs.Open("room", "a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(f)
+		f.Close()
+		if string(got) != data {
+			t.Errorf("key %v: room file differs from the upload", key != nil)
+		}
+	}
+}
+
+func TestSealStreamPassesReadErrors(t *testing.T) {
+	errBody := errors.New("body failed")
+	src := sealStream(store.NewEncrypted(t.TempDir(), make([]byte, 32)),
+		io.MultiReader(strings.NewReader("some data"), iotest.ErrReader(errBody)))
+	defer src.Close()
+	if _, err := io.ReadAll(src); !errors.Is(err, errBody) {
+		t.Errorf("reading the stream = %v, want %v", err, errBody)
+	}
+}
+
+// An upload replaces the room's file of that name only once it is stored
+func TestStoreReceivedReplaces(t *testing.T) {
+	root := t.TempDir()
+	blobs := store.New(root)
+	stage := func(data string) string {
+		t.Helper()
+		p := filepath.Join(root, "staged")
+		if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	room := func() string {
+		t.Helper()
+		f, _, err := blobs.Open("room", "a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		data, _ := io.ReadAll(f)
+		return string(data)
+	}
+
+	if err := storeReceived(blobs, stage("old"), "room", "a.txt", sha256.Sum256([]byte("old"))); err != nil {
+		t.Fatal(err)
+	}
+	// Data that doesn't match its checksum leaves the old file in place
+	if err := storeReceived(blobs, stage("corrupted"), "room", "a.txt", sha256.Sum256([]byte("new"))); err == nil {
+		t.Error("storeReceived accepted data that doesn't match its checksum")
+	}
+	if got := room(); got != "old" {
+		t.Errorf("a.txt after a failed replacement = %q, want old", got)
+	}
+
+	if err := storeReceived(blobs, stage("new"), "room", "a.txt", sha256.Sum256([]byte("new"))); err != nil {
+		t.Fatal(err)
+	}
+	if got := room(); got != "new" {
+		t.Errorf("a.txt = %q, want new", got)
+	}
+}
@@ -0,0 +1,205 @@
+// Package archive streams directory trees as tar archives and unpacks them,
+// refusing any entry that would land outside the destination directory.
+package archive
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopher-fs/internal/protocol"
+)
+
+// Write walks dir and writes its directories and regular files to w as a
+// tar archive, with names starting with prefix (e.g. dir's own base name).
+// Other file types, such as symlinks, are skipped. It returns the number
+// of regular files written.
+func Write(w io.Writer, dir, prefix string) (int, error) {
+	tw := tar.NewWriter(w)
+	files := 0
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := path.Join(prefix, filepath.ToSlash(rel))
+		if name == "." {
+			return nil // no prefix: the root itself needs no entry
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if d.IsDir() {
+			hdr.Name += "/"
+		}
+		// Owner names aren't meaningful on the receiving host
+		hdr.Uname, hdr.Gname = "", ""
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := io.CopyN(tw, f, hdr.Size); err != nil {
+			return fmt.Errorf("archiving %s: %w", name, err)
+		}
+		files++
+		return nil
+	})
+	if err != nil {
+		return files, err
+	}
+	return files, tw.Close()
+}
+
+// Extract unpacks the tar archive read from r under dest, recreating its
+// directories and regular files with their permissions and modification
+// times; other entry types are skipped. Every name goes through
+// protocol.CleanPath, and entries under an existing symlink are refused, so
+// nothing is written outside dest: such an entry aborts the extraction with
+// an error wrapping protocol.ErrUnsafePath. If check is set it is called
+// before each regular file is written, and a non-nil error aborts too.
+// It returns the number of files written.
+func Extract(r io.Reader, dest string, check func(h *tar.Header) error) (int, error) {
+	type dirMeta struct {
+		path    string
+		mode    fs.FileMode
+		modTime time.Time
+	}
+	var dirs []dirMeta
+	files := 0
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return files, fmt.Errorf("reading archive: %w", err)
+		}
+
+		target, err := SafePath(dest, hdr.Name)
+		if err != nil {
+			return files, err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return files, err
+			}
+			dirs = append(dirs, dirMeta{target, hdr.FileInfo().Mode().Perm(), hdr.ModTime})
+		case tar.TypeReg:
+			if check != nil {
+				if err := check(hdr); err != nil {
+					return files, err
+				}
+			}
+			if err := extractFile(tr, target, hdr); err != nil {
+				return files, err
+			}
+			files++
+		default:
+			// Links and special files could point outside dest
+		}
+	}
+
+	// Directory times last, as creating their contents updates them.
+	// Deepest first, so restoring a parent isn't undone by its children.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d := dirs[i]
+		if d.mode != 0 {
+			os.Chmod(d.path, d.mode|0700) // keep it writable for later uploads
+		}
+		os.Chtimes(d.path, d.modTime, d.modTime)
+	}
+	return files, nil
+}
+
+// extractFile writes the current entry of tr to target
+func extractFile(tr *tar.Reader, target string, hdr *tar.Header) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, tr); err != nil {
+		f.Close()
+		os.Remove(target)
+		return fmt.Errorf("extracting %s: %w", hdr.Name, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if mode := hdr.FileInfo().Mode().Perm(); mode != 0 {
+		os.Chmod(target, mode)
+	}
+	if !hdr.ModTime.IsZero() {
+		os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+	}
+	return nil
+}
+
+// SafePath joins the slash-separated relative name sent by a peer to dest.
+// Names that CleanPath refuses, and names that pass through an existing
+// symlink below dest (which could redirect a write), return an error
+// wrapping protocol.ErrUnsafePath.
+func SafePath(dest, name string) (string, error) {
+	rel, err := protocol.CleanPath(name)
+	if err != nil {
+		return "", err
+	}
+	if err := checkNoSymlinks(dest, rel); err != nil {
+		return "", err
+	}
+	return filepath.Join(dest, filepath.FromSlash(rel)), nil
+}
+
+// checkNoSymlinks refuses rel if it, or any directory on the way to it
+// below dest, is an existing symlink
+func checkNoSymlinks(dest, rel string) error {
+	p := dest
+	for _, part := range strings.Split(rel, "/") {
+		p = filepath.Join(p, part)
+		info, err := os.Lstat(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("%w: %q passes through a symlink", protocol.ErrUnsafePath, rel)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopher-fs/internal/protocol"
+)
+
+func TestWriteExtractNested(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "project")
+	files := map[string]string{
+		"README.md":              "top",
+		"docs/guide.txt":         "guide",
+		"docs/img/logo.svg":      "<svg/>",
+		"src/pkg/deep/main.go":   "package main",
+		"src/pkg/deep/empty.txt": "",
+	}
+	for name, content := range files {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(src, "empty-dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(src, "docs", "guide.txt"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(src, "docs"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	written, err := Write(&buf, src, "project")
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if written != len(files) {
+		t.Errorf("Write archived %d files, want %d", written, len(files))
+	}
+
+	dest := t.TempDir()
+	extracted, err := Extract(&buf, dest, nil)
+	if err != nil {
+		t.Fatalf("Extract: %v", err)
+	}
+	if extracted != len(files) {
+		t.Errorf("Extract wrote %d files, want %d", extracted, len(files))
+	}
+	for name, content := range files {
+		p := filepath.Join(dest, "project", filepath.FromSlash(name))
+		got, err := os.ReadFile(p)
+		if err != nil {
+			t.Errorf("reading %s: %v", name, err)
+			continue
+		}
+		if string(got) != content {
+			t.Errorf("%s = %q, want %q", name, got, content)
+		}
+		if info, _ := os.Stat(p); info.Mode().Perm() != 0600 {
+			t.Errorf("%s mode = %v, want 0600", name, info.Mode().Perm())
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dest, "project", "empty-dir")); err != nil || !info.IsDir() {
+		t.Errorf("empty directory not recreated: %v", err)
+	}
+	for _, name := range []string{"docs/guide.txt", "docs"} {
+		info, err := os.Stat(filepath.Join(dest, "project", filepath.FromSlash(name)))
+		if err != nil || !info.ModTime().Equal(mtime) {
+			t.Errorf("%s mtime = %v, %v; want %v", name, info.ModTime(), err, mtime)
+		}
+	}
+}
+
+// tarOf builds an archive of regular files with the given names
+func tarOf(t *testing.T, names ...string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 4, Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte("evil"))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestExtractRejectsTraversal(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry string
+	}{
+		{"parent directory", "../escaped.txt"},
+		{"nested parent", "ok/../../escaped.txt"},
+		{"absolute", "/tmp/escaped.txt"},
+		{"backslashes", `..\escaped.txt`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := t.TempDir()
+			dest := filepath.Join(parent, "dest")
+			if err := os.Mkdir(dest, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := Extract(tarOf(t, "fine.txt", tt.entry), dest, nil)
+			if !errors.Is(err, protocol.ErrUnsafePath) {
+				t.Fatalf("Extract = %v, want ErrUnsafePath", err)
+			}
+			if _, err := os.Stat(filepath.Join(parent, "escaped.txt")); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("entry escaped the destination (stat: %v)", err)
+			}
+		})
+	}
+}
+
+func TestExtractRejectsSymlinkedDirectory(t *testing.T) {
+	outside := t.TempDir()
+	dest := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dest, "link")); err != nil {
+		t.Skipf("symlinks unavailable: %v", err)
+	}
+
+	_, err := Extract(tarOf(t, "link/escaped.txt"), dest, nil)
+	if !errors.Is(err, protocol.ErrUnsafePath) {
+		t.Fatalf("Extract = %v, want ErrUnsafePath", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "escaped.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("entry was written through the symlink (stat: %v)", err)
+	}
+}
+
+func TestExtractCheckAborts(t *testing.T) {
+	errTooBig := errors.New("too big")
+	dest := t.TempDir()
+	_, err := Extract(tarOf(t, "a.txt"), dest, func(h *tar.Header) error { return errTooBig })
+	if !errors.Is(err, errTooBig) {
+		t.Fatalf("Extract = %v, want the check's error", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "a.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("refused file was written (stat: %v)", err)
+	}
+}
@@ -0,0 +1,1103 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopher-fs/internal/archive"
+	"gopher-fs/internal/protocol"
+	"gopher-fs/internal/retry"
+	"gopher-fs/internal/security"
+	"gopher-fs/internal/ui"
+)
+
+// ChecksumError is returned by Download when the received data doesn't
+// match the checksum the server advertised
+type ChecksumError struct {
+	Expected []byte
+	Actual   []byte
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch: server %x, received %x", e.Expected, e.Actual)
+}
+
+// AckError is returned by Upload when the server acknowledges an upload
+// with a failure status (protocol v4+), by List when the server refuses
+// the pattern, and by downloads when the server reports that the file
+// shrank while it was being sent (protocol v5+)
+type AckError struct {
+	Status  uint8 // one of the protocol.Ack* codes
+	Message string
+}
+
+func (e *AckError) Error() string {
+	switch e.Status {
+	case protocol.AckChecksumMismatch:
+		return "server reported checksum mismatch: " + e.Message
+	case protocol.AckRejected:
+		return "server rejected request: " + e.Message
+	}
+	return "server error: " + e.Message
+}
+
+// Client transfers files to and from a gopher-fs server. All methods honor
+// context cancellation and deadlines, aborting in-flight copies.
+type Client struct {
+	TLSConfig *tls.Config
+
+	// Plaintext dials servers over plain TCP instead of TLS, to match a
+	// server.Server with Plaintext set. TLSConfig is then unused.
+	Plaintext bool
+
+	// ShowProgress renders a progress bar while data is transferred, drawn
+	// as Progress says
+	ShowProgress bool
+	Progress     ui.ProgressOptions
+
+	// OnUploadProgress, if set, is called as upload data is sent with the
+	// bytes sent so far and the total, in place of the ShowProgress bar
+	OnUploadProgress func(current, total int64)
+
+	// OnDownloadProgress is the same for downloads: it is called as data
+	// arrives, in place of the ShowProgress bar
+	OnDownloadProgress func(current, total int64)
+
+	// Pause, if set, holds file data in both directions while it is
+	// paused, leaving connections open. A pause longer than the server's
+	// idle timeout still loses the connection.
+	Pause *ui.Pauser
+
+	// OnHeader, if set, is called once a download's metadata has arrived.
+	// ModTime and Mode are zero if the server only speaks protocol v1.
+	OnHeader func(h protocol.FileHeader)
+
+	// DialAttempts is how many times a failed connection is retried, with
+	// exponential backoff starting at DialBackoff, before giving up
+	DialAttempts int
+	DialBackoff  time.Duration
+
+	// Reconnects is how many times a download whose connection drops
+	// partway reconnects and resumes from the last byte received, backing
+	// off from DialBackoff, before giving up (0 = fail at once). Each
+	// attempt is reported to OnReconnect, if set, with the offset it
+	// resumes from and the error that ended the last one. Sessions,
+	// directory, tar and parallel downloads don't reconnect.
+	Reconnects  int
+	OnReconnect func(attempt int, offset int64, err error)
+
+	// TransferTimeout caps how long the data of any one file may take to
+	// send or receive, however steadily it arrives (0 = no limit). A
+	// download's reconnections count towards it. A file over it fails with
+	// ErrTransferTimeout and no partial file is left behind.
+	TransferTimeout time.Duration
+
+	// BufferSize is the buffer file data is sent and received through
+	// (0 = protocol.DefaultBufferSize)
+	BufferSize int
+
+	// Checksum is the algorithm asked for in the handshake. Servers that
+	// don't support it (or speak protocol v2 and older) use SHA-256.
+	Checksum protocol.ChecksumAlgo
+
+	// Compression is asked for in the handshake and, if the server
+	// supports its codec, applies to whole-file downloads and uploads.
+	// Other servers send and take data uncompressed.
+	Compression protocol.Compression
+
+	// Mismatch decides what happens to a file of a directory download whose
+	// checksum doesn't match; with SkipVerify no download is checked
+	Mismatch MismatchPolicy
+
+	// PSK, if set, is the pre-shared key every connection authenticates
+	// with before its request. A wrong key fails with protocol.ErrAuthFailed.
+	PSK []byte
+
+	// ListPartial has List and ListSince also return the uploads the
+	// server is still receiving, marked Partial, so a caller can wait for
+	// one to finish. Servers before protocol v9 don't report them.
+	ListPartial bool
+}
+
+// New returns a Client that dials servers with tlsConfig
+func New(tlsConfig *tls.Config) *Client {
+	return &Client{
+		TLSConfig:    tlsConfig,
+		DialAttempts: 3,
+		DialBackoff:  250 * time.Millisecond,
+		Reconnects:   3,
+	}
+}
+
+// dial connects to addr and ties the connection's lifetime to ctx. The
+// returned stop function must be called once the transfer is finished.
+func (c *Client) dial(ctx context.Context, addr string) (net.Conn, func() bool, error) {
+	var dialer interface {
+		DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+	} = &tls.Dialer{Config: c.TLSConfig}
+	if c.Plaintext {
+		dialer = &net.Dialer{}
+	}
+	var conn net.Conn
+	err := retry.Do(c.DialAttempts, c.DialBackoff, func() error {
+		var err error
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+		if ctx.Err() != nil {
+			return retry.Stop(ctx.Err())
+		}
+		if errors.Is(err, security.ErrFingerprintMismatch) {
+			return retry.Stop(err) // a different server won't become the right one
+		}
+		return err
+	})
+	if err != nil {
+		if c.Plaintext {
+			return nil, nil, fmt.Errorf("connecting to server (plaintext): %w", err)
+		}
+		return nil, nil, fmt.Errorf("connecting to server (TLS): %w", err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// Unblock any pending read/write as soon as ctx is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	if len(c.PSK) > 0 {
+		if err := protocol.ClientAuth(conn, c.PSK); err != nil {
+			stop()
+			conn.Close()
+			return nil, nil, ctxErr(ctx, err)
+		}
+	}
+	return conn, stop, nil
+}
+
+// ctxErr prefers the context's error, or the cause it was cancelled with,
+// over the I/O error it caused
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return err
+}
+
+// ErrTransferTimeout is returned for a file whose data took longer than
+// Client.TransferTimeout
+var ErrTransferTimeout = errors.New("transfer timeout exceeded")
+
+// limitTransfer bounds the copy of one file's data to c.TransferTimeout,
+// returning the context to run it under and the function that ends it.
+// When the time is up, pending reads and writes on conn are cut off and
+// the context's cause is ErrTransferTimeout. Connections dialed under the
+// returned context are bound to it already, so conn may be nil.
+func (c *Client) limitTransfer(ctx context.Context, conn net.Conn) (context.Context, func()) {
+	if c.TransferTimeout <= 0 {
+		return ctx, func() {}
+	}
+	cause := fmt.Errorf("%w: file took longer than %v", ErrTransferTimeout, c.TransferTimeout)
+	ctx, cancel := context.WithTimeoutCause(ctx, c.TransferTimeout, cause)
+	stop := func() bool { return true }
+	if conn != nil {
+		stop = context.AfterFunc(ctx, func() {
+			conn.SetDeadline(time.Unix(1, 0))
+		})
+	}
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// Download requests name from the server at addr and writes its content to
+// dst, verifying the checksum. A mismatch returns a *ChecksumError. If the
+// connection drops partway, it reconnects and carries on from the last
+// byte written to dst, as c.Reconnects allows.
+func (c *Client) Download(ctx context.Context, addr, name string, dst io.Writer) error {
+	_, err := c.download(ctx, addr, name, dst)
+	return err
+}
+
+// DownloadFile downloads name into the local file target. The data is
+// written to target+protocol.PartSuffix and settled with c.Mismatch (see
+// MismatchPolicy.Finish); once in place the file gets the server's
+// modification time and permissions. A dropped connection is resumed as
+// in Download.
+func (c *Client) DownloadFile(ctx context.Context, addr, name, target string) error {
+	f, err := os.Create(target + protocol.PartSuffix)
+	if err != nil {
+		return err
+	}
+	header, err := c.download(ctx, addr, name, f)
+	if closeErr := f.Close(); err == nil && closeErr != nil {
+		err = closeErr
+	}
+	if _, err := c.Mismatch.Finish(target, err); err != nil {
+		return err
+	}
+	protocol.RestoreMetadata(target, header) // best effort: the data is intact
+	return nil
+}
+
+// receive copies the content described by header, compressed with codec,
+// from conn to dst and, unless c.Mismatch is SkipVerify, verifies its
+// checksum. A mismatch returns a *ChecksumError, and a file the server
+// reports as cut short an *AckError. Only the file's data and trailer are
+// read, never more, so after any of these conn is ready for what the
+// server sends next.
+func (c *Client) receive(ctx context.Context, conn net.Conn, sess protocol.Session, header protocol.FileHeader, dst io.Writer, codec protocol.Codec) error {
+	hasher, err := c.newVerifier(header)
+	if err != nil {
+		return err
+	}
+	if hasher != nil {
+		dst = io.MultiWriter(dst, hasher)
+	}
+	ctx, done := c.limitTransfer(ctx, conn)
+	defer done()
+	if _, err := c.receiveData(ctx, conn, sess, header.Size, dst, codec, c.downloadBar(header.Size)); err != nil {
+		return err
+	}
+	return verify(header, hasher)
+}
+
+// receiveData copies length bytes of file data, compressed with codec,
+// from conn to dst, counting them on bar if it isn't nil, then reads the
+// trailer. It returns how many bytes reached dst, also on failure.
+func (c *Client) receiveData(ctx context.Context, conn net.Conn, sess protocol.Session, length int64, dst io.Writer, codec protocol.Codec, bar *ui.ProgressReader) (int64, error) {
+	// Chain: Network -> Decompressor -> ProgressReader -> LimitReader
+	// We want progress to update as bytes come out of the decompressor,
+	// so it counts toward the file's size.
+	dec, err := protocol.NewDecompressor(c.Pause.Reader(conn), codec)
+	if err != nil {
+		return 0, err
+	}
+	defer dec.Close()
+	var src io.Reader = dec
+	if bar != nil {
+		bar.Reader = src
+		src = bar
+	}
+
+	received, err := protocol.Copy(dst, io.LimitReader(src, length), c.BufferSize)
+	if err != nil {
+		return received, ctxErr(ctx, fmt.Errorf("downloading file: %w", err))
+	}
+	if received != length {
+		return received, ctxErr(ctx, fmt.Errorf("downloading file: server closed the connection after %d of %d bytes", received, length))
+	}
+	if err := dec.Finish(); err != nil {
+		return received, ctxErr(ctx, fmt.Errorf("downloading file: %w", err))
+	}
+	return received, ctxErr(ctx, readTrailer(conn, sess))
+}
+
+// downloadBar returns the progress bar for a download of size bytes, or
+// nil if neither OnDownloadProgress nor ShowProgress asks for one. Its
+// Reader is set by whatever feeds it.
+func (c *Client) downloadBar(size int64) *ui.ProgressReader {
+	var bar *ui.ProgressReader
+	if c.OnDownloadProgress != nil {
+		bar = ui.NewProgressReader(size, nil)
+		bar.OnProgress = c.OnDownloadProgress
+	} else if c.ShowProgress {
+		bar = ui.NewProgressReaderOpts(size, nil, c.Progress)
+	}
+	if bar != nil {
+		bar.Pause = c.Pause
+		if size == 0 {
+			bar.Refresh() // nothing will be read
+		}
+	}
+	return bar
+}
+
+// newVerifier returns the hash a download described by header is checked
+// with, or nil under SkipVerify
+func (c *Client) newVerifier(header protocol.FileHeader) (hash.Hash, error) {
+	if c.Mismatch == SkipVerify {
+		return nil, nil
+	}
+	newHash, err := header.Algo.Hasher()
+	if err != nil {
+		return nil, err
+	}
+	return newHash(), nil
+}
+
+// verify compares the checksum of the data fed to hasher from newVerifier
+// with the server's, returning a *ChecksumError if they differ
+func verify(header protocol.FileHeader, hasher hash.Hash) error {
+	if hasher == nil {
+		return nil
+	}
+	clientChecksum := hasher.Sum(nil)
+	if !bytes.Equal(clientChecksum, header.Checksum) {
+		return &ChecksumError{Expected: header.Checksum, Actual: clientChecksum}
+	}
+	return nil
+}
+
+// byteRange selects part of a file for OpDownloadRange
+type byteRange struct {
+	offset, length int64
+}
+
+// request dials addr, asks for name (the whole file when rng is nil) and
+// reads the reply header. On success the caller owns conn and must call stop.
+func (c *Client) request(ctx context.Context, addr, name string, rng *byteRange) (net.Conn, func() bool, protocol.Session, protocol.FileHeader, error) {
+	var header protocol.FileHeader
+	var sess protocol.Session
+	conn, stop, err := c.dial(ctx, addr)
+	if err != nil {
+		return nil, nil, sess, header, err
+	}
+	fail := func(err error) (net.Conn, func() bool, protocol.Session, protocol.FileHeader, error) {
+		stop()
+		conn.Close()
+		return nil, nil, sess, header, ctxErr(ctx, err)
+	}
+
+	// 1. Negotiate Version
+	sess, err = protocol.ClientHelloCompressed(conn, c.Checksum, c.Compression)
+	if err != nil {
+		return fail(err)
+	}
+	header, err = requestFile(conn, sess, name, rng)
+	if err != nil {
+		return fail(err)
+	}
+	return conn, stop, sess, header, nil
+}
+
+// requestFile asks for name (the whole file when rng is nil) on a
+// connection that has said hello and reads the reply header
+func requestFile(conn net.Conn, sess protocol.Session, name string, rng *byteRange) (protocol.FileHeader, error) {
+	var header protocol.FileHeader
+
+	// 2. Send Operation Code (Download)
+	op := uint8(protocol.OpDownload)
+	if rng != nil {
+		op = protocol.OpDownloadRange
+	}
+	if err := binary.Write(conn, binary.LittleEndian, op); err != nil {
+		return header, fmt.Errorf("sending operation code: %w", err)
+	}
+
+	// 3. Send Request (Filename, plus the range if any)
+	if err := binary.Write(conn, binary.LittleEndian, uint32(len(name))); err != nil {
+		return header, fmt.Errorf("sending filename length: %w", err)
+	}
+	if _, err := conn.Write([]byte(name)); err != nil {
+		return header, fmt.Errorf("sending filename: %w", err)
+	}
+	if rng != nil {
+		if err := binary.Write(conn, binary.LittleEndian, [2]int64{rng.offset, rng.length}); err != nil {
+			return header, fmt.Errorf("sending range: %w", err)
+		}
+	}
+
+	// 4. Read Response Header (Metadata)
+	header, err := protocol.ReadHeader(conn, sess.Version)
+	if err != nil {
+		return header, fmt.Errorf("reading file header: %w", err)
+	}
+	if err := sess.CheckAlgo(header); err != nil {
+		return header, err
+	}
+	return header, nil
+}
+
+// List returns the files on the server matching the glob pattern, matched
+// per path component against names relative to the server's storage root
+// (so "*.log" only matches top-level files). An empty pattern lists
+// everything.
+func (c *Client) List(ctx context.Context, addr, pattern string) ([]protocol.FileEntry, error) {
+	return c.ListSince(ctx, addr, pattern, time.Time{})
+}
+
+// ListSince is List restricted to files modified after since, for
+// incremental backups; the zero time lists every match. Servers from
+// protocol v7 filter the listing themselves, so only the recent files
+// cross the network.
+func (c *Client) ListSince(ctx context.Context, addr, pattern string, since time.Time) ([]protocol.FileEntry, error) {
+	conn, stop, err := c.dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer stop()
+
+	sess, err := protocol.ClientHello(conn, c.Checksum)
+	if err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	entries, err := list(conn, sess, pattern, since, c.ListPartial)
+	if err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	return entries, nil
+}
+
+// list sends an OpList request for pattern and reads the reply. Files not
+// modified after since (unless it is zero) are left out, by the server
+// from protocol v7 and here before that. With partial, uploads in progress
+// are listed too if the server speaks v9.
+func list(conn net.Conn, sess protocol.Session, pattern string, since time.Time, partial bool) ([]protocol.FileEntry, error) {
+	var cutoff int64
+	if !since.IsZero() {
+		cutoff = since.UnixNano()
+	}
+	if err := binary.Write(conn, binary.LittleEndian, uint8(protocol.OpList)); err != nil {
+		return nil, fmt.Errorf("sending operation code: %w", err)
+	}
+	if err := writeName(conn, pattern); err != nil {
+		return nil, fmt.Errorf("sending pattern: %w", err)
+	}
+	if sess.Version >= 7 {
+		if err := binary.Write(conn, binary.LittleEndian, cutoff); err != nil {
+			return nil, fmt.Errorf("sending cutoff: %w", err)
+		}
+	}
+	partial = partial && sess.Version >= 9
+	if sess.Version >= 9 {
+		var flags uint8
+		if partial {
+			flags |= protocol.ListPartial
+		}
+		if err := binary.Write(conn, binary.LittleEndian, flags); err != nil {
+			return nil, fmt.Errorf("sending list flags: %w", err)
+		}
+	}
+
+	status, msg, err := protocol.ReadAck(conn)
+	if err != nil {
+		return nil, fmt.Errorf("reading list reply: %w", err)
+	}
+	if status != protocol.AckOK {
+		return nil, &AckError{Status: status, Message: msg}
+	}
+	readList := protocol.ReadList
+	if partial {
+		readList = protocol.ReadPartialList
+	}
+	entries, err := readList(conn)
+	if err != nil {
+		return nil, fmt.Errorf("reading list: %w", err)
+	}
+	if cutoff != 0 && sess.Version < 7 {
+		recent := entries[:0]
+		for _, e := range entries {
+			if e.ModTime > cutoff {
+				recent = append(recent, e)
+			}
+		}
+		entries = recent
+	}
+	return entries, nil
+}
+
+// Rename renames the server file oldName to newName. Both are relative to
+// the server's storage root; the server refuses to overwrite an existing
+// file, returning an *AckError.
+func (c *Client) Rename(ctx context.Context, addr, oldName, newName string) error {
+	conn, stop, err := c.dial(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer stop()
+
+	if _, err := protocol.ClientHello(conn, c.Checksum); err != nil {
+		return ctxErr(ctx, err)
+	}
+	if err := rename(conn, oldName, newName); err != nil {
+		return ctxErr(ctx, err)
+	}
+	return nil
+}
+
+// rename sends an OpRename request and reads the reply
+func rename(conn net.Conn, oldName, newName string) error {
+	if err := binary.Write(conn, binary.LittleEndian, uint8(protocol.OpRename)); err != nil {
+		return fmt.Errorf("sending operation code: %w", err)
+	}
+	for _, name := range []string{oldName, newName} {
+		if err := writeName(conn, name); err != nil {
+			return fmt.Errorf("sending filename: %w", err)
+		}
+	}
+
+	status, msg, err := protocol.ReadAck(conn)
+	if err != nil {
+		return fmt.Errorf("reading rename reply: %w", err)
+	}
+	if status != protocol.AckOK {
+		return &AckError{Status: status, Message: msg}
+	}
+	return nil
+}
+
+// Delete removes the server file name, relative to the server's storage
+// root. A missing file or a directory is refused with an *AckError.
+func (c *Client) Delete(ctx context.Context, addr, name string) error {
+	conn, stop, err := c.dial(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer stop()
+
+	if _, err := protocol.ClientHello(conn, c.Checksum); err != nil {
+		return ctxErr(ctx, err)
+	}
+	if err := remove(conn, name); err != nil {
+		return ctxErr(ctx, err)
+	}
+	return nil
+}
+
+// remove sends an OpDelete request and reads the reply
+func remove(conn net.Conn, name string) error {
+	if err := binary.Write(conn, binary.LittleEndian, uint8(protocol.OpDelete)); err != nil {
+		return fmt.Errorf("sending operation code: %w", err)
+	}
+	if err := writeName(conn, name); err != nil {
+		return fmt.Errorf("sending filename: %w", err)
+	}
+
+	status, msg, err := protocol.ReadAck(conn)
+	if err != nil {
+		return fmt.Errorf("reading delete reply: %w", err)
+	}
+	if status != protocol.AckOK {
+		return &AckError{Status: status, Message: msg}
+	}
+	return nil
+}
+
+// ReportVerification tells the server at addr whether the checksum of a
+// download of name matched, for the server to log. A server that predates
+// OpReport hangs up, which is returned as an error.
+func (c *Client) ReportVerification(ctx context.Context, addr, name string, verified bool) error {
+	conn, stop, err := c.dial(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer stop()
+
+	if _, err := protocol.ClientHello(conn, c.Checksum); err != nil {
+		return ctxErr(ctx, err)
+	}
+	if err := binary.Write(conn, binary.LittleEndian, uint8(protocol.OpReport)); err != nil {
+		return ctxErr(ctx, fmt.Errorf("sending operation code: %w", err))
+	}
+	if err := writeName(conn, name); err != nil {
+		return ctxErr(ctx, fmt.Errorf("sending filename: %w", err))
+	}
+	var result uint8
+	if verified {
+		result = 1
+	}
+	if err := binary.Write(conn, binary.LittleEndian, result); err != nil {
+		return ctxErr(ctx, fmt.Errorf("sending report: %w", err))
+	}
+
+	status, msg, err := protocol.ReadAck(conn)
+	if err != nil {
+		return ctxErr(ctx, fmt.Errorf("reading report reply: %w", err))
+	}
+	if status != protocol.AckOK {
+		return &AckError{Status: status, Message: msg}
+	}
+	return nil
+}
+
+// UploadTar sends the local directory dir as one tar archive, which the
+// server unpacks under its storage root as filepath.Base(dir)/... It
+// returns the number of files sent. A refusal, e.g. for exceeding the
+// quota, is returned as an *AckError.
+func (c *Client) UploadTar(ctx context.Context, addr, dir string) (int, error) {
+	return c.UploadTarAs(ctx, addr, dir, filepath.Base(filepath.Clean(dir)))
+}
+
+// UploadTarAs is UploadTar with the files unpacked under prefix, a
+// slash-separated server path, instead of dir's base name
+func (c *Client) UploadTarAs(ctx context.Context, addr, dir, prefix string) (int, error) {
+	conn, stop, err := c.dial(ctx, addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	defer stop()
+
+	sess, err := protocol.ClientHello(conn, c.Checksum)
+	if err != nil {
+		return 0, ctxErr(ctx, err)
+	}
+	if sess.Version < 4 {
+		return 0, fmt.Errorf("server speaks protocol v%d; tar uploads need v4", sess.Version)
+	}
+	if err := binary.Write(conn, binary.LittleEndian, uint8(protocol.OpUploadTar)); err != nil {
+		return 0, ctxErr(ctx, fmt.Errorf("sending operation code: %w", err))
+	}
+
+	files, err := archive.Write(c.Pause.Writer(conn), dir, prefix)
+	if err != nil {
+		// A server that refused the archive early has already said why. If
+		// the failure was local it is still waiting for data, so don't
+		// wait long for a reply.
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if ackErr := readAck(conn, sess); ackErr != nil && errors.As(ackErr, new(*AckError)) {
+			return files, ackErr
+		}
+		return files, ctxErr(ctx, fmt.Errorf("sending archive: %w", err))
+	}
+	if err := readAck(conn, sess); err != nil {
+		return files, ctxErr(ctx, err)
+	}
+	return files, nil
+}
+
+// DownloadTar fetches the server directory name as a tar archive and
+// unpacks it under the local directory dest, as path.Base(name)/... It
+// returns the number of files written.
+func (c *Client) DownloadTar(ctx context.Context, addr, name, dest string) (int, error) {
+	conn, stop, err := c.dial(ctx, addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	defer stop()
+
+	if _, err := protocol.ClientHello(conn, c.Checksum); err != nil {
+		return 0, ctxErr(ctx, err)
+	}
+	if err := binary.Write(conn, binary.LittleEndian, uint8(protocol.OpDownloadTar)); err != nil {
+		return 0, ctxErr(ctx, fmt.Errorf("sending operation code: %w", err))
+	}
+	if err := writeName(conn, name); err != nil {
+		return 0, ctxErr(ctx, fmt.Errorf("sending directory name: %w", err))
+	}
+
+	status, msg, err := protocol.ReadAck(conn)
+	if err != nil {
+		return 0, ctxErr(ctx, fmt.Errorf("reading tar download reply: %w", err))
+	}
+	if status != protocol.AckOK {
+		return 0, &AckError{Status: status, Message: msg}
+	}
+	files, err := archive.Extract(c.Pause.Reader(conn), dest, nil)
+	if err != nil {
+		return files, ctxErr(ctx, err)
+	}
+	return files, nil
+}
+
+// Stat asks the server about the file name. found is false if it doesn't
+// exist; otherwise the header carries its size, metadata and checksum
+// under the negotiated algorithm.
+func (c *Client) Stat(ctx context.Context, addr, name string) (header protocol.FileHeader, found bool, err error) {
+	conn, stop, err := c.dial(ctx, addr)
+	if err != nil {
+		return header, false, err
+	}
+	defer conn.Close()
+	defer stop()
+
+	sess, err := protocol.ClientHello(conn, c.Checksum)
+	if err != nil {
+		return header, false, ctxErr(ctx, err)
+	}
+	header, found, err = stat(conn, sess, name)
+	if err != nil {
+		return header, false, ctxErr(ctx, err)
+	}
+	return header, found, nil
+}
+
+// stat sends an OpStat request for name and reads the reply
+func stat(conn net.Conn, sess protocol.Session, name string) (header protocol.FileHeader, found bool, err error) {
+	if err := binary.Write(conn, binary.LittleEndian, uint8(protocol.OpStat)); err != nil {
+		return header, false, fmt.Errorf("sending operation code: %w", err)
+	}
+	if err := writeName(conn, name); err != nil {
+		return header, false, fmt.Errorf("sending filename: %w", err)
+	}
+
+	status, msg, err := protocol.ReadAck(conn)
+	if err != nil {
+		return header, false, fmt.Errorf("reading stat reply: %w", err)
+	}
+	if status != protocol.AckOK {
+		return header, false, &AckError{Status: status, Message: msg}
+	}
+	var exists [1]byte
+	if _, err := io.ReadFull(conn, exists[:]); err != nil {
+		return header, false, fmt.Errorf("reading stat reply: %w", err)
+	}
+	if exists[0] == 0 {
+		return header, false, nil
+	}
+	header, err = protocol.ReadHeader(conn, sess.Version)
+	if err != nil {
+		return header, false, fmt.Errorf("reading file header: %w", err)
+	}
+	if err := sess.CheckAlgo(header); err != nil {
+		return header, false, err
+	}
+	return header, true, nil
+}
+
+// FileResult reports how one file of a DownloadDir went
+type FileResult struct {
+	Header protocol.FileHeader
+	Path   string // where it was written
+	Err    error  // nil if it was written and verified
+}
+
+// DownloadDir fetches every file below the server directory name over one
+// connection and recreates them under the local directory dest, as
+// path.Base(name)/... Each file is verified on its own; one that fails
+// (e.g. a *ChecksumError) is removed and reported in its FileResult while
+// the rest continue. The returned error is set when the transfer as a
+// whole failed.
+func (c *Client) DownloadDir(ctx context.Context, addr, name, dest string) ([]FileResult, error) {
+	conn, stop, err := c.dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer stop()
+
+	sess, err := protocol.ClientHello(conn, c.Checksum)
+	if err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	if err := binary.Write(conn, binary.LittleEndian, uint8(protocol.OpDownloadDir)); err != nil {
+		return nil, ctxErr(ctx, fmt.Errorf("sending operation code: %w", err))
+	}
+	if err := writeName(conn, name); err != nil {
+		return nil, ctxErr(ctx, fmt.Errorf("sending directory name: %w", err))
+	}
+	status, msg, err := protocol.ReadAck(conn)
+	if err != nil {
+		return nil, ctxErr(ctx, fmt.Errorf("reading directory download reply: %w", err))
+	}
+	if status != protocol.AckOK {
+		return nil, &AckError{Status: status, Message: msg}
+	}
+
+	var results []FileResult
+	for {
+		header, err := protocol.ReadDirEntry(conn, sess.Version)
+		if err == io.EOF {
+			return results, nil
+		}
+		if err != nil {
+			return results, ctxErr(ctx, fmt.Errorf("reading file header: %w", err))
+		}
+		if err := sess.CheckAlgo(header); err != nil {
+			return results, err
+		}
+		if c.OnHeader != nil {
+			c.OnHeader(header)
+		}
+
+		// A name the server shouldn't have sent ends the transfer: its
+		// data can't be skipped safely without trusting the rest
+		target, err := archive.SafePath(dest, header.Name)
+		if err != nil {
+			return results, err
+		}
+		result := FileResult{Header: header, Path: target}
+		result.Err, err = c.receiveFile(ctx, conn, sess, header, target)
+		results = append(results, result)
+		if err != nil {
+			return results, err
+		}
+	}
+}
+
+// receiveFile writes one file of a directory download to target. A local
+// or verification failure is returned as fileErr, with the file's data
+// and trailer still consumed so the stream stays in sync; err is set if
+// the connection can't continue.
+func (c *Client) receiveFile(ctx context.Context, conn net.Conn, sess protocol.Session, header protocol.FileHeader, target string) (fileErr, err error) {
+	skip := func(fileErr error) (error, error) {
+		if _, err := io.CopyN(io.Discard, conn, header.Size); err != nil {
+			return fileErr, ctxErr(ctx, fmt.Errorf("downloading file: %w", err))
+		}
+		// Left unread, the trailer's status byte would pass for the end
+		// of the directory
+		if err := readTrailer(conn, sess); err != nil && !errors.As(err, new(*AckError)) {
+			return fileErr, ctxErr(ctx, err)
+		}
+		return fileErr, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return skip(err)
+	}
+	part := target + protocol.PartSuffix
+	f, err := os.Create(part)
+	if err != nil {
+		return skip(err)
+	}
+
+	err = c.receive(ctx, conn, sess, header, f, protocol.CodecNone)
+	if closeErr := f.Close(); err == nil && closeErr != nil {
+		os.Remove(part)
+		return closeErr, nil
+	}
+	// Only errors that leave the stream in sync let the transfer go on
+	var mismatch *ChecksumError
+	var short *AckError
+	connOK := err == nil || errors.As(err, &mismatch) || errors.As(err, &short)
+	if _, err = c.Mismatch.Finish(target, err); err != nil {
+		if connOK {
+			return err, nil
+		}
+		return err, err
+	}
+	protocol.RestoreMetadata(target, header) // best effort: the data is intact
+	return nil, nil
+}
+
+// writeName sends a uint32-length-prefixed name or pattern
+func writeName(w io.Writer, name string) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(name))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, name)
+	return err
+}
+
+// Upload sends size bytes from src to the server at addr, stored as name.
+// A src that is an io.Seeker is read twice, once for the checksum that
+// precedes the data. Any other, such as a pipe or a bytes.Buffer, is
+// streamed as it is read, with the checksum computed on the way and sent
+// after the data (protocol v10); for older servers it is spooled to a
+// temporary file first. When src is an *os.File its modification time and
+// permissions are sent along. Servers speaking protocol v4+ acknowledge
+// the upload once they have verified the checksum; a failed verification
+// or refusal is returned as an *AckError.
+func (c *Client) Upload(ctx context.Context, addr, name string, src io.Reader, size int64) error {
+	header := protocol.FileHeader{Name: name, Size: size}
+	if f, ok := src.(*os.File); ok {
+		if info, err := f.Stat(); err == nil {
+			header.ModTime = info.ModTime().UnixNano()
+			header.Mode = uint32(info.Mode().Perm())
+		}
+	}
+
+	rs, ok := src.(io.ReadSeeker)
+	if ok {
+		// An *os.File may still be a pipe
+		_, err := rs.Seek(0, io.SeekCurrent)
+		ok = err == nil
+	}
+	if !ok {
+		err := c.upload(ctx, addr, header, src, nil)
+		if !errors.Is(err, errChecksumFirst) {
+			return err
+		}
+		tmp, err := os.CreateTemp("", "gopher-upload-*")
+		if err != nil {
+			return fmt.Errorf("spooling upload: %w", err)
+		}
+		defer func() { tmp.Close(); os.Remove(tmp.Name()) }()
+		if _, err := io.CopyN(tmp, src, size); err != nil {
+			return fmt.Errorf("spooling upload: %w", err)
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("spooling upload: %w", err)
+		}
+		rs = tmp
+	}
+
+	// 1. Compute Checksum, then rewind for the transfer
+	start, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("seeking source: %w", err)
+	}
+	checksum := func(algo protocol.ChecksumAlgo) ([]byte, error) {
+		sum, err := algo.Compute(io.LimitReader(rs, size))
+		if err != nil {
+			return nil, fmt.Errorf("computing checksum: %w", err)
+		}
+		if _, err := rs.Seek(start, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("seeking source: %w", err)
+		}
+		return sum, nil
+	}
+	header.Algo = c.Checksum
+	if header.Checksum, err = checksum(c.Checksum); err != nil {
+		return err
+	}
+	return c.upload(ctx, addr, header, rs, checksum)
+}
+
+// errChecksumFirst is returned by upload, before anything is read from
+// src, when there is no checksum to send ahead of the data and the server
+// can't take it after
+var errChecksumFirst = errors.New("server needs the checksum before the data")
+
+// upload sends header and the header.Size bytes of src that follow it to
+// addr and waits for the server's verdict. If the server settles on
+// another checksum algorithm, header.Checksum is recomputed with
+// checksum. A nil checksum sends the checksum after the data instead,
+// hashing src as it is sent.
+func (c *Client) upload(ctx context.Context, addr string, header protocol.FileHeader, src io.Reader, checksum func(protocol.ChecksumAlgo) ([]byte, error)) error {
+	size := header.Size
+	conn, stop, err := c.dial(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer stop()
+
+	// 2. Negotiate Version, then Send Operation Code (Upload)
+	sess, err := protocol.ClientHelloCompressed(conn, c.Checksum, c.Compression)
+	if err != nil {
+		return ctxErr(ctx, err)
+	}
+	var trailer hash.Hash
+	switch {
+	case checksum != nil:
+		if sess.Algo != header.Algo {
+			// The server fell back to SHA-256
+			header.Algo = sess.Algo
+			if header.Checksum, err = checksum(sess.Algo); err != nil {
+				return err
+			}
+		}
+	case sess.Version < 10:
+		return errChecksumFirst
+	default:
+		newHash, err := sess.Algo.Hasher()
+		if err != nil {
+			return err
+		}
+		header.Algo, header.Checksum, trailer = sess.Algo, nil, newHash()
+		src = io.TeeReader(src, trailer)
+	}
+	if err := binary.Write(conn, binary.LittleEndian, uint8(protocol.OpUpload)); err != nil {
+		return ctxErr(ctx, fmt.Errorf("sending operation code: %w", err))
+	}
+
+	// 3. Send Header
+	if err := protocol.WriteHeader(conn, sess.Version, header); err != nil {
+		return ctxErr(ctx, fmt.Errorf("sending file header: %w", err))
+	}
+
+	// 4. Stream File Content, compressed after the progress bar counts it
+	enc, err := protocol.NewCompressor(c.Pause.Writer(conn), sess.Compression)
+	if err != nil {
+		return err
+	}
+	var dst io.Writer = enc
+	var bar *ui.ProgressWriter
+	if c.OnUploadProgress != nil {
+		bar = ui.NewProgressWriter(size, dst)
+		bar.OnProgress = c.OnUploadProgress
+	} else if c.ShowProgress {
+		bar = ui.NewProgressWriterOpts(size, dst, c.Progress)
+	}
+	if bar != nil {
+		bar.Pause = c.Pause
+		dst = bar
+		if size == 0 {
+			bar.Refresh() // nothing will be written
+		}
+	}
+	ctx, done := c.limitTransfer(ctx, conn)
+	defer done()
+	source := &sourceReader{r: io.LimitReader(src, size)}
+	sent, err := protocol.Copy(dst, source, c.BufferSize)
+	if err != nil {
+		// A server that refused the upload early has already said why,
+		// but one whose data stopped because src failed is still waiting
+		if source.err == nil {
+			if ackErr := readAck(conn, sess); ackErr != nil && errors.As(ackErr, new(*AckError)) {
+				return ackErr
+			}
+		}
+		return ctxErr(ctx, fmt.Errorf("sending file data: %w", err))
+	}
+	if sent != size {
+		return fmt.Errorf("sending file data: source ended after %d of %d bytes", sent, size)
+	}
+	if err := enc.Close(); err != nil {
+		return ctxErr(ctx, fmt.Errorf("sending file data: %w", err))
+	}
+	if trailer != nil {
+		if _, err := conn.Write(trailer.Sum(nil)); err != nil {
+			return ctxErr(ctx, fmt.Errorf("sending checksum: %w", err))
+		}
+	}
+
+	// 5. Wait for the server to verify what it received
+	if err := readAck(conn, sess); err != nil {
+		return ctxErr(ctx, err)
+	}
+	return nil
+}
+
+// sourceReader remembers the error the data being uploaded failed with
+type sourceReader struct {
+	r   io.Reader
+	err error
+}
+
+func (s *sourceReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF {
+		s.err = err
+	}
+	return n, err
+}
+
+// readAck reads the server's verdict on an upload. Servers before protocol
+// v4 send none, so there is nothing to wait for.
+func readAck(conn net.Conn, sess protocol.Session) error {
+	if sess.Version < 4 {
+		return nil
+	}
+	status, msg, err := protocol.ReadAck(conn)
+	if err != nil {
+		return fmt.Errorf("waiting for upload acknowledgement: %w", err)
+	}
+	if status != protocol.AckOK {
+		return &AckError{Status: status, Message: msg}
+	}
+	return nil
+}
+
+// readTrailer reads the acknowledgement that follows a downloaded file's
+// data from protocol v5 on. A file that shrank while the server was
+// sending it (its missing tail zero-padded) returns an *AckError.
+func readTrailer(conn net.Conn, sess protocol.Session) error {
+	if sess.Version < 5 {
+		return nil
+	}
+	status, msg, err := protocol.ReadAck(conn)
+	if err != nil {
+		return fmt.Errorf("reading transfer trailer: %w", err)
+	}
+	if status != protocol.AckOK {
+		return &AckError{Status: status, Message: msg}
+	}
+	return nil
+}
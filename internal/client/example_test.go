@@ -0,0 +1,47 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+
+	"gopher-fs/internal/client"
+	"gopher-fs/internal/security"
+	"gopher-fs/internal/server"
+)
+
+// Uploading from and downloading into memory: neither side needs a file,
+// and a source that can't seek is streamed with its checksum sent last.
+func ExampleClient_Upload() {
+	tlsConfig, err := security.GenerateTLSConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := server.New("", tlsConfig)
+	srv.Store = server.NewMemoryStore(0)
+	l, err := srv.Listen("127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Close()
+	go srv.Serve(l)
+
+	pinned, err := security.TLSConfigWithPin(security.Fingerprint(tlsConfig.Certificates[0].Certificate[0]))
+	if err != nil {
+		log.Fatal(err)
+	}
+	c := client.New(pinned)
+	ctx := context.Background()
+
+	src := bytes.NewBufferString("hello from memory")
+	if err := c.Upload(ctx, l.Addr().String(), "greeting.txt", src, int64(src.Len())); err != nil {
+		log.Fatal(err)
+	}
+	var dst bytes.Buffer
+	if err := c.Download(ctx, l.Addr().String(), "greeting.txt", &dst); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(dst.String())
+	// Output: hello from memory
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"gopher-fs/internal/protocol"
+)
+
+// BuildManifest checksums the local files with c.Checksum and returns a
+// manifest listing each under its remote name. files maps remote names
+// to local paths.
+func (c *Client) BuildManifest(files map[string]string) (protocol.Manifest, error) {
+	entries := make([]protocol.ManifestEntry, 0, len(files))
+	for name, local := range files {
+		f, err := os.Open(local)
+		if err != nil {
+			return protocol.Manifest{}, err
+		}
+		info, err := f.Stat()
+		if err == nil {
+			var sum []byte
+			if sum, err = c.Checksum.Compute(f); err == nil {
+				entries = append(entries, protocol.ManifestEntry{Name: name, Size: info.Size(), Algo: c.Checksum, Checksum: sum})
+			}
+		}
+		f.Close()
+		if err != nil {
+			return protocol.Manifest{}, fmt.Errorf("%s: %w", local, err)
+		}
+	}
+	return protocol.NewManifest(entries), nil
+}
+
+// SendManifest announces the files of a multi-file upload and returns the
+// ones the server doesn't hold yet. Sending it again once they have been
+// uploaded checks that none are missing. Servers from before manifests
+// drop the connection, which is reported as an error.
+func (c *Client) SendManifest(ctx context.Context, addr string, m protocol.Manifest) ([]protocol.FileEntry, error) {
+	conn, stop, err := c.dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer stop()
+
+	if _, err := protocol.ClientHello(conn, c.Checksum); err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	if err := binary.Write(conn, binary.LittleEndian, uint8(protocol.OpManifest)); err != nil {
+		return nil, ctxErr(ctx, fmt.Errorf("sending operation code: %w", err))
+	}
+	if err := protocol.WriteManifest(conn, m); err != nil {
+		return nil, ctxErr(ctx, fmt.Errorf("sending manifest: %w", err))
+	}
+
+	status, msg, err := protocol.ReadAck(conn)
+	if err != nil {
+		return nil, ctxErr(ctx, fmt.Errorf("reading manifest reply: %w", err))
+	}
+	if status != protocol.AckOK {
+		return nil, &AckError{Status: status, Message: msg}
+	}
+	missing, err := protocol.ReadList(conn)
+	if err != nil {
+		return nil, ctxErr(ctx, fmt.Errorf("reading missing files: %w", err))
+	}
+	return missing, nil
+}
@@ -0,0 +1,147 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"gopher-fs/internal/protocol"
+	"gopher-fs/internal/ui"
+)
+
+// errFileChanged is returned when the server's copy of a file changes while
+// its parts are being fetched
+var errFileChanged = errors.New("file changed on the server during download")
+
+// DownloadParallel fetches name over up to parts connections at once, each
+// transferring a disjoint byte range written into dst at its offset. dst is
+// resized to the file's size first and read back at the end to verify the
+// combined checksum. A mismatch returns a *ChecksumError.
+func (c *Client) DownloadParallel(ctx context.Context, addr, name string, dst *os.File, parts int) error {
+	// 1. Fetch the header alone (a zero-length range) to learn the size
+	conn, stop, _, header, err := c.request(ctx, addr, name, &byteRange{})
+	if err != nil {
+		return err
+	}
+	stop()
+	conn.Close()
+	if c.OnHeader != nil {
+		c.OnHeader(header)
+	}
+
+	// 2. Pre-allocate the output so every part can write at its offset
+	if err := dst.Truncate(header.Size); err != nil {
+		return fmt.Errorf("allocating output: %w", err)
+	}
+
+	var progress io.Writer = io.Discard
+	if bar := c.downloadBar(header.Size); bar != nil {
+		progress = &sharedProgress{bar: bar}
+	}
+
+	// 3. Fetch the parts concurrently; the first failure cancels the rest.
+	// All of them share the transfer timeout.
+	ctx, done := c.limitTransfer(ctx, nil)
+	defer done()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	for _, rng := range splitRanges(header.Size, parts) {
+		wg.Add(1)
+		go func(rng byteRange) {
+			defer wg.Done()
+			if err := c.downloadRange(ctx, addr, name, header, rng, dst, progress); err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(rng)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+
+	// 4. Verify Checksum over the reassembled file
+	if c.Mismatch == SkipVerify {
+		return nil
+	}
+	clientChecksum, err := header.Algo.Compute(io.NewSectionReader(dst, 0, header.Size))
+	if err != nil {
+		return fmt.Errorf("verifying download: %w", err)
+	}
+	if !bytes.Equal(clientChecksum, header.Checksum) {
+		return &ChecksumError{Expected: header.Checksum, Actual: clientChecksum}
+	}
+	return nil
+}
+
+// downloadRange fetches one part of the file described by want into dst
+func (c *Client) downloadRange(ctx context.Context, addr, name string, want protocol.FileHeader, rng byteRange, dst io.WriterAt, progress io.Writer) error {
+	conn, stop, sess, header, err := c.request(ctx, addr, name, &rng)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer stop()
+
+	if header.Size != want.Size || !bytes.Equal(header.Checksum, want.Checksum) {
+		return errFileChanged
+	}
+
+	w := io.NewOffsetWriter(dst, rng.offset)
+	received, err := protocol.Copy(io.MultiWriter(w, progress), io.LimitReader(c.Pause.Reader(conn), rng.length), c.BufferSize)
+	if err != nil {
+		return ctxErr(ctx, fmt.Errorf("downloading bytes %d-%d: %w", rng.offset, rng.offset+rng.length, err))
+	}
+	if received != rng.length {
+		return ctxErr(ctx, fmt.Errorf("downloading bytes %d-%d: received %d of %d bytes", rng.offset, rng.offset+rng.length, received, rng.length))
+	}
+	return ctxErr(ctx, readTrailer(conn, sess))
+}
+
+// splitRanges divides size bytes into at most n contiguous ranges. The
+// remainder of an uneven split is spread over the first ranges, one byte
+// each, so lengths differ by at most one. An empty file yields no ranges.
+func splitRanges(size int64, n int) []byteRange {
+	if n < 1 {
+		n = 1
+	}
+	if int64(n) > size {
+		n = int(size)
+	}
+	ranges := make([]byteRange, 0, n)
+	var offset int64
+	for i := 0; i < n; i++ {
+		length := size / int64(n)
+		if int64(i) < size%int64(n) {
+			length++
+		}
+		ranges = append(ranges, byteRange{offset: offset, length: length})
+		offset += length
+	}
+	return ranges
+}
+
+// sharedProgress feeds the bytes written by all part downloads into one
+// progress bar
+type sharedProgress struct {
+	mu  sync.Mutex
+	bar *ui.ProgressReader
+}
+
+func (s *sharedProgress) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bar.Add(int64(len(p)))
+	return len(p), nil
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"gopher-fs/internal/protocol"
+	"gopher-fs/internal/security"
+)
+
+// download requests name from addr and writes it to dst, verifying it
+// once it is complete. When the connection fails partway through, the
+// rest is fetched over a new one as a range starting at the first byte dst
+// hasn't received, up to c.Reconnects times, so a drop at 80% costs the
+// last 20% rather than the whole file. It returns the file's header.
+func (c *Client) download(ctx context.Context, addr, name string, dst io.Writer) (protocol.FileHeader, error) {
+	conn, stop, sess, header, err := c.request(ctx, addr, name, nil)
+	if err != nil {
+		return header, err
+	}
+	if c.OnHeader != nil {
+		c.OnHeader(header)
+	}
+	hasher, err := c.newVerifier(header)
+	if err != nil {
+		stop()
+		conn.Close()
+		return header, err
+	}
+	local := &localWriter{w: dst}
+	var w io.Writer = local
+	if hasher != nil {
+		w = io.MultiWriter(local, hasher)
+	}
+	bar := c.downloadBar(header.Size)
+	// Later connections are dialed under ctx, so it bounds them too
+	ctx, done := c.limitTransfer(ctx, conn)
+	defer done()
+
+	codec := sess.Compression.Codec
+	var received int64
+	for attempt := 0; ; attempt++ {
+		if err == nil {
+			n, recvErr := c.receiveData(ctx, conn, sess, header.Size-received, w, codec, bar)
+			received += n
+			stop()
+			conn.Close()
+			if err = recvErr; err == nil {
+				break
+			}
+		}
+		if attempt == c.Reconnects || local.err != nil || !resumable(ctx, err) {
+			return header, err
+		}
+		if c.OnReconnect != nil {
+			c.OnReconnect(attempt+1, received, err)
+		}
+		select {
+		case <-ctx.Done():
+			return header, context.Cause(ctx)
+		case <-time.After(c.DialBackoff << attempt):
+		}
+		// Ranges are sent uncompressed
+		conn, stop, sess, err = c.resume(ctx, addr, name, header, received)
+		codec = protocol.CodecNone
+	}
+	return header, verify(header, hasher)
+}
+
+// resume connects again for the file described by header from offset on,
+// failing with errFileChanged if the server's copy is no longer that file
+func (c *Client) resume(ctx context.Context, addr, name string, header protocol.FileHeader, offset int64) (net.Conn, func() bool, protocol.Session, error) {
+	conn, stop, sess, h, err := c.request(ctx, addr, name, &byteRange{offset: offset, length: header.Size - offset})
+	if err != nil {
+		return nil, nil, sess, err
+	}
+	if h.Size != header.Size || !bytes.Equal(h.Checksum, header.Checksum) {
+		stop()
+		conn.Close()
+		return nil, nil, sess, errFileChanged
+	}
+	return conn, stop, sess, nil
+}
+
+// resumable reports whether a download that failed with err is worth
+// resuming: the connection broke, rather than ctx ending or the server
+// answering in a way another try won't change
+func resumable(ctx context.Context, err error) bool {
+	return ctx.Err() == nil &&
+		!errors.As(err, new(*AckError)) &&
+		!errors.As(err, new(*ChecksumError)) &&
+		!errors.Is(err, errFileChanged) &&
+		!errors.Is(err, protocol.ErrAuthFailed) &&
+		!errors.Is(err, security.ErrFingerprintMismatch)
+}
+
+// localWriter remembers the error dst failed with, which no reconnection
+// can fix
+type localWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (l *localWriter) Write(p []byte) (int, error) {
+	n, err := l.w.Write(p)
+	if err != nil {
+		l.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,146 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"gopher-fs/internal/protocol"
+)
+
+// ErrSessionUnsupported is returned by Open when the server predates
+// protocol v6 and serves only one request per connection
+var ErrSessionUnsupported = errors.New("server does not support sessions (protocol v6)")
+
+// Session carries any number of requests over one connection, saving the
+// TLS handshake and hello each one-shot Client method pays. Requests run
+// one at a time; a Session isn't safe for concurrent use.
+type Session struct {
+	client *Client
+	conn   net.Conn
+	sess   protocol.Session
+
+	// broken is set once a request fails in a way that leaves the
+	// connection out of step; every later request returns it
+	broken error
+}
+
+// Open connects to addr for a session of requests, returning
+// ErrSessionUnsupported if the server can't keep the connection open.
+// ctx only bounds the connecting; each request takes its own. The caller
+// must Close the session.
+func (c *Client) Open(ctx context.Context, addr string) (*Session, error) {
+	conn, stop, err := c.dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := protocol.ClientHelloCompressed(conn, c.Checksum, c.Compression)
+	if !stop() && err == nil {
+		err = ctx.Err() // the deadline may already be cut short
+	}
+	if err != nil {
+		conn.Close()
+		return nil, ctxErr(ctx, err)
+	}
+	if sess.Version < 6 {
+		conn.Close()
+		return nil, ErrSessionUnsupported
+	}
+	conn.SetDeadline(time.Time{})
+	return &Session{client: c, conn: conn, sess: sess}, nil
+}
+
+// do runs one request under ctx. A failure the server answered in full,
+// an *AckError or *ChecksumError, leaves the session usable; any other
+// breaks it.
+func (s *Session) do(ctx context.Context, request func() error) error {
+	if s.broken != nil {
+		return s.broken
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		s.conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		s.conn.SetDeadline(time.Unix(1, 0))
+	})
+	err := request()
+	if !stop() {
+		// Cancelled mid-request: whatever it was doing is cut off
+		s.broken = fmt.Errorf("session ended by an earlier request: %w", ctx.Err())
+		return ctxErr(ctx, err)
+	}
+	s.conn.SetDeadline(time.Time{})
+
+	var ackErr *AckError
+	var sumErr *ChecksumError
+	if err != nil && !errors.As(err, &ackErr) && !errors.As(err, &sumErr) {
+		s.broken = fmt.Errorf("session ended by an earlier request: %w", err)
+	}
+	return err
+}
+
+// List is Client.List over the session
+func (s *Session) List(ctx context.Context, pattern string) ([]protocol.FileEntry, error) {
+	return s.ListSince(ctx, pattern, time.Time{})
+}
+
+// ListSince is Client.ListSince over the session
+func (s *Session) ListSince(ctx context.Context, pattern string, since time.Time) (entries []protocol.FileEntry, err error) {
+	err = s.do(ctx, func() error {
+		entries, err = list(s.conn, s.sess, pattern, since, s.client.ListPartial)
+		return err
+	})
+	return entries, err
+}
+
+// Stat is Client.Stat over the session
+func (s *Session) Stat(ctx context.Context, name string) (header protocol.FileHeader, found bool, err error) {
+	err = s.do(ctx, func() error {
+		header, found, err = stat(s.conn, s.sess, name)
+		return err
+	})
+	return header, found, err
+}
+
+// Download is Client.Download over the session. A *ChecksumError leaves
+// the session usable, as the whole file was still read.
+func (s *Session) Download(ctx context.Context, name string, dst io.Writer) error {
+	return s.do(ctx, func() error {
+		header, err := requestFile(s.conn, s.sess, name, nil)
+		if err != nil {
+			return err
+		}
+		if s.client.OnHeader != nil {
+			s.client.OnHeader(header)
+		}
+		return s.client.receive(ctx, s.conn, s.sess, header, dst, s.sess.Compression.Codec)
+	})
+}
+
+// Rename is Client.Rename over the session
+func (s *Session) Rename(ctx context.Context, oldName, newName string) error {
+	return s.do(ctx, func() error {
+		return rename(s.conn, oldName, newName)
+	})
+}
+
+// Delete is Client.Delete over the session
+func (s *Session) Delete(ctx context.Context, name string) error {
+	return s.do(ctx, func() error {
+		return remove(s.conn, name)
+	})
+}
+
+// Close tells the server the session is over and closes the connection
+func (s *Session) Close() error {
+	if s.broken == nil {
+		s.conn.SetDeadline(time.Now().Add(5 * time.Second))
+		binary.Write(s.conn, binary.LittleEndian, uint8(protocol.OpClose))
+		s.broken = net.ErrClosed
+	}
+	return s.conn.Close()
+}
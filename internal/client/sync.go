@@ -0,0 +1,41 @@
+package client
+
+import "sort"
+
+// SyncPlan lists what a sync must change on the server to mirror a local
+// tree. Names are slash-separated and sorted.
+type SyncPlan struct {
+	Add    []string // only present locally
+	Update []string // on both sides with different contents
+	Delete []string // only present on the server
+}
+
+// Empty reports whether the server already mirrors the local tree
+func (p SyncPlan) Empty() bool {
+	return len(p.Add) == 0 && len(p.Update) == 0 && len(p.Delete) == 0
+}
+
+// DiffTrees compares the checksums of a local tree with the server's,
+// both keyed by file name, and returns the changes that make the server
+// match local
+func DiffTrees(local, remote map[string][32]byte) SyncPlan {
+	var plan SyncPlan
+	for name, sum := range local {
+		remoteSum, ok := remote[name]
+		switch {
+		case !ok:
+			plan.Add = append(plan.Add, name)
+		case remoteSum != sum:
+			plan.Update = append(plan.Update, name)
+		}
+	}
+	for name := range remote {
+		if _, ok := local[name]; !ok {
+			plan.Delete = append(plan.Delete, name)
+		}
+	}
+	sort.Strings(plan.Add)
+	sort.Strings(plan.Update)
+	sort.Strings(plan.Delete)
+	return plan
+}
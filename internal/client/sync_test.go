@@ -0,0 +1,41 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffTrees(t *testing.T) {
+	sum := func(b byte) [32]byte { return [32]byte{b} }
+	local := map[string][32]byte{
+		"docs/same.txt":    sum(1),
+		"docs/changed.txt": sum(2),
+		"docs/new.txt":     sum(3),
+		"a/new.txt":        sum(4),
+	}
+	remote := map[string][32]byte{
+		"docs/same.txt":    sum(1),
+		"docs/changed.txt": sum(9),
+		"docs/old.txt":     sum(5),
+	}
+
+	got := DiffTrees(local, remote)
+	want := SyncPlan{
+		Add:    []string{"a/new.txt", "docs/new.txt"},
+		Update: []string{"docs/changed.txt"},
+		Delete: []string{"docs/old.txt"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffTrees = %+v, want %+v", got, want)
+	}
+	if got.Empty() {
+		t.Error("plan with changes reports Empty")
+	}
+
+	if plan := DiffTrees(local, local); !plan.Empty() {
+		t.Errorf("DiffTrees of identical trees = %+v, want an empty plan", plan)
+	}
+	if plan := DiffTrees(nil, remote); len(plan.Delete) != len(remote) || len(plan.Add) != 0 {
+		t.Errorf("DiffTrees against an empty tree = %+v, want everything deleted", plan)
+	}
+}
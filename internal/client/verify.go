@@ -0,0 +1,54 @@
+package client
+
+import (
+	"errors"
+	"os"
+
+	"gopher-fs/internal/protocol"
+)
+
+// MismatchPolicy decides what becomes of a download whose checksum doesn't
+// match the server's
+type MismatchPolicy int
+
+const (
+	// RemoveOnMismatch deletes the data; it's the default
+	RemoveOnMismatch MismatchPolicy = iota
+
+	// KeepOnMismatch keeps the data for inspection as <name>.corrupt
+	KeepOnMismatch
+
+	// SkipVerify doesn't check downloads at all: the checksum isn't
+	// computed and the data is kept as if it had matched
+	SkipVerify
+)
+
+// CorruptSuffix is appended to the name of a download kept by
+// KeepOnMismatch
+const CorruptSuffix = ".corrupt"
+
+// Finish settles a download written to target+protocol.PartSuffix once
+// err, the outcome of the transfer, is known. Complete data is renamed to
+// target; after a *ChecksumError the policy decides, and after any other
+// error the partial file is removed. It returns where the data was left
+// ("" if it was removed) and the error to report.
+func (p MismatchPolicy) Finish(target string, err error) (string, error) {
+	part := target + protocol.PartSuffix
+	var mismatch *ChecksumError
+	switch {
+	case errors.As(err, &mismatch) && p == KeepOnMismatch:
+		if renameErr := os.Rename(part, target+CorruptSuffix); renameErr != nil {
+			os.Remove(part)
+			return "", err
+		}
+		return target + CorruptSuffix, err
+	case err != nil:
+		os.Remove(part)
+		return "", err
+	}
+	if err := os.Rename(part, target); err != nil {
+		os.Remove(part)
+		return "", err
+	}
+	return target, nil
+}
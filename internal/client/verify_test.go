@@ -0,0 +1,60 @@
+package client
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopher-fs/internal/protocol"
+)
+
+func TestMismatchPolicyFinish(t *testing.T) {
+	mismatch := &ChecksumError{Expected: []byte{1}, Actual: []byte{2}}
+	dropped := errors.New("connection reset")
+	tests := []struct {
+		name     string
+		policy   MismatchPolicy
+		err      error
+		wantPath string // relative to the target's directory, "" if removed
+		wantErr  error
+	}{
+		{"verified", RemoveOnMismatch, nil, "file.bin", nil},
+		{"mismatch removed", RemoveOnMismatch, mismatch, "", mismatch},
+		{"mismatch kept", KeepOnMismatch, mismatch, "file.bin" + CorruptSuffix, mismatch},
+		{"transfer failed", KeepOnMismatch, dropped, "", dropped},
+		{"unverified", SkipVerify, nil, "file.bin", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			target := filepath.Join(dir, "file.bin")
+			if err := os.WriteFile(target+protocol.PartSuffix, []byte("data"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			path, err := tt.policy.Finish(target, tt.err)
+			if err != tt.wantErr {
+				t.Errorf("Finish error = %v, want %v", err, tt.wantErr)
+			}
+			want := ""
+			if tt.wantPath != "" {
+				want = filepath.Join(dir, tt.wantPath)
+			}
+			if path != want {
+				t.Errorf("Finish path = %q, want %q", path, want)
+			}
+
+			left, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case want == "" && len(left) != 0:
+				t.Errorf("removed download left %v behind", left)
+			case want != "" && (len(left) != 1 || left[0].Name() != tt.wantPath):
+				t.Errorf("directory holds %v, want only %s", left, tt.wantPath)
+			}
+		})
+	}
+}
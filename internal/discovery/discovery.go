@@ -1,100 +1,346 @@
 package discovery
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"strconv"
+	"strings"
 	"time"
 )
 
 const DiscoveryPort = 9999
 const DiscoveryMsg = "DISCOVER_GOPHER_FS"
 
+// DefaultTimeout is how long clients wait for discovery replies by default
+const DefaultTimeout = 5 * time.Second
+
+// ErrNoServers is returned by FindServer when nothing replied before the timeout
+var ErrNoServers = errors.New("no servers found")
+
+// AnnounceMsg prefixes the periodic presence beacon; the TCP port follows it
+const AnnounceMsg = "ANNOUNCE_GOPHER_FS"
+
+// TokenEnv is the environment variable the commands read the discovery
+// token from when no flag sets it
+const TokenEnv = "DISCOVERY_TOKEN"
+
+// namespaced appends token to a discovery message. Servers and clients only
+// see each other when their tokens match; the empty token leaves the
+// message unchanged, so it matches deployments that predate tokens.
+func namespaced(msg, token string) string {
+	if token == "" {
+		return msg
+	}
+	return msg + "/" + token
+}
+
+// Server is a gopher-fs server found on the network
+type Server struct {
+	IP   net.IP
+	Addr string // host:port to dial
+	Name string // mDNS instance name; empty when found by broadcast
+}
+
 // Listen listens for UDP broadcasts and responds with the server's TCP port
-func Listen(serviceTCPPort string) {
+// to those carrying token. It only returns if the discovery port can't be
+// bound.
+//
+// Clients dial the port at the address the reply came from. A server
+// listening on every interface passes a nil bind and the kernel picks that
+// address; one bound to a single IP passes it, and replies are sent from
+// it so clients dial the address actually being served. Bound to a
+// loopback address, only requests from this host are answered.
+func Listen(bind net.IP, serviceTCPPort, token string) error {
 	addr := &net.UDPAddr{
 		Port: DiscoveryPort,
 		IP:   net.ParseIP("0.0.0.0"),
 	}
 	conn, err := net.ListenUDP("udp4", addr)
 	if err != nil {
-		log.Printf("Warning: UDP Discovery disabled (Error binding %d: %v)", DiscoveryPort, err)
-		return
+		return fmt.Errorf("binding UDP %d: %w", DiscoveryPort, err)
 	}
 	defer conn.Close()
 
-	fmt.Printf("Discovery Server listening on UDP %d\n", DiscoveryPort)
+	reply := conn
+	if bound(bind) {
+		if reply, err = replySocket(bind); err != nil {
+			return err
+		}
+		defer reply.Close()
+	}
+
+	slog.Info("Discovery server listening", "udp_port", DiscoveryPort)
 
+	want := namespaced(DiscoveryMsg, token)
 	buf := make([]byte, 1024)
 	for {
 		n, remoteAddr, err := conn.ReadFromUDP(buf)
 		if err != nil {
-			log.Printf("Error reading UDP: %v", err)
+			slog.Error("Error reading UDP", "err", err)
 			continue
 		}
 		
 		msg := string(buf[:n])
-		if msg == DiscoveryMsg {
-			log.Printf("Received discovery request from %s", remoteAddr)
-			// Respond with our TCP port
-			_, err := conn.WriteToUDP([]byte(serviceTCPPort), remoteAddr)
-			if err != nil {
-				log.Printf("Error sending discovery response: %v", err)
-			}
+		if msg != want {
+			slog.Debug("Ignored discovery request with another token", "remote", remoteAddr)
+			continue
+		}
+		if bind.IsLoopback() && !isLocal(remoteAddr.IP) {
+			slog.Debug("Ignored discovery request from another host to a loopback-bound server", "remote", remoteAddr)
+			continue
+		}
+		slog.Debug("Received discovery request", "remote", remoteAddr)
+		// Respond with our TCP port
+		if _, err := reply.WriteToUDP([]byte(serviceTCPPort), remoteAddr); err != nil {
+			slog.Error("Error sending discovery response", "err", err)
 		}
 	}
 }
 
-// FindServer broadcasts a discovery message and returns the server's TCP address
-func FindServer() string {
-	fmt.Println("Broadcasting for servers...")
+// bound reports whether bind names a single address rather than every
+// interface
+func bound(bind net.IP) bool {
+	return bind != nil && !bind.IsUnspecified()
+}
 
-	// Listen on a random UDP port for the response (Force IPv4)
-	conn, err := net.ListenPacket("udp4", ":0")
+// replySocket opens a UDP socket on any port of bind, for discovery
+// traffic that has to come from that address. Discovery is IPv4 only.
+func replySocket(bind net.IP) (*net.UDPConn, error) {
+	if bind.To4() == nil {
+		return nil, fmt.Errorf("discovery is IPv4 only, but the server is bound to %s", bind)
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: bind})
 	if err != nil {
-		log.Fatalf("Error listening for UDP response: %v", err)
+		return nil, fmt.Errorf("binding UDP to %s: %w", bind, err)
 	}
-	defer conn.Close()
+	return conn, nil
+}
+
+// isLocal reports whether ip is an address of this host
+func isLocal(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
 
-	// Broadcast to 255.255.255.255 (Global Broadcast)
-	broadcastAddr, err := net.ResolveUDPAddr("udp4", "255.255.255.255:9999")
+// FindServer broadcasts a discovery message carrying token and returns the
+// first server's TCP address, or ErrNoServers if none replies within timeout
+func FindServer(timeout time.Duration, token string) (string, error) {
+	servers, err := discover(timeout, token, true)
 	if err != nil {
-		log.Fatalf("Error resolving broadcast address: %v", err)
+		return "", err
 	}
+	if len(servers) == 0 {
+		return "", ErrNoServers
+	}
+	return servers[0].Addr, nil
+}
 
-	msg := []byte(DiscoveryMsg)
-	_, err = conn.WriteTo(msg, broadcastAddr)
+// FindServers broadcasts a discovery message carrying token and returns
+// every server that replies within timeout, one per source IP.
+func FindServers(timeout time.Duration, token string) ([]Server, error) {
+	return discover(timeout, token, false)
+}
+
+func discover(timeout time.Duration, token string, firstOnly bool) ([]Server, error) {
+	slog.Info("Broadcasting for servers")
+
+	// Listen on a random UDP port for the response (Force IPv4)
+	conn, err := net.ListenPacket("udp4", ":0")
 	if err != nil {
+		return nil, fmt.Errorf("listening for UDP response: %w", err)
+	}
+	defer conn.Close()
+
+	// Send to each interface's directed broadcast address, then to
+	// 255.255.255.255 (Global Broadcast) as a fallback
+	msg := []byte(namespaced(DiscoveryMsg, token))
+	sent := 0
+	for _, ip := range append(broadcastAddrs(), net.IPv4bcast) {
+		addr := &net.UDPAddr{IP: ip, Port: DiscoveryPort}
+		if _, err := conn.WriteTo(msg, addr); err != nil {
+			slog.Debug("Broadcast failed", "addr", addr, "err", err)
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
 		// Fallback: Try localhost if broadcast fails (useful for local testing/restrictions)
-		log.Printf("Broadcast failed (%v), trying localhost...", err)
-		localAddr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:9999")
+		slog.Info("Broadcast failed, trying localhost")
+		localAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: DiscoveryPort}
 		_, err = conn.WriteTo(msg, localAddr)
 		if err != nil {
-			log.Fatalf("Error communicating with server: %v", err)
+			return nil, fmt.Errorf("communicating with server: %w", err)
 		}
 	}
 
-	// Wait for response
-	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// Collect responses until the deadline; a server reachable through several
+	// interfaces answers each broadcast, so de-duplicate by source IP
+	conn.SetReadDeadline(time.Now().Add(timeout))
 	buf := make([]byte, 1024)
-	
-	n, remoteAddr, err := conn.ReadFrom(buf)
+
+	seen := make(map[string]bool)
+	var servers []Server
+	for {
+		n, remoteAddr, err := conn.ReadFrom(buf)
+		if err != nil {
+			// Deadline reached
+			break
+		}
+
+		// remoteAddr is an interface (net.Addr), we need the IP
+		udpAddr, ok := remoteAddr.(*net.UDPAddr)
+		if !ok {
+			slog.Warn("Could not get UDP address from response")
+			continue
+		}
+
+		serverIP := udpAddr.IP.String()
+		if seen[serverIP] {
+			continue
+		}
+		seen[serverIP] = true
+
+		tcpPort := string(buf[:n])
+		fullAddr := serverIP + tcpPort
+		slog.Info("Found server", "addr", fullAddr)
+		servers = append(servers, Server{IP: udpAddr.IP, Addr: fullAddr})
+		if firstOnly {
+			break
+		}
+	}
+	return servers, nil
+}
+
+// broadcastAddrs returns the directed broadcast address of every up,
+// broadcast-capable IPv4 interface (e.g. 192.168.1.255 for 192.168.1.0/24)
+func broadcastAddrs() []net.IP {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		slog.Warn("Error listing interfaces", "err", err)
+		return nil
+	}
+
+	var ips []net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip4 := ipnet.IP.To4()
+			mask := ipnet.Mask
+			if len(mask) == net.IPv6len {
+				mask = mask[12:]
+			}
+			if ip4 == nil || len(mask) != net.IPv4len {
+				continue
+			}
+			bcast := make(net.IP, net.IPv4len)
+			for i := range ip4 {
+				bcast[i] = ip4[i] | ^mask[i]
+			}
+			ips = append(ips, bcast)
+		}
+	}
+	return ips
+}
+
+// Announce periodically broadcasts a presence beacon carrying token and the
+// server's TCP port, for networks where client broadcasts never reach the
+// server. It is additive to Listen and only returns if its socket can't be
+// opened. As with Listen, a server bound to a single IP passes it so
+// beacons come from that address, and a loopback-bound server, which no
+// other host could reach, can't announce.
+func Announce(interval time.Duration, bind net.IP, tcpPort, token string) error {
+	if bind.IsLoopback() {
+		return fmt.Errorf("the server is bound to %s, which other hosts can't reach", bind)
+	}
+	var conn *net.UDPConn
+	var err error
+	if bound(bind) {
+		conn, err = replySocket(bind)
+	} else {
+		conn, err = net.ListenUDP("udp4", &net.UDPAddr{})
+	}
 	if err != nil {
-		log.Printf("Discovery timed out or failed: %v", err)
-		return ""
-	}
-	
-	tcpPort := string(buf[:n])
-	
-	// remoteAddr is an interface (net.Addr), we need the IP
-	udpAddr, ok := remoteAddr.(*net.UDPAddr)
-	if !ok {
-		log.Printf("Could not get UDP address from response")
-		return ""
-	}
-	
-	serverIP := udpAddr.IP.String()
-	fullAddr := serverIP + tcpPort
-	fmt.Printf("Found server at %s\n", fullAddr)
-	return fullAddr
+		return fmt.Errorf("opening announcement socket: %w", err)
+	}
+	defer conn.Close()
+
+	broadcastAddr := &net.UDPAddr{IP: net.IPv4bcast, Port: DiscoveryPort}
+	beacon := []byte(namespaced(AnnounceMsg, token) + tcpPort)
+
+	slog.Info("Announcing presence", "udp_port", DiscoveryPort, "every", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := conn.WriteTo(beacon, broadcastAddr); err != nil {
+			slog.Error("Error sending announcement", "err", err)
+		}
+		<-ticker.C
+	}
+}
+
+// ListenForAnnouncements passively collects server beacons carrying token on
+// the discovery port until timeout and returns the distinct servers heard.
+// The discovery port must be free, so this can't run on a host that is
+// itself running Listen.
+func ListenForAnnouncements(timeout time.Duration, token string) ([]Server, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: DiscoveryPort})
+	if err != nil {
+		return nil, fmt.Errorf("listening for announcements: %w", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 1024)
+
+	prefix := namespaced(AnnounceMsg, token)
+	seen := make(map[string]bool)
+	var servers []Server
+	for {
+		n, remoteAddr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			// Deadline reached
+			break
+		}
+
+		// What follows the prefix must be exactly ":port"; anything else
+		// is a beacon for another token
+		port, ok := strings.CutPrefix(string(buf[:n]), prefix)
+		if !ok || !strings.HasPrefix(port, ":") {
+			continue
+		}
+		if _, err := strconv.Atoi(port[1:]); err != nil {
+			continue
+		}
+		fullAddr := remoteAddr.IP.String() + port
+		if !seen[fullAddr] {
+			seen[fullAddr] = true
+			servers = append(servers, Server{IP: remoteAddr.IP, Addr: fullAddr})
+			slog.Info("Heard announcement", "addr", fullAddr)
+		}
+	}
+	return servers, nil
 }
@@ -0,0 +1,88 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// MDNSService is the DNS-SD service type servers advertise over mDNS, so
+// they also show up in standard service browsers, e.g.
+// dns-sd -B _gopherfs._tcp or avahi-browse _gopherfs._tcp
+const MDNSService = "_gopherfs._tcp"
+
+const mdnsDomain = "local."
+
+// AnnounceMDNS advertises a server on TCP port as the instance name of
+// MDNSService, with the addresses of every multicast-capable interface,
+// and answers mDNS queries for it in the background until stop is called.
+// An empty name uses the hostname. Unlike broadcast discovery, mDNS is
+// not namespaced by a discovery token: every host on the link sees the
+// advertisement.
+func AnnounceMDNS(port int, name string) (stop func(), err error) {
+	if name == "" {
+		if name, err = os.Hostname(); err != nil || name == "" {
+			name = "gopher-fs"
+		}
+	}
+	server, err := zeroconf.Register(name, MDNSService, mdnsDomain, port, []string{"txtvers=1"}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("registering mDNS service: %w", err)
+	}
+	slog.Info("Advertising over mDNS", "service", MDNSService, "name", name)
+	return server.Shutdown, nil
+}
+
+// BrowseMDNS collects the servers advertising MDNSService over mDNS until
+// timeout, one per instance name. A server's IPv4 address is preferred;
+// IPv6 link-local addresses are skipped, since the advertisement doesn't
+// say which interface they belong to.
+func BrowseMDNS(timeout time.Duration) ([]Server, error) {
+	slog.Info("Browsing mDNS for servers")
+	resolver, err := zeroconf.NewResolver(nil)
+	if err != nil {
+		return nil, fmt.Errorf("starting mDNS browser: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Closed by the resolver once ctx is done
+	entries := make(chan *zeroconf.ServiceEntry)
+	if err := resolver.Browse(ctx, MDNSService, mdnsDomain, entries); err != nil {
+		return nil, fmt.Errorf("browsing mDNS: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	var servers []Server
+	for entry := range entries {
+		ip := dialableIP(entry)
+		if ip == nil || seen[entry.Instance] {
+			continue
+		}
+		seen[entry.Instance] = true
+		addr := net.JoinHostPort(ip.String(), strconv.Itoa(entry.Port))
+		slog.Info("Found server", "name", entry.Instance, "addr", addr)
+		servers = append(servers, Server{IP: ip, Addr: addr, Name: entry.Instance})
+	}
+	return servers, nil
+}
+
+// dialableIP picks the address to reach an advertised server at, or nil
+// if it has none that can be dialed
+func dialableIP(entry *zeroconf.ServiceEntry) net.IP {
+	if len(entry.AddrIPv4) > 0 {
+		return entry.AddrIPv4[0]
+	}
+	for _, ip := range entry.AddrIPv6 {
+		if !ip.IsLinkLocalUnicast() {
+			return ip
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+// Package policy decides which uploads are accepted. The file server and
+// the web gateway share it, so a file refused by one is refused by both.
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// BlockedExtensionsEnv names the environment variable holding the default
+// blocklist, e.g. ".exe,.bat,.sh"
+const BlockedExtensionsEnv = "BLOCKED_EXTENSIONS"
+
+// ErrBlockedExtension is reported for an upload whose extension is on the
+// blocklist
+var ErrBlockedExtension = errors.New("file type not allowed")
+
+// Blocklist is a set of file extensions uploads may not have, lower-cased
+// and with their leading dot. A nil Blocklist allows everything.
+type Blocklist map[string]bool
+
+// ParseBlocklist parses a comma-separated list of extensions such as
+// ".exe,.BAT,sh". The dot is optional, case is ignored and blank entries
+// are skipped.
+func ParseBlocklist(list string) Blocklist {
+	var b Blocklist
+	for _, ext := range strings.Split(list, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" || ext == "." {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if b == nil {
+			b = make(Blocklist)
+		}
+		b[ext] = true
+	}
+	return b
+}
+
+// String returns the blocked extensions in the form ParseBlocklist reads
+func (b Blocklist) String() string {
+	exts := make([]string, 0, len(b))
+	for ext := range b {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	return strings.Join(exts, ",")
+}
+
+// AllowUpload returns an error wrapping ErrBlockedExtension if filename, a
+// slash-separated path, has a blocked extension
+func (b Blocklist) AllowUpload(filename string) error {
+	ext := strings.ToLower(path.Ext(filename))
+	if b[ext] {
+		return fmt.Errorf("%w: %s files are blocked", ErrBlockedExtension, ext)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package policy
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAllowUpload(t *testing.T) {
+	b := ParseBlocklist(" .exe, BAT ,,.Sh")
+	if got := b.String(); got != ".bat,.exe,.sh" {
+		t.Errorf("String() = %q, want .bat,.exe,.sh", got)
+	}
+
+	for name, blocked := range map[string]bool{
+		"setup.exe":         true,
+		"SETUP.EXE":         true,
+		"room1/run.Bat":     true,
+		"deploy.sh":         true,
+		"notes.txt":         false,
+		"archive.exe.zip":   false,
+		"exe":               false,
+		"scripts.sh/readme": false,
+		"Makefile":          false,
+	} {
+		err := b.AllowUpload(name)
+		if blocked != errors.Is(err, ErrBlockedExtension) {
+			t.Errorf("AllowUpload(%q) = %v, want blocked %v", name, err, blocked)
+		}
+	}
+
+	var none Blocklist
+	if err := none.AllowUpload("setup.exe"); err != nil {
+		t.Errorf("empty blocklist refused setup.exe: %v", err)
+	}
+	if ParseBlocklist("") != nil {
+		t.Error("ParseBlocklist(\"\") should be nil")
+	}
+}
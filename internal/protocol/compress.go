@@ -0,0 +1,325 @@
+package protocol
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec identifies how file data is compressed on the wire (see
+// ProtocolVersion 8)
+type Codec uint8
+
+const (
+	// CodecNone sends data as is, and is all peers before v8 speak
+	CodecNone Codec = 0
+	CodecGzip Codec = 1
+	CodecZstd Codec = 2
+)
+
+// ErrUnsupportedCodec is returned for an unknown compression codec
+var ErrUnsupportedCodec = errors.New("unsupported compression codec")
+
+// codecs lists each codec's name and the levels it takes. Level 0 always
+// means the codec's default.
+var codecs = map[Codec]struct {
+	name                    string
+	minLevel, maxLevel, def int
+}{
+	CodecNone: {"none", 0, 0, 0},
+	CodecGzip: {"gzip", gzip.BestSpeed, gzip.BestCompression, 6},
+	CodecZstd: {"zstd", 1, 22, 3},
+}
+
+func (c Codec) String() string {
+	if info, ok := codecs[c]; ok {
+		return info.name
+	}
+	return fmt.Sprintf("codec(%d)", uint8(c))
+}
+
+// Supported reports whether this build can compress and decompress c
+func (c Codec) Supported() bool {
+	_, ok := codecs[c]
+	return ok
+}
+
+// DefaultLevel is the level c compresses at when none is asked for
+func (c Codec) DefaultLevel() int {
+	return codecs[c].def
+}
+
+// ParseCodec maps a name such as "gzip" or "zstd" to its id. An empty
+// name is CodecNone.
+func ParseCodec(name string) (Codec, error) {
+	if name == "" {
+		return CodecNone, nil
+	}
+	for c, info := range codecs {
+		if strings.EqualFold(name, info.name) {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %q", ErrUnsupportedCodec, name)
+}
+
+// Compression is a codec and the level to compress at (0 = the codec's
+// default)
+type Compression struct {
+	Codec Codec
+	Level uint8
+}
+
+// NewCompression checks level against codec's range
+func NewCompression(codec Codec, level int) (Compression, error) {
+	info, ok := codecs[codec]
+	if !ok {
+		return Compression{}, fmt.Errorf("%w: %d", ErrUnsupportedCodec, uint8(codec))
+	}
+	if level != 0 && (level < info.minLevel || level > info.maxLevel) {
+		if codec == CodecNone {
+			return Compression{}, errors.New("a compression level needs a codec")
+		}
+		return Compression{}, fmt.Errorf("%s level %d is outside %d-%d", codec, level, info.minLevel, info.maxLevel)
+	}
+	return Compression{Codec: codec, Level: uint8(level)}, nil
+}
+
+// valid reports whether the level is one the codec takes
+func (c Compression) valid() bool {
+	_, err := NewCompression(c.Codec, int(c.Level))
+	return err == nil
+}
+
+func (c Compression) String() string {
+	if c.Codec == CodecNone {
+		return c.Codec.String()
+	}
+	level := int(c.Level)
+	if level == 0 {
+		level = c.Codec.DefaultLevel()
+	}
+	return fmt.Sprintf("%s level %d", c.Codec, level)
+}
+
+// compressedChunkSize is how much compressed data is gathered into one
+// frame on the wire
+const compressedChunkSize = 64 << 10
+
+// NewCompressor returns a writer that compresses what is written to it
+// with c onto w. The compressed stream is sent as uint32-length-prefixed
+// chunks ended by an empty one, so the reader stops exactly at its end
+// whatever the codec buffers. Close ends the stream but not w. With
+// CodecNone data is written to w as is.
+func NewCompressor(w io.Writer, c Compression) (io.WriteCloser, error) {
+	if c.Codec == CodecNone {
+		return nopWriteCloser{w}, nil
+	}
+	if !c.valid() {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedCodec, c)
+	}
+	level := int(c.Level)
+	if level == 0 {
+		level = c.Codec.DefaultLevel()
+	}
+
+	frames := bufio.NewWriterSize(&frameWriter{w: w}, compressedChunkSize)
+	var enc io.WriteCloser
+	var err error
+	switch c.Codec {
+	case CodecGzip:
+		enc, err = gzip.NewWriterLevel(frames, level)
+	case CodecZstd:
+		enc, err = zstd.NewWriter(frames,
+			zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
+			zstd.WithEncoderConcurrency(1))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &compressor{enc: enc, frames: frames, w: w}, nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// compressor feeds enc, whose output is framed through frames onto w
+type compressor struct {
+	enc    io.WriteCloser
+	frames *bufio.Writer
+	w      io.Writer
+	closed bool
+}
+
+func (c *compressor) Write(p []byte) (int, error) {
+	return c.enc.Write(p)
+}
+
+// Close flushes the codec and sends the end of the stream
+func (c *compressor) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if err := c.enc.Close(); err != nil {
+		return err
+	}
+	if err := c.frames.Flush(); err != nil {
+		return err
+	}
+	return binary.Write(c.w, binary.LittleEndian, uint32(0))
+}
+
+// frameWriter sends each write as one length-prefixed chunk
+type frameWriter struct {
+	w io.Writer
+}
+
+func (f *frameWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := binary.Write(f.w, binary.LittleEndian, uint32(len(p))); err != nil {
+		return 0, err
+	}
+	return f.w.Write(p)
+}
+
+// frameReader reads the chunks a frameWriter sent, returning io.EOF at
+// the empty one that ends them
+type frameReader struct {
+	r         io.Reader
+	remaining uint32
+	done      bool
+}
+
+func (f *frameReader) Read(p []byte) (int, error) {
+	for f.remaining == 0 {
+		if f.done {
+			return 0, io.EOF
+		}
+		if err := binary.Read(f.r, binary.LittleEndian, &f.remaining); err != nil {
+			return 0, noEOF(err)
+		}
+		f.done = f.remaining == 0
+	}
+	if uint32(len(p)) > f.remaining {
+		p = p[:f.remaining]
+	}
+	n, err := f.r.Read(p)
+	f.remaining -= uint32(n)
+	if err == io.EOF && f.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// noEOF reports a stream cut off before its end marker as such
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Decompressor reads the uncompressed data of a stream from NewCompressor
+type Decompressor struct {
+	frames *frameReader
+	dec    io.Reader
+	close  func()
+}
+
+// NewDecompressor returns a reader of the data compressed onto r with
+// codec. With CodecNone it reads r as is.
+func NewDecompressor(r io.Reader, codec Codec) (*Decompressor, error) {
+	if codec == CodecNone {
+		return &Decompressor{dec: r}, nil
+	}
+	frames := &frameReader{r: r}
+	d := &Decompressor{frames: frames}
+	switch codec {
+	case CodecGzip:
+		// gzip.NewReader reads the gzip header, which a sender may not
+		// write until its first data, so it is opened on the first Read
+		d.dec = &lazyGzip{r: frames}
+	case CodecZstd:
+		dec, err := zstd.NewReader(frames, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		d.dec, d.close = dec, dec.Close
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedCodec, uint8(codec))
+	}
+	return d, nil
+}
+
+func (d *Decompressor) Read(p []byte) (int, error) {
+	n, err := d.dec.Read(p)
+	if d.frames != nil {
+		err = noEOFBefore(err, d.frames)
+	}
+	return n, err
+}
+
+// noEOFBefore turns the codec's io.EOF into io.ErrUnexpectedEOF if its
+// stream ended before the end marker
+func noEOFBefore(err error, frames *frameReader) error {
+	if err == io.EOF && !frames.done {
+		if _, err := frames.Read(make([]byte, 1)); err != io.EOF {
+			return errors.New("compressed stream has data after its end")
+		}
+	}
+	return err
+}
+
+// Finish reads to the end of the stream, so r is left at whatever follows
+// it, and closes d. It fails if uncompressed data is left unread, as the
+// sender said its data was shorter.
+func (d *Decompressor) Finish() error {
+	defer d.Close()
+	if d.frames == nil {
+		return nil
+	}
+	n, err := io.Copy(io.Discard, d)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("compressed stream has %d bytes more than expected", n)
+	}
+	return nil
+}
+
+// Close releases the codec without reading any further
+func (d *Decompressor) Close() error {
+	if d.close != nil {
+		d.close()
+		d.close = nil
+	}
+	return nil
+}
+
+// lazyGzip is a gzip.Reader opened on its first Read
+type lazyGzip struct {
+	r   io.Reader
+	dec *gzip.Reader
+}
+
+func (l *lazyGzip) Read(p []byte) (int, error) {
+	if l.dec == nil {
+		dec, err := gzip.NewReader(l.r)
+		if err != nil {
+			return 0, noEOF(err)
+		}
+		l.dec = dec
+	}
+	return l.dec.Read(p)
+}
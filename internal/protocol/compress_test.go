@@ -0,0 +1,165 @@
+package protocol
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// sampleText returns about n bytes of server-log-like text: repetitive
+// structure with varying timestamps, paths and numbers, as most text that
+// is worth compressing is
+func sampleText(n int) []byte {
+	rng := rand.New(rand.NewSource(1))
+	levels := []string{"INFO", "INFO", "INFO", "DEBUG", "WARN", "ERROR"}
+	msgs := []string{"Sent file", "Received file, integrity verified", "Client connected", "Rejecting upload", "Listing files"}
+	dirs := []string{"projects/alpha", "backups", "logs/2024", "photos/raw", "shared"}
+	t := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	for buf.Len() < n {
+		t = t.Add(time.Duration(rng.Intn(5000)) * time.Millisecond)
+		fmt.Fprintf(&buf, "time=%s level=%s msg=%q file=%s/file-%04d.bin bytes=%d remote=192.0.2.%d:%d\n",
+			t.Format(time.RFC3339Nano), levels[rng.Intn(len(levels))], msgs[rng.Intn(len(msgs))],
+			dirs[rng.Intn(len(dirs))], rng.Intn(10000), rng.Int63n(1<<30), rng.Intn(254)+1, 40000+rng.Intn(20000))
+	}
+	return buf.Bytes()
+}
+
+func TestCompressorRoundTrip(t *testing.T) {
+	text := sampleText(300 << 10)
+	for _, comp := range []Compression{{CodecNone, 0}, {CodecGzip, 0}, {CodecGzip, 9}, {CodecZstd, 0}, {CodecZstd, 19}} {
+		for _, data := range [][]byte{text, nil} {
+			t.Run(fmt.Sprintf("%s/%d", comp, len(data)), func(t *testing.T) {
+				var wire bytes.Buffer
+				w, err := NewCompressor(&wire, comp)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := w.Write(data); err != nil {
+					t.Fatal(err)
+				}
+				if err := w.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if comp.Codec != CodecNone && len(data) > 0 && wire.Len() >= len(data)/2 {
+					t.Errorf("%d bytes compressed to %d", len(data), wire.Len())
+				}
+				// Whatever follows the stream, e.g. the trailer, is left alone
+				wire.WriteString("next")
+
+				r, err := NewDecompressor(&wire, comp.Codec)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := io.ReadAll(io.LimitReader(r, int64(len(data))))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := r.Finish(); err != nil {
+					t.Fatalf("Finish: %v", err)
+				}
+				if !bytes.Equal(got, data) {
+					t.Fatalf("got %d bytes back, want %d", len(got), len(data))
+				}
+				if rest := wire.String(); rest != "next" {
+					t.Errorf("left %q after the stream, want %q", rest, "next")
+				}
+			})
+		}
+	}
+}
+
+func TestDecompressorRejectsCutStream(t *testing.T) {
+	data := sampleText(64 << 10)
+	for _, codec := range []Codec{CodecGzip, CodecZstd} {
+		var wire bytes.Buffer
+		w, _ := NewCompressor(&wire, Compression{Codec: codec})
+		w.Write(data)
+		w.Close()
+
+		// Without its end marker, and cut off partway through
+		for _, cut := range []int{wire.Len() - 4, wire.Len() / 2} {
+			r, err := NewDecompressor(bytes.NewReader(wire.Bytes()[:cut]), codec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadAll(r); err == nil {
+				t.Errorf("%s: reading a stream cut to %d of %d bytes succeeded", codec, cut, wire.Len())
+			}
+		}
+	}
+}
+
+func TestNewCompression(t *testing.T) {
+	tests := []struct {
+		codec Codec
+		level int
+		ok    bool
+	}{
+		{CodecNone, 0, true},
+		{CodecNone, 3, false},
+		{CodecGzip, 0, true},
+		{CodecGzip, 9, true},
+		{CodecGzip, 10, false},
+		{CodecZstd, 22, true},
+		{CodecZstd, 23, false},
+		{CodecZstd, -1, false},
+		{Codec(9), 0, false},
+	}
+	for _, tt := range tests {
+		if _, err := NewCompression(tt.codec, tt.level); (err == nil) != tt.ok {
+			t.Errorf("NewCompression(%s, %d) = %v, want ok %v", tt.codec, tt.level, err, tt.ok)
+		}
+	}
+	for name, want := range map[string]Codec{"": CodecNone, "none": CodecNone, "GZIP": CodecGzip, "zstd": CodecZstd} {
+		if got, err := ParseCodec(name); err != nil || got != want {
+			t.Errorf("ParseCodec(%q) = %v, %v; want %v", name, got, err, want)
+		}
+	}
+	if _, err := ParseCodec("brotli"); err == nil {
+		t.Error("ParseCodec(brotli) succeeded")
+	}
+}
+
+// BenchmarkCompression compresses and decompresses sample text with each
+// codec at a few levels, reporting the compressed size as a percentage of
+// the original
+func BenchmarkCompression(b *testing.B) {
+	text := sampleText(16 << 20)
+	for _, comp := range []Compression{{CodecGzip, 1}, {CodecGzip, 6}, {CodecGzip, 9}, {CodecZstd, 1}, {CodecZstd, 3}, {CodecZstd, 7}, {CodecZstd, 19}} {
+		var wire bytes.Buffer
+		b.Run(fmt.Sprintf("%s-%d/compress", comp.Codec, comp.Level), func(b *testing.B) {
+			b.SetBytes(int64(len(text)))
+			for i := 0; i < b.N; i++ {
+				wire.Reset()
+				w, err := NewCompressor(&wire, comp)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := w.Write(text); err != nil {
+					b.Fatal(err)
+				}
+				if err := w.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(100*float64(wire.Len())/float64(len(text)), "%size")
+		})
+		b.Run(fmt.Sprintf("%s-%d/decompress", comp.Codec, comp.Level), func(b *testing.B) {
+			b.SetBytes(int64(len(text)))
+			for i := 0; i < b.N; i++ {
+				r, err := NewDecompressor(bytes.NewReader(wire.Bytes()), comp.Codec)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(io.Discard, r); err != nil {
+					b.Fatal(err)
+				}
+				r.Close()
+			}
+		})
+	}
+}
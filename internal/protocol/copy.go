@@ -0,0 +1,20 @@
+package protocol
+
+import "io"
+
+// DefaultBufferSize is the buffer file data is copied through unless a
+// size is configured. Well above io.Copy's 32 KiB, so multi-gigabyte
+// transfers over fast links take fewer, larger reads and writes.
+const DefaultBufferSize = 256 << 10
+
+// Copy copies src to dst until EOF like io.Copy, but always through a
+// buffer of bufSize bytes (DefaultBufferSize if bufSize <= 0): a dst that
+// is an *os.File would otherwise fall back to io.Copy's 32 KiB reads from
+// network connections.
+func Copy(dst io.Writer, src io.Reader, bufSize int) (int64, error) {
+	if bufSize <= 0 {
+		bufSize = DefaultBufferSize
+	}
+	// The wrappers hide ReadFrom and WriteTo, which would bypass buf
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, make([]byte, bufSize))
+}
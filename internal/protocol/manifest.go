@@ -0,0 +1,146 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// MaxManifestLen bounds the encoded size of a manifest accepted from a peer
+const MaxManifestLen = 32 << 20
+
+// ErrInvalidManifest is returned for a manifest that can't describe a real
+// upload, e.g. one listing an unsafe or duplicate name
+var ErrInvalidManifest = errors.New("invalid manifest")
+
+// Manifest lists every file of a multi-file upload, so the receiver knows
+// the whole set up front (see OpManifest)
+type Manifest struct {
+	// ID identifies the set of files; NewManifest derives it from them, so
+	// a retried upload of the same files has the same ID
+	ID    string          `json:"id"`
+	Files []ManifestEntry `json:"files"`
+}
+
+// ManifestEntry describes one file of a Manifest
+type ManifestEntry struct {
+	Name     string // slash-separated, as it will be uploaded
+	Size     int64
+	Algo     ChecksumAlgo
+	Checksum []byte
+}
+
+// manifestEntryJSON is how a ManifestEntry is written: the algorithm by
+// name and the checksum in hex
+type manifestEntryJSON struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Algo     string `json:"algo"`
+	Checksum string `json:"checksum"`
+}
+
+func (e ManifestEntry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(manifestEntryJSON{e.Name, e.Size, e.Algo.String(), hex.EncodeToString(e.Checksum)})
+}
+
+func (e *ManifestEntry) UnmarshalJSON(data []byte) error {
+	var j manifestEntryJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	algo, err := ParseChecksumAlgo(j.Algo)
+	if err != nil {
+		return err
+	}
+	checksum, err := hex.DecodeString(j.Checksum)
+	if err != nil {
+		return fmt.Errorf("checksum of %s: %w", j.Name, err)
+	}
+	*e = ManifestEntry{Name: j.Name, Size: j.Size, Algo: algo, Checksum: checksum}
+	return nil
+}
+
+// NewManifest returns a manifest of files, sorted by name, with an ID
+// derived from their names, sizes and checksums
+func NewManifest(files []ManifestEntry) Manifest {
+	files = append([]ManifestEntry(nil), files...)
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	h := sha256.New()
+	for _, f := range files {
+		fmt.Fprintf(h, "%s\x00%d\x00%s\x00%x\n", f.Name, f.Size, f.Algo, f.Checksum)
+	}
+	return Manifest{ID: hex.EncodeToString(h.Sum(nil)[:16]), Files: files}
+}
+
+// Validate reports the first problem that makes m unusable: a missing ID,
+// too many files, or a file with an unsafe or repeated name, a negative
+// size or a checksum that doesn't fit its algorithm
+func (m Manifest) Validate() error {
+	if m.ID == "" {
+		return fmt.Errorf("%w: no id", ErrInvalidManifest)
+	}
+	if len(m.Files) > MaxListEntries {
+		return fmt.Errorf("%w: %d files exceeds maximum %d", ErrInvalidManifest, len(m.Files), MaxListEntries)
+	}
+	seen := make(map[string]bool, len(m.Files))
+	for _, f := range m.Files {
+		name, err := CleanPath(f.Name)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+		}
+		if seen[name] {
+			return fmt.Errorf("%w: %s is listed twice", ErrInvalidManifest, name)
+		}
+		seen[name] = true
+		if f.Size < 0 {
+			return fmt.Errorf("%w: %s has negative size %d", ErrInvalidManifest, name, f.Size)
+		}
+		if !f.Algo.Supported() || len(f.Checksum) != f.Algo.Size() {
+			return fmt.Errorf("%w: %s has a bad %s checksum", ErrInvalidManifest, name, f.Algo)
+		}
+	}
+	return nil
+}
+
+// WriteManifest sends m as a uint32 length followed by that much JSON
+func WriteManifest(w io.Writer, m Manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxManifestLen {
+		return fmt.Errorf("manifest of %d bytes exceeds maximum %d", len(data), MaxManifestLen)
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(data))); err != nil {
+		return fmt.Errorf("failed to write manifest length: %v", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+	return nil
+}
+
+// ReadManifest reads a manifest sent with WriteManifest and validates it
+func ReadManifest(r io.Reader) (Manifest, error) {
+	var length uint32
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return Manifest{}, fmt.Errorf("failed to read manifest length: %v", err)
+	}
+	if length > MaxManifestLen {
+		return Manifest{}, fmt.Errorf("manifest of %d bytes exceeds maximum %d", length, MaxManifestLen)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return Manifest{}, fmt.Errorf("failed to read manifest: %v", err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return Manifest{}, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+	return m, m.Validate()
+}
@@ -1,10 +1,23 @@
 package protocol
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+	"lukechampine.com/blake3"
 )
 
 const (
@@ -12,81 +25,840 @@ const (
 	DiscoveryPort  = 9999
 	BufferSize     = 1024
 	DiscoveryMsg   = "DISCOVER_GOPHER_FS"
+
+	// MaxFilenameLen bounds the filename length accepted from a peer, so a
+	// forged length can't force a huge allocation
+	MaxFilenameLen = 4096
 	
 	// Operation Codes
 	OpDownload = 1
 	OpUpload   = 2
+
+	// OpDownloadRange requests part of a file: the filename is followed by
+	// an int64 offset and int64 length. The reply header still describes
+	// the whole file; only length bytes starting at offset follow it.
+	OpDownloadRange = 3
+
+	// OpList is followed by a length-prefixed glob pattern (empty matches
+	// everything) and, from protocol v7, an int64 cutoff in unix
+	// nanoseconds: when it isn't 0, only files modified after it match.
+	// From v9 a flags byte follows; with ListPartial set, uploads still
+	// in progress are listed too. The reply is an acknowledgement frame
+	// and, if it is AckOK, the matching files as written by WriteList, or
+	// by WritePartialList when ListPartial was set.
+	OpList = 4
+
+	// ListPartial is the OpList flag asking for uploads in progress
+	ListPartial = 1 << 0
+
+	// OpRename is followed by the current and the new length-prefixed
+	// names. The reply is an acknowledgement frame.
+	OpRename = 5
+
+	// OpUploadTar is followed by a tar archive of regular files and
+	// directories, unpacked under the storage root. The server replies with
+	// an acknowledgement frame once the archive has ended.
+	OpUploadTar = 6
+
+	// OpDownloadTar is followed by a length-prefixed directory name. The
+	// reply is an acknowledgement frame and, if it is AckOK, a tar archive
+	// of the directory with names starting with its base name.
+	OpDownloadTar = 7
+
+	// OpDownloadDir is followed by a length-prefixed directory name. The
+	// reply is an acknowledgement frame and, if it is AckOK, every file
+	// below the directory as written by WriteDirEntry, then WriteDirEnd.
+	OpDownloadDir = 8
+
+	// OpStat is followed by a length-prefixed filename. The reply is an
+	// acknowledgement frame and, if it is AckOK, a 1 byte if the file
+	// exists (followed by its header, checksummed with the session's
+	// algorithm) or a 0 byte if it doesn't.
+	OpStat = 9
+
+	// OpDelete is followed by a length-prefixed filename. The server
+	// removes that regular file and replies with an acknowledgement frame.
+	OpDelete = 10
+
+	// OpManifest announces the files of a multi-file upload before they
+	// are sent: it is followed by a manifest as written by WriteManifest.
+	// The server keeps it and replies with an acknowledgement frame and, if
+	// it is AckOK, the listed files it doesn't hold yet (with their
+	// manifest sizes) as written by WriteList. Sending the same manifest
+	// again once the files are uploaded checks that none are missing.
+	OpManifest = 11
+
+	// OpClose ends a session (see ProtocolVersion 6); nothing follows it
+	// and there is no reply
+	OpClose = 12
+
+	// OpReport is followed by a length-prefixed filename and a byte, 1 if
+	// the client's checksum of its download of that file matched the
+	// header and 0 if it didn't, for the server to log. The reply is an
+	// acknowledgement frame. Servers that predate it hang up, so clients
+	// send it on a connection of its own and ignore failures.
+	OpReport = 13
+
+	// OpHello optionally precedes the real opcode to negotiate a protocol
+	// version. Peers that skip it speak version 1.
+	OpHello = 0x10
+
+	// OpAuth comes first on a connection to a server that requires a
+	// pre-shared key: the server replies with a NonceSize-byte random
+	// nonce, the client sends the HMAC-SHA256 of the nonce keyed with the
+	// PSK, and the server answers with an acknowledgement frame. OpHello or
+	// the real opcode follows AckOK. A fresh nonce per connection means a
+	// recorded answer can't be replayed.
+	OpAuth = 0x11
+
+	// NonceSize is the length of the OpAuth challenge
+	NonceSize = 32
+
+	// ProtocolVersion is the newest version this build speaks.
+	// Version 2 adds ModTime and Mode to the file header.
+	// Version 3 negotiates the checksum algorithm in the hello and sends
+	// an algorithm id and variable-length digest in the header.
+	// Version 4 has the server acknowledge every upload (see WriteAck).
+	// Version 5 follows the data of every downloaded file with an
+	// acknowledgement trailer, so a file that shrinks while being sent is
+	// reported instead of silently coming up short (see ErrShortFile).
+	// Version 6 keeps the connection open after a request: the client may
+	// send further opcodes, each with its own request and reply and no new
+	// hello, until OpClose or it hangs up. A request the server couldn't
+	// read or answer in full, e.g. a download of a missing file, an upload
+	// refused before its data or any tar transfer, still closes it.
+	// Version 7 adds the modification time cutoff to OpList.
+	// Version 8 negotiates a compression codec in the hello, which then
+	// applies to the file data of OpDownload and OpUpload (see
+	// NewCompressor). Checksums stay over the uncompressed data.
+	// Version 9 adds the flags byte to OpList, so a client can see uploads
+	// still in progress.
+	// Version 10 lets an upload's header leave the checksum out, to send
+	// it after the data instead (see FileHeader.Checksum), so a source
+	// that can't be read twice is streamed as it is read.
+	ProtocolVersion = 10
+
+	// MaxListEntries bounds the number of entries in a file list
+	MaxListEntries = 100000
+
+	// MaxAckMessageLen bounds the message carried in an upload acknowledgement
+	MaxAckMessageLen = 1024
 )
 
+// ErrShortFile describes a file that shrank while it was being downloaded.
+// From protocol v5 the server zero-pads the missing tail, keeping the
+// stream in sync, and reports it in the trailer with AckError.
+var ErrShortFile = errors.New("file shrank during transfer")
+
+// PartSuffix is appended to a file's name while it is being received. The
+// file is renamed into place only once its checksum verifies, so a
+// transfer that fails or is interrupted never leaves a complete-looking
+// file behind.
+const PartSuffix = ".part"
+
+// Upload acknowledgement status codes
+const (
+	AckOK               uint8 = 0 // stored and checksum verified
+	AckChecksumMismatch uint8 = 1 // data arrived but didn't match the header
+	AckRejected         uint8 = 2 // refused before storing (quota, unsafe path, ...)
+	AckError            uint8 = 3 // server-side failure
+)
+
+// ChecksumAlgo identifies the hash function behind a header's checksum
+type ChecksumAlgo uint8
+
+const (
+	// ChecksumSHA256 is the default, and the only algorithm before v3
+	ChecksumSHA256 ChecksumAlgo = 0
+	ChecksumSHA512 ChecksumAlgo = 1
+	ChecksumBLAKE3 ChecksumAlgo = 2
+)
+
+// ErrUnsupportedChecksum is returned for an unknown checksum algorithm id
+var ErrUnsupportedChecksum = errors.New("unsupported checksum algorithm")
+
+var checksumAlgos = map[ChecksumAlgo]struct {
+	name    string
+	size    int
+	newHash func() hash.Hash
+}{
+	ChecksumSHA256: {"sha256", sha256.Size, sha256.New},
+	ChecksumSHA512: {"sha512", sha512.Size, sha512.New},
+	ChecksumBLAKE3: {"blake3", 32, func() hash.Hash { return blake3.New(32, nil) }},
+}
+
+func (a ChecksumAlgo) String() string {
+	if info, ok := checksumAlgos[a]; ok {
+		return info.name
+	}
+	return fmt.Sprintf("checksum(%d)", uint8(a))
+}
+
+// Supported reports whether this build can compute a
+func (a ChecksumAlgo) Supported() bool {
+	_, ok := checksumAlgos[a]
+	return ok
+}
+
+// Size is the digest length in bytes, or 0 for an unsupported algorithm
+func (a ChecksumAlgo) Size() int {
+	return checksumAlgos[a].size
+}
+
+// Hasher returns the factory for a's hash.Hash
+func (a ChecksumAlgo) Hasher() (func() hash.Hash, error) {
+	info, ok := checksumAlgos[a]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedChecksum, uint8(a))
+	}
+	return info.newHash, nil
+}
+
+// ParseChecksumAlgo maps a name such as "sha256" or "blake3" to its id
+func ParseChecksumAlgo(name string) (ChecksumAlgo, error) {
+	for a, info := range checksumAlgos {
+		if strings.EqualFold(name, info.name) {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %q", ErrUnsupportedChecksum, name)
+}
+
 // FileHeader represents the metadata sent before file content
 type FileHeader struct {
-	FileNameLen uint32
-	FileSize    int64
-	Checksum    [32]byte
+	Name string
+	Size int64
+
+	// Checksum is the digest of the content under Algo. Before protocol
+	// v3 the algorithm is always SHA-256. From v10 an upload's header may
+	// carry an empty one, in which case the digest (Algo.Size() bytes)
+	// follows the file data, after the end of any compressed stream.
+	Algo     ChecksumAlgo
+	Checksum []byte
+
+	// Sent from protocol version 2 on; zero when talking to a v1 peer
+	ModTime int64  // unix nanoseconds
+	Mode    uint32 // permission bits
 }
 
-// ComputeChecksum calculates SHA256 hash of a file
-func ComputeChecksum(r io.Reader) ([32]byte, error) {
-	hash := sha256.New()
-	if _, err := io.Copy(hash, r); err != nil {
-		return [32]byte{}, err
+// RestoreMetadata applies the modification time and permissions h carries
+// to the file at path, when the sender included them (protocol v2+)
+func RestoreMetadata(path string, h FileHeader) error {
+	var errs []error
+	if h.Mode != 0 {
+		if err := os.Chmod(path, os.FileMode(h.Mode).Perm()); err != nil {
+			errs = append(errs, fmt.Errorf("restoring mode: %w", err))
+		}
+	}
+	if h.ModTime != 0 {
+		mtime := time.Unix(0, h.ModTime)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			errs = append(errs, fmt.Errorf("restoring modification time: %w", err))
+		}
 	}
+	return errors.Join(errs...)
+}
 
+// ComputeDigest hashes everything read from r with a hash from newHash
+func ComputeDigest(r io.Reader, newHash func() hash.Hash) ([]byte, error) {
+	h := newHash()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// Compute hashes everything read from r with algorithm a
+func (a ChecksumAlgo) Compute(r io.Reader) ([]byte, error) {
+	newHash, err := a.Hasher()
+	if err != nil {
+		return nil, err
+	}
+	return ComputeDigest(r, newHash)
+}
+
+// ComputeChecksum calculates SHA256 hash of a file
+func ComputeChecksum(r io.Reader) ([32]byte, error) {
 	var checksum [32]byte
-	copy(checksum[:], hash.Sum(nil))
+	sum, err := ComputeDigest(r, sha256.New)
+	if err != nil {
+		return checksum, err
+	}
+	copy(checksum[:], sum)
 	return checksum, nil
 }
 
-// SendFileHeader sends the metadata over the connection
+// ValidateFilename rejects names that are too long, contain NUL bytes or
+// backslashes, are absolute, or have ".." components. Forward slashes are
+// allowed so directory uploads can carry relative paths.
+func ValidateFilename(name string) error {
+	if len(name) > MaxFilenameLen {
+		return fmt.Errorf("filename length %d exceeds maximum %d", len(name), MaxFilenameLen)
+	}
+	if strings.ContainsAny(name, "\x00\\") {
+		return fmt.Errorf("%w: %q contains a NUL byte or backslash", ErrUnsafePath, name)
+	}
+	if strings.HasPrefix(name, "/") {
+		return fmt.Errorf("%w: %q is absolute", ErrUnsafePath, name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return fmt.Errorf("%w: %q", ErrUnsafePath, name)
+		}
+	}
+	return nil
+}
+
+// SendFileHeader sends a version 1 header over the connection
 func SendFileHeader(w io.Writer, filename string, fileSize int64, checksum [32]byte) error {
+	return WriteHeader(w, 1, FileHeader{Name: filename, Size: fileSize, Checksum: checksum[:]})
+}
+
+// ReadFileHeader reads a version 1 header from the connection
+func ReadFileHeader(r io.Reader) (string, int64, [32]byte, error) {
+	var checksum [32]byte
+	h, err := ReadHeader(r, 1)
+	copy(checksum[:], h.Checksum)
+	return h.Name, h.Size, checksum, err
+}
+
+// ErrChecksumAlgoMismatch is returned when a header's checksum algorithm
+// isn't the one negotiated for the connection
+var ErrChecksumAlgoMismatch = errors.New("checksum algorithm mismatch")
+
+// CheckAlgo rejects a header whose checksum doesn't use the algorithm agreed
+// in the hello, so a peer can't silently switch to a weaker one
+func (s Session) CheckAlgo(h FileHeader) error {
+	if h.Algo != s.Algo {
+		return fmt.Errorf("%w: negotiated %s, header uses %s", ErrChecksumAlgoMismatch, s.Algo, h.Algo)
+	}
+	return nil
+}
+
+// WriteHeader sends the metadata in the wire format of the given version
+func WriteHeader(w io.Writer, version uint8, h FileHeader) error {
+	if err := ValidateFilename(h.Name); err != nil {
+		return err
+	}
+	if h.Size < 0 {
+		return fmt.Errorf("negative file size %d", h.Size)
+	}
+
 	// 1. Send Filename Length
-	if err := binary.Write(w, binary.LittleEndian, uint32(len(filename))); err != nil {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(h.Name))); err != nil {
 		return fmt.Errorf("failed to write filename length: %v", err)
 	}
 	
 	// 2. Send File Size
-	if err := binary.Write(w, binary.LittleEndian, fileSize); err != nil {
+	if err := binary.Write(w, binary.LittleEndian, h.Size); err != nil {
 		return fmt.Errorf("failed to write file size: %v", err)
 	}
 
-	// 3. Send Checksum
-	if _, err := w.Write(checksum[:]); err != nil {
+	// 3. Send Checksum (algorithm id and digest length first from v3)
+	if len(h.Checksum) != h.Algo.Size() && !(version >= 10 && len(h.Checksum) == 0) {
+		return fmt.Errorf("%d-byte checksum for %s", len(h.Checksum), h.Algo)
+	}
+	if version >= 3 {
+		if _, err := w.Write([]byte{uint8(h.Algo), uint8(len(h.Checksum))}); err != nil {
+			return fmt.Errorf("failed to write checksum algorithm: %v", err)
+		}
+	} else if h.Algo != ChecksumSHA256 {
+		return fmt.Errorf("%w: protocol v%d only carries sha256", ErrUnsupportedChecksum, version)
+	}
+	if _, err := w.Write(h.Checksum); err != nil {
 		return fmt.Errorf("failed to write checksum: %v", err)
 	}
 
-	// 4. Send Filename
-	if _, err := w.Write([]byte(filename)); err != nil {
+	// 4. Send Modification Time and Mode (v2+)
+	if version >= 2 {
+		if err := binary.Write(w, binary.LittleEndian, h.ModTime); err != nil {
+			return fmt.Errorf("failed to write modification time: %v", err)
+		}
+		if err := binary.Write(w, binary.LittleEndian, h.Mode); err != nil {
+			return fmt.Errorf("failed to write mode: %v", err)
+		}
+	}
+
+	// 5. Send Filename
+	if _, err := w.Write([]byte(h.Name)); err != nil {
 		return fmt.Errorf("failed to write filename: %v", err)
 	}
 
 	return nil
 }
 
-// ReadFileHeader reads the metadata from the connection
-func ReadFileHeader(r io.Reader) (string, int64, [32]byte, error) {
+// ReadHeader reads the metadata in the wire format of the given version
+func ReadHeader(r io.Reader, version uint8) (FileHeader, error) {
+	var h FileHeader
+
 	// 1. Read Filename Length
 	var nameLen uint32
 	if err := binary.Read(r, binary.LittleEndian, &nameLen); err != nil {
-		return "", 0, [32]byte{}, fmt.Errorf("failed to read filename length: %v", err)
+		return h, fmt.Errorf("failed to read filename length: %v", err)
 	}
 
 	// 2. Read File Size
-	var fileSize int64
-	if err := binary.Read(r, binary.LittleEndian, &fileSize); err != nil {
-		return "", 0, [32]byte{}, fmt.Errorf("failed to read file size: %v", err)
+	if err := binary.Read(r, binary.LittleEndian, &h.Size); err != nil {
+		return h, fmt.Errorf("failed to read file size: %v", err)
+	}
+	if h.Size < 0 {
+		return h, fmt.Errorf("negative file size %d", h.Size)
 	}
 
-	// 3. Read Checksum
-	var checksum [32]byte
-	if _, err := io.ReadFull(r, checksum[:]); err != nil {
-		return "", 0, [32]byte{}, fmt.Errorf("failed to read checksum: %v", err)
+	// 3. Read Checksum (algorithm id and digest length first from v3)
+	digestLen := uint8(sha256.Size)
+	if version >= 3 {
+		var algo [2]byte
+		if _, err := io.ReadFull(r, algo[:]); err != nil {
+			return h, fmt.Errorf("failed to read checksum algorithm: %v", err)
+		}
+		h.Algo, digestLen = ChecksumAlgo(algo[0]), algo[1]
+		if !h.Algo.Supported() {
+			return h, fmt.Errorf("%w: %d", ErrUnsupportedChecksum, algo[0])
+		}
+		if int(digestLen) != h.Algo.Size() && !(version >= 10 && digestLen == 0) {
+			return h, fmt.Errorf("%d-byte checksum for %s", digestLen, h.Algo)
+		}
+	}
+	h.Checksum = make([]byte, digestLen)
+	if _, err := io.ReadFull(r, h.Checksum); err != nil {
+		return h, fmt.Errorf("failed to read checksum: %v", err)
+	}
+
+	// 4. Read Modification Time and Mode (v2+)
+	if version >= 2 {
+		if err := binary.Read(r, binary.LittleEndian, &h.ModTime); err != nil {
+			return h, fmt.Errorf("failed to read modification time: %v", err)
+		}
+		if err := binary.Read(r, binary.LittleEndian, &h.Mode); err != nil {
+			return h, fmt.Errorf("failed to read mode: %v", err)
+		}
 	}
 
-	// 4. Read Filename
+	// 5. Read Filename (length checked before allocating)
+	if nameLen > MaxFilenameLen {
+		return h, fmt.Errorf("filename length %d exceeds maximum %d", nameLen, MaxFilenameLen)
+	}
 	nameBuf := make([]byte, nameLen)
 	if _, err := io.ReadFull(r, nameBuf); err != nil {
-		return "", 0, [32]byte{}, fmt.Errorf("failed to read filename: %v", err)
+		return h, fmt.Errorf("failed to read filename: %v", err)
+	}
+	if err := ValidateFilename(string(nameBuf)); err != nil {
+		return h, err
 	}
+	h.Name = string(nameBuf)
+
+	return h, nil
+}
+
+// PSKEnv is the environment variable the client and server read their
+// pre-shared key from when -psk isn't given
+const PSKEnv = "GOPHER_FS_PSK"
+
+// ErrAuthFailed is returned when the client's answer to the OpAuth
+// challenge doesn't prove it knows the server's pre-shared key
+var ErrAuthFailed = errors.New("authentication failed")
+
+// authMAC is the answer to nonce for a peer holding psk
+func authMAC(psk, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, psk)
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+// ClientAuth sends OpAuth and answers the server's challenge with psk. A
+// rejected answer is reported as ErrAuthFailed.
+func ClientAuth(rw io.ReadWriter, psk []byte) error {
+	if _, err := rw.Write([]byte{OpAuth}); err != nil {
+		return fmt.Errorf("failed to send auth request: %v", err)
+	}
+	nonce := make([]byte, NonceSize)
+	if _, err := io.ReadFull(rw, nonce); err != nil {
+		return fmt.Errorf("failed to read auth challenge: %v", err)
+	}
+	if _, err := rw.Write(authMAC(psk, nonce)); err != nil {
+		return fmt.Errorf("failed to send auth response: %v", err)
+	}
+	status, msg, err := ReadAck(rw)
+	if err != nil {
+		return err
+	}
+	if status != AckOK {
+		return fmt.Errorf("%w: %s", ErrAuthFailed, msg)
+	}
+	return nil
+}
+
+// AcceptAuth completes authentication on the server after OpAuth has been
+// read: it sends a fresh nonce, checks the client's answer against psk and
+// acknowledges either way, returning ErrAuthFailed for a wrong answer. An
+// empty psk accepts any answer, so clients that have a key can still use
+// servers that don't require one.
+func AcceptAuth(rw io.ReadWriter, psk []byte) error {
+	nonce := make([]byte, NonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate auth challenge: %v", err)
+	}
+	if _, err := rw.Write(nonce); err != nil {
+		return fmt.Errorf("failed to send auth challenge: %v", err)
+	}
+	answer := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(rw, answer); err != nil {
+		return fmt.Errorf("failed to read auth response: %v", err)
+	}
+	if len(psk) > 0 && !hmac.Equal(answer, authMAC(psk, nonce)) {
+		WriteAck(rw, AckRejected, ErrAuthFailed.Error())
+		return ErrAuthFailed
+	}
+	return WriteAck(rw, AckOK, "")
+}
+
+// Session is what the hello handshake agreed on for one connection
+type Session struct {
+	Version uint8
+	Algo    ChecksumAlgo
+
+	// Compression is how OpDownload and OpUpload data is sent; CodecNone
+	// before v8
+	Compression Compression
+}
+
+// DefaultSession applies to peers that skip the hello
+var DefaultSession = Session{Version: 1, Algo: ChecksumSHA256}
+
+// ClientHello sends OpHello with our ProtocolVersion and returns the version
+// the server agreed to. From v3 on it also asks for algo as the checksum
+// algorithm; the server may fall back to SHA-256 if it doesn't support it.
+// The caller then sends the real opcode.
+func ClientHello(rw io.ReadWriter, algo ChecksumAlgo) (Session, error) {
+	return ClientHelloCompressed(rw, algo, Compression{})
+}
+
+// ClientHelloCompressed is ClientHello that, from v8 on, also asks for
+// comp. The server uses no compression if it doesn't support the codec.
+func ClientHelloCompressed(rw io.ReadWriter, algo ChecksumAlgo, comp Compression) (Session, error) {
+	sess := DefaultSession
+	if _, err := rw.Write([]byte{OpHello, ProtocolVersion}); err != nil {
+		return sess, fmt.Errorf("failed to send hello: %v", err)
+	}
+	var version uint8
+	if err := binary.Read(rw, binary.LittleEndian, &version); err != nil {
+		return sess, fmt.Errorf("failed to read hello reply: %v", err)
+	}
+	if version < 1 || version > ProtocolVersion {
+		return sess, fmt.Errorf("server chose unsupported protocol version %d", version)
+	}
+	sess.Version = version
+	if version < 3 {
+		return sess, nil
+	}
+
+	if _, err := rw.Write([]byte{uint8(algo)}); err != nil {
+		return sess, fmt.Errorf("failed to send checksum algorithm: %v", err)
+	}
+	if err := binary.Read(rw, binary.LittleEndian, &sess.Algo); err != nil {
+		return sess, fmt.Errorf("failed to read checksum algorithm reply: %v", err)
+	}
+	if sess.Algo != algo && sess.Algo != ChecksumSHA256 {
+		return sess, fmt.Errorf("%w: asked for %s, server chose %s", ErrChecksumAlgoMismatch, algo, sess.Algo)
+	}
+	if version < 8 {
+		return sess, nil
+	}
+
+	if _, err := rw.Write([]byte{uint8(comp.Codec), comp.Level}); err != nil {
+		return sess, fmt.Errorf("failed to send compression: %v", err)
+	}
+	var codec Codec
+	if err := binary.Read(rw, binary.LittleEndian, &codec); err != nil {
+		return sess, fmt.Errorf("failed to read compression reply: %v", err)
+	}
+	switch codec {
+	case comp.Codec:
+		sess.Compression = comp
+	case CodecNone:
+	default:
+		return sess, fmt.Errorf("asked for %s compression, server chose %s", comp.Codec, codec)
+	}
+	return sess, nil
+}
+
+// AcceptHello completes the handshake on the server after OpHello has been
+// read: it reads the client's version, replies with the highest version
+// both sides support, from v3 on settles the checksum algorithm and from
+// v8 on the compression.
+func AcceptHello(rw io.ReadWriter) (Session, error) {
+	sess := DefaultSession
+	var clientVersion uint8
+	if err := binary.Read(rw, binary.LittleEndian, &clientVersion); err != nil {
+		return sess, fmt.Errorf("failed to read client version: %v", err)
+	}
+	version := clientVersion
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	if version < 1 {
+		return sess, fmt.Errorf("client sent invalid protocol version %d", clientVersion)
+	}
+	if err := binary.Write(rw, binary.LittleEndian, version); err != nil {
+		return sess, fmt.Errorf("failed to send hello reply: %v", err)
+	}
+	sess.Version = version
+	if version < 3 {
+		return sess, nil
+	}
+
+	var algo ChecksumAlgo
+	if err := binary.Read(rw, binary.LittleEndian, &algo); err != nil {
+		return sess, fmt.Errorf("failed to read checksum algorithm: %v", err)
+	}
+	if algo.Supported() {
+		sess.Algo = algo
+	}
+	if err := binary.Write(rw, binary.LittleEndian, sess.Algo); err != nil {
+		return sess, fmt.Errorf("failed to send checksum algorithm reply: %v", err)
+	}
+	if version < 8 {
+		return sess, nil
+	}
+
+	var comp [2]byte
+	if _, err := io.ReadFull(rw, comp[:]); err != nil {
+		return sess, fmt.Errorf("failed to read compression: %v", err)
+	}
+	// A codec or level this build doesn't know means no compression
+	if c := (Compression{Codec: Codec(comp[0]), Level: comp[1]}); c.valid() {
+		sess.Compression = c
+	}
+	if err := binary.Write(rw, binary.LittleEndian, sess.Compression.Codec); err != nil {
+		return sess, fmt.Errorf("failed to send compression reply: %v", err)
+	}
+	return sess, nil
+}
+
+// WriteAck sends an upload acknowledgement: a status byte, then a uint16
+// message length and the message (empty on success). Longer messages are
+// truncated to MaxAckMessageLen.
+func WriteAck(w io.Writer, status uint8, msg string) error {
+	if len(msg) > MaxAckMessageLen {
+		msg = msg[:MaxAckMessageLen]
+	}
+	if err := binary.Write(w, binary.LittleEndian, status); err != nil {
+		return fmt.Errorf("failed to write ack status: %v", err)
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint16(len(msg))); err != nil {
+		return fmt.Errorf("failed to write ack message length: %v", err)
+	}
+	if _, err := io.WriteString(w, msg); err != nil {
+		return fmt.Errorf("failed to write ack message: %v", err)
+	}
+	return nil
+}
+
+// ReadAck reads an upload acknowledgement sent with WriteAck
+func ReadAck(r io.Reader) (uint8, string, error) {
+	var status uint8
+	if err := binary.Read(r, binary.LittleEndian, &status); err != nil {
+		return 0, "", fmt.Errorf("failed to read ack status: %v", err)
+	}
+	var msgLen uint16
+	if err := binary.Read(r, binary.LittleEndian, &msgLen); err != nil {
+		return 0, "", fmt.Errorf("failed to read ack message length: %v", err)
+	}
+	if msgLen > MaxAckMessageLen {
+		return 0, "", fmt.Errorf("ack message length %d exceeds maximum %d", msgLen, MaxAckMessageLen)
+	}
+	msg := make([]byte, msgLen)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return 0, "", fmt.Errorf("failed to read ack message: %v", err)
+	}
+	return status, string(msg), nil
+}
+
+// FileEntry describes one file in an OpList reply
+type FileEntry struct {
+	Name    string // slash-separated, relative to the server's storage root
+	Size    int64
+	ModTime int64 // unix nanoseconds
+
+	// Partial marks an upload still in progress (see ListPartial): Size is
+	// what the file will be, Received how much of it has arrived and
+	// ModTime when the last of it did. Both are zero for complete files.
+	Partial  bool
+	Received int64
+}
+
+// WriteList sends a uint32 entry count, then for each entry its
+// length-prefixed name, size and modification time
+func WriteList(w io.Writer, entries []FileEntry) error {
+	return writeList(w, entries, false)
+}
+
+// WritePartialList is WriteList for a reply to OpList with ListPartial:
+// each entry's modification time is followed by a byte that is 1 for an
+// upload in progress, and the int64 bytes of it received so far
+func WritePartialList(w io.Writer, entries []FileEntry) error {
+	return writeList(w, entries, true)
+}
+
+func writeList(w io.Writer, entries []FileEntry, partial bool) error {
+	if len(entries) > MaxListEntries {
+		return fmt.Errorf("%d list entries exceeds maximum %d", len(entries), MaxListEntries)
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(entries))); err != nil {
+		return fmt.Errorf("failed to write entry count: %v", err)
+	}
+	for _, e := range entries {
+		if err := ValidateFilename(e.Name); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, uint32(len(e.Name))); err != nil {
+			return fmt.Errorf("failed to write entry name length: %v", err)
+		}
+		if _, err := io.WriteString(w, e.Name); err != nil {
+			return fmt.Errorf("failed to write entry name: %v", err)
+		}
+		if err := binary.Write(w, binary.LittleEndian, [2]int64{e.Size, e.ModTime}); err != nil {
+			return fmt.Errorf("failed to write entry metadata: %v", err)
+		}
+		if !partial {
+			continue
+		}
+		var flag uint8
+		if e.Partial {
+			flag = 1
+		}
+		if err := binary.Write(w, binary.LittleEndian, flag); err != nil {
+			return fmt.Errorf("failed to write entry progress: %v", err)
+		}
+		if err := binary.Write(w, binary.LittleEndian, e.Received); err != nil {
+			return fmt.Errorf("failed to write entry progress: %v", err)
+		}
+	}
+	return nil
+}
+
+// ReadList reads a file list sent with WriteList
+func ReadList(r io.Reader) ([]FileEntry, error) {
+	return readList(r, false)
+}
+
+// ReadPartialList reads a file list sent with WritePartialList
+func ReadPartialList(r io.Reader) ([]FileEntry, error) {
+	return readList(r, true)
+}
+
+func readList(r io.Reader, partial bool) ([]FileEntry, error) {
+	var count uint32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, fmt.Errorf("failed to read entry count: %v", err)
+	}
+	if count > MaxListEntries {
+		return nil, fmt.Errorf("%d list entries exceeds maximum %d", count, MaxListEntries)
+	}
+	entries := make([]FileEntry, 0, count)
+	for i := uint32(0); i < count; i++ {
+		var nameLen uint32
+		if err := binary.Read(r, binary.LittleEndian, &nameLen); err != nil {
+			return nil, fmt.Errorf("failed to read entry name length: %v", err)
+		}
+		if nameLen > MaxFilenameLen {
+			return nil, fmt.Errorf("filename length %d exceeds maximum %d", nameLen, MaxFilenameLen)
+		}
+		name := make([]byte, nameLen)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return nil, fmt.Errorf("failed to read entry name: %v", err)
+		}
+		if err := ValidateFilename(string(name)); err != nil {
+			return nil, err
+		}
+		var meta [2]int64
+		if err := binary.Read(r, binary.LittleEndian, &meta); err != nil {
+			return nil, fmt.Errorf("failed to read entry metadata: %v", err)
+		}
+		e := FileEntry{Name: string(name), Size: meta[0], ModTime: meta[1]}
+		if partial {
+			var progress struct {
+				Partial  uint8
+				Received int64
+			}
+			if err := binary.Read(r, binary.LittleEndian, &progress); err != nil {
+				return nil, fmt.Errorf("failed to read entry progress: %v", err)
+			}
+			e.Partial, e.Received = progress.Partial == 1, progress.Received
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// WriteDirEntry announces the next file of a directory download: a 1 byte
+// followed by its header. The file's content follows.
+func WriteDirEntry(w io.Writer, version uint8, h FileHeader) error {
+	if _, err := w.Write([]byte{1}); err != nil {
+		return err
+	}
+	return WriteHeader(w, version, h)
+}
+
+// WriteDirEnd ends a directory download with a 0 byte
+func WriteDirEnd(w io.Writer) error {
+	_, err := w.Write([]byte{0})
+	return err
+}
+
+// ReadDirEntry reads the next file header of a directory download. It
+// returns io.EOF once the server has sent WriteDirEnd.
+func ReadDirEntry(r io.Reader, version uint8) (FileHeader, error) {
+	var more [1]byte
+	if _, err := io.ReadFull(r, more[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF // the end marker is missing
+		}
+		return FileHeader{}, err
+	}
+	switch more[0] {
+	case 0:
+		return FileHeader{}, io.EOF
+	case 1:
+		return ReadHeader(r, version)
+	}
+	return FileHeader{}, fmt.Errorf("invalid directory entry marker %d", more[0])
+}
+
+// ErrUnsafePath is returned for names that would escape the storage root
+var ErrUnsafePath = errors.New("unsafe path")
+
+// CleanPath normalizes a slash-separated relative path sent in a header
+// (e.g. "photos/2024/a.png") and rejects absolute paths and any ".."
+// component, so the result can be joined safely under a storage root.
+func CleanPath(name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if name == "" || strings.HasPrefix(name, "/") {
+		return "", fmt.Errorf("%w: %q", ErrUnsafePath, name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("%w: %q", ErrUnsafePath, name)
+		}
+	}
+	cleaned := path.Clean(name)
+	if cleaned == "." {
+		return "", fmt.Errorf("%w: %q", ErrUnsafePath, name)
+	}
+	return cleaned, nil
+}
 
-	return string(nameBuf), fileSize, checksum, nil
+// NormalizeName puts name in Unicode normalization form C and drops
+// control characters, so names that look the same compare equal: macOS
+// tends to produce decomposed names ("e" + U+0301) where Linux keeps the
+// composed "é" that was typed. Names are otherwise left alone; pass the
+// result to CleanPath as usual.
+func NormalizeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, norm.NFC.String(name))
 }
@@ -0,0 +1,474 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		size     int64
+	}{
+		{"simple", "report.pdf", 1024},
+		{"empty filename", "", 10},
+		{"utf8 filename", "résumé-日本語-🐹.txt", 42},
+		{"zero size", "empty.bin", 0},
+		{"relative path", "photos/2024/cat.png", 7},
+		{"max length filename", strings.Repeat("a", MaxFilenameLen), 1 << 40},
+		{"largest size", "huge.bin", math.MaxInt64},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checksum := sha256.Sum256([]byte(tt.filename))
+
+			var buf bytes.Buffer
+			if err := SendFileHeader(&buf, tt.filename, tt.size, checksum); err != nil {
+				t.Fatalf("SendFileHeader: %v", err)
+			}
+
+			gotName, gotSize, gotChecksum, err := ReadFileHeader(&buf)
+			if err != nil {
+				t.Fatalf("ReadFileHeader: %v", err)
+			}
+			if gotName != tt.filename {
+				t.Errorf("filename = %q, want %q", gotName, tt.filename)
+			}
+			if gotSize != tt.size {
+				t.Errorf("size = %d, want %d", gotSize, tt.size)
+			}
+			if gotChecksum != checksum {
+				t.Errorf("checksum = %x, want %x", gotChecksum, checksum)
+			}
+			if buf.Len() != 0 {
+				t.Errorf("%d bytes left unread after header", buf.Len())
+			}
+		})
+	}
+}
+
+func TestHeaderV2RoundTrip(t *testing.T) {
+	sum := sha256.Sum256([]byte("notes"))
+	want := FileHeader{
+		Name:     "notes.txt",
+		Size:     99,
+		Checksum: sum[:],
+		ModTime:  1700000000123456789,
+		Mode:     0640,
+	}
+
+	var buf bytes.Buffer
+	if err := WriteHeader(&buf, 2, want); err != nil {
+		t.Fatalf("WriteHeader: %v", err)
+	}
+	got, err := ReadHeader(&buf, 2)
+	if err != nil {
+		t.Fatalf("ReadHeader: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// A v1 header drops the metadata fields
+	buf.Reset()
+	WriteHeader(&buf, 1, want)
+	got, err = ReadHeader(&buf, 1)
+	if err != nil {
+		t.Fatalf("ReadHeader v1: %v", err)
+	}
+	if got.ModTime != 0 || got.Mode != 0 || got.Name != want.Name {
+		t.Errorf("v1 header = %+v", got)
+	}
+}
+
+func TestHeaderV3ChecksumAlgorithms(t *testing.T) {
+	for _, algo := range []ChecksumAlgo{ChecksumSHA256, ChecksumSHA512, ChecksumBLAKE3} {
+		t.Run(algo.String(), func(t *testing.T) {
+			sum, err := algo.Compute(strings.NewReader("payload"))
+			if err != nil {
+				t.Fatalf("Compute: %v", err)
+			}
+			want := FileHeader{Name: "a.bin", Size: 7, Algo: algo, Checksum: sum, ModTime: 1, Mode: 0600}
+
+			var buf bytes.Buffer
+			if err := WriteHeader(&buf, 3, want); err != nil {
+				t.Fatalf("WriteHeader: %v", err)
+			}
+			got, err := ReadHeader(&buf, 3)
+			if err != nil {
+				t.Fatalf("ReadHeader: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+
+	// Only SHA-256 fits the fixed checksum field of older versions
+	sum, _ := ChecksumSHA512.Compute(strings.NewReader("x"))
+	h := FileHeader{Name: "a", Algo: ChecksumSHA512, Checksum: sum}
+	if err := WriteHeader(io.Discard, 2, h); !errors.Is(err, ErrUnsupportedChecksum) {
+		t.Errorf("v2 SHA-512 header: err = %v, want ErrUnsupportedChecksum", err)
+	}
+}
+
+func TestHeaderV10TrailingChecksum(t *testing.T) {
+	want := FileHeader{Name: "piped.bin", Size: 7, Algo: ChecksumBLAKE3, Checksum: []byte{}, ModTime: 1, Mode: 0600}
+	var buf bytes.Buffer
+	if err := WriteHeader(&buf, 10, want); err != nil {
+		t.Fatalf("WriteHeader: %v", err)
+	}
+	got, err := ReadHeader(&buf, 10)
+	if err != nil {
+		t.Fatalf("ReadHeader: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// Earlier versions always carry the checksum up front
+	if err := WriteHeader(io.Discard, 9, want); err == nil {
+		t.Error("v9 header without a checksum was written")
+	}
+	buf.Reset()
+	WriteHeader(&buf, 10, want)
+	if _, err := ReadHeader(&buf, 9); err == nil {
+		t.Error("v9 header without a checksum was read")
+	}
+}
+
+func TestCheckAlgoRejectsMismatch(t *testing.T) {
+	sess := Session{Version: 3, Algo: ChecksumBLAKE3}
+	sum, _ := ChecksumSHA256.Compute(strings.NewReader("x"))
+	if err := sess.CheckAlgo(FileHeader{Algo: ChecksumSHA256, Checksum: sum}); !errors.Is(err, ErrChecksumAlgoMismatch) {
+		t.Errorf("err = %v, want ErrChecksumAlgoMismatch", err)
+	}
+	if err := sess.CheckAlgo(FileHeader{Algo: ChecksumBLAKE3}); err != nil {
+		t.Errorf("matching algorithm: %v", err)
+	}
+}
+
+func TestHelloNegotiation(t *testing.T) {
+	tests := []struct {
+		hello     []byte // client's bytes after the opcode the server already consumed
+		want      Session
+		wantReply []byte
+	}{
+		{[]byte{1}, Session{Version: 1, Algo: ChecksumSHA256}, []byte{1}},
+		{[]byte{2}, Session{Version: 2, Algo: ChecksumSHA256}, []byte{2}},
+		{[]byte{3, byte(ChecksumBLAKE3)}, Session{Version: 3, Algo: ChecksumBLAKE3}, []byte{3, byte(ChecksumBLAKE3)}},
+		{[]byte{3, 200}, Session{Version: 3, Algo: ChecksumSHA256}, []byte{3, byte(ChecksumSHA256)}},
+		{[]byte{7, byte(ChecksumSHA512)}, Session{Version: 7, Algo: ChecksumSHA512}, []byte{7, byte(ChecksumSHA512)}},
+		{
+			[]byte{ProtocolVersion + 5, byte(ChecksumSHA512), byte(CodecZstd), 3},
+			Session{Version: ProtocolVersion, Algo: ChecksumSHA512, Compression: Compression{CodecZstd, 3}},
+			[]byte{ProtocolVersion, byte(ChecksumSHA512), byte(CodecZstd)},
+		},
+		// An unknown codec or a level out of range falls back to none
+		{[]byte{8, 0, 200, 0}, Session{Version: 8, Algo: ChecksumSHA256}, []byte{8, 0, byte(CodecNone)}},
+		{[]byte{8, 0, byte(CodecGzip), 12}, Session{Version: 8, Algo: ChecksumSHA256}, []byte{8, 0, byte(CodecNone)}},
+	}
+	for _, tt := range tests {
+		in := bytes.NewBuffer(tt.hello)
+		var out bytes.Buffer
+		got, err := AcceptHello(struct {
+			io.Reader
+			io.Writer
+		}{in, &out})
+		if err != nil {
+			t.Fatalf("AcceptHello(%v): %v", tt.hello, err)
+		}
+		if got != tt.want || !bytes.Equal(out.Bytes(), tt.wantReply) {
+			t.Errorf("AcceptHello(%v) = %+v, reply %v; want %+v, %v", tt.hello, got, out.Bytes(), tt.want, tt.wantReply)
+		}
+	}
+}
+
+// rawHeader builds a header frame by hand so tests can forge fields
+// SendFileHeader would refuse to produce
+func rawHeader(nameLen uint32, name string) []byte {
+	return rawHeaderSize(nameLen, name, 1)
+}
+
+func rawHeaderSize(nameLen uint32, name string, size int64) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, nameLen)
+	binary.Write(&buf, binary.LittleEndian, size)
+	buf.Write(make([]byte, 32))
+	buf.WriteString(name)
+	return buf.Bytes()
+}
+
+func TestReadFileHeaderRejectsOversizedLength(t *testing.T) {
+	for _, nameLen := range []uint32{MaxFilenameLen + 1, 1 << 31, ^uint32(0)} {
+		// No name bytes follow: an implementation that allocates first
+		// would try to grab up to 4GB before noticing the short read
+		_, _, _, err := ReadFileHeader(bytes.NewReader(rawHeader(nameLen, "")))
+		if err == nil || !strings.Contains(err.Error(), "exceeds maximum") {
+			t.Errorf("nameLen %d: err = %v, want length error", nameLen, err)
+		}
+	}
+}
+
+func TestFileHeaderRejectsNegativeSize(t *testing.T) {
+	// A size over 8 EiB read as uint64 would come out negative; it must
+	// never reach LimitReader or a length comparison
+	for _, size := range []int64{-1, math.MinInt64} {
+		if _, _, _, err := ReadFileHeader(bytes.NewReader(rawHeaderSize(1, "a", size))); err == nil {
+			t.Errorf("ReadFileHeader accepted size %d", size)
+		}
+		var buf bytes.Buffer
+		if err := SendFileHeader(&buf, "a", size, [32]byte{}); err == nil || buf.Len() != 0 {
+			t.Errorf("SendFileHeader(size %d) = %v after %d bytes, want an error before writing", size, err, buf.Len())
+		}
+	}
+}
+
+func TestReadFileHeaderRejectsUnsafeNames(t *testing.T) {
+	for _, name := range []string{
+		"../../etc/passwd",
+		"a/../../b",
+		"/etc/passwd",
+		"evil\x00.txt",
+		`..\windows\system32`,
+	} {
+		_, _, _, err := ReadFileHeader(bytes.NewReader(rawHeader(uint32(len(name)), name)))
+		if !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("%q: err = %v, want ErrUnsafePath", name, err)
+		}
+	}
+}
+
+func TestSendFileHeaderRejectsUnsafeNames(t *testing.T) {
+	var buf bytes.Buffer
+	if err := SendFileHeader(&buf, "../secret", 1, [32]byte{}); !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("err = %v, want ErrUnsafePath", err)
+	}
+	if err := SendFileHeader(&buf, strings.Repeat("a", MaxFilenameLen+1), 1, [32]byte{}); err == nil {
+		t.Error("expected error for oversized filename")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("rejected header still wrote %d bytes", buf.Len())
+	}
+}
+
+func TestReadFileHeaderTruncated(t *testing.T) {
+	full := rawHeader(5, "hello")
+	for i := 0; i < len(full); i++ {
+		if _, _, _, err := ReadFileHeader(bytes.NewReader(full[:i])); err == nil {
+			t.Errorf("truncated at %d bytes: expected error", i)
+		}
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"a.txt", "a.txt", false},
+		{"dir/sub/a.txt", "dir/sub/a.txt", false},
+		{"./dir//a.txt", "dir/a.txt", false},
+		{`dir\a.txt`, "dir/a.txt", false},
+		{"", "", true},
+		{".", "", true},
+		{"/abs", "", true},
+		{"../up", "", true},
+		{"dir/../../up", "", true},
+	}
+	for _, tt := range tests {
+		got, err := CleanPath(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("CleanPath(%q) err = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("CleanPath(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeName(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"caf\u00e9.txt", "caf\u00e9.txt"},  // NFC already
+		{"cafe\u0301.txt", "caf\u00e9.txt"}, // NFD
+		{"r\u00e9sum\u00e9s/cafe\u0301.txt", "r\u00e9sum\u00e9s/caf\u00e9.txt"},
+		{"line\nbreak\t.txt", "linebreak.txt"},
+		{"bell\x07\u0085.txt", "bell.txt"},
+		{"\uff21.txt", "\uff21.txt"}, // compatibility forms are kept
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := NormalizeName(tt.in); got != tt.want {
+			t.Errorf("NormalizeName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func FuzzReadFileHeader(f *testing.F) {
+	var buf bytes.Buffer
+	SendFileHeader(&buf, "seed.txt", 123, sha256.Sum256([]byte("seed")))
+	f.Add(buf.Bytes())
+	f.Add(rawHeader(^uint32(0), ""))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		name, _, _, err := ReadFileHeader(bytes.NewReader(data))
+		if err == nil && len(name) > MaxFilenameLen {
+			t.Fatalf("accepted %d-byte filename", len(name))
+		}
+	})
+}
+
+func TestAckRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteAck(&buf, AckChecksumMismatch, "bad data"); err != nil {
+		t.Fatalf("WriteAck: %v", err)
+	}
+	status, msg, err := ReadAck(&buf)
+	if err != nil || status != AckChecksumMismatch || msg != "bad data" {
+		t.Errorf("ReadAck = %d, %q, %v", status, msg, err)
+	}
+
+	// Oversized messages are truncated rather than rejected
+	buf.Reset()
+	WriteAck(&buf, AckError, strings.Repeat("x", MaxAckMessageLen+10))
+	if _, msg, err := ReadAck(&buf); err != nil || len(msg) != MaxAckMessageLen {
+		t.Errorf("long message: len %d, err %v", len(msg), err)
+	}
+}
+
+func TestListRoundTrip(t *testing.T) {
+	want := []FileEntry{
+		{Name: "a.log", Size: 3, ModTime: 1700000000000000000},
+		{Name: "logs/b.log", Size: 0, ModTime: 1},
+	}
+	var buf bytes.Buffer
+	if err := WriteList(&buf, want); err != nil {
+		t.Fatalf("WriteList: %v", err)
+	}
+	got, err := ReadList(&buf)
+	if err != nil {
+		t.Fatalf("ReadList: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// With uploads in progress among them
+	want = append(want, FileEntry{Name: "big.iso", Size: 1 << 30, ModTime: 2, Partial: true, Received: 1 << 20})
+	buf.Reset()
+	if err := WritePartialList(&buf, want); err != nil {
+		t.Fatalf("WritePartialList: %v", err)
+	}
+	if got, err = ReadPartialList(&buf); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("partial list: got %+v, %v; want %+v", got, err, want)
+	}
+
+	// A forged count must not trigger a huge allocation
+	buf.Reset()
+	binary.Write(&buf, binary.LittleEndian, uint32(MaxListEntries+1))
+	if _, err := ReadList(&buf); err == nil {
+		t.Error("expected error for oversized entry count")
+	}
+}
+
+func TestManifestRoundTrip(t *testing.T) {
+	sumA, sumB := sha256.Sum256([]byte("a")), sha256.Sum256([]byte("bb"))
+	files := []ManifestEntry{
+		{Name: "photos/b.png", Size: 2, Algo: ChecksumSHA256, Checksum: sumB[:]},
+		{Name: "photos/a.png", Size: 1, Algo: ChecksumSHA256, Checksum: sumA[:]},
+	}
+	want := NewManifest(files)
+	if want.Files[0].Name != "photos/a.png" {
+		t.Errorf("NewManifest didn't sort by name: %+v", want.Files)
+	}
+	if again := NewManifest([]ManifestEntry{files[1], files[0]}); again.ID != want.ID {
+		t.Errorf("ID depends on order: %s vs %s", again.ID, want.ID)
+	}
+	files[0].Size = 3
+	if changed := NewManifest(files); changed.ID == want.ID {
+		t.Error("ID unchanged after a file's size changed")
+	}
+
+	var buf bytes.Buffer
+	if err := WriteManifest(&buf, want); err != nil {
+		t.Fatalf("WriteManifest: %v", err)
+	}
+	if !strings.Contains(buf.String(), `"algo":"sha256","checksum":"`) {
+		t.Errorf("checksums should be written as a named algorithm and hex: %s", buf.String())
+	}
+	got, err := ReadManifest(&buf)
+	if err != nil {
+		t.Fatalf("ReadManifest: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestReadManifestRejects(t *testing.T) {
+	sum := sha256.Sum256(nil)
+	ok := ManifestEntry{Name: "a.txt", Algo: ChecksumSHA256, Checksum: sum[:]}
+	for name, m := range map[string]Manifest{
+		"no id":          {Files: []ManifestEntry{ok}},
+		"unsafe name":    {ID: "x", Files: []ManifestEntry{{Name: "../a.txt", Algo: ChecksumSHA256, Checksum: sum[:]}}},
+		"duplicate":      {ID: "x", Files: []ManifestEntry{ok, ok}},
+		"negative size":  {ID: "x", Files: []ManifestEntry{{Name: "a.txt", Size: -1, Algo: ChecksumSHA256, Checksum: sum[:]}}},
+		"short checksum": {ID: "x", Files: []ManifestEntry{{Name: "a.txt", Algo: ChecksumSHA512, Checksum: sum[:]}}},
+	} {
+		var buf bytes.Buffer
+		if err := WriteManifest(&buf, m); err != nil {
+			t.Fatalf("%s: WriteManifest: %v", name, err)
+		}
+		if _, err := ReadManifest(&buf); !errors.Is(err, ErrInvalidManifest) {
+			t.Errorf("%s: ReadManifest = %v, want ErrInvalidManifest", name, err)
+		}
+	}
+
+	// A forged length must not trigger a huge allocation
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(MaxManifestLen+1))
+	if _, err := ReadManifest(&buf); err == nil {
+		t.Error("expected error for oversized manifest")
+	}
+}
+
+func TestRestoreMetadata(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.txt")
+	if err := os.WriteFile(path, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := RestoreMetadata(path, FileHeader{ModTime: mtime.UnixNano(), Mode: 0600}); err != nil {
+		t.Fatalf("RestoreMetadata: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(mtime) || info.Mode().Perm() != 0600 {
+		t.Errorf("file has %v, %v; want %v, -rw-------", info.ModTime(), info.Mode().Perm(), mtime)
+	}
+
+	// A v1 header carries neither, so the file is left alone
+	if err := RestoreMetadata(path, FileHeader{}); err != nil {
+		t.Errorf("RestoreMetadata without metadata: %v", err)
+	}
+	if err := RestoreMetadata(filepath.Join(t.TempDir(), "missing"), FileHeader{Mode: 0644}); err == nil {
+		t.Error("RestoreMetadata of a missing file succeeded")
+	}
+}
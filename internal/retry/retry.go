@@ -0,0 +1,44 @@
+package retry
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// stopError marks an error that retrying won't fix
+type stopError struct{ err error }
+
+func (e stopError) Error() string { return e.err.Error() }
+func (e stopError) Unwrap() error { return e.err }
+
+// Stop wraps err so Do returns it immediately instead of trying again
+func Stop(err error) error {
+	return stopError{err}
+}
+
+// Do calls fn up to attempts times, sleeping base, 2*base, 4*base, ...
+// between failures. It returns nil on the first success, otherwise the
+// error of the last attempt annotated with how many attempts were made.
+func Do(attempts int, base time.Duration, fn func() error) error {
+	if attempts < 1 {
+		attempts = 1
+	}
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(base << (i - 1))
+		}
+		if err = fn(); err == nil {
+			return nil
+		}
+		var stop stopError
+		if errors.As(err, &stop) {
+			return stop.err
+		}
+	}
+	if attempts == 1 {
+		return err
+	}
+	return fmt.Errorf("giving up after %d attempts: %w", attempts, err)
+}
@@ -0,0 +1,267 @@
+package security
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted files start with encMagic and a random salt, followed by the
+// content in segments of up to encSegmentSize bytes, each sealed with
+// AES-256-GCM. Every file gets its own key, the HMAC-SHA256 of the salt
+// under the storage key, so segment nonces can simply count: the segment
+// index in the first 11 bytes and, in the last, 1 for the final segment
+// (0 otherwise) so a file cut short at a segment boundary doesn't verify.
+// Segments can be decrypted on their own, which keeps files seekable.
+const (
+	encMagic       = "GFSENC01"
+	encSaltSize    = 16
+	encHeaderSize  = len(encMagic) + encSaltSize
+	encSegmentSize = 64 << 10
+	encTagSize     = 16
+	encSealedSize  = encSegmentSize + encTagSize
+)
+
+// StorageKeySize is the length of the keys DeriveStorageKey returns and
+// NewEncryptWriter and NewDecryptReader take
+const StorageKeySize = 32
+
+// ErrDecrypt is returned for encrypted content that doesn't open with the
+// key given: the key is wrong or the data was tampered with or truncated
+var ErrDecrypt = errors.New("decryption failed: wrong key or damaged data")
+
+// DeriveStorageKey stretches secret into a StorageKeySize key with scrypt.
+// salt should be random and kept with the data; the same secret and salt
+// always give the same key.
+func DeriveStorageKey(secret string, salt []byte) ([]byte, error) {
+	if secret == "" {
+		return nil, errors.New("empty storage secret")
+	}
+	return scrypt.Key([]byte(secret), salt, 1<<15, 8, 1, StorageKeySize)
+}
+
+// fileAEAD returns the cipher for the file whose header carries salt
+func fileAEAD(key, salt []byte) (cipher.AEAD, error) {
+	if len(key) != StorageKeySize {
+		return nil, fmt.Errorf("storage key is %d bytes, want %d", len(key), StorageKeySize)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// segmentNonce is the nonce of segment index, marked if it is the last
+func segmentNonce(index int64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], uint64(index))
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// EncryptedSize is the length of the encrypted file NewEncryptWriter
+// writes for size bytes of content: the header, and a tag per segment
+func EncryptedSize(size int64) int64 {
+	segments := max((size+encSegmentSize-1)/encSegmentSize, 1)
+	return int64(encHeaderSize) + size + segments*encTagSize
+}
+
+// EncryptWriter encrypts what is written to it onto an underlying writer.
+// Close must be called to seal the final segment; without it the output
+// doesn't decrypt.
+type EncryptWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	buf   []byte // plaintext of the segment being filled
+	index int64
+	err   error
+}
+
+// NewEncryptWriter writes the header of a new encrypted file to w and
+// returns a writer for its content under key
+func NewEncryptWriter(w io.Writer, key []byte) (*EncryptWriter, error) {
+	salt := make([]byte, encSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := fileAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, encMagic); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(salt); err != nil {
+		return nil, err
+	}
+	return &EncryptWriter{w: w, aead: aead, buf: make([]byte, 0, encSegmentSize)}, nil
+}
+
+func (e *EncryptWriter) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	written := 0
+	for len(p) > 0 {
+		// A full segment is only sealed once more data shows it isn't the last
+		if len(e.buf) == encSegmentSize {
+			if e.err = e.seal(false); e.err != nil {
+				return written, e.err
+			}
+		}
+		n := copy(e.buf[len(e.buf):encSegmentSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the final segment, which is empty for empty content. It
+// doesn't close the underlying writer.
+func (e *EncryptWriter) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	e.err = e.seal(true)
+	if e.err == nil {
+		e.err = errors.New("write to closed EncryptWriter")
+		return nil
+	}
+	return e.err
+}
+
+func (e *EncryptWriter) seal(final bool) error {
+	sealed := e.aead.Seal(nil, segmentNonce(e.index, final), e.buf, nil)
+	if _, err := e.w.Write(sealed); err != nil {
+		return err
+	}
+	e.index++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+// DecryptReader reads and seeks through the content of an encrypted file,
+// decrypting and verifying a segment at a time. Any segment that doesn't
+// verify fails with ErrDecrypt.
+type DecryptReader struct {
+	r        io.ReadSeeker
+	aead     cipher.AEAD
+	size     int64 // of the content
+	segments int64
+	pos      int64
+
+	cached int64 // index of the segment in plain, -1 for none
+	plain  []byte
+	sealed []byte
+}
+
+// NewDecryptReader opens the encrypted file r under key. The last segment
+// is checked straight away, so a wrong key or a truncated file fails here
+// with ErrDecrypt.
+func NewDecryptReader(r io.ReadSeeker, key []byte) (*DecryptReader, error) {
+	total, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	header := make([]byte, encHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(encMagic)]) != encMagic {
+		return nil, fmt.Errorf("%w: not an encrypted file", ErrDecrypt)
+	}
+	aead, err := fileAEAD(key, header[len(encMagic):])
+	if err != nil {
+		return nil, err
+	}
+
+	// Every segment but the last is full; the last holds at least its tag
+	body := total - int64(encHeaderSize)
+	segments := (body + encSealedSize - 1) / encSealedSize
+	if segments == 0 || body-(segments-1)*encSealedSize < encTagSize {
+		return nil, fmt.Errorf("%w: truncated", ErrDecrypt)
+	}
+	d := &DecryptReader{
+		r:        r,
+		aead:     aead,
+		size:     body - segments*encTagSize,
+		segments: segments,
+		cached:   -1,
+	}
+	if err := d.load(segments - 1); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Size is the length of the decrypted content
+func (d *DecryptReader) Size() int64 {
+	return d.size
+}
+
+func (d *DecryptReader) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		return 0, io.EOF
+	}
+	index := d.pos / encSegmentSize
+	if index != d.cached {
+		if err := d.load(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain[d.pos-index*encSegmentSize:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+// load decrypts segment index into d.plain
+func (d *DecryptReader) load(index int64) error {
+	d.cached = -1
+	if d.sealed == nil {
+		d.sealed = make([]byte, encSealedSize)
+	}
+	if _, err := d.r.Seek(int64(encHeaderSize)+index*encSealedSize, io.SeekStart); err != nil {
+		return err
+	}
+	n, err := io.ReadFull(d.r, d.sealed)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	plain, err := d.aead.Open(d.plain[:0], segmentNonce(index, index == d.segments-1), d.sealed[:n], nil)
+	if err != nil {
+		return ErrDecrypt
+	}
+	d.plain, d.cached = plain, index
+	return nil
+}
+
+func (d *DecryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	d.pos = offset
+	return offset, nil
+}
@@ -0,0 +1,110 @@
+package security
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+func testKey(t *testing.T, secret string) []byte {
+	t.Helper()
+	key, err := DeriveStorageKey(secret, []byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func encrypt(t *testing.T, key, plain []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	ew, err := NewEncryptWriter(&buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Odd-sized writes, so segments fill across Write calls
+	for p := plain; len(p) > 0; {
+		n := min(len(p), 10007)
+		if _, err := ew.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := ew.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	key := testKey(t, "correct horse")
+	for _, size := range []int{0, 1, encSegmentSize - 1, encSegmentSize, encSegmentSize + 1, 3*encSegmentSize + 123} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		sealed := encrypt(t, key, plain)
+		if got := EncryptedSize(int64(size)); got != int64(len(sealed)) {
+			t.Errorf("size %d: EncryptedSize = %d, encrypted file has %d", size, got, len(sealed))
+		}
+		if size > 16 && bytes.Contains(sealed, plain[:16]) {
+			t.Errorf("size %d: plaintext visible in the encrypted file", size)
+		}
+
+		dr, err := NewDecryptReader(bytes.NewReader(sealed), key)
+		if err != nil {
+			t.Fatalf("size %d: NewDecryptReader: %v", size, err)
+		}
+		if dr.Size() != int64(size) {
+			t.Errorf("size %d: Size() = %d", size, dr.Size())
+		}
+		got, err := io.ReadAll(dr)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Fatalf("size %d: read back %d bytes, %v", size, len(got), err)
+		}
+
+		// Seeking lands mid-segment, as a Range request would
+		if size > 100 {
+			off := int64(size) - 100
+			if _, err := dr.Seek(off, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(dr)
+			if err != nil || !bytes.Equal(got, plain[off:]) {
+				t.Errorf("size %d: read after seek to %d = %d bytes, %v", size, off, len(got), err)
+			}
+		}
+	}
+}
+
+func TestDecryptWrongKeyOrDamage(t *testing.T) {
+	key := testKey(t, "correct horse")
+	plain := bytes.Repeat([]byte("secret "), 2*encSegmentSize/7)
+	sealed := encrypt(t, key, plain)
+
+	if _, err := NewDecryptReader(bytes.NewReader(sealed), testKey(t, "wrong horse")); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("wrong key: err = %v, want ErrDecrypt", err)
+	}
+	if _, err := NewDecryptReader(bytes.NewReader(encrypt(t, key, nil)), testKey(t, "wrong horse")); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("wrong key on empty content: err = %v, want ErrDecrypt", err)
+	}
+	if _, err := NewDecryptReader(bytes.NewReader(plain), key); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("plaintext: err = %v, want ErrDecrypt", err)
+	}
+
+	// Dropping whole segments leaves a file whose last segment isn't final
+	cut := sealed[:encHeaderSize+encSealedSize]
+	if _, err := NewDecryptReader(bytes.NewReader(cut), key); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("truncated at a segment boundary: err = %v, want ErrDecrypt", err)
+	}
+
+	flipped := bytes.Clone(sealed)
+	flipped[encHeaderSize+10] ^= 1
+	dr, err := NewDecryptReader(bytes.NewReader(flipped), key)
+	if err != nil {
+		t.Fatal(err) // only the first segment is damaged
+	}
+	if _, err := io.ReadAll(dr); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("tampered segment: err = %v, want ErrDecrypt", err)
+	}
+}
@@ -0,0 +1,147 @@
+package security
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCertValidity(t *testing.T) {
+	tests := []struct {
+		name     string
+		validity time.Duration
+		want     time.Duration
+	}{
+		{"short ttl", 90 * time.Second, 90 * time.Second},
+		{"default", 0, DefaultCertValidity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := time.Now().Truncate(time.Second)
+			cfg, err := GenerateTLSConfigOpts(CertOptions{Validity: tt.validity})
+			if err != nil {
+				t.Fatalf("GenerateTLSConfigOpts: %v", err)
+			}
+			after := time.Now()
+
+			// Parse the raw certificate rather than trusting Leaf
+			cert, err := x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+			if err != nil {
+				t.Fatalf("ParseCertificate: %v", err)
+			}
+			// Certificate times have second precision
+			if cert.NotAfter.Before(before.Add(tt.want)) || cert.NotAfter.After(after.Add(tt.want)) {
+				t.Errorf("NotAfter = %v, want %v after generation (between %v and %v)", cert.NotAfter, tt.want, before, after)
+			}
+			if !cfg.Certificates[0].Leaf.NotAfter.Equal(cert.NotAfter) {
+				t.Errorf("Leaf.NotAfter = %v, want %v", cfg.Certificates[0].Leaf.NotAfter, cert.NotAfter)
+			}
+		})
+	}
+}
+
+func TestCertExtraSANs(t *testing.T) {
+	cfg, err := GenerateTLSConfigOpts(CertOptions{ExtraSANs: []string{"files.example.com", "203.0.113.5"}})
+	if err != nil {
+		t.Fatalf("GenerateTLSConfigOpts: %v", err)
+	}
+	leaf := cfg.Certificates[0].Leaf
+	for _, host := range []string{"files.example.com", "localhost", "203.0.113.5"} {
+		if err := leaf.VerifyHostname(host); err != nil {
+			t.Errorf("VerifyHostname(%q): %v", host, err)
+		}
+	}
+}
+
+// handshake runs a TLS handshake between a server with serverConfig and a
+// client with clientConfig over an in-memory connection
+func handshake(serverConfig, clientConfig *tls.Config) error {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	errc := make(chan error, 1)
+	go func() { errc <- tls.Server(c1, serverConfig).Handshake() }()
+	clientErr := tls.Client(c2, clientConfig).Handshake()
+	if clientErr != nil {
+		c2.Close() // unblock the server
+	}
+	if err := <-errc; clientErr == nil {
+		return err
+	}
+	return clientErr
+}
+
+func TestCertKeyTypes(t *testing.T) {
+	for _, kt := range []KeyType{"", KeyEd25519, KeyRSA} {
+		t.Run(fmt.Sprintf("%q", kt), func(t *testing.T) {
+			cfg, err := GenerateTLSConfigOpts(CertOptions{KeyType: kt})
+			if err != nil {
+				t.Fatalf("GenerateTLSConfigOpts: %v", err)
+			}
+			switch key := cfg.Certificates[0].Leaf.PublicKey.(type) {
+			case ed25519.PublicKey:
+				if kt == KeyRSA {
+					t.Errorf("asked for %s, got an Ed25519 key", kt)
+				}
+			case *rsa.PublicKey:
+				if kt != KeyRSA || key.N.BitLen() != 2048 {
+					t.Errorf("asked for %q, got a %d-bit RSA key", kt, key.N.BitLen())
+				}
+			default:
+				t.Fatalf("certificate has a %T key", key)
+			}
+
+			// The generated config serves, and a pinned client accepts it
+			pinned, err := TLSConfigWithPin(Fingerprint(cfg.Certificates[0].Certificate[0]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := handshake(cfg, pinned); err != nil {
+				t.Fatalf("handshake: %v", err)
+			}
+		})
+	}
+	if _, err := GenerateTLSConfigOpts(CertOptions{KeyType: "dsa"}); err == nil {
+		t.Error("GenerateTLSConfigOpts with an unknown key type succeeded")
+	}
+	for name, want := range map[string]KeyType{"ed25519": KeyEd25519, "RSA": KeyRSA} {
+		if got, err := ParseKeyType(name); err != nil || got != want {
+			t.Errorf("ParseKeyType(%q) = %q, %v; want %q", name, got, err, want)
+		}
+	}
+	if _, err := ParseKeyType("ecdsa"); err == nil {
+		t.Error("ParseKeyType(ecdsa) succeeded")
+	}
+}
+
+// BenchmarkCertKeyTypes times generating a certificate, and the server's
+// side of a handshake with it, for each key type
+func BenchmarkCertKeyTypes(b *testing.B) {
+	for _, kt := range []KeyType{KeyEd25519, KeyRSA} {
+		b.Run(string(kt)+"/generate", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := GenerateTLSConfigOpts(CertOptions{KeyType: kt}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(string(kt)+"/handshake", func(b *testing.B) {
+			cfg, err := GenerateTLSConfigOpts(CertOptions{KeyType: kt})
+			if err != nil {
+				b.Fatal(err)
+			}
+			client := &tls.Config{InsecureSkipVerify: true}
+			for i := 0; i < b.N; i++ {
+				if err := handshake(cfg, client); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"gopher-fs/internal/protocol"
+)
+
+// Config holds the settings of a standalone server, as read from a JSON
+// config file by LoadConfig. Settings the file leaves out keep the values
+// from DefaultConfig.
+type Config struct {
+	// StorageDir is where uploads land and downloads are served from
+	StorageDir string `json:"storage_dir"`
+
+	// Port is the TCP port the file server listens on and advertises
+	// through discovery; 0 picks any free port
+	Port int `json:"port"`
+
+	// Bind is the IP address the file server listens on, e.g. 127.0.0.1
+	// or a VPN address; empty listens on every interface
+	Bind string `json:"bind,omitempty"`
+
+	// IdleTimeout disconnects clients that make no progress for this
+	// long, e.g. "2m" (0 = never)
+	IdleTimeout Duration `json:"idle_timeout"`
+
+	// TransferTimeout aborts any one file's upload or download that takes
+	// longer than this, even if it never idles, e.g. "10m" (0 = never)
+	TransferTimeout Duration `json:"transfer_timeout,omitempty"`
+
+	// MaxConns is the number of connections served at once
+	MaxConns int `json:"max_conns"`
+
+	// QuotaBytes caps the total bytes stored (0 = unlimited)
+	QuotaBytes int64 `json:"quota_bytes"`
+
+	// MaxFileSize is the largest file an upload may carry (0 = unlimited)
+	MaxFileSize int64 `json:"max_file_size"`
+
+	// BufferSize is the buffer file data is copied through, in bytes
+	BufferSize int `json:"buffer_size"`
+
+	// BlockedExtensions is a comma-separated list of file extensions
+	// uploads may not have, e.g. ".exe,.bat,.sh" (see policy.ParseBlocklist)
+	BlockedExtensions string `json:"blocked_extensions,omitempty"`
+
+	// NormalizeNames stores and looks up files under the Unicode NFC form
+	// of the names clients send, without control characters (see
+	// Server.NormalizeNames). Recommended when clients mix macOS with
+	// Linux or Windows.
+	NormalizeNames bool `json:"normalize_names,omitempty"`
+
+	// OnConflict is what an upload of an existing file does: "overwrite"
+	// (the default), "reject" or "rename" (see Server.OnConflict)
+	OnConflict ConflictPolicy `json:"on_conflict,omitempty"`
+
+	// CertFile and KeyFile name a PEM certificate and private key to serve
+	// instead of generating a self-signed certificate. Set both or neither.
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+
+	// PSK is a pre-shared key clients must authenticate with before any
+	// request is served (empty = no authentication)
+	PSK string `json:"psk,omitempty"`
+
+	// Plaintext serves unencrypted TCP instead of TLS (see
+	// Server.Plaintext), so CertFile and KeyFile can't be set with it
+	Plaintext bool `json:"plaintext,omitempty"`
+}
+
+// DefaultConfig returns the settings used when neither a config file nor a
+// flag says otherwise
+func DefaultConfig() Config {
+	return Config{
+		StorageDir:  "storage",
+		Port:        9000,
+		IdleTimeout: Duration(2 * time.Minute),
+		MaxConns:    256,
+		BufferSize:  protocol.DefaultBufferSize,
+	}
+}
+
+// LoadConfig reads the JSON config file at path over DefaultConfig.
+// Unknown keys are an error, so a misspelt setting isn't silently ignored.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := DefaultConfig()
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// Validate reports the first setting that can't be used
+func (c *Config) Validate() error {
+	switch {
+	case c.StorageDir == "":
+		return errors.New("storage_dir must not be empty")
+	case c.Port < 0 || c.Port > 65535:
+		return fmt.Errorf("port %d is out of range", c.Port)
+	case c.Bind != "" && net.ParseIP(c.Bind) == nil:
+		return fmt.Errorf("bind %q is not an IP address", c.Bind)
+	case c.IdleTimeout < 0:
+		return errors.New("idle_timeout must not be negative")
+	case c.TransferTimeout < 0:
+		return errors.New("transfer_timeout must not be negative")
+	case c.MaxConns < 1:
+		return errors.New("max_conns must be at least 1")
+	case c.QuotaBytes < 0:
+		return errors.New("quota_bytes must not be negative")
+	case c.MaxFileSize < 0:
+		return errors.New("max_file_size must not be negative")
+	case c.BufferSize < 1 || c.BufferSize > MaxBufferSize:
+		return fmt.Errorf("buffer_size must be between 1 and %d", MaxBufferSize)
+	case c.OnConflict != "" && c.OnConflict != ConflictOverwrite && c.OnConflict != ConflictReject && c.OnConflict != ConflictRename:
+		return fmt.Errorf("on_conflict %q must be overwrite, reject or rename", c.OnConflict)
+	case (c.CertFile == "") != (c.KeyFile == ""):
+		return errors.New("cert_file and key_file must be set together")
+	case c.Plaintext && c.CertFile != "":
+		return errors.New("cert_file can't be used with plaintext")
+	}
+	return nil
+}
+
+// ListenAddr is the address the file server listens on: Bind and Port
+// joined, or just ":port" without a Bind
+func (c *Config) ListenAddr() string {
+	return net.JoinHostPort(c.Bind, strconv.Itoa(c.Port))
+}
+
+// MaxBufferSize bounds Config.BufferSize; every transfer allocates one
+const MaxBufferSize = 64 << 20
+
+// Duration is a time.Duration written in config files as a string such as
+// "90s" or "2m"
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"2m\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
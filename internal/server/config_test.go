@@ -0,0 +1,90 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "server.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigRoundTrip(t *testing.T) {
+	want := Config{
+		StorageDir:        "/srv/gopher",
+		Port:              9100,
+		Bind:              "10.8.0.1",
+		IdleTimeout:       Duration(90 * time.Second),
+		TransferTimeout:   Duration(10 * time.Minute),
+		MaxConns:          32,
+		QuotaBytes:        1 << 30,
+		MaxFileSize:       1 << 20,
+		BufferSize:        1 << 20,
+		BlockedExtensions: ".exe,.sh",
+		NormalizeNames:    true,
+		OnConflict:        ConflictRename,
+		CertFile:          "cert.pem",
+		KeyFile:           "key.pem",
+		PSK:               "correct horse battery staple",
+	}
+	data, err := json.Marshal(want)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if !strings.Contains(string(data), `"idle_timeout":"1m30s"`) {
+		t.Errorf("durations should marshal as strings: %s", data)
+	}
+
+	got, err := LoadConfig(writeConfig(t, string(data)))
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if *got != want {
+		t.Errorf("round trip = %+v, want %+v", *got, want)
+	}
+}
+
+func TestLoadConfigKeepsDefaults(t *testing.T) {
+	got, err := LoadConfig(writeConfig(t, `{"port": 9200}`))
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	want := DefaultConfig()
+	want.Port = 9200
+	if *got != want {
+		t.Errorf("LoadConfig = %+v, want %+v", *got, want)
+	}
+}
+
+func TestLoadConfigRejects(t *testing.T) {
+	tests := []struct {
+		name, content string
+	}{
+		{"unknown key", `{"max_connections": 5}`},
+		{"bad duration", `{"idle_timeout": "soon"}`},
+		{"numeric duration", `{"idle_timeout": 120}`},
+		{"negative transfer timeout", `{"transfer_timeout": "-1m"}`},
+		{"port out of range", `{"port": 70000}`},
+		{"bind to a hostname", `{"bind": "fileserver.local"}`},
+		{"cert without key", `{"cert_file": "cert.pem"}`},
+		{"cert with plaintext", `{"cert_file": "cert.pem", "key_file": "key.pem", "plaintext": true}`},
+		{"zero buffer", `{"buffer_size": 0}`},
+		{"unknown conflict policy", `{"on_conflict": "skip"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := LoadConfig(writeConfig(t, tt.content)); err == nil {
+				t.Errorf("LoadConfig(%s) succeeded, want an error", tt.content)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"gopher-fs/internal/protocol"
+)
+
+// maxManifests bounds the manifests a Server keeps track of; announcing
+// another forgets the oldest
+const maxManifests = 64
+
+// manifests tracks the multi-file uploads announced with OpManifest that
+// still have files to come, to log their progress as the files land
+type manifests struct {
+	mu      sync.Mutex
+	pending map[string]*pendingManifest // by manifest ID
+}
+
+type pendingManifest struct {
+	total   int
+	waiting map[string]int64 // cleaned names still to come, with their sizes
+	added   time.Time
+}
+
+// track starts following m, whose missing files are still to come. A
+// manifest with nothing missing is complete and forgotten.
+func (ms *manifests) track(m protocol.Manifest, missing []protocol.FileEntry) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if len(missing) == 0 {
+		delete(ms.pending, m.ID)
+		return
+	}
+	if ms.pending == nil {
+		ms.pending = make(map[string]*pendingManifest)
+	}
+	p := &pendingManifest{total: len(m.Files), waiting: make(map[string]int64, len(missing)), added: time.Now()}
+	for _, f := range missing {
+		name, _ := protocol.CleanPath(f.Name) // validated with the manifest
+		p.waiting[name] = f.Size
+	}
+	ms.pending[m.ID] = p
+
+	if len(ms.pending) > maxManifests {
+		oldest := m.ID
+		for id, p := range ms.pending {
+			if p.added.Before(ms.pending[oldest].added) {
+				oldest = id
+			}
+		}
+		slog.Warn("Forgetting manifest", "id", oldest, "missing", len(ms.pending[oldest].waiting))
+		delete(ms.pending, oldest)
+	}
+}
+
+// received notes that name was stored with size bytes, logging the
+// progress of every manifest waiting for it
+func (ms *manifests) received(name string, size int64) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for id, p := range ms.pending {
+		if want, ok := p.waiting[name]; !ok || want != size {
+			continue
+		}
+		delete(p.waiting, name)
+		if len(p.waiting) == 0 {
+			slog.Info("Manifest complete", "id", id, "files", p.total)
+			delete(ms.pending, id)
+			continue
+		}
+		slog.Info("Manifest progress", "id", id, "received", p.total-len(p.waiting), "files", p.total)
+	}
+}
+
+// handleManifest keeps the announced manifest and replies with the files
+// it lists that the store doesn't hold with the same size and checksum
+func (s *Server) handleManifest(conn net.Conn) bool {
+	m, err := protocol.ReadManifest(conn)
+	if err != nil {
+		slog.Warn("Rejecting manifest", "err", err)
+		protocol.WriteAck(conn, protocol.AckRejected, err.Error())
+		// Only a manifest that was read whole leaves the connection in step
+		return errors.Is(err, protocol.ErrInvalidManifest)
+	}
+	missing, err := s.missingFiles(m)
+	if err != nil {
+		slog.Error("Error checking manifest", "id", m.ID, "err", err)
+		protocol.WriteAck(conn, protocol.AckError, "checking files failed")
+		return true
+	}
+	// The reply names files as the client does; uploads arrive normalized
+	tracked := missing
+	if s.NormalizeNames {
+		tracked = make([]protocol.FileEntry, len(missing))
+		for i, f := range missing {
+			f.Name = protocol.NormalizeName(f.Name)
+			tracked[i] = f
+		}
+	}
+	s.manifests.track(m, tracked)
+	slog.Info("Received manifest", "id", m.ID, "files", len(m.Files), "missing", len(missing))
+
+	if err := protocol.WriteAck(conn, protocol.AckOK, ""); err != nil {
+		slog.Error("Error sending manifest reply", "err", err)
+		return false
+	}
+	if err := protocol.WriteList(conn, missing); err != nil {
+		slog.Error("Error sending manifest reply", "err", err)
+		return false
+	}
+	return true
+}
+
+// missingFiles returns the files of m the store lacks or holds with a
+// different size or checksum
+func (s *Server) missingFiles(m protocol.Manifest) ([]protocol.FileEntry, error) {
+	st := s.store()
+	missing := []protocol.FileEntry{}
+	for _, f := range m.Files {
+		name, err := s.cleanPath(f.Name)
+		if err != nil {
+			return nil, err
+		}
+		held, err := s.holds(st, name, f)
+		if err != nil {
+			return nil, err
+		}
+		if !held {
+			missing = append(missing, protocol.FileEntry{Name: f.Name, Size: f.Size})
+		}
+	}
+	return missing, nil
+}
+
+// holds reports whether st has name with f's size and checksum
+func (s *Server) holds(st Store, name string, f protocol.ManifestEntry) (bool, error) {
+	r, info, err := st.Get(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	if info.Size() != f.Size {
+		return false, nil
+	}
+	sum, err := f.Algo.Compute(r)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(sum, f.Checksum), nil
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics aggregates traffic over every connection tracked with it, and
+// keeps a registry of the connections still open. The zero value is ready
+// to use and it is safe for concurrent use.
+type Metrics struct {
+	bytesIn     atomic.Int64
+	bytesOut    atomic.Int64
+	activeConns atomic.Int64
+	transfers   atomic.Int64
+
+	mu     sync.Mutex
+	nextID uint64
+	active map[uint64]*countingConn
+}
+
+// Transfer describes a connection being served, as of the call to Active
+// that returned it
+type Transfer struct {
+	ID       uint64    `json:"id"`
+	Remote   string    `json:"remote"`
+	Op       string    `json:"op"`             // the request being served, e.g. "upload"; "" before the first
+	File     string    `json:"file,omitempty"` // the file or directory it names, once read
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+	Started  time.Time `json:"started"`
+}
+
+// ConnStats is what one connection transferred
+type ConnStats struct {
+	BytesIn  int64
+	BytesOut int64
+	Duration time.Duration
+}
+
+// Throughput is the average rate in bytes per second, counting both
+// directions
+func (s ConnStats) Throughput() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.BytesIn+s.BytesOut) / s.Duration.Seconds()
+}
+
+// Track wraps conn so the bytes read from and written to it are counted,
+// both for the connection and in m's totals, and marks it active. The
+// returned finish function ends tracking and reports the connection's
+// stats; it must be called exactly once, usually when conn is closed.
+func (m *Metrics) Track(conn net.Conn) (net.Conn, func() ConnStats) {
+	m.activeConns.Add(1)
+	c := &countingConn{Conn: conn, m: m, start: time.Now()}
+	m.mu.Lock()
+	if m.active == nil {
+		m.active = make(map[uint64]*countingConn)
+	}
+	m.nextID++
+	c.id = m.nextID
+	m.active[c.id] = c
+	m.mu.Unlock()
+	return c, func() ConnStats {
+		m.activeConns.Add(-1)
+		m.mu.Lock()
+		delete(m.active, c.id)
+		m.mu.Unlock()
+		return ConnStats{BytesIn: c.in.Load(), BytesOut: c.out.Load(), Duration: time.Since(c.start)}
+	}
+}
+
+// Active lists the tracked connections that are still open, oldest first
+func (m *Metrics) Active() []Transfer {
+	m.mu.Lock()
+	conns := make([]*countingConn, 0, len(m.active))
+	for _, c := range m.active {
+		conns = append(conns, c)
+	}
+	m.mu.Unlock()
+
+	transfers := make([]Transfer, len(conns))
+	for i, c := range conns {
+		transfers[i] = c.transfer()
+	}
+	sort.Slice(transfers, func(i, j int) bool { return transfers[i].ID < transfers[j].ID })
+	return transfers
+}
+
+// noteOp records the request conn is about to serve, for Active.
+// Connections Track didn't wrap are ignored.
+func noteOp(conn net.Conn, op string) {
+	if c, ok := conn.(*countingConn); ok {
+		c.mu.Lock()
+		c.op, c.file = op, ""
+		c.mu.Unlock()
+	}
+}
+
+// noteFile records the file conn's current request names, like noteOp
+func noteFile(conn net.Conn, name string) {
+	if c, ok := conn.(*countingConn); ok {
+		c.mu.Lock()
+		c.file = name
+		c.mu.Unlock()
+	}
+}
+
+// TransferDone counts one handled request in the totals
+func (m *Metrics) TransferDone() {
+	m.transfers.Add(1)
+}
+
+// WritePrometheus writes the totals to w in the Prometheus text format
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	metrics := []struct {
+		name, kind, help string
+		value            int64
+	}{
+		{"gopherfs_bytes_in_total", "counter", "Bytes received from clients.", m.bytesIn.Load()},
+		{"gopherfs_bytes_out_total", "counter", "Bytes sent to clients.", m.bytesOut.Load()},
+		{"gopherfs_active_connections", "gauge", "Connections currently being served.", m.activeConns.Load()},
+		{"gopherfs_transfers_total", "counter", "Requests handled.", m.transfers.Load()},
+	}
+	for _, metric := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n",
+			metric.name, metric.help, metric.name, metric.kind, metric.name, metric.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countingConn counts the bytes moved over the connection. Its counters
+// and description are read by Active while it is being served, so they
+// are atomic or locked.
+type countingConn struct {
+	net.Conn
+	m       *Metrics
+	id      uint64
+	start   time.Time
+	in, out atomic.Int64
+
+	mu       sync.Mutex
+	op, file string
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.in.Add(int64(n))
+	c.m.bytesIn.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.out.Add(int64(n))
+	c.m.bytesOut.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) transfer() Transfer {
+	c.mu.Lock()
+	op, file := c.op, c.file
+	c.mu.Unlock()
+	return Transfer{
+		ID:       c.id,
+		Remote:   c.RemoteAddr().String(),
+		Op:       op,
+		File:     file,
+		BytesIn:  c.in.Load(),
+		BytesOut: c.out.Load(),
+		Started:  c.start,
+	}
+}
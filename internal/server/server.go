@@ -0,0 +1,1289 @@
+// Package server implements the gopher-fs file server: it accepts
+// connections on a listener and serves downloads, uploads and listings from
+// a storage directory.
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopher-fs/internal/archive"
+	"gopher-fs/internal/policy"
+	"gopher-fs/internal/protocol"
+	"gopher-fs/internal/storage"
+)
+
+// Server serves the files under Root. Create one with New, or set Root
+// before calling Serve.
+type Server struct {
+	// Root is the storage directory uploads land in and downloads are
+	// served from
+	Root string
+
+	// QuotaBytes caps the total bytes stored under Root (0 = unlimited)
+	QuotaBytes int64
+
+	// Store holds the files served instead of Root when set, e.g. a
+	// MemoryStore. Renames and tar transfers work on Root directly and are
+	// refused with a Store.
+	Store Store
+
+	// MaxFileSize is the largest single file accepted by an upload
+	// (0 = unlimited)
+	MaxFileSize int64
+
+	// Blocklist names file extensions uploads and renames may not have
+	Blocklist policy.Blocklist
+
+	// NormalizeNames puts every name a client sends in Unicode NFC and
+	// drops control characters from it (see protocol.NormalizeName), so a
+	// name typed on macOS and the same name typed on Linux are one file.
+	// Off by default, as it changes the names of files uploaded with it.
+	NormalizeNames bool
+
+	// OnConflict is what an upload of a file that already exists does
+	// (empty = ConflictOverwrite). Rejecting and renaming take the name
+	// atomically, so two uploads racing for it can't both get it.
+	OnConflict ConflictPolicy
+
+	// MaxConns is the number of connections served at once; further
+	// clients wait in the listen backlog. Zero or less means one.
+	MaxConns int
+	// IdleTimeout disconnects a client once a read or write has made no
+	// progress for this long (0 = never)
+	IdleTimeout time.Duration
+	// TransferTimeout caps how long the data of any one uploaded or
+	// downloaded file may take, however steadily it moves (0 = no limit).
+	// A transfer over it is aborted and its connection closed; an upload
+	// is then discarded, and its client told why.
+	TransferTimeout time.Duration
+
+	// BufferSize is the buffer file data is sent and received through
+	// (0 = protocol.DefaultBufferSize)
+	BufferSize int
+
+	// PSK, if set, is a pre-shared key clients must prove they hold (see
+	// protocol.OpAuth) before any request is served
+	PSK []byte
+
+	// TLSConfig secures the listener opened by Listen and ListenAndServe
+	TLSConfig *tls.Config
+
+	// Plaintext has Listen open a plain TCP listener instead, for trusted
+	// networks and devices too slow for the TLS handshake. Anyone on the
+	// network can read and alter what is sent.
+	Plaintext bool
+
+	// Metrics accumulates traffic totals across all connections
+	Metrics Metrics
+
+	manifests manifests
+	uploads   uploads
+}
+
+// New returns a Server for the files under storageDir that serves TLS with
+// tlsConfig and the default connection limits
+func New(storageDir string, tlsConfig *tls.Config) *Server {
+	defaults := DefaultConfig()
+	return &Server{
+		Root:        storageDir,
+		TLSConfig:   tlsConfig,
+		MaxConns:    defaults.MaxConns,
+		IdleTimeout: time.Duration(defaults.IdleTimeout),
+		BufferSize:  defaults.BufferSize,
+	}
+}
+
+// Listen opens a TLS listener on the TCP address addr, e.g. ":9000", or a
+// plain one if Plaintext is set. Use it instead of ListenAndServe to learn
+// the bound port before serving.
+func (s *Server) Listen(addr string) (net.Listener, error) {
+	if s.Plaintext {
+		return net.Listen("tcp", addr)
+	}
+	if s.TLSConfig == nil {
+		return nil, errors.New("server has no TLS configuration")
+	}
+	return tls.Listen("tcp", addr, s.TLSConfig)
+}
+
+// ListenAndServe listens on the TCP address addr and serves connections
+// until the listener fails
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := s.Listen(addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	return s.Serve(l)
+}
+
+// ErrFileTooLarge is reported for an uploaded file bigger than MaxFileSize
+var ErrFileTooLarge = errors.New("file too large")
+
+// errNeedsDisk refuses operations that only work on a storage directory
+var errNeedsDisk = errors.New("not supported without a storage directory")
+
+// store returns where files are kept: Store, or a DiskStore on Root
+func (s *Server) store() Store {
+	if s.Store != nil {
+		return s.Store
+	}
+	return &DiskStore{Root: s.Root, QuotaBytes: s.QuotaBytes, BufferSize: s.BufferSize}
+}
+
+// Serve accepts connections on l and handles each in its own goroutine. It
+// returns once l is closed.
+func (s *Server) Serve(l net.Listener) error {
+	// A slot is taken before accepting, so once MaxConns connections are
+	// being served new clients wait in the listen backlog instead of
+	// getting an error; they are picked up as soon as a slot frees
+	slots := make(chan struct{}, max(s.MaxConns, 1))
+	for {
+		slots <- struct{}{}
+		conn, err := l.Accept()
+		if err != nil {
+			<-slots
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			slog.Error("Error accepting connection", "err", err)
+			continue
+		}
+		go func() {
+			defer func() { <-slots }()
+			s.handleConnection(WithIdleTimeout(conn, s.IdleTimeout))
+		}()
+	}
+}
+
+// WithIdleTimeout wraps conn so that every read and write must make
+// progress within timeout, pushing the deadline forward each time. A peer
+// that stalls mid-request is then disconnected instead of holding a
+// goroutine forever. A timeout of zero or less returns conn unchanged.
+func WithIdleTimeout(conn net.Conn, timeout time.Duration) net.Conn {
+	if timeout <= 0 {
+		return conn
+	}
+	return &idleConn{Conn: conn, timeout: timeout}
+}
+
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(p)
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(p)
+}
+
+// cleanPath is protocol.CleanPath for a name sent by a client, normalized
+// first if s.NormalizeNames is set
+func (s *Server) cleanPath(name string) (string, error) {
+	if s.NormalizeNames {
+		name = protocol.NormalizeName(name)
+	}
+	return protocol.CleanPath(name)
+}
+
+// ErrTransferTimeout aborts a file whose data took longer than
+// TransferTimeout
+var ErrTransferTimeout = errors.New("transfer timeout exceeded")
+
+// limitTransfer bounds the copy of one file's data over conn to
+// s.TransferTimeout. The copy goes through the returned connection, whose
+// reads and writes fail for good once the time is up, pending ones
+// included. The returned function ends the limit, reporting
+// ErrTransferTimeout if it cut the copy off; conn itself is then usable
+// again to say so.
+func (s *Server) limitTransfer(conn net.Conn) (net.Conn, func() error) {
+	if s.TransferTimeout <= 0 {
+		return conn, func() error { return nil }
+	}
+	cause := fmt.Errorf("%w: file took longer than %v", ErrTransferTimeout, s.TransferTimeout)
+	ctx, cancel := context.WithTimeoutCause(context.Background(), s.TransferTimeout, cause)
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	return &transferConn{Conn: conn, ctx: ctx}, func() error {
+		defer cancel()
+		if stop() {
+			return nil
+		}
+		conn.SetDeadline(time.Time{})
+		return context.Cause(ctx)
+	}
+}
+
+// transferConn fails every read and write once ctx has timed out, so an
+// idleConn underneath can't push its deadline forward again
+type transferConn struct {
+	net.Conn
+	ctx context.Context
+}
+
+func (c *transferConn) Read(p []byte) (int, error) {
+	if err := c.expired(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *transferConn) Write(p []byte) (int, error) {
+	if err := c.expired(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *transferConn) expired() error {
+	if errors.Is(c.ctx.Err(), context.DeadlineExceeded) {
+		return context.Cause(c.ctx)
+	}
+	return nil
+}
+
+// opNames labels operations in the connection summary
+var opNames = map[uint8]string{
+	protocol.OpDownload:      "download",
+	protocol.OpUpload:        "upload",
+	protocol.OpDownloadRange: "download-range",
+	protocol.OpList:          "list",
+	protocol.OpRename:        "rename",
+	protocol.OpUploadTar:     "upload-tar",
+	protocol.OpDownloadTar:   "download-tar",
+	protocol.OpDownloadDir:   "download-dir",
+	protocol.OpStat:          "stat",
+	protocol.OpDelete:        "delete",
+	protocol.OpManifest:      "manifest",
+	protocol.OpReport:        "report",
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
+	conn, finish := s.Metrics.Track(conn)
+	op := "none"
+	probe := false // closed without a word, e.g. a health check's dial
+	defer func() {
+		conn.Close()
+		stats := finish()
+		level := slog.LevelInfo
+		if probe {
+			level = slog.LevelDebug
+		}
+		slog.Log(context.Background(), level, "Connection closed",
+			"remote", conn.RemoteAddr(),
+			"op", op,
+			"bytes_in", stats.BytesIn,
+			"bytes_out", stats.BytesOut,
+			"duration", stats.Duration.Round(time.Millisecond),
+			"mb_per_sec", fmt.Sprintf("%.2f", stats.Throughput()/(1024*1024)))
+	}()
+	slog.Debug("Accepted connection", "remote", conn.RemoteAddr())
+
+	// 1. Read Operation Code (1 byte)
+	var opCode uint8
+	if err := binary.Read(conn, binary.LittleEndian, &opCode); err != nil {
+		if errors.Is(err, io.EOF) {
+			probe = true
+			slog.Debug("Client closed the connection before any request", "remote", conn.RemoteAddr())
+			return
+		}
+		slog.Error("Error reading operation code", "err", err)
+		return
+	}
+
+	if opCode == protocol.OpAuth {
+		if err := protocol.AcceptAuth(conn, s.PSK); err != nil {
+			slog.Warn("Authentication failed", "remote", conn.RemoteAddr(), "err", err)
+			return
+		}
+		if err := binary.Read(conn, binary.LittleEndian, &opCode); err != nil {
+			slog.Error("Error reading operation code", "err", err)
+			return
+		}
+	} else if len(s.PSK) > 0 {
+		slog.Warn("Rejecting unauthenticated client", "remote", conn.RemoteAddr(), "op", opCode)
+		return
+	}
+
+	// Clients that don't say hello speak protocol version 1
+	sess := protocol.DefaultSession
+	if opCode == protocol.OpHello {
+		var err error
+		if sess, err = protocol.AcceptHello(conn); err != nil {
+			slog.Error("Error negotiating protocol version", "err", err)
+			return
+		}
+		if err := binary.Read(conn, binary.LittleEndian, &opCode); err != nil {
+			slog.Error("Error reading operation code", "err", err)
+			return
+		}
+	}
+
+	// From v6 the client may send further requests until OpClose
+	var ops []string
+	defer func() {
+		if len(ops) > 0 {
+			op = strings.Join(ops, ",")
+		}
+	}()
+	for opCode != protocol.OpClose {
+		name, ok := opNames[opCode]
+		if !ok {
+			slog.Error("Unknown operation code", "op", opCode)
+			return
+		}
+		ops = append(ops, name)
+		noteOp(conn, name)
+		inStep := s.handle(conn, sess, opCode)
+		s.Metrics.TransferDone()
+		if !inStep || sess.Version < 6 {
+			return
+		}
+		if err := binary.Read(conn, binary.LittleEndian, &opCode); err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.Error("Error reading operation code", "err", err)
+			}
+			return
+		}
+	}
+}
+
+// handle serves one request. Like the handlers it calls, it reports
+// whether the request was read and answered in full, leaving the
+// connection in step for another.
+func (s *Server) handle(conn net.Conn, sess protocol.Session, opCode uint8) bool {
+	switch opCode {
+	case protocol.OpDownload:
+		return s.handleDownload(conn, sess)
+	case protocol.OpUpload:
+		return s.handleUpload(conn, sess)
+	case protocol.OpDownloadRange:
+		return s.handleDownloadRange(conn, sess)
+	case protocol.OpList:
+		return s.handleList(conn, sess)
+	case protocol.OpRename:
+		return s.handleRename(conn)
+	case protocol.OpUploadTar:
+		return s.handleUploadTar(conn)
+	case protocol.OpDownloadTar:
+		return s.handleDownloadTar(conn)
+	case protocol.OpDownloadDir:
+		return s.handleDownloadDir(conn, sess)
+	case protocol.OpStat:
+		return s.handleStat(conn, sess)
+	case protocol.OpDelete:
+		return s.handleDelete(conn)
+	case protocol.OpManifest:
+		return s.handleManifest(conn)
+	case protocol.OpReport:
+		return s.handleReport(conn)
+	}
+	return false
+}
+
+func (s *Server) handleDownload(conn net.Conn, sess protocol.Session) bool {
+	file, header, ok := s.openRequestedFile(conn, sess.Algo)
+	if !ok {
+		return false
+	}
+	defer file.Close()
+
+	// 7. Send Header (File Metadata)
+	slog.Debug("Sending file header", "size", header.Size)
+	if err := protocol.WriteHeader(conn, sess.Version, header); err != nil {
+		slog.Error("Error sending file header", "err", err)
+		return false
+	}
+
+	// 8. Stream File Content
+	sentBytes, err := s.sendContent(conn, file, header.Size, sess.Version, sess.Compression)
+	if err != nil {
+		logSendError("Error sending file data", err, "file", header.Name, "bytes", sentBytes)
+		return inSync(err, sess.Version)
+	}
+	slog.Info("Sent file", "file", header.Name, "bytes", sentBytes)
+	return true
+}
+
+// handleDownloadRange serves length bytes starting at offset, so a client
+// can fetch disjoint parts of one file over several connections
+func (s *Server) handleDownloadRange(conn net.Conn, sess protocol.Session) bool {
+	file, header, ok := s.openRequestedFile(conn, sess.Algo)
+	if !ok {
+		return false
+	}
+	defer file.Close()
+
+	var offset, length int64
+	if err := binary.Read(conn, binary.LittleEndian, &offset); err != nil {
+		slog.Error("Error reading range offset", "err", err)
+		return false
+	}
+	if err := binary.Read(conn, binary.LittleEndian, &length); err != nil {
+		slog.Error("Error reading range length", "err", err)
+		return false
+	}
+	if offset < 0 || length < 0 || offset > header.Size || length > header.Size-offset {
+		slog.Warn("Rejecting range", "file", header.Name, "offset", offset, "length", length, "size", header.Size)
+		return false
+	}
+
+	if err := protocol.WriteHeader(conn, sess.Version, header); err != nil {
+		slog.Error("Error sending file header", "err", err)
+		return false
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		slog.Error("Error seeking", "file", header.Name, "err", err)
+		return false
+	}
+	sentBytes, err := s.sendContent(conn, file, length, sess.Version, protocol.Compression{})
+	if err != nil {
+		logSendError("Error sending file data", err, "file", header.Name, "bytes", sentBytes)
+		return inSync(err, sess.Version)
+	}
+	slog.Info("Sent range", "file", header.Name, "offset", offset, "bytes", sentBytes)
+	return true
+}
+
+// sendContent sends the next length bytes of file, compressed with comp.
+// From protocol v5 they are followed by a trailer acknowledgement. If the
+// file shrank since its header was sent (it was truncated or rewritten),
+// the shortfall is zero-padded and the trailer reports ErrShortFile, which
+// is also returned; older clients can't be told, so the connection must be
+// closed.
+func (s *Server) sendContent(conn net.Conn, file io.Reader, length int64, version uint8, comp protocol.Compression) (int64, error) {
+	timed, done := s.limitTransfer(conn)
+	sent, short, err := s.copyContent(timed, file, length, version, comp)
+	if timeout := done(); timeout != nil {
+		err = timeout
+	}
+	if err != nil {
+		return sent, err
+	}
+	if version < 5 {
+		return sent, nil
+	}
+	if short != nil {
+		if err := protocol.WriteAck(conn, protocol.AckError, short.Error()); err != nil {
+			return sent, err
+		}
+		return sent, short
+	}
+	return sent, protocol.WriteAck(conn, protocol.AckOK, "")
+}
+
+// copyContent does the sending for sendContent, returning the shortfall
+// it padded as short. Before v5 it is not padded but returned as err.
+func (s *Server) copyContent(conn net.Conn, file io.Reader, length int64, version uint8, comp protocol.Compression) (sent int64, short, err error) {
+	dst, err := protocol.NewCompressor(conn, comp)
+	if err != nil {
+		return 0, nil, err
+	}
+	sent, err = protocol.Copy(dst, io.LimitReader(file, length), s.BufferSize)
+	if err != nil {
+		return sent, nil, err
+	}
+	if sent < length {
+		short = fmt.Errorf("%w: sent %d of %d bytes", protocol.ErrShortFile, sent, length)
+		if version < 5 {
+			return sent, nil, short
+		}
+		if _, err := io.CopyN(dst, zeros{}, length-sent); err != nil {
+			return sent, short, err
+		}
+	}
+	return sent, short, dst.Close()
+}
+
+// inSync reports whether a download that failed with err from sendContent
+// still left the connection ready for another request: only a file that
+// shrank, once its shortfall was padded and reported in the trailer
+func inSync(err error, version uint8) bool {
+	return version >= 5 && errors.Is(err, protocol.ErrShortFile)
+}
+
+// logSendError logs err, which ended the sending of file data, with the
+// key-value pairs in args. A client that hung up mid-transfer is the
+// usual way of cancelling one, so that is only noted at debug level as a
+// disconnection; anything else is logged as an error, with msg.
+func logSendError(msg string, err error, args ...any) {
+	args = append(args, "err", err)
+	if clientGone(err) {
+		slog.Debug("Client disconnected", args...)
+		return
+	}
+	slog.Error(msg, args...)
+}
+
+// clientGone reports whether err comes from writing to a connection the
+// client has closed
+func clientGone(err error) bool {
+	return errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, io.ErrClosedPipe)
+}
+
+// zeros is an endless source of zero bytes
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// openRequestedFile reads a download request's filename and opens the file,
+// returning the header describing it with its checksum under algo.
+// Errors are logged.
+func (s *Server) openRequestedFile(conn net.Conn, algo protocol.ChecksumAlgo) (io.ReadSeekCloser, protocol.FileHeader, bool) {
+	var header protocol.FileHeader
+
+	// 2. Read requested filename
+	fileName, ok := readRequestName(conn)
+	if !ok {
+		return nil, header, false
+	}
+
+	// Sanitize filename: only paths inside the storage root are served
+	relPath, err := s.cleanPath(fileName)
+	if err != nil {
+		slog.Warn("Rejecting download", "err", err)
+		return nil, header, false
+	}
+	slog.Info("Client requested file", "file", relPath)
+	noteFile(conn, relPath)
+
+	file, header, err := s.openFile(relPath, algo)
+	if err != nil {
+		slog.Error("Error opening file", "file", relPath, "err", err)
+		return nil, header, false
+	}
+	return file, header, true
+}
+
+// openFile opens the file relPath from the store and returns the header
+// describing it with its checksum under algo
+func (s *Server) openFile(relPath string, algo protocol.ChecksumAlgo) (io.ReadSeekCloser, protocol.FileHeader, error) {
+	var header protocol.FileHeader
+
+	// 4-5. Open File and Get File Info (Size)
+	file, fileInfo, err := s.store().Get(relPath)
+	if err != nil {
+		return nil, header, err
+	}
+
+	// 6. Compute Checksum, then rewind for the transfer
+	slog.Debug("Computing checksum", "file", relPath, "algo", algo)
+	checksum, err := algo.Compute(file)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, header, fmt.Errorf("computing checksum: %w", err)
+	}
+
+	header = protocol.FileHeader{
+		Name:     relPath,
+		Size:     fileInfo.Size(),
+		Algo:     algo,
+		Checksum: checksum,
+		ModTime:  fileInfo.ModTime().UnixNano(),
+		Mode:     uint32(fileInfo.Mode().Perm()),
+	}
+	return file, header, nil
+}
+
+func (s *Server) handleUpload(conn net.Conn, sess protocol.Session) bool {
+	slog.Debug("Client initiating upload")
+
+	// From v4 the client waits for the outcome; older clients just close
+	ack := func(status uint8, msg string) {
+		if sess.Version < 4 {
+			return
+		}
+		if err := protocol.WriteAck(conn, status, msg); err != nil {
+			slog.Error("Error sending upload acknowledgement", "err", err)
+		}
+	}
+
+	// 1. Read Header
+	header, err := protocol.ReadHeader(conn, sess.Version) // Corrected: Receive header first
+	if err != nil {
+		slog.Error("Error reading upload header", "err", err)
+		return false
+	}
+	if err := sess.CheckAlgo(header); err != nil {
+		slog.Warn("Rejecting upload", "file", header.Name, "err", err)
+		ack(protocol.AckRejected, err.Error())
+		return false
+	}
+	fileName, fileSize, checksum := header.Name, header.Size, header.Checksum
+	noteFile(conn, fileName)
+	if err := s.checkFileSize(fileSize); err != nil {
+		slog.Warn("Rejecting upload", "file", fileName, "err", err)
+		ack(protocol.AckRejected, err.Error())
+		return false
+	}
+	if err := s.Blocklist.AllowUpload(fileName); err != nil {
+		slog.Warn("Rejecting upload", "file", fileName, "err", err)
+		ack(protocol.AckRejected, err.Error())
+		return false
+	}
+	if err := checkFileName(fileName); err != nil {
+		slog.Warn("Rejecting upload", "file", fileName, "err", err)
+		ack(protocol.AckRejected, err.Error())
+		return false
+	}
+	slog.Info("Receiving file", "file", fileName, "size", fileSize)
+
+	// Relative paths (directory uploads) are recreated in the store
+	relPath, err := s.cleanPath(fileName)
+	if err != nil {
+		slog.Warn("Rejecting upload", "err", err)
+		ack(protocol.AckRejected, err.Error())
+		return false
+	}
+
+	// 2-5. Stream the data into the store, verifying it on the way: a
+	// mismatch fails the last read, so nothing is stored. The store checks
+	// its quota before reading anything.
+	newHash, err := header.Algo.Hasher()
+	if err != nil {
+		slog.Warn("Rejecting upload", "file", relPath, "err", err)
+		ack(protocol.AckRejected, err.Error())
+		return false
+	}
+	timed, timeoutDone := s.limitTransfer(conn)
+	src, err := protocol.NewDecompressor(timed, sess.Compression.Codec)
+	if err != nil {
+		timeoutDone()
+		slog.Error("Error starting decompression", "err", err)
+		return false
+	}
+	defer src.Close()
+	st := s.store()
+	counted, done := s.uploads.begin(relPath, fileSize, src)
+	defer done()
+	data := &verifyingReader{r: counted, h: newHash(), remaining: fileSize, want: checksum}
+	if len(checksum) == 0 {
+		// From v10 the checksum may follow the data instead
+		data.trailer = func() ([]byte, error) {
+			if err := src.Finish(); err != nil {
+				return nil, err
+			}
+			sum := make([]byte, header.Algo.Size())
+			if _, err := io.ReadFull(timed, sum); err != nil {
+				return nil, fmt.Errorf("reading checksum: %w", err)
+			}
+			return sum, nil
+		}
+	}
+	if fileSize == 0 {
+		err = data.verify() // there is nothing to read for Put to check
+	}
+	stored := relPath
+	if err == nil {
+		if s.OnConflict == "" || s.OnConflict == ConflictOverwrite {
+			err = st.Put(relPath, data, fileSize)
+		} else {
+			stored, err = st.Create(relPath, data, fileSize, s.OnConflict == ConflictRename)
+		}
+	}
+	if timeout := timeoutDone(); timeout != nil {
+		err = timeout // whatever the copy failed with, this is why
+	}
+	if data.trailer == nil && (errors.Is(err, errChecksumMismatch) || err == nil) {
+		// Step past the end of the compressed stream to the next request
+		if finishErr := src.Finish(); finishErr != nil {
+			slog.Error("Error reading upload", "file", relPath, "err", finishErr)
+			ack(protocol.AckError, finishErr.Error())
+			return false
+		}
+	}
+	switch {
+	case errors.Is(err, errChecksumMismatch):
+		slog.Error("Checksum mismatch", "file", relPath)
+		ack(protocol.AckChecksumMismatch, fmt.Sprintf("received %d bytes with checksum %x", fileSize, data.got))
+		return true // all of it was read
+	case errors.Is(err, ErrTransferTimeout):
+		slog.Warn("Aborting upload", "file", relPath, "err", err)
+		ack(protocol.AckError, err.Error())
+		return false
+	case errors.Is(err, storage.ErrQuotaExceeded), errors.Is(err, protocol.ErrUnsafePath), errors.Is(err, fs.ErrExist):
+		slog.Warn("Rejecting upload", "file", relPath, "err", err)
+		ack(protocol.AckRejected, err.Error())
+		return false
+	case err != nil:
+		slog.Error("Error storing file", "file", relPath, "err", err)
+		ack(protocol.AckError, "storing file failed")
+		return false
+	}
+	if stored != relPath {
+		slog.Info("File exists, stored upload under a new name", "file", relPath, "stored", stored)
+	}
+	slog.Info("Received file, integrity verified", "file", stored, "bytes", fileSize)
+	s.manifests.received(stored, fileSize)
+	if d, ok := st.(*DiskStore); ok {
+		if err := protocol.RestoreMetadata(d.path(stored), header); err != nil {
+			slog.Error("Error restoring metadata", "file", stored, "err", err)
+		}
+	}
+	ack(protocol.AckOK, "")
+	return true
+}
+
+// errChecksumMismatch is returned by a verifyingReader whose data doesn't
+// match the expected checksum
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// verifyingReader reads the remaining bytes of an upload from r, hashing
+// them with h. The read that returns the last of them fails with
+// errChecksumMismatch unless the hash matches want, which trailer reads
+// at that point if it is set.
+type verifyingReader struct {
+	r         io.Reader
+	h         hash.Hash
+	remaining int64
+	want, got []byte
+	trailer   func() ([]byte, error)
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	if v.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > v.remaining {
+		p = p[:v.remaining]
+	}
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	v.remaining -= int64(n)
+	if v.remaining == 0 {
+		if verifyErr := v.verify(); verifyErr != nil {
+			return n, verifyErr
+		}
+		if err == io.EOF {
+			err = nil
+		}
+	}
+	return n, err
+}
+
+// verify compares the hash of what was read with want, reading it with
+// trailer first if that is set
+func (v *verifyingReader) verify() error {
+	if v.trailer != nil {
+		var err error
+		if v.want, err = v.trailer(); err != nil {
+			return err
+		}
+	}
+	v.got = v.h.Sum(nil)
+	if !bytes.Equal(v.got, v.want) {
+		return errChecksumMismatch
+	}
+	return nil
+}
+
+// checkFileSize refuses a file of size bytes if it's over MaxFileSize
+func (s *Server) checkFileSize(size int64) error {
+	if s.MaxFileSize > 0 && size > s.MaxFileSize {
+		return fmt.Errorf("%w: %d bytes is over the %d byte limit", ErrFileTooLarge, size, s.MaxFileSize)
+	}
+	return nil
+}
+
+// ErrReservedName refuses a file name ending in protocol.PartSuffix. Such
+// names belong to transfers in progress, which listings leave out, so a
+// stored file by that name would never be listed.
+var ErrReservedName = errors.New("names ending in " + protocol.PartSuffix + " are reserved for transfers in progress")
+
+// checkFileName refuses to store a file as name if it is reserved
+func checkFileName(name string) error {
+	if strings.HasSuffix(name, protocol.PartSuffix) {
+		return fmt.Errorf("%w: %s", ErrReservedName, name)
+	}
+	return nil
+}
+
+// readRequestName reads the uint32-length-prefixed name (a filename or
+// pattern) that follows a request opcode. Errors are logged.
+func readRequestName(conn net.Conn) (string, bool) {
+	var nameLen uint32
+	if err := binary.Read(conn, binary.LittleEndian, &nameLen); err != nil {
+		slog.Error("Error reading filename length", "err", err)
+		return "", false
+	}
+	if nameLen > protocol.MaxFilenameLen {
+		slog.Warn("Rejecting filename length", "length", nameLen, "max", protocol.MaxFilenameLen)
+		return "", false
+	}
+	nameBuf := make([]byte, nameLen)
+	if _, err := io.ReadFull(conn, nameBuf); err != nil {
+		slog.Error("Error reading filename", "err", err)
+		return "", false
+	}
+	return string(nameBuf), true
+}
+
+// handleList replies with the files in the store matching the
+// requested glob pattern (every file when it's empty) and, from protocol
+// v7, modified after the requested cutoff. Patterns are matched per path
+// component, so "logs/*.gz" looks inside logs/, and patterns that are
+// absolute or contain ".." are refused.
+func (s *Server) handleList(conn net.Conn, sess protocol.Session) bool {
+	pattern, ok := readRequestName(conn)
+	if !ok {
+		return false
+	}
+	var since int64
+	if sess.Version >= 7 {
+		if err := binary.Read(conn, binary.LittleEndian, &since); err != nil {
+			slog.Error("Error reading list cutoff", "err", err)
+			return false
+		}
+	}
+	var flags uint8
+	if sess.Version >= 9 {
+		if err := binary.Read(conn, binary.LittleEndian, &flags); err != nil {
+			slog.Error("Error reading list flags", "err", err)
+			return false
+		}
+	}
+	partial := flags&protocol.ListPartial != 0
+	if s.NormalizeNames {
+		pattern = protocol.NormalizeName(pattern)
+	}
+
+	entries, err := s.store().List()
+	if err == nil && partial {
+		// Each upload in progress is listed beside any complete file of
+		// the same name, which it will replace
+		entries = append(entries, s.uploads.list()...)
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	}
+	if err == nil {
+		entries, err = matchFiles(entries, pattern, since)
+	}
+	if err != nil {
+		slog.Warn("Rejecting list", "pattern", pattern, "err", err)
+		protocol.WriteAck(conn, protocol.AckRejected, err.Error())
+		return true
+	}
+	if err := protocol.WriteAck(conn, protocol.AckOK, ""); err != nil {
+		slog.Error("Error sending list", "err", err)
+		return false
+	}
+	writeList := protocol.WriteList
+	if partial {
+		writeList = protocol.WritePartialList
+	}
+	if err := writeList(conn, entries); err != nil {
+		slog.Error("Error sending list", "err", err)
+		return false
+	}
+	attrs := []any{"pattern", pattern, "matches", len(entries)}
+	if since != 0 {
+		attrs = append(attrs, "since", time.Unix(0, since))
+	}
+	slog.Info("Sent file list", attrs...)
+	return true
+}
+
+// handleRename renames a file within the storage root. Both names go
+// through CleanPath, and an existing file is never overwritten.
+func (s *Server) handleRename(conn net.Conn) bool {
+	reply := func(status uint8, msg string) {
+		if err := protocol.WriteAck(conn, status, msg); err != nil {
+			slog.Error("Error sending rename reply", "err", err)
+		}
+	}
+
+	oldName, ok := readRequestName(conn)
+	if !ok {
+		return false
+	}
+	newName, ok := readRequestName(conn)
+	if !ok {
+		return false
+	}
+	if s.Store != nil {
+		slog.Warn("Rejecting rename", "err", errNeedsDisk)
+		reply(protocol.AckRejected, errNeedsDisk.Error())
+		return true
+	}
+	var newRel string
+	oldRel, err := s.cleanPath(oldName)
+	if err == nil {
+		newRel, err = s.cleanPath(newName)
+	}
+	if err == nil {
+		// Otherwise a blocked file could be uploaded under another name
+		err = s.Blocklist.AllowUpload(newRel)
+	}
+	if err == nil {
+		err = checkFileName(newRel)
+	}
+	if err != nil {
+		slog.Warn("Rejecting rename", "err", err)
+		reply(protocol.AckRejected, err.Error())
+		return true
+	}
+	// Neither name may pass through a symlink, which could lead out of Root
+	var newPath string
+	oldPath, err := archive.SafePath(s.Root, oldRel)
+	if err == nil {
+		newPath, err = archive.SafePath(s.Root, newRel)
+	}
+	if err != nil {
+		slog.Warn("Rejecting rename", "err", err)
+		reply(protocol.AckRejected, err.Error())
+		return true
+	}
+
+	if info, err := os.Lstat(oldPath); err != nil || !info.Mode().IsRegular() {
+		slog.Warn("Rejecting rename of missing or non-regular file", "file", oldRel)
+		reply(protocol.AckRejected, oldRel+" is not a file")
+		return true
+	}
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		slog.Error("Error creating directory", "path", newPath, "err", err)
+		reply(protocol.AckError, "creating directory failed")
+		return true
+	}
+	// claim fails rather than replace a file that appears at newPath, e.g.
+	// an upload finishing meanwhile
+	err = claim(oldPath, newPath)
+	if errors.Is(err, fs.ErrExist) {
+		slog.Warn("Rejecting rename onto existing file", "file", newRel)
+		reply(protocol.AckRejected, newRel+" already exists")
+		return true
+	}
+	if err != nil {
+		slog.Error("Error renaming file", "from", oldRel, "to", newRel, "err", err)
+		reply(protocol.AckError, "rename failed")
+		return true
+	}
+	slog.Info("Renamed file", "from", oldRel, "to", newRel)
+	reply(protocol.AckOK, "")
+	return true
+}
+
+// handleDelete removes a file from the store. Directories are refused.
+func (s *Server) handleDelete(conn net.Conn) bool {
+	reply := func(status uint8, msg string) {
+		if err := protocol.WriteAck(conn, status, msg); err != nil {
+			slog.Error("Error sending delete reply", "err", err)
+		}
+	}
+
+	name, ok := readRequestName(conn)
+	if !ok {
+		return false
+	}
+	rel, err := s.cleanPath(name)
+	if err != nil {
+		slog.Warn("Rejecting delete", "err", err)
+		reply(protocol.AckRejected, err.Error())
+		return true
+	}
+	if err := s.store().Delete(rel); errors.Is(err, fs.ErrNotExist) {
+		slog.Warn("Rejecting delete of missing or non-regular file", "file", rel)
+		reply(protocol.AckRejected, rel+" is not a file")
+		return true
+	} else if err != nil {
+		slog.Error("Error deleting file", "file", rel, "err", err)
+		reply(protocol.AckError, "delete failed")
+		return true
+	}
+	slog.Info("Deleted file", "file", rel)
+	reply(protocol.AckOK, "")
+	return true
+}
+
+// handleReport logs a client's verification of a file it downloaded. The
+// name is only logged, never opened, so it isn't checked against the store.
+func (s *Server) handleReport(conn net.Conn) bool {
+	name, ok := readRequestName(conn)
+	if !ok {
+		return false
+	}
+	var verified uint8
+	if err := binary.Read(conn, binary.LittleEndian, &verified); err != nil {
+		slog.Error("Error reading verification report", "err", err)
+		return false
+	}
+	if verified == 1 {
+		slog.Info("Client verified download", "file", name, "remote", conn.RemoteAddr())
+	} else {
+		slog.Warn("Client reported a checksum mismatch", "file", name, "remote", conn.RemoteAddr())
+	}
+	if err := protocol.WriteAck(conn, protocol.AckOK, ""); err != nil {
+		slog.Error("Error sending report reply", "err", err)
+		return false
+	}
+	return true
+}
+
+// handleUploadTar unpacks a tar archive under the storage root. An entry
+// that would escape the root, or a file that would exceed the quota, stops
+// the upload; files extracted before it are kept.
+func (s *Server) handleUploadTar(conn net.Conn) bool {
+	slog.Debug("Client initiating tar upload")
+	if s.Store != nil {
+		slog.Warn("Rejecting tar upload", "err", errNeedsDisk)
+		protocol.WriteAck(conn, protocol.AckRejected, errNeedsDisk.Error())
+		return false
+	}
+	if err := os.MkdirAll(s.Root, 0755); err != nil {
+		slog.Error("Error ensuring storage directory", "err", err)
+		protocol.WriteAck(conn, protocol.AckError, "storage unavailable")
+		return false
+	}
+
+	files, err := archive.Extract(conn, s.Root, func(h *tar.Header) error {
+		if err := s.checkFileSize(h.Size); err != nil {
+			return err
+		}
+		if err := s.Blocklist.AllowUpload(h.Name); err != nil {
+			return err
+		}
+		if err := checkFileName(h.Name); err != nil {
+			return err
+		}
+		exceeded, err := storage.QuotaExceeded(s.Root, s.QuotaBytes, h.Size)
+		if err != nil {
+			return err
+		}
+		if exceeded {
+			return storage.ErrQuotaExceeded
+		}
+		return nil
+	})
+	if err != nil {
+		status := uint8(protocol.AckError)
+		if errors.Is(err, protocol.ErrUnsafePath) || errors.Is(err, storage.ErrQuotaExceeded) || errors.Is(err, ErrFileTooLarge) || errors.Is(err, policy.ErrBlockedExtension) || errors.Is(err, ErrReservedName) {
+			status = protocol.AckRejected
+		}
+		slog.Warn("Tar upload failed", "files", files, "err", err)
+		protocol.WriteAck(conn, status, fmt.Sprintf("after %d files: %v", files, err))
+		return false
+	}
+	if err := protocol.WriteAck(conn, protocol.AckOK, ""); err != nil {
+		slog.Error("Error sending upload acknowledgement", "err", err)
+	}
+	slog.Info("Received tar upload", "files", files)
+	return false // archives always end the session
+}
+
+// handleDownloadTar sends a directory under the storage root as a tar
+// archive
+func (s *Server) handleDownloadTar(conn net.Conn) bool {
+	name, ok := readRequestName(conn)
+	if !ok {
+		return false
+	}
+	relPath, err := s.cleanPath(name)
+	if err == nil && s.Store != nil {
+		err = errNeedsDisk
+	}
+	if err != nil {
+		slog.Warn("Rejecting tar download", "err", err)
+		protocol.WriteAck(conn, protocol.AckRejected, err.Error())
+		return true
+	}
+	noteFile(conn, relPath)
+	dir := filepath.Join(s.Root, filepath.FromSlash(relPath))
+	if info, err := os.Lstat(dir); err != nil || !info.IsDir() {
+		slog.Warn("Rejecting tar download of missing or non-directory path", "dir", relPath)
+		protocol.WriteAck(conn, protocol.AckRejected, relPath+" is not a directory")
+		return true
+	}
+
+	if err := protocol.WriteAck(conn, protocol.AckOK, ""); err != nil {
+		slog.Error("Error sending tar download reply", "err", err)
+		return false
+	}
+	files, err := archive.Write(conn, dir, path.Base(relPath))
+	if err != nil {
+		logSendError("Error sending archive", err, "dir", relPath)
+		return false
+	}
+	slog.Info("Sent directory archive", "dir", relPath, "files", files)
+	return false // archives always end the session
+}
+
+// handleStat tells the client whether a file exists and, if so, its size
+// and checksum, so an identical upload can be skipped
+func (s *Server) handleStat(conn net.Conn, sess protocol.Session) bool {
+	name, ok := readRequestName(conn)
+	if !ok {
+		return false
+	}
+	relPath, err := s.cleanPath(name)
+	if err != nil {
+		slog.Warn("Rejecting stat", "err", err)
+		protocol.WriteAck(conn, protocol.AckRejected, err.Error())
+		return true
+	}
+	if err := protocol.WriteAck(conn, protocol.AckOK, ""); err != nil {
+		slog.Error("Error sending stat reply", "err", err)
+		return false
+	}
+
+	file, header, err := s.openFile(relPath, sess.Algo)
+	if err != nil {
+		slog.Debug("Stat: file not found", "file", relPath, "err", err)
+		_, err := conn.Write([]byte{0})
+		return err == nil
+	}
+	file.Close()
+	if _, err := conn.Write([]byte{1}); err != nil {
+		slog.Error("Error sending stat reply", "err", err)
+		return false
+	}
+	if err := protocol.WriteHeader(conn, sess.Version, header); err != nil {
+		slog.Error("Error sending stat reply", "err", err)
+		return false
+	}
+	slog.Debug("Stat: file found", "file", relPath, "size", header.Size)
+	return true
+}
+
+// handleDownloadDir streams every file below a directory of the store over
+// the one connection, each as a header (named after the directory's base
+// name and the path below it) and its content. A directory with no files
+// below it is refused like a missing one.
+func (s *Server) handleDownloadDir(conn net.Conn, sess protocol.Session) bool {
+	name, ok := readRequestName(conn)
+	if !ok {
+		return false
+	}
+	relDir, err := s.cleanPath(name)
+	if err != nil {
+		slog.Warn("Rejecting directory download", "err", err)
+		protocol.WriteAck(conn, protocol.AckRejected, err.Error())
+		return true
+	}
+	noteFile(conn, relDir)
+	all, err := s.store().List()
+	if err != nil {
+		slog.Error("Error listing files", "err", err)
+		protocol.WriteAck(conn, protocol.AckError, "listing files failed")
+		return true
+	}
+	var entries []protocol.FileEntry
+	for _, e := range all {
+		if rel, ok := strings.CutPrefix(e.Name, relDir+"/"); ok {
+			e.Name = rel
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) == 0 {
+		slog.Warn("Rejecting download of missing or non-directory path", "dir", relDir)
+		protocol.WriteAck(conn, protocol.AckRejected, relDir+" is not a directory")
+		return true
+	}
+	if len(entries) > protocol.MaxListEntries {
+		err := fmt.Errorf("more than %d files", protocol.MaxListEntries)
+		slog.Warn("Rejecting directory download", "dir", relDir, "err", err)
+		protocol.WriteAck(conn, protocol.AckRejected, err.Error())
+		return true
+	}
+	if err := protocol.WriteAck(conn, protocol.AckOK, ""); err != nil {
+		slog.Error("Error sending directory download reply", "err", err)
+		return false
+	}
+
+	var total int64
+	sent := 0
+	for _, e := range entries {
+		file, header, err := s.openFile(path.Join(relDir, e.Name), sess.Algo)
+		if err != nil {
+			// Removed or replaced since it was listed
+			slog.Warn("Skipping file", "file", path.Join(relDir, e.Name), "err", err)
+			continue
+		}
+		header.Name = path.Join(path.Base(relDir), e.Name)
+		err = protocol.WriteDirEntry(conn, sess.Version, header)
+		if err == nil {
+			_, err = s.sendContent(conn, file, header.Size, sess.Version, protocol.Compression{})
+		}
+		file.Close()
+		if errors.Is(err, protocol.ErrShortFile) && sess.Version >= 5 {
+			// Padded and reported; the client skips it and reads on
+			slog.Warn("Error sending file", "file", header.Name, "err", err)
+			continue
+		}
+		if err != nil {
+			logSendError("Error sending file", err, "file", header.Name)
+			return false
+		}
+		sent++
+		total += header.Size
+	}
+	if err := protocol.WriteDirEnd(conn); err != nil {
+		slog.Error("Error ending directory download", "err", err)
+		return false
+	}
+	slog.Info("Sent directory", "dir", relDir, "files", sent, "bytes", total)
+	return true
+}
+
+// matchFiles returns the entries whose names match pattern, or all of them
+// when it's empty, leaving out those not modified after since (unix
+// nanoseconds) unless it is 0
+func matchFiles(entries []protocol.FileEntry, pattern string, since int64) ([]protocol.FileEntry, error) {
+	var cleaned string
+	if pattern != "" {
+		var err error
+		if cleaned, err = protocol.CleanPath(pattern); err != nil {
+			return nil, err
+		}
+		if _, err := path.Match(cleaned, ""); err != nil {
+			return nil, fmt.Errorf("bad pattern %q: %w", pattern, err)
+		}
+	}
+
+	var matches []protocol.FileEntry
+	for _, e := range entries {
+		if since != 0 && e.ModTime <= since {
+			continue
+		}
+		if cleaned != "" {
+			if ok, _ := path.Match(cleaned, e.Name); !ok {
+				continue
+			}
+		}
+		matches = append(matches, e)
+		if len(matches) > protocol.MaxListEntries {
+			return nil, fmt.Errorf("more than %d matches", protocol.MaxListEntries)
+		}
+	}
+	return matches, nil
+}
@@ -0,0 +1,2171 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"gopher-fs/internal/client"
+	"gopher-fs/internal/policy"
+	"gopher-fs/internal/protocol"
+	"gopher-fs/internal/security"
+	"gopher-fs/internal/ui"
+)
+
+// startServer runs srv with a fresh storage directory on a loopback TLS
+// listener and returns its address and a client pinned to its certificate
+func startServer(t testing.TB, srv *Server) (string, *client.Client) {
+	t.Helper()
+	tlsConfig, err := security.GenerateTLSConfig()
+	if err != nil {
+		t.Fatalf("GenerateTLSConfig: %v", err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+
+	srv.Root = t.TempDir()
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(l) }()
+	t.Cleanup(func() {
+		l.Close()
+		if err := <-done; !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Serve returned %v, want net.ErrClosed", err)
+		}
+	})
+
+	pinned, err := security.TLSConfigWithPin(security.Fingerprint(tlsConfig.Certificates[0].Certificate[0]))
+	if err != nil {
+		t.Fatalf("TLSConfigWithPin: %v", err)
+	}
+	c := client.New(pinned)
+	c.DialAttempts = 1
+	return l.Addr().String(), c
+}
+
+func randomFile(t *testing.T, size int) (*os.File, []byte) {
+	t.Helper()
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "upload.bin")
+	if err := os.WriteFile(path, data, 0640); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f, data
+}
+
+func TestUploadDownloadRoundTrip(t *testing.T) {
+	for _, algo := range []protocol.ChecksumAlgo{protocol.ChecksumSHA256, protocol.ChecksumSHA512, protocol.ChecksumBLAKE3} {
+		t.Run(algo.String(), func(t *testing.T) {
+			srv := &Server{}
+			addr, c := startServer(t, srv)
+			c.Checksum = algo
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			src, data := randomFile(t, 1<<20+7)
+			if err := c.Upload(ctx, addr, "nested/dir/upload.bin", src, int64(len(data))); err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+			stored, err := os.ReadFile(filepath.Join(srv.Root, "nested", "dir", "upload.bin"))
+			if err != nil {
+				t.Fatalf("reading stored file: %v", err)
+			}
+			if !bytes.Equal(stored, data) {
+				t.Fatal("stored file differs from the upload")
+			}
+
+			var header protocol.FileHeader
+			c.OnHeader = func(h protocol.FileHeader) { header = h }
+			var got bytes.Buffer
+			if err := c.Download(ctx, addr, "nested/dir/upload.bin", &got); err != nil {
+				t.Fatalf("Download: %v", err)
+			}
+			if !bytes.Equal(got.Bytes(), data) {
+				t.Fatal("downloaded data differs from the upload")
+			}
+
+			want, err := algo.Compute(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header.Algo != algo || !bytes.Equal(header.Checksum, want) {
+				t.Errorf("header checksum = %s %x, want %s %x", header.Algo, header.Checksum, algo, want)
+			}
+			if header.Size != int64(len(data)) || header.Mode != 0640 {
+				t.Errorf("header size %d mode %o, want %d 640", header.Size, header.Mode, len(data))
+			}
+		})
+	}
+}
+
+func TestCompressedRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("time=2024-03-01T09:00:00Z level=INFO msg=\"Sent file\" file=logs/app.log\n"), 20000)
+	for _, comp := range []protocol.Compression{{Codec: protocol.CodecGzip}, {Codec: protocol.CodecZstd, Level: 3}} {
+		t.Run(comp.Codec.String(), func(t *testing.T) {
+			srv := &Server{}
+			addr, c := startServer(t, srv)
+			c.Compression = comp
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			if err := c.Upload(ctx, addr, "app.log", bytes.NewReader(data), int64(len(data))); err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+			stored, err := os.ReadFile(filepath.Join(srv.Root, "app.log"))
+			if err != nil || !bytes.Equal(stored, data) {
+				t.Fatalf("stored file differs from the upload (%v)", err)
+			}
+
+			// Each download must end exactly where the next request starts
+			s, err := c.Open(ctx, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			for i := 0; i < 2; i++ {
+				var got bytes.Buffer
+				if err := s.Download(ctx, "app.log", &got); err != nil || !bytes.Equal(got.Bytes(), data) {
+					t.Fatalf("Download #%d = %d bytes, %v; want %d bytes", i+1, got.Len(), err, len(data))
+				}
+			}
+			if _, found, err := s.Stat(ctx, "app.log"); err != nil || !found {
+				t.Fatalf("Stat after downloads = found %v, %v", found, err)
+			}
+			if sent := srv.Metrics.bytesOut.Load(); sent >= 2*int64(len(data))/10 {
+				t.Errorf("sent %d bytes for two downloads of %d, want them compressed", sent, len(data))
+			}
+		})
+	}
+}
+
+func TestUploadFromNonSeekableReader(t *testing.T) {
+	data := bytes.Repeat([]byte("streamed without a second pass\n"), 10000)
+	for _, comp := range []protocol.Compression{{}, {Codec: protocol.CodecGzip}, {Codec: protocol.CodecZstd}} {
+		t.Run(comp.Codec.String(), func(t *testing.T) {
+			srv := &Server{}
+			addr, c := startServer(t, srv)
+			c.Compression = comp
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			// A pipe is an *os.File that can't seek
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			go func() {
+				w.Write(data)
+				w.Close()
+			}()
+			if err := c.Upload(ctx, addr, "piped.txt", r, int64(len(data))); err != nil {
+				t.Fatalf("Upload from a pipe: %v", err)
+			}
+			if err := c.Upload(ctx, addr, "buffered.txt", bytes.NewBuffer(data), int64(len(data))); err != nil {
+				t.Fatalf("Upload from a bytes.Buffer: %v", err)
+			}
+			for _, name := range []string{"piped.txt", "buffered.txt"} {
+				var got bytes.Buffer
+				if err := c.Download(ctx, addr, name, &got); err != nil || !bytes.Equal(got.Bytes(), data) {
+					t.Errorf("Download %s = %d bytes, %v; want %d bytes", name, got.Len(), err, len(data))
+				}
+			}
+		})
+	}
+}
+
+func TestParallelDownload(t *testing.T) {
+	addr, c := startServer(t, &Server{MaxConns: 8})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	src, data := randomFile(t, 3<<20+5)
+	if err := c.Upload(ctx, addr, "big.bin", src, int64(len(data))); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+
+	dst, err := os.Create(filepath.Join(t.TempDir(), "big.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if err := c.DownloadParallel(ctx, addr, "big.bin", dst, 4); err != nil {
+		t.Fatalf("DownloadParallel: %v", err)
+	}
+	got, err := os.ReadFile(dst.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded data differs from the upload")
+	}
+}
+
+func TestEmptyFileRoundTrip(t *testing.T) {
+	addr, c := startServer(t, &Server{})
+	var bars bytes.Buffer
+	c.ShowProgress = true
+	c.Progress = ui.ProgressOptions{Out: &bars}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	src, _ := randomFile(t, 0)
+	if err := c.Upload(ctx, addr, "empty.txt", src, 0); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	var got bytes.Buffer
+	if err := c.Download(ctx, addr, "empty.txt", &got); err != nil || got.Len() != 0 {
+		t.Fatalf("Download = %d bytes, %v; want 0", got.Len(), err)
+	}
+	dst, err := os.Create(filepath.Join(t.TempDir(), "empty.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if err := c.DownloadParallel(ctx, addr, "empty.txt", dst, 4); err != nil {
+		t.Fatalf("DownloadParallel: %v", err)
+	}
+
+	// Every transfer still finishes its bar, at 100% rather than NaN
+	out := bars.String()
+	if strings.Contains(out, "NaN") {
+		t.Errorf("progress output has NaN: %q", out)
+	}
+	if n := strings.Count(out, "Uploaded 100%"); n != 1 {
+		t.Errorf("upload finished %d times in %q, want once", n, out)
+	}
+	if n := strings.Count(out, "Downloaded 100%"); n != 2 {
+		t.Errorf("downloads finished %d times in %q, want twice", n, out)
+	}
+}
+
+func TestUploadOverQuotaRejected(t *testing.T) {
+	srv := &Server{QuotaBytes: 1024}
+	addr, c := startServer(t, srv)
+
+	src, data := randomFile(t, 4096)
+	err := c.Upload(context.Background(), addr, "too-big.bin", src, int64(len(data)))
+	var ackErr *client.AckError
+	if !errors.As(err, &ackErr) || ackErr.Status != protocol.AckRejected {
+		t.Fatalf("Upload = %v, want an AckRejected *AckError", err)
+	}
+	if _, err := os.Stat(filepath.Join(srv.Root, "too-big.bin")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("rejected upload was stored (stat: %v)", err)
+	}
+}
+
+func TestUploadThroughSymlinkRejected(t *testing.T) {
+	srv := &Server{}
+	addr, c := startServer(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "target.txt"), []byte("keep"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(srv.Root, "dir")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "target.txt"), filepath.Join(srv.Root, "file.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"dir/new.txt", "file.txt"} {
+		src, data := randomFile(t, 64)
+		err := c.Upload(ctx, addr, name, src, int64(len(data)))
+		var ackErr *client.AckError
+		if !errors.As(err, &ackErr) || ackErr.Status != protocol.AckRejected {
+			t.Errorf("Upload(%q) = %v, want an AckRejected *AckError", name, err)
+		}
+	}
+	if err := c.Rename(ctx, addr, "file.txt", "dir/moved.txt"); err == nil {
+		t.Error("Rename into a symlinked directory succeeded")
+	}
+
+	entries, err := os.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d files outside the root, want only the original", len(entries))
+	}
+	if data, err := os.ReadFile(filepath.Join(outside, "target.txt")); err != nil || string(data) != "keep" {
+		t.Errorf("symlink target = %q, %v; want it untouched", data, err)
+	}
+}
+
+func TestUploadOverMaxFileSizeRejected(t *testing.T) {
+	srv := &Server{MaxFileSize: 2048}
+	addr, c := startServer(t, srv)
+	ctx := context.Background()
+
+	src, data := randomFile(t, 2048)
+	if err := c.Upload(ctx, addr, "at-limit.bin", src, int64(len(data))); err != nil {
+		t.Fatalf("Upload at the limit: %v", err)
+	}
+
+	src, data = randomFile(t, 2049)
+	err := c.Upload(ctx, addr, "too-big.bin", src, int64(len(data)))
+	var ackErr *client.AckError
+	if !errors.As(err, &ackErr) || ackErr.Status != protocol.AckRejected || !strings.Contains(ackErr.Message, ErrFileTooLarge.Error()) {
+		t.Fatalf("Upload = %v, want an AckRejected *AckError for the size", err)
+	}
+	if _, err := os.Stat(filepath.Join(srv.Root, "too-big.bin")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("rejected upload was written (stat: %v)", err)
+	}
+	if parts := partFiles(t, srv.Root); len(parts) > 0 {
+		t.Errorf("rejected upload left %v behind", parts)
+	}
+}
+
+// partFiles returns the protocol.PartSuffix files directly under dir
+func partFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	parts, err := filepath.Glob(filepath.Join(dir, "*"+protocol.PartSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parts
+}
+
+func TestDownloadMissingFile(t *testing.T) {
+	addr, c := startServer(t, &Server{MaxConns: 8})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := c.Download(ctx, addr, "missing.txt", &bytes.Buffer{}); err == nil {
+		t.Fatal("Download of a missing file succeeded")
+	}
+	if err := c.Download(ctx, addr, "../outside.txt", &bytes.Buffer{}); err == nil {
+		t.Fatal("Download outside the storage root succeeded")
+	}
+}
+
+func TestPathTraversalRejected(t *testing.T) {
+	srv := &Server{}
+	addr, c := startServer(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Beside the storage root, where "../secret.txt" would reach
+	outside := filepath.Dir(srv.Root)
+	secret := filepath.Join(outside, "secret.txt")
+	if err := os.WriteFile(secret, []byte("outside the root"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(srv.Root, "inside.txt"), []byte("inside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"../secret.txt", "../../etc/passwd", "/etc/passwd", "a/../../secret.txt", ".."} {
+		var got bytes.Buffer
+		if err := c.Download(ctx, addr, name, &got); err == nil {
+			t.Errorf("Download(%q) succeeded", name)
+		}
+		if got.Len() > 0 {
+			t.Errorf("Download(%q) received %q", name, got.Bytes())
+		}
+		if _, found, err := c.Stat(ctx, addr, name); err == nil && found {
+			t.Errorf("Stat(%q) found a file", name)
+		}
+		if _, err := c.DownloadDir(ctx, addr, name, t.TempDir()); err == nil {
+			t.Errorf("DownloadDir(%q) succeeded", name)
+		}
+	}
+
+	// The client won't send an unsafe name, so write a version 1 upload
+	// request by hand
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	name, data := "../planted.txt", []byte("planted")
+	checksum := sha256.Sum256(data)
+	var req bytes.Buffer
+	req.WriteByte(protocol.OpUpload)
+	binary.Write(&req, binary.LittleEndian, uint32(len(name)))
+	binary.Write(&req, binary.LittleEndian, int64(len(data)))
+	req.Write(checksum[:])
+	req.WriteString(name)
+	req.Write(data)
+	conn.Write(req.Bytes())
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("server answered an upload of ../planted.txt")
+	}
+	if err := c.Rename(ctx, addr, "inside.txt", "../moved.txt"); err == nil {
+		t.Error("Rename to ../moved.txt succeeded")
+	}
+	if err := c.Delete(ctx, addr, "../secret.txt"); err == nil {
+		t.Error("Delete of ../secret.txt succeeded")
+	}
+	for _, name := range []string{"planted.txt", "moved.txt"} {
+		if _, err := os.Stat(filepath.Join(outside, name)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s was written outside the storage root (stat: %v)", name, err)
+		}
+	}
+	if _, err := os.Stat(secret); err != nil {
+		t.Errorf("file outside the storage root is gone: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(srv.Root, "inside.txt")); err != nil {
+		t.Errorf("rename source is gone: %v", err)
+	}
+}
+
+func TestListSince(t *testing.T) {
+	srv := &Server{}
+	addr, c := startServer(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	old := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{"old.txt", "new.txt", "logs/new.log"} {
+		p := filepath.Join(srv.Root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(filepath.Join(srv.Root, "old.txt"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	since := time.Now().Add(-24 * time.Hour)
+	tests := []struct {
+		pattern string
+		since   time.Time
+		want    []string
+	}{
+		{"", time.Time{}, []string{"logs/new.log", "new.txt", "old.txt"}},
+		{"", since, []string{"logs/new.log", "new.txt"}},
+		{"*.txt", since, []string{"new.txt"}},
+		{"*.txt", time.Now().Add(time.Hour), nil},
+	}
+	for _, tt := range tests {
+		entries, err := c.ListSince(ctx, addr, tt.pattern, tt.since)
+		if err != nil {
+			t.Fatalf("ListSince(%q, %v): %v", tt.pattern, tt.since, err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Name)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ListSince(%q, %v) = %q, want %q", tt.pattern, tt.since, got, tt.want)
+		}
+	}
+}
+
+// gatedReader serves data, but once it has been read through once (an
+// upload's checksum pass) holds any read past limit until gate is closed
+type gatedReader struct {
+	*bytes.Reader
+	limit int64
+	gate  chan struct{}
+	read  int64
+}
+
+func (g *gatedReader) Read(p []byte) (int, error) {
+	pos := g.Size() - int64(g.Len())
+	if g.read >= g.Size() {
+		if pos >= g.limit {
+			<-g.gate
+		} else if int64(len(p)) > g.limit-pos {
+			p = p[:g.limit-pos]
+		}
+	}
+	n, err := g.Reader.Read(p)
+	g.read += int64(n)
+	return n, err
+}
+
+func TestListPartialUploads(t *testing.T) {
+	srv := &Server{MaxConns: 4}
+	addr, c := startServer(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := os.WriteFile(filepath.Join(srv.Root, "big.bin"), []byte("old copy"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 200<<10)
+	src := &gatedReader{Reader: bytes.NewReader(data), limit: 64 << 10, gate: make(chan struct{})}
+	uploaded := make(chan error, 1)
+	go func() { uploaded <- c.Upload(ctx, addr, "big.bin", src, int64(len(data))) }()
+
+	// Once the first 64 KiB have arrived, the upload lists beside the
+	// file it will replace
+	want := []protocol.FileEntry{
+		{Name: "big.bin", Size: 8},
+		{Name: "big.bin", Size: int64(len(data)), Partial: true, Received: 64 << 10},
+	}
+	c.ListPartial = true
+	var entries []protocol.FileEntry
+	for {
+		var err error
+		if entries, err = c.List(ctx, addr, "*.bin"); err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		if len(entries) == 2 && entries[1].Received == want[1].Received {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("List = %+v, want %+v", entries, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := range entries {
+		entries[i].ModTime = 0
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("List = %+v, want %+v", entries, want)
+	}
+
+	// Without ListPartial only complete files are listed
+	c.ListPartial = false
+	if entries, err := c.List(ctx, addr, ""); err != nil || len(entries) != 1 || entries[0].Partial {
+		t.Errorf("List without ListPartial = %+v, %v; want just the complete file", entries, err)
+	}
+
+	close(src.gate)
+	if err := <-uploaded; err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	c.ListPartial = true
+	if entries, err := c.List(ctx, addr, ""); err != nil || len(entries) != 1 || entries[0].Partial || entries[0].Size != int64(len(data)) {
+		t.Errorf("List after the upload = %+v, %v; want just the new file", entries, err)
+	}
+}
+
+func TestNormalizeNames(t *testing.T) {
+	const (
+		nfc = "caf\u00e9/r\u00e9sum\u00e9.txt"
+		nfd = "cafe\u0301/re\u0301sume\u0301.txt"
+	)
+	data := []byte("same name, spelt two ways")
+	upload := func(t *testing.T, c *client.Client, addr, name string) {
+		t.Helper()
+		if err := c.Upload(context.Background(), addr, name, bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatalf("Upload %q: %v", name, err)
+		}
+	}
+
+	t.Run("normalized", func(t *testing.T) {
+		srv := &Server{NormalizeNames: true}
+		addr, c := startServer(t, srv)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		upload(t, c, addr, "cafe\u0301/re\u0301sume\u0301\n.txt")
+		if _, err := os.Stat(filepath.Join(srv.Root, filepath.FromSlash(nfc))); err != nil {
+			t.Fatalf("upload not stored under its NFC name: %v", err)
+		}
+		for _, name := range []string{nfc, nfd} {
+			var got bytes.Buffer
+			if err := c.Download(ctx, addr, name, &got); err != nil || !bytes.Equal(got.Bytes(), data) {
+				t.Errorf("Download %q = %q, %v; want the upload", name, got.Bytes(), err)
+			}
+		}
+		upload(t, c, addr, nfc) // replaces it rather than adding a second file
+		if entries, err := c.List(ctx, addr, "cafe\u0301/*"); err != nil || len(entries) != 1 || entries[0].Name != nfc {
+			t.Errorf("List by an NFD pattern = %+v, %v; want just %q", entries, err, nfc)
+		}
+		if err := c.Delete(ctx, addr, nfd); err != nil {
+			t.Errorf("Delete by the NFD name: %v", err)
+		}
+	})
+
+	t.Run("exact", func(t *testing.T) {
+		addr, c := startServer(t, &Server{})
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		upload(t, c, addr, nfd)
+		if err := c.Download(ctx, addr, nfc, io.Discard); err == nil {
+			t.Error("Download by the NFC name found the NFD upload without NormalizeNames")
+		}
+	})
+}
+
+func TestOnConflict(t *testing.T) {
+	for _, memory := range []bool{false, true} {
+		stores := "disk"
+		if memory {
+			stores = "memory"
+		}
+		newServer := func(policy ConflictPolicy) (*Server, string, *client.Client) {
+			srv := &Server{OnConflict: policy, MaxConns: 8}
+			if memory {
+				srv.Store = NewMemoryStore(0)
+			}
+			addr, c := startServer(t, srv)
+			return srv, addr, c
+		}
+		upload := func(c *client.Client, addr, name, data string) error {
+			return c.Upload(context.Background(), addr, name, strings.NewReader(data), int64(len(data)))
+		}
+		contents := func(t *testing.T, srv *Server) map[string]string {
+			t.Helper()
+			files := map[string]string{}
+			entries, err := srv.store().List()
+			if err != nil {
+				t.Fatalf("List: %v", err)
+			}
+			for _, e := range entries {
+				r, _, err := srv.store().Get(e.Name)
+				if err != nil {
+					t.Fatalf("Get %s: %v", e.Name, err)
+				}
+				data, _ := io.ReadAll(r)
+				r.Close()
+				files[e.Name] = string(data)
+			}
+			return files
+		}
+
+		t.Run(stores+"/overwrite", func(t *testing.T) {
+			srv, addr, c := newServer(ConflictOverwrite)
+			for _, data := range []string{"first", "second"} {
+				if err := upload(c, addr, "dir/report.pdf", data); err != nil {
+					t.Fatalf("Upload: %v", err)
+				}
+			}
+			if got := contents(t, srv); !maps.Equal(got, map[string]string{"dir/report.pdf": "second"}) {
+				t.Errorf("store = %v, want the second upload in place of the first", got)
+			}
+		})
+
+		t.Run(stores+"/reject", func(t *testing.T) {
+			srv, addr, c := newServer(ConflictReject)
+			if err := upload(c, addr, "dir/report.pdf", "first"); err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+			var ackErr *client.AckError
+			if err := upload(c, addr, "dir/report.pdf", "second"); !errors.As(err, &ackErr) || ackErr.Status != protocol.AckRejected {
+				t.Fatalf("Upload over an existing file = %v, want it rejected", err)
+			}
+			if got := contents(t, srv); !maps.Equal(got, map[string]string{"dir/report.pdf": "first"}) {
+				t.Errorf("store = %v, want just the first upload", got)
+			}
+		})
+
+		t.Run(stores+"/rename", func(t *testing.T) {
+			srv, addr, c := newServer(ConflictRename)
+			for _, data := range []string{"first", "second", "third"} {
+				if err := upload(c, addr, "dir/report.pdf", data); err != nil {
+					t.Fatalf("Upload: %v", err)
+				}
+			}
+			want := map[string]string{"dir/report.pdf": "first", "dir/report-1.pdf": "second", "dir/report-2.pdf": "third"}
+			if got := contents(t, srv); !maps.Equal(got, want) {
+				t.Errorf("store = %v, want %v", got, want)
+			}
+		})
+
+		// Uploads racing for one name: the name goes to exactly one of them,
+		// and no upload's data ends up under another's name
+		for _, policy := range []ConflictPolicy{ConflictReject, ConflictRename} {
+			t.Run(stores+"/concurrent "+string(policy), func(t *testing.T) {
+				srv, addr, c := newServer(policy)
+				const uploads = 8
+				errs := make(chan error, uploads)
+				for i := 0; i < uploads; i++ {
+					go func(i int) {
+						errs <- upload(c, addr, "race.bin", strings.Repeat(strconv.Itoa(i), 64<<10))
+					}(i)
+				}
+				succeeded := 0
+				for i := 0; i < uploads; i++ {
+					if err := <-errs; err == nil {
+						succeeded++
+					}
+				}
+				files := contents(t, srv)
+				if policy == ConflictReject && (succeeded != 1 || len(files) != 1) {
+					t.Errorf("%d uploads succeeded leaving %d files, want 1 and 1", succeeded, len(files))
+				}
+				if policy == ConflictRename && (succeeded != uploads || len(files) != uploads) {
+					t.Errorf("%d uploads succeeded leaving %d files, want %d and %d", succeeded, len(files), uploads, uploads)
+				}
+				seen := map[byte]bool{}
+				for name, data := range files {
+					if len(data) != 64<<10 || strings.Count(data, data[:1]) != len(data) || seen[data[0]] {
+						t.Errorf("%s holds a mix of uploads or a duplicate", name)
+					}
+					seen[data[0]] = true
+				}
+			})
+		}
+	}
+}
+
+// claim never replaces what is at the target, and the target only appears
+// holding the whole part file
+func TestClaim(t *testing.T) {
+	dir := t.TempDir()
+	part := filepath.Join(dir, "upload.part")
+	target := filepath.Join(dir, "report.pdf")
+	if err := os.WriteFile(part, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(target, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := claim(part, target); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("claim over an existing file = %v, want fs.ErrExist", err)
+	}
+	if data, _ := os.ReadFile(target); string(data) != "old" {
+		t.Errorf("existing file = %q after a refused claim, want old", data)
+	}
+
+	free := filepath.Join(dir, "report-1.pdf")
+	if err := claim(part, free); err != nil {
+		t.Fatalf("claim of a free name: %v", err)
+	}
+	if data, _ := os.ReadFile(free); string(data) != "new" {
+		t.Errorf("claimed file = %q, want new", data)
+	}
+	if _, err := os.Stat(part); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("part file left after claiming: %v", err)
+	}
+}
+
+func TestConflictName(t *testing.T) {
+	tests := []struct {
+		name string
+		n    int
+		want string
+	}{
+		{"report.pdf", 0, "report.pdf"},
+		{"report.pdf", 1, "report-1.pdf"},
+		{"a/b/report.pdf", 12, "a/b/report-12.pdf"},
+		{"archive.tar.gz", 1, "archive.tar-1.gz"},
+		{"README", 2, "README-2"},
+		{"a/.env", 1, "a/.env-1"},
+	}
+	for _, tt := range tests {
+		if got := ConflictName(tt.name, tt.n); got != tt.want {
+			t.Errorf("ConflictName(%q, %d) = %q, want %q", tt.name, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestRename(t *testing.T) {
+	srv := &Server{}
+	addr, c := startServer(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, name := range []string{"a.txt", "taken.txt"} {
+		if err := os.WriteFile(filepath.Join(srv.Root, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.Rename(ctx, addr, "a.txt", "sub/b.txt"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(srv.Root, "sub", "b.txt")); err != nil || string(got) != "a.txt" {
+		t.Fatalf("renamed file = %q, %v", got, err)
+	}
+
+	// A directory symlink inside Root leads to files outside it
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(srv.Root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	rejected := []struct{ from, to string }{
+		{"sub/b.txt", "taken.txt"},
+		{"link/secret.txt", "stolen.txt"},
+		{"sub/b.txt", "link/b.txt"},
+		{"missing.txt", "c.txt"},
+		{"sub/b.txt", "../escape.txt"},
+		{"../etc/passwd", "c.txt"},
+		{"sub", "d"},
+	}
+	for _, r := range rejected {
+		err := c.Rename(ctx, addr, r.from, r.to)
+		var ackErr *client.AckError
+		if !errors.As(err, &ackErr) || ackErr.Status != protocol.AckRejected {
+			t.Errorf("Rename(%q, %q) = %v, want an AckRejected *AckError", r.from, r.to, err)
+		}
+	}
+	if got, err := os.ReadFile(filepath.Join(srv.Root, "taken.txt")); err != nil || string(got) != "taken.txt" {
+		t.Errorf("existing file was overwritten: %q, %v", got, err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "secret.txt")); err != nil {
+		t.Errorf("file outside Root was moved: %v", err)
+	}
+}
+
+func TestTarRoundTrip(t *testing.T) {
+	addr, c := startServer(t, &Server{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	src := filepath.Join(t.TempDir(), "tree")
+	files := map[string]string{"a.txt": "a", "sub/b.txt": "b", "sub/deeper/c.txt": "c"}
+	for name, content := range files {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sent, err := c.UploadTar(ctx, addr, src)
+	if err != nil {
+		t.Fatalf("UploadTar: %v", err)
+	}
+	if sent != len(files) {
+		t.Errorf("UploadTar sent %d files, want %d", sent, len(files))
+	}
+
+	dest := t.TempDir()
+	got, err := c.DownloadTar(ctx, addr, "tree/sub", dest)
+	if err != nil {
+		t.Fatalf("DownloadTar: %v", err)
+	}
+	if got != 2 {
+		t.Errorf("DownloadTar wrote %d files, want 2", got)
+	}
+	for name, content := range map[string]string{"sub/b.txt": "b", "sub/deeper/c.txt": "c"} {
+		data, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+		if err != nil || string(data) != content {
+			t.Errorf("%s = %q, %v; want %q", name, data, err, content)
+		}
+	}
+
+	_, err = c.DownloadTar(ctx, addr, "../tree", dest)
+	var ackErr *client.AckError
+	if !errors.As(err, &ackErr) || ackErr.Status != protocol.AckRejected {
+		t.Errorf("DownloadTar outside the root = %v, want an AckRejected *AckError", err)
+	}
+
+	// Into a server directory that doesn't exist yet, but not out of the root
+	if _, err := c.UploadTarAs(ctx, addr, src, "projects/alpha/tree"); err != nil {
+		t.Fatalf("UploadTarAs: %v", err)
+	}
+	if _, _, err := c.Stat(ctx, addr, "projects/alpha/tree/sub/deeper/c.txt"); err != nil {
+		t.Errorf("Stat of a file uploaded under a prefix: %v", err)
+	}
+	if _, err := c.UploadTarAs(ctx, addr, src, "../escape"); !errors.As(err, &ackErr) || ackErr.Status != protocol.AckRejected {
+		t.Errorf("UploadTarAs outside the root = %v, want an AckRejected *AckError", err)
+	}
+}
+
+func TestDownloadDir(t *testing.T) {
+	srv := &Server{}
+	addr, c := startServer(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	files := map[string]string{"docs/a.txt": "a", "docs/sub/b.txt": "bb", "docs/sub/deep/c.txt": "ccc", "other.txt": "x"}
+	for name, content := range files {
+		p := filepath.Join(srv.Root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dest := t.TempDir()
+	results, err := c.DownloadDir(ctx, addr, "docs", dest)
+	if err != nil {
+		t.Fatalf("DownloadDir: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("DownloadDir returned %d results, want 3", len(results))
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			t.Errorf("%s: %v", r.Header.Name, r.Err)
+		}
+	}
+	for name, content := range files {
+		data, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+		if name == "other.txt" {
+			if err == nil {
+				t.Error("file outside the requested directory was downloaded")
+			}
+			continue
+		}
+		if err != nil || string(data) != content {
+			t.Errorf("%s = %q, %v; want %q", name, data, err, content)
+		}
+	}
+
+	for _, dir := range []string{"../docs", "other.txt", "missing"} {
+		_, err := c.DownloadDir(ctx, addr, dir, dest)
+		var ackErr *client.AckError
+		if !errors.As(err, &ackErr) || ackErr.Status != protocol.AckRejected {
+			t.Errorf("DownloadDir(%q) = %v, want an AckRejected *AckError", dir, err)
+		}
+	}
+}
+
+func TestDownloadDirSkipsUnwritableFile(t *testing.T) {
+	srv := &Server{}
+	addr, c := startServer(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	files := map[string]string{"docs/a.txt": "a", "docs/sub/b.txt": "bb", "docs/z.txt": "zzz"}
+	for name, content := range files {
+		p := filepath.Join(srv.Root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A directory in the way of its .part file makes b.txt fail locally;
+	// its data and trailer must still be skipped for the files after it
+	dest := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dest, "docs", "sub", "b.txt"+protocol.PartSuffix), 0755); err != nil {
+		t.Fatal(err)
+	}
+	results, err := c.DownloadDir(ctx, addr, "docs", dest)
+	if err != nil {
+		t.Fatalf("DownloadDir: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("DownloadDir returned %d results, want 3", len(results))
+	}
+	for _, r := range results {
+		if failed := r.Err != nil; failed != (r.Header.Name == "docs/sub/b.txt") {
+			t.Errorf("%s: err = %v", r.Header.Name, r.Err)
+		}
+	}
+	for _, name := range []string{"docs/a.txt", "docs/z.txt"} {
+		if data, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(name))); err != nil || string(data) != files[name] {
+			t.Errorf("%s = %q, %v; want %q", name, data, err, files[name])
+		}
+	}
+}
+
+func TestIdleTimeoutDisconnectsStalledClient(t *testing.T) {
+	addr, _ := startServer(t, &Server{IdleTimeout: 200 * time.Millisecond})
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	// Say hello, then stall instead of sending the opcode
+	if _, err := conn.Write([]byte{protocol.OpHello, 1}); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	buf := make([]byte, 16)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				t.Fatal("server kept the stalled connection open")
+			}
+			break
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("disconnected after %v, want about 200ms", elapsed)
+	}
+}
+
+func TestMaxConnsQueuesExtraClients(t *testing.T) {
+	const limit = 3
+	addr, _ := startServer(t, &Server{MaxConns: limit})
+	// The handshake only completes once the server accepts the connection
+	dial := func() (*tls.Conn, error) {
+		return tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	}
+
+	var held []*tls.Conn
+	defer func() {
+		for _, conn := range held {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < limit; i++ {
+		conn, err := dial()
+		if err != nil {
+			t.Fatalf("Dial #%d within the limit: %v", i+1, err)
+		}
+		held = append(held, conn)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		conn, err := dial()
+		if err == nil {
+			conn.Close()
+		}
+		served <- err
+	}()
+	select {
+	case err := <-served:
+		t.Fatalf("connection over the limit was served while %d were open (err %v)", limit, err)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	held[0].Close()
+	held = held[1:]
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("queued connection failed once a slot freed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued connection not served after a slot freed")
+	}
+}
+
+// tricklingReader serves data, but once it has been read through once (an
+// upload's checksum pass) gives out at most chunk bytes per read, every
+// delay: steady progress that never idles, but takes its time
+type tricklingReader struct {
+	*bytes.Reader
+	chunk int
+	delay time.Duration
+	read  int64
+}
+
+func (r *tricklingReader) Read(p []byte) (int, error) {
+	if r.read >= r.Size() {
+		time.Sleep(r.delay)
+		p = p[:min(len(p), r.chunk)]
+	}
+	n, err := r.Reader.Read(p)
+	r.read += int64(n)
+	return n, err
+}
+
+func TestTransferTimeout(t *testing.T) {
+	const size = 256 << 10
+	slowUpload := func() *tricklingReader {
+		return &tricklingReader{Reader: bytes.NewReader(make([]byte, size)), chunk: 1 << 10, delay: 5 * time.Millisecond}
+	}
+	slowWriter := writerFunc(func(p []byte) (int, error) {
+		time.Sleep(5 * time.Millisecond)
+		return len(p), nil
+	})
+
+	t.Run("server aborts upload", func(t *testing.T) {
+		srv := &Server{IdleTimeout: 10 * time.Second, TransferTimeout: 200 * time.Millisecond}
+		addr, c := startServer(t, srv)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		start := time.Now()
+		if err := c.Upload(ctx, addr, "slow.bin", slowUpload(), size); err == nil {
+			t.Fatal("Upload over the server's transfer timeout succeeded")
+		}
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Errorf("Upload failed after %v, want about 200ms", elapsed)
+		}
+		// The server cleans up once its handler returns
+		deadline := time.Now().Add(5 * time.Second)
+		for len(partFiles(t, srv.Root)) > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if parts := partFiles(t, srv.Root); len(parts) > 0 {
+			t.Errorf("aborted upload left %v", parts)
+		}
+		if _, err := os.Stat(filepath.Join(srv.Root, "slow.bin")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("aborted upload was stored (stat: %v)", err)
+		}
+	})
+
+	t.Run("client aborts upload", func(t *testing.T) {
+		addr, c := startServer(t, &Server{})
+		c.TransferTimeout = 200 * time.Millisecond
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := c.Upload(ctx, addr, "slow.bin", slowUpload(), size); !errors.Is(err, client.ErrTransferTimeout) {
+			t.Fatalf("Upload = %v, want ErrTransferTimeout", err)
+		}
+	})
+
+	t.Run("client aborts download", func(t *testing.T) {
+		srv := &Server{BufferSize: 1 << 10}
+		addr, c := startServer(t, srv)
+		c.TransferTimeout = 200 * time.Millisecond
+		c.BufferSize = 1 << 10
+		reconnected := false
+		c.OnReconnect = func(int, int64, error) { reconnected = true }
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := os.WriteFile(filepath.Join(srv.Root, "slow.bin"), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.Download(ctx, addr, "slow.bin", slowWriter); !errors.Is(err, client.ErrTransferTimeout) {
+			t.Fatalf("Download = %v, want ErrTransferTimeout", err)
+		}
+		if reconnected {
+			t.Error("Download reconnected after its transfer timeout")
+		}
+	})
+
+	t.Run("within the limit", func(t *testing.T) {
+		srv := &Server{TransferTimeout: 10 * time.Second}
+		addr, c := startServer(t, srv)
+		c.TransferTimeout = 10 * time.Second
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		f, data := randomFile(t, size)
+		if err := c.Upload(ctx, addr, "quick.bin", f, size); err != nil {
+			t.Fatalf("Upload: %v", err)
+		}
+		var got bytes.Buffer
+		if err := c.Download(ctx, addr, "quick.bin", &got); err != nil || !bytes.Equal(got.Bytes(), data) {
+			t.Errorf("Download = %d bytes, %v; want the uploaded file", got.Len(), err)
+		}
+	})
+}
+
+func TestStat(t *testing.T) {
+	srv := &Server{}
+	addr, c := startServer(t, srv)
+	c.Checksum = protocol.ChecksumBLAKE3
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	data := []byte("already here")
+	if err := os.WriteFile(filepath.Join(srv.Root, "here.txt"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h, found, err := c.Stat(ctx, addr, "here.txt")
+	if err != nil || !found {
+		t.Fatalf("Stat(here.txt) = found %v, %v", found, err)
+	}
+	want, _ := protocol.ChecksumBLAKE3.Compute(bytes.NewReader(data))
+	if h.Size != int64(len(data)) || h.Algo != protocol.ChecksumBLAKE3 || !bytes.Equal(h.Checksum, want) {
+		t.Errorf("Stat header = size %d %s %x, want size %d blake3 %x", h.Size, h.Algo, h.Checksum, len(data), want)
+	}
+
+	if _, found, err := c.Stat(ctx, addr, "missing.txt"); err != nil || found {
+		t.Errorf("Stat(missing.txt) = found %v, %v; want not found", found, err)
+	}
+	var ackErr *client.AckError
+	if _, _, err := c.Stat(ctx, addr, "../here.txt"); !errors.As(err, &ackErr) {
+		t.Errorf("Stat outside the root = %v, want an *AckError", err)
+	}
+}
+
+func TestMetricsCountTraffic(t *testing.T) {
+	srv := &Server{}
+	addr, c := startServer(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := os.WriteFile(filepath.Join(srv.Root, "m.txt"), []byte("metrics"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.Stat(ctx, addr, "m.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server finishes its bookkeeping after the client has its reply
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.Metrics.transfers.Load() < 1 || srv.Metrics.activeConns.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("transfers = %d, active = %d; want 1 and 0",
+				srv.Metrics.transfers.Load(), srv.Metrics.activeConns.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if srv.Metrics.bytesIn.Load() == 0 || srv.Metrics.bytesOut.Load() == 0 {
+		t.Errorf("bytes in/out = %d/%d, want both counted", srv.Metrics.bytesIn.Load(), srv.Metrics.bytesOut.Load())
+	}
+
+	var buf bytes.Buffer
+	if err := srv.Metrics.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"gopherfs_transfers_total 1\n", "gopherfs_active_connections 0\n", "# TYPE gopherfs_bytes_in_total counter\n"} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("exposition lacks %q:\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestActiveTransfers(t *testing.T) {
+	srv := &Server{}
+	addr, c := startServer(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Hold the upload partway through, leaving its connection open
+	c.Pause = &ui.Pauser{}
+	var once sync.Once
+	c.OnUploadProgress = func(current, total int64) {
+		if current < total {
+			once.Do(c.Pause.Pause)
+		}
+	}
+	src, data := randomFile(t, 1<<20)
+	done := make(chan error, 1)
+	go func() { done <- c.Upload(ctx, addr, "dir/held.bin", src, int64(len(data))) }()
+
+	var active []Transfer
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		active = srv.Metrics.Active()
+		if c.Pause.Paused() && len(active) == 1 && active[0].File == "dir/held.bin" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Active = %+v, want the held upload", active)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if tr := active[0]; tr.Op != "upload" || tr.Remote == "" || tr.Started.IsZero() || tr.BytesIn >= int64(len(data)) {
+		t.Errorf("held upload = %+v", tr)
+	}
+
+	c.Pause.Resume()
+	if err := <-done; err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for len(srv.Metrics.Active()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Active = %+v after the upload finished, want none", srv.Metrics.Active())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSession(t *testing.T) {
+	srv := &Server{}
+	addr, c := startServer(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	data := []byte("one connection, many requests")
+	if err := os.WriteFile(filepath.Join(srv.Root, "s.txt"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := c.Open(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if entries, err := s.List(ctx, ""); err != nil || len(entries) != 1 {
+		t.Fatalf("List = %v, %v; want one entry", entries, err)
+	}
+	for i := 0; i < 2; i++ {
+		var buf bytes.Buffer
+		if err := s.Download(ctx, "s.txt", &buf); err != nil || !bytes.Equal(buf.Bytes(), data) {
+			t.Fatalf("Download #%d = %q, %v", i+1, buf.Bytes(), err)
+		}
+	}
+	if _, found, err := s.Stat(ctx, "missing.txt"); err != nil || found {
+		t.Fatalf("Stat(missing.txt) = found %v, %v; want not found", found, err)
+	}
+	// A refusal is answered in full, so the session carries on
+	var ackErr *client.AckError
+	if err := s.Rename(ctx, "s.txt", "../s.txt"); !errors.As(err, &ackErr) {
+		t.Fatalf("Rename outside the root = %v, want an *AckError", err)
+	}
+	if err := s.Rename(ctx, "s.txt", "t.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := s.Stat(ctx, "t.txt"); err != nil || !found {
+		t.Fatalf("Stat(t.txt) = found %v, %v", found, err)
+	}
+	if got := srv.Metrics.activeConns.Load(); got != 1 {
+		t.Errorf("active connections = %d, want 1", got)
+	}
+
+	// A missing file closes the connection, and with it the session
+	if err := s.Download(ctx, "missing.txt", io.Discard); err == nil {
+		t.Fatal("Download(missing.txt) succeeded")
+	}
+	if _, err := s.List(ctx, ""); err == nil {
+		t.Error("List after the session broke succeeded")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.Metrics.activeConns.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("server kept the broken session's connection open")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := srv.Metrics.transfers.Load(); got != 8 {
+		t.Errorf("transfers = %d, want 8", got)
+	}
+
+	// One-shot requests still get their reply and hang up
+	if _, found, err := c.Stat(ctx, addr, "t.txt"); err != nil || !found {
+		t.Fatalf("one-shot Stat(t.txt) = found %v, %v", found, err)
+	}
+}
+
+func TestSessionDownloadsBackToBack(t *testing.T) {
+	srv := &Server{BufferSize: 4096}
+	addr, c := startServer(t, srv)
+	c.BufferSize = 1000 // never a multiple of the file sizes
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Sizes on and around buffer boundaries, an empty file, and content
+	// that reads as a valid trailer or header if a read runs over
+	files := map[string][]byte{
+		"exact.bin":  bytes.Repeat([]byte{protocol.AckOK}, 4096),
+		"odd.bin":    bytes.Repeat([]byte("gopher"), 1001),
+		"empty.bin":  nil,
+		"header.bin": append(binary.LittleEndian.AppendUint32(nil, 4), "next"...),
+	}
+	names := []string{"exact.bin", "odd.bin", "empty.bin", "header.bin", "odd.bin", "exact.bin"}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(srv.Root, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := c.Open(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i, name := range names {
+		var got bytes.Buffer
+		if err := s.Download(ctx, name, &got); err != nil {
+			t.Fatalf("Download #%d (%s): %v", i+1, name, err)
+		}
+		if !bytes.Equal(got.Bytes(), files[name]) {
+			t.Fatalf("Download #%d (%s) = %d bytes, want %d", i+1, name, got.Len(), len(files[name]))
+		}
+	}
+	if _, found, err := s.Stat(ctx, "odd.bin"); err != nil || !found {
+		t.Fatalf("Stat after the downloads = found %v, %v", found, err)
+	}
+}
+
+func TestUploadChecksumMismatchLeavesNothing(t *testing.T) {
+	srv := &Server{}
+	addr, _ := startServer(t, srv)
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	sess, err := protocol.ClientHello(conn, protocol.ChecksumSHA256)
+	if err != nil {
+		t.Fatalf("ClientHello: %v", err)
+	}
+	data := []byte("not what the checksum says")
+	h := protocol.FileHeader{Name: "bad.txt", Size: int64(len(data)), Algo: protocol.ChecksumSHA256, Checksum: make([]byte, 32)}
+	if _, err := conn.Write([]byte{protocol.OpUpload}); err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.WriteHeader(conn, sess.Version, h); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if status, _, err := protocol.ReadAck(conn); err != nil || status != protocol.AckChecksumMismatch {
+		t.Fatalf("ReadAck = %d, %v; want AckChecksumMismatch", status, err)
+	}
+
+	// The same goes for a checksum sent after the data
+	conn.Close()
+	conn, err = tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if sess, err = protocol.ClientHello(conn, protocol.ChecksumSHA256); err != nil {
+		t.Fatalf("ClientHello: %v", err)
+	}
+	h.Checksum = nil
+	if _, err := conn.Write([]byte{protocol.OpUpload}); err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.WriteHeader(conn, sess.Version, h); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(append(data, make([]byte, 32)...)); err != nil {
+		t.Fatal(err)
+	}
+	if status, _, err := protocol.ReadAck(conn); err != nil || status != protocol.AckChecksumMismatch {
+		t.Fatalf("ReadAck after a trailing checksum = %d, %v; want AckChecksumMismatch", status, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(srv.Root, "bad.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("bad.txt left behind (stat: %v)", err)
+	}
+	if parts := partFiles(t, srv.Root); len(parts) > 0 {
+		t.Errorf("%v left behind", parts)
+	}
+}
+
+func TestBlockedExtensionRejected(t *testing.T) {
+	srv := &Server{Blocklist: policy.ParseBlocklist(".exe,.sh")}
+	addr, c := startServer(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	src, data := randomFile(t, 1024)
+	err := c.Upload(ctx, addr, "room1/SETUP.EXE", src, int64(len(data)))
+	var ackErr *client.AckError
+	if !errors.As(err, &ackErr) || ackErr.Status != protocol.AckRejected || !strings.Contains(ackErr.Message, policy.ErrBlockedExtension.Error()) {
+		t.Fatalf("Upload = %v, want an AckRejected *AckError for the extension", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(srv.Root, "room1")); len(entries) > 0 {
+		t.Errorf("blocked upload left %d files behind", len(entries))
+	}
+
+	// Nor can an allowed upload be renamed to a blocked name
+	src.Seek(0, io.SeekStart)
+	if err := c.Upload(ctx, addr, "setup.txt", src, int64(len(data))); err != nil {
+		t.Fatalf("Upload of an allowed name: %v", err)
+	}
+	if err := c.Rename(ctx, addr, "setup.txt", "setup.sh"); err == nil {
+		t.Error("Rename to a blocked extension succeeded")
+	}
+}
+
+// A file stored under a .part name would be left out of listings, so none
+// can be uploaded or renamed to one
+func TestPartSuffixNamesRejected(t *testing.T) {
+	srv := &Server{}
+	addr, c := startServer(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var ackErr *client.AckError
+	err := c.Upload(ctx, addr, "notes.part", strings.NewReader("notes"), 5)
+	if !errors.As(err, &ackErr) || ackErr.Status != protocol.AckRejected {
+		t.Errorf("Upload as notes.part = %v, want an AckRejected *AckError", err)
+	}
+
+	if err := c.Upload(ctx, addr, "notes.txt", strings.NewReader("notes"), 5); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if err := c.Rename(ctx, addr, "notes.txt", "draft.part"); !errors.As(err, &ackErr) || ackErr.Status != protocol.AckRejected {
+		t.Errorf("Rename to draft.part = %v, want an AckRejected *AckError", err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "tree")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "notes.part"), []byte("notes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.UploadTar(ctx, addr, dir); !errors.As(err, &ackErr) || ackErr.Status != protocol.AckRejected {
+		t.Errorf("UploadTar of notes.part = %v, want an AckRejected *AckError", err)
+	}
+
+	entries, err := c.List(ctx, addr, "")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name != "notes.txt" {
+		t.Errorf("List = %+v, want just notes.txt", entries)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	srv := &Server{}
+	addr, c := startServer(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	local := t.TempDir()
+	files := map[string]string{}
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		files["set/"+name] = filepath.Join(local, name)
+		if err := os.WriteFile(files["set/"+name], []byte("content of "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// One is already on the server, another is there with other content
+	os.MkdirAll(filepath.Join(srv.Root, "set"), 0755)
+	os.WriteFile(filepath.Join(srv.Root, "set", "a.txt"), []byte("content of a.txt"), 0644)
+	os.WriteFile(filepath.Join(srv.Root, "set", "b.txt"), []byte("content of B.txt"), 0644)
+
+	m, err := c.BuildManifest(files)
+	if err != nil {
+		t.Fatalf("BuildManifest: %v", err)
+	}
+	missing, err := c.SendManifest(ctx, addr, m)
+	if err != nil {
+		t.Fatalf("SendManifest: %v", err)
+	}
+	var names []string
+	for _, e := range missing {
+		names = append(names, e.Name)
+	}
+	if strings.Join(names, ",") != "set/b.txt,set/c.txt" {
+		t.Fatalf("missing = %v, want set/b.txt and set/c.txt", names)
+	}
+
+	// Uploading only some of them leaves the rest missing
+	upload := func(name string) {
+		f, err := os.Open(files[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		info, _ := f.Stat()
+		if err := c.Upload(ctx, addr, name, f, info.Size()); err != nil {
+			t.Fatalf("Upload %s: %v", name, err)
+		}
+	}
+	upload("set/b.txt")
+	if missing, err = c.SendManifest(ctx, addr, m); err != nil || len(missing) != 1 || missing[0].Name != "set/c.txt" {
+		t.Fatalf("after one upload SendManifest = %v, %v; want only set/c.txt missing", missing, err)
+	}
+	upload("set/c.txt")
+	if missing, err = c.SendManifest(ctx, addr, m); err != nil || len(missing) != 0 {
+		t.Fatalf("once complete SendManifest = %v, %v; want nothing missing", missing, err)
+	}
+
+	m.Files = append(m.Files, m.Files[0])
+	var ackErr *client.AckError
+	if _, err := c.SendManifest(ctx, addr, m); !errors.As(err, &ackErr) || ackErr.Status != protocol.AckRejected {
+		t.Errorf("SendManifest with a duplicate = %v, want AckRejected", err)
+	}
+}
+
+func TestConcurrentUploadsOfTheSameName(t *testing.T) {
+	srv := &Server{MaxConns: 8}
+	addr, c := startServer(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// What the web gateway does when two rooms get an image.png at once
+	rooms := []string{"room1", "room2"}
+	want := make(map[string][]byte)
+	var wg sync.WaitGroup
+	for _, room := range rooms {
+		src, data := randomFile(t, 1<<20)
+		want[room] = data
+		wg.Add(1)
+		go func(room string, src *os.File, size int64) {
+			defer wg.Done()
+			if err := c.Upload(ctx, addr, room+"/image.png", src, size); err != nil {
+				t.Errorf("Upload to %s: %v", room, err)
+			}
+		}(room, src, int64(len(data)))
+	}
+	wg.Wait()
+
+	for _, room := range rooms {
+		got, err := os.ReadFile(filepath.Join(srv.Root, room, "image.png"))
+		if err != nil {
+			t.Fatalf("reading %s/image.png: %v", room, err)
+		}
+		if !bytes.Equal(got, want[room]) {
+			t.Errorf("%s/image.png differs from what was uploaded to it", room)
+		}
+		if parts := partFiles(t, filepath.Join(srv.Root, room)); len(parts) > 0 {
+			t.Errorf("%v left behind", parts)
+		}
+	}
+
+	// Two uploads racing to the same name must each land whole, never a mix
+	srcA, dataA := randomFile(t, 1<<20)
+	srcB, dataB := randomFile(t, 1<<20)
+	wg.Add(2)
+	for _, src := range []*os.File{srcA, srcB} {
+		go func(src *os.File) {
+			defer wg.Done()
+			if err := c.Upload(ctx, addr, "room1/image.png", src, 1<<20); err != nil {
+				t.Errorf("Upload: %v", err)
+			}
+		}(src)
+	}
+	wg.Wait()
+	got, err := os.ReadFile(filepath.Join(srv.Root, "room1", "image.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, dataA) && !bytes.Equal(got, dataB) {
+		t.Error("racing uploads of one name left a mix of both")
+	}
+}
+
+func TestCancelledUploadLeavesNothing(t *testing.T) {
+	srv := &Server{}
+	addr, c := startServer(t, srv)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Stands in for a browser that goes away halfway through its upload.
+	// Upload reads the source once for the checksum before sending it.
+	const size = 1 << 20
+	src := &cancellingReader{ReadSeeker: bytes.NewReader(make([]byte, size)), after: size + size/2, cancel: cancel}
+	if err := c.Upload(ctx, addr, "room1/big.bin", src, size); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Upload = %v, want context.Canceled", err)
+	}
+
+	// The server notices the dropped connection on its own schedule
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		entries, _ := os.ReadDir(filepath.Join(srv.Root, "room1"))
+		if len(entries) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("cancelled upload left %d files in room1", len(entries))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUploadSourceFailureReturnsPromptly(t *testing.T) {
+	// Left waiting for the rest of the data, the server would only give
+	// up after its idle timeout
+	srv := &Server{IdleTimeout: time.Minute}
+	addr, c := startServer(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	errBroken := errors.New("source broke")
+	src := io.MultiReader(bytes.NewReader(make([]byte, 64<<10)), iotest.ErrReader(errBroken))
+	start := time.Now()
+	if err := c.Upload(ctx, addr, "broken.bin", src, 1<<20); !errors.Is(err, errBroken) {
+		t.Fatalf("Upload = %v, want the source's error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Upload took %v to give up", elapsed)
+	}
+}
+
+// cancellingReader calls cancel, and fails from then on, once after bytes
+// have been read from it
+type cancellingReader struct {
+	io.ReadSeeker
+	after  int
+	cancel func()
+	read   int
+}
+
+func (r *cancellingReader) Read(p []byte) (int, error) {
+	if r.read >= r.after {
+		r.cancel()
+		return 0, context.Canceled
+	}
+	n, err := r.ReadSeeker.Read(p[:min(len(p), r.after-r.read)])
+	r.read += n
+	return n, err
+}
+
+// writerFunc adapts a function to io.Writer
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+func TestDownloadReportsFileTruncatedMidTransfer(t *testing.T) {
+	srv := &Server{}
+	addr, c := startServer(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// Far more than fits in the socket buffers, so the server is still
+	// reading the file when it gets truncated
+	path := filepath.Join(srv.Root, "shrinking.bin")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("gopher"), 32<<20/6), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var once sync.Once
+	var truncErr error
+	err := c.Download(ctx, addr, "shrinking.bin", writerFunc(func(p []byte) (int, error) {
+		once.Do(func() { truncErr = os.Truncate(path, 1024) })
+		return len(p), nil
+	}))
+	if truncErr != nil {
+		t.Fatal(truncErr)
+	}
+	var ackErr *client.AckError
+	if !errors.As(err, &ackErr) || !strings.Contains(ackErr.Message, protocol.ErrShortFile.Error()) {
+		t.Fatalf("Download = %v, want an *AckError reporting %q", err, protocol.ErrShortFile)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	srv := &Server{}
+	addr, c := startServer(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := os.MkdirAll(filepath.Join(srv.Root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(srv.Root, "dir", "gone.txt"), []byte("bye"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Delete(ctx, addr, "dir/gone.txt"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(srv.Root, "dir", "gone.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("file still exists (stat: %v)", err)
+	}
+
+	for _, name := range []string{"dir/gone.txt", "dir", "../outside.txt"} {
+		var ackErr *client.AckError
+		if err := c.Delete(ctx, addr, name); !errors.As(err, &ackErr) || ackErr.Status != protocol.AckRejected {
+			t.Errorf("Delete(%q) = %v, want a rejection", name, err)
+		}
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe to log into from the server's
+// goroutines
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestReportVerification(t *testing.T) {
+	var logs lockedBuffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	addr, c := startServer(t, &Server{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := c.ReportVerification(ctx, addr, "good.txt", true); err != nil {
+		t.Fatalf("ReportVerification: %v", err)
+	}
+	if err := c.ReportVerification(ctx, addr, "bad.txt", false); err != nil {
+		t.Fatalf("ReportVerification: %v", err)
+	}
+	got := logs.String()
+	for _, want := range []string{
+		`msg="Client verified download" file=good.txt`,
+		`msg="Client reported a checksum mismatch" file=bad.txt`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("log is missing %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestClientDisconnectMidDownload(t *testing.T) {
+	var logs lockedBuffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	srv := &Server{}
+	addr, c := startServer(t, srv)
+	c.Reconnects = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := os.WriteFile(filepath.Join(srv.Root, "big.bin"), make([]byte, 32<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The client gives up after the first 64 KiB and hangs up while the
+	// server is still sending
+	var received int
+	errGaveUp := errors.New("gave up")
+	dst := writerFunc(func(p []byte) (int, error) {
+		if received += len(p); received >= 64<<10 {
+			return 0, errGaveUp
+		}
+		return len(p), nil
+	})
+	if err := c.Download(ctx, addr, "big.bin", dst); !errors.Is(err, errGaveUp) {
+		t.Fatalf("Download = %v, want the writer's error", err)
+	}
+
+	for !strings.Contains(logs.String(), "Connection closed") {
+		if ctx.Err() != nil {
+			t.Fatalf("server never closed the connection:\n%s", logs.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	got := logs.String()
+	if !strings.Contains(got, `level=DEBUG msg="Client disconnected" file=big.bin`) {
+		t.Errorf("log doesn't note the disconnection at debug level:\n%s", got)
+	}
+	if strings.Contains(got, "level=ERROR") {
+		t.Errorf("a client hanging up was logged as an error:\n%s", got)
+	}
+}
+
+func TestProbeConnectionLoggedAtDebug(t *testing.T) {
+	var logs lockedBuffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	addr, _ := startServer(t, &Server{})
+	// What a liveness probe such as the web gateway's /healthz does
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	conn.Close()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !strings.Contains(logs.String(), "Connection closed") {
+		if time.Now().After(deadline) {
+			t.Fatalf("server never closed the connection:\n%s", logs.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	got := logs.String()
+	if !strings.Contains(got, `level=DEBUG msg="Connection closed"`) {
+		t.Errorf("probe's connection summary not logged at debug level:\n%s", got)
+	}
+	if strings.Contains(got, "level=ERROR") {
+		t.Errorf("a probe was logged as an error:\n%s", got)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore(3000)
+	addr, c := startServer(t, &Server{Store: store})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	src, data := randomFile(t, 2000)
+	if err := c.Upload(ctx, addr, "mem/a.bin", src, int64(len(data))); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	var got bytes.Buffer
+	if err := c.Download(ctx, addr, "mem/a.bin", &got); err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Fatal("downloaded data differs from the upload")
+	}
+	entries, err := c.List(ctx, addr, "mem/*")
+	if err != nil || len(entries) != 1 || entries[0].Name != "mem/a.bin" {
+		t.Errorf("List = %+v, %v; want mem/a.bin", entries, err)
+	}
+
+	// Past the cap, unless it replaces a file it then no longer counts
+	src, data = randomFile(t, 1500)
+	var ackErr *client.AckError
+	if err := c.Upload(ctx, addr, "mem/b.bin", src, int64(len(data))); !errors.As(err, &ackErr) || ackErr.Status != protocol.AckRejected {
+		t.Fatalf("Upload over the cap = %v, want an AckRejected *AckError", err)
+	}
+	src, data = randomFile(t, 1500)
+	if err := c.Upload(ctx, addr, "mem/a.bin", src, int64(len(data))); err != nil {
+		t.Fatalf("Upload replacing a file: %v", err)
+	}
+	if used := store.UsedBytes(); used != 1500 {
+		t.Errorf("UsedBytes = %d, want 1500", used)
+	}
+
+	if err := c.Delete(ctx, addr, "mem/a.bin"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if used := store.UsedBytes(); used != 0 {
+		t.Errorf("UsedBytes after delete = %d, want 0", used)
+	}
+	if err := c.Rename(ctx, addr, "mem/a.bin", "mem/c.bin"); !errors.As(err, &ackErr) || ackErr.Status != protocol.AckRejected {
+		t.Errorf("Rename = %v, want an AckRejected *AckError", err)
+	}
+}
+
+func TestPSKAuthentication(t *testing.T) {
+	addr, c := startServer(t, &Server{PSK: []byte("s3cret")})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c.PSK = []byte("s3cret")
+	if _, err := c.List(ctx, addr, ""); err != nil {
+		t.Fatalf("List with the right key: %v", err)
+	}
+
+	c.PSK = []byte("guess")
+	if _, err := c.List(ctx, addr, ""); !errors.Is(err, protocol.ErrAuthFailed) {
+		t.Errorf("List with a wrong key = %v, want ErrAuthFailed", err)
+	}
+	c.PSK = nil
+	if _, err := c.List(ctx, addr, ""); err == nil {
+		t.Error("List without a key succeeded")
+	}
+
+	// A key is harmless against a server that doesn't require one
+	openAddr, open := startServer(t, &Server{})
+	open.PSK = []byte("s3cret")
+	if _, err := open.List(ctx, openAddr, ""); err != nil {
+		t.Errorf("List with a key against an open server: %v", err)
+	}
+}
+
+func TestDownloadFile(t *testing.T) {
+	srv := &Server{}
+	addr, c := startServer(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := os.WriteFile(filepath.Join(srv.Root, "notes.txt"), []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(t.TempDir(), "notes.txt")
+	if err := c.DownloadFile(ctx, addr, "notes.txt", target); err != nil {
+		t.Fatalf("DownloadFile: %v", err)
+	}
+	info, err := os.Stat(target)
+	if err != nil || info.Size() != 5 || info.Mode().Perm() != 0600 {
+		t.Errorf("downloaded file = %v, %v; want 5 bytes with mode 600", info, err)
+	}
+	if _, err := os.Stat(target + protocol.PartSuffix); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("part file left behind (stat: %v)", err)
+	}
+
+	if err := c.DownloadFile(ctx, addr, "missing.txt", target+"2"); err == nil {
+		t.Error("DownloadFile of a missing file succeeded")
+	}
+}
+
+// cuttingProxy forwards connections to addr, hanging up the i-th of them
+// once cuts[i] bytes have come back from the server; later connections
+// pass through whole. It returns the proxy's address.
+func cuttingProxy(t *testing.T, addr string, cuts ...int64) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for i := 0; ; i++ {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", addr)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			limit := int64(-1)
+			if i < len(cuts) {
+				limit = cuts[i]
+			}
+			go func() {
+				io.Copy(upstream, conn)
+				upstream.Close()
+			}()
+			go func() {
+				if limit < 0 {
+					io.Copy(conn, upstream)
+				} else {
+					io.CopyN(conn, upstream, limit)
+				}
+				conn.Close()
+				upstream.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestDownloadResumesAfterDroppedConnection(t *testing.T) {
+	data := make([]byte, 1<<20)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	for _, comp := range []protocol.Compression{{}, {Codec: protocol.CodecZstd}} {
+		t.Run(comp.String(), func(t *testing.T) {
+			srv := &Server{}
+			addr, c := startServer(t, srv)
+			c.Compression = comp
+			c.DialBackoff = time.Millisecond
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := os.WriteFile(filepath.Join(srv.Root, "big.bin"), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			// Two drops partway through, each resumed from where it stopped
+			var offsets []int64
+			c.Reconnects = 2
+			c.OnReconnect = func(attempt int, offset int64, err error) {
+				offsets = append(offsets, offset)
+			}
+			target := filepath.Join(t.TempDir(), "big.bin")
+			if err := c.DownloadFile(ctx, cuttingProxy(t, addr, 300<<10, 300<<10), "big.bin", target); err != nil {
+				t.Fatalf("DownloadFile: %v", err)
+			}
+			if got, err := os.ReadFile(target); err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("downloaded file differs from the original (%v)", err)
+			}
+			if len(offsets) != 2 || offsets[0] <= 0 || offsets[1] <= offsets[0] || offsets[1] >= int64(len(data)) {
+				t.Errorf("resumed from %v, want two offsets advancing through the file", offsets)
+			}
+
+			// One more drop than it may reconnect for
+			c.Reconnects = 1
+			var got bytes.Buffer
+			if err := c.Download(ctx, cuttingProxy(t, addr, 300<<10, 300<<10), "big.bin", &got); err == nil {
+				t.Error("Download succeeded with more drops than reconnects")
+			}
+		})
+	}
+}
+
+func TestNewListen(t *testing.T) {
+	tlsConfig, err := security.GenerateTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := New(t.TempDir(), tlsConfig)
+	if srv.MaxConns != DefaultConfig().MaxConns || srv.IdleTimeout == 0 {
+		t.Errorf("New left limits unset: %+v", srv)
+	}
+	l, err := srv.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go srv.Serve(l)
+	defer l.Close()
+
+	pinned, err := security.TLSConfigWithPin(security.Fingerprint(tlsConfig.Certificates[0].Certificate[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := client.New(pinned).List(ctx, l.Addr().String(), ""); err != nil {
+		t.Errorf("List against a listener from Listen: %v", err)
+	}
+
+	if _, err := New(t.TempDir(), nil).Listen("127.0.0.1:0"); err == nil {
+		t.Error("Listen without a TLS configuration succeeded")
+	}
+}
+
+func TestPlaintext(t *testing.T) {
+	srv := New(t.TempDir(), nil)
+	srv.Plaintext = true
+	l, err := srv.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go srv.Serve(l)
+	defer l.Close()
+	addr := l.Addr().String()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c := client.New(nil)
+	c.Plaintext = true
+	data := []byte("sent in the clear")
+	if err := c.Upload(ctx, addr, "clear.txt", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	var got bytes.Buffer
+	if err := c.Download(ctx, addr, "clear.txt", &got); err != nil || got.String() != string(data) {
+		t.Fatalf("Download = %q, %v; want %q", got.String(), err, data)
+	}
+
+	// Both sides must agree
+	tlsClient := client.New(&tls.Config{InsecureSkipVerify: true})
+	tlsClient.DialAttempts = 1
+	if _, err := tlsClient.List(ctx, addr, ""); err == nil {
+		t.Error("List over TLS against a plaintext server succeeded")
+	}
+}
+
+// BenchmarkDownloadBufferSize downloads a 64 MiB file over loopback TLS
+// with the server and client copying through buffers of each size. Run it
+// with -bench DownloadBufferSize to pick a -buffer-size.
+func BenchmarkDownloadBufferSize(b *testing.B) {
+	data := make([]byte, 64<<20)
+	if _, err := rand.Read(data); err != nil {
+		b.Fatal(err)
+	}
+	for _, size := range []int{32 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20} {
+		b.Run(fmt.Sprintf("%dKiB", size>>10), func(b *testing.B) {
+			srv := &Server{BufferSize: size}
+			addr, c := startServer(b, srv)
+			c.BufferSize = size
+			if err := os.WriteFile(filepath.Join(srv.Root, "big.bin"), data, 0644); err != nil {
+				b.Fatal(err)
+			}
+			ctx := context.Background()
+
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := c.Download(ctx, addr, "big.bin", io.Discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
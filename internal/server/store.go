@@ -0,0 +1,438 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopher-fs/internal/archive"
+	"gopher-fs/internal/protocol"
+	"gopher-fs/internal/storage"
+)
+
+// Store holds the files a Server serves. Names are slash-separated paths
+// that have already been through protocol.CleanPath.
+type Store interface {
+	// Get opens the file name for reading. A missing file is reported as
+	// fs.ErrNotExist.
+	Get(name string) (io.ReadSeekCloser, fs.FileInfo, error)
+
+	// Put stores the next size bytes of r as name. An existing file is only
+	// replaced once all of them were read, so an error from r, including
+	// one returned alongside its last bytes, leaves the store unchanged.
+	Put(name string, r io.Reader, size int64) error
+
+	// Create stores the next size bytes of r like Put, but never replaces
+	// an existing file. If name is taken it fails with fs.ErrExist or, with
+	// rename set, stores the file under the first free name from
+	// ConflictName. It returns the name the file was stored as.
+	Create(name string, r io.Reader, size int64, rename bool) (string, error)
+
+	// List returns every file in the store
+	List() ([]protocol.FileEntry, error)
+
+	// Delete removes the file name; a missing file is fs.ErrNotExist
+	Delete(name string) error
+}
+
+// ConflictPolicy is what an upload does when its file already exists
+type ConflictPolicy string
+
+const (
+	// ConflictOverwrite replaces the existing file, as uploads always have.
+	// It is the default.
+	ConflictOverwrite ConflictPolicy = "overwrite"
+
+	// ConflictReject refuses the upload, leaving the existing file alone
+	ConflictReject ConflictPolicy = "reject"
+
+	// ConflictRename stores the upload beside the existing file under the
+	// first free name from ConflictName
+	ConflictRename ConflictPolicy = "rename"
+)
+
+// ParseConflictPolicy maps "overwrite", "reject" or "rename" to its
+// ConflictPolicy
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(strings.ToLower(name)); p {
+	case ConflictOverwrite, ConflictReject, ConflictRename:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q: want overwrite, reject or rename", name)
+}
+
+// ConflictName returns the nth alternative ConflictRename tries for name,
+// with -n added before its extension: "a/report.pdf" becomes
+// "a/report-1.pdf", then "a/report-2.pdf". The 0th is name itself.
+func ConflictName(name string, n int) string {
+	if n == 0 {
+		return name
+	}
+	dir, base := path.Split(name)
+	ext := path.Ext(base)
+	if ext == base {
+		ext = "" // a dotfile such as ".env" is all name
+	}
+	return fmt.Sprintf("%s%s-%d%s", dir, strings.TrimSuffix(base, ext), n, ext)
+}
+
+// DiskStore keeps files under a directory. Uploads are written to a
+// uniquely named protocol.PartSuffix file beside their target and renamed
+// over it once complete. Uploads to a path that is, or goes through, an
+// existing symlink are refused with protocol.ErrUnsafePath.
+type DiskStore struct {
+	Root string
+
+	// QuotaBytes caps the total bytes stored under Root (0 = unlimited)
+	QuotaBytes int64
+
+	// BufferSize is the buffer uploads are written through
+	// (0 = protocol.DefaultBufferSize)
+	BufferSize int
+}
+
+func (d *DiskStore) path(name string) string {
+	return filepath.Join(d.Root, filepath.FromSlash(name))
+}
+
+func (d *DiskStore) Get(name string) (io.ReadSeekCloser, fs.FileInfo, error) {
+	file, err := os.Open(d.path(name))
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return nil, nil, fmt.Errorf("%s: not a regular file: %w", name, fs.ErrNotExist)
+	}
+	return file, info, nil
+}
+
+func (d *DiskStore) Put(name string, r io.Reader, size int64) error {
+	return d.put(name, r, size, func(partPath string) error {
+		target, err := archive.SafePath(d.Root, name)
+		if err != nil {
+			return err
+		}
+		return os.Rename(partPath, target)
+	})
+}
+
+// put writes the next size bytes of r to a part file beside name and has
+// finish move it into place once complete
+func (d *DiskStore) put(name string, r io.Reader, size int64, finish func(partPath string) error) error {
+	exceeded, err := storage.QuotaExceeded(d.Root, d.QuotaBytes, size)
+	if err != nil {
+		return fmt.Errorf("checking storage quota: %w", err)
+	}
+	if exceeded {
+		return storage.ErrQuotaExceeded
+	}
+
+	// A symlink on the way, whether the file itself or a directory, could
+	// send the write outside Root
+	target, err := archive.SafePath(d.Root, name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	// Each transfer gets its own part file, so concurrent uploads of the
+	// same name never write into each other; with Put the last to finish
+	// wins
+	file, err := os.CreateTemp(filepath.Dir(target), filepath.Base(target)+".*"+protocol.PartSuffix)
+	if err != nil {
+		return err
+	}
+	partPath := file.Name()
+	defer os.Remove(partPath) // a no-op once renamed or claimed
+	// CreateTemp makes it 0600; stored files have always been world-readable
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		return err
+	}
+
+	// Never reads past size, so a client sending more can't grow the file:
+	// the excess is left unread and dropped with the connection
+	err = copyExactly(file, r, size, d.BufferSize)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return finish(partPath)
+}
+
+func (d *DiskStore) Create(name string, r io.Reader, size int64, rename bool) (string, error) {
+	target, err := archive.SafePath(d.Root, name)
+	if err != nil {
+		return "", err
+	}
+	// Refused before any data is read; claim below is what makes it safe
+	// against an upload of the same name finishing meanwhile
+	if !rename {
+		if _, err := os.Lstat(target); err == nil {
+			return "", fmt.Errorf("%s: %w", name, fs.ErrExist)
+		}
+	}
+
+	stored := name
+	err = d.put(name, r, size, func(partPath string) error {
+		for n := 0; ; n++ {
+			stored = ConflictName(name, n)
+			candidate, err := archive.SafePath(d.Root, stored)
+			if err != nil {
+				return err
+			}
+			err = claim(partPath, candidate)
+			if !errors.Is(err, fs.ErrExist) {
+				return err
+			}
+			if !rename || n == maxConflictRenames {
+				return fmt.Errorf("%s: %w", stored, fs.ErrExist)
+			}
+		}
+	})
+	return stored, err
+}
+
+// maxConflictRenames bounds the -1, -2, ... names tried for one upload
+const maxConflictRenames = 1000
+
+// claim moves the file at partPath, e.g. a complete upload's part file, to
+// target only if nothing is there.
+// A hard link is made atomically and fails with fs.ErrExist instead of
+// replacing target, so of two uploads racing for the name exactly one wins,
+// and target never appears before it holds the whole file.
+func claim(partPath, target string) error {
+	if err := os.Link(partPath, target); err != nil {
+		return err
+	}
+	return os.Remove(partPath)
+}
+
+func (d *DiskStore) List() ([]protocol.FileEntry, error) {
+	var entries []protocol.FileEntry
+	err := filepath.WalkDir(d.Root, func(p string, de fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !de.Type().IsRegular() || strings.HasSuffix(de.Name(), protocol.PartSuffix) {
+			return nil // in-progress uploads aren't files yet
+		}
+		rel, err := filepath.Rel(d.Root, p)
+		if err != nil {
+			return err
+		}
+		info, err := de.Info()
+		if err != nil {
+			return nil // removed since listing the directory
+		}
+		entries = append(entries, protocol.FileEntry{Name: filepath.ToSlash(rel), Size: info.Size(), ModTime: info.ModTime().UnixNano()})
+		return nil
+	})
+	return entries, err
+}
+
+func (d *DiskStore) Delete(name string) error {
+	p := d.path(name)
+	info, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s: not a regular file: %w", name, fs.ErrNotExist)
+	}
+	return os.Remove(p)
+}
+
+// copyExactly copies size bytes from r to w through a bufSize buffer (see
+// protocol.Copy). Unlike io.CopyN, an error returned with the last bytes
+// is reported rather than dropped.
+func copyExactly(w io.Writer, r io.Reader, size int64, bufSize int) error {
+	n, err := protocol.Copy(w, io.LimitReader(r, size), bufSize)
+	if err == nil && n < size {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// MemoryStore keeps files in memory and never touches the disk; everything
+// is gone when the process exits. Create one with NewMemoryStore.
+type MemoryStore struct {
+	maxBytes int64
+
+	mu    sync.Mutex
+	files map[string]*memFile
+	used  int64
+}
+
+type memFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemoryStore returns an empty MemoryStore holding at most maxBytes of
+// file data (0 = unlimited); uploads beyond that fail with
+// storage.ErrQuotaExceeded
+func NewMemoryStore(maxBytes int64) *MemoryStore {
+	return &MemoryStore{maxBytes: maxBytes, files: make(map[string]*memFile)}
+}
+
+// fits reports whether storing size bytes as name stays within the cap.
+// m.mu must be held.
+func (m *MemoryStore) fits(name string, size int64) bool {
+	if m.maxBytes <= 0 {
+		return true
+	}
+	used := m.used
+	if old, ok := m.files[name]; ok {
+		used -= int64(len(old.data))
+	}
+	return used+size <= m.maxBytes
+}
+
+func (m *MemoryStore) Get(name string) (io.ReadSeekCloser, fs.FileInfo, error) {
+	m.mu.Lock()
+	f, ok := m.files[name]
+	m.mu.Unlock()
+	if !ok {
+		return nil, nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	// The data is never modified once stored, only replaced, so readers
+	// can share it
+	info := memInfo{name: path.Base(name), size: int64(len(f.data)), modTime: f.modTime}
+	return nopCloser{bytes.NewReader(f.data)}, info, nil
+}
+
+func (m *MemoryStore) Put(name string, r io.Reader, size int64) error {
+	m.mu.Lock()
+	fits := m.fits(name, size)
+	m.mu.Unlock()
+	if !fits {
+		return storage.ErrQuotaExceeded
+	}
+
+	// Grown as data arrives rather than allocated up front, so a header
+	// claiming a huge size costs nothing until the bytes turn up
+	var buf bytes.Buffer
+	if err := copyExactly(&buf, r, size, 0); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Checked again: other uploads may have landed while this one streamed
+	if !m.fits(name, size) {
+		return storage.ErrQuotaExceeded
+	}
+	if old, ok := m.files[name]; ok {
+		m.used -= int64(len(old.data))
+	}
+	m.files[name] = &memFile{data: buf.Bytes(), modTime: time.Now()}
+	m.used += size
+	return nil
+}
+
+func (m *MemoryStore) Create(name string, r io.Reader, size int64, rename bool) (string, error) {
+	m.mu.Lock()
+	_, taken := m.files[name]
+	fits := m.fits("", size)
+	m.mu.Unlock()
+	if taken && !rename {
+		return "", fmt.Errorf("%s: %w", name, fs.ErrExist)
+	}
+	if !fits {
+		return "", storage.ErrQuotaExceeded
+	}
+
+	var buf bytes.Buffer
+	if err := copyExactly(&buf, r, size, 0); err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := name
+	for n := 1; ; n++ {
+		if _, taken := m.files[stored]; !taken {
+			break
+		}
+		if !rename || n > maxConflictRenames {
+			return "", fmt.Errorf("%s: %w", stored, fs.ErrExist)
+		}
+		stored = ConflictName(name, n)
+	}
+	if !m.fits(stored, size) {
+		return "", storage.ErrQuotaExceeded
+	}
+	m.files[stored] = &memFile{data: buf.Bytes(), modTime: time.Now()}
+	m.used += size
+	return stored, nil
+}
+
+func (m *MemoryStore) List() ([]protocol.FileEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := make([]protocol.FileEntry, 0, len(m.files))
+	for name, f := range m.files {
+		entries = append(entries, protocol.FileEntry{Name: name, Size: int64(len(f.data)), ModTime: f.modTime.UnixNano()})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+func (m *MemoryStore) Delete(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[name]
+	if !ok {
+		return fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	m.used -= int64(len(f.data))
+	delete(m.files, name)
+	return nil
+}
+
+// UsedBytes returns the total size of the files held
+func (m *MemoryStore) UsedBytes() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.used
+}
+
+type nopCloser struct{ *bytes.Reader }
+
+func (nopCloser) Close() error { return nil }
+
+// memInfo describes a MemoryStore file
+type memInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) Mode() fs.FileMode  { return 0644 }
+func (i memInfo) ModTime() time.Time { return i.modTime }
+func (i memInfo) IsDir() bool        { return false }
+func (i memInfo) Sys() any           { return nil }
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopher-fs/internal/protocol"
+)
+
+// uploads keeps track of the uploads being received, so OpList can
+// report them with ListPartial
+type uploads struct {
+	mu     sync.Mutex
+	nextID uint64
+	active map[uint64]*activeUpload
+}
+
+// activeUpload is one upload being received. Its counters are updated by
+// the connection receiving it and read by listings, so they are atomic.
+type activeUpload struct {
+	name     string
+	size     int64
+	received atomic.Int64
+	lastData atomic.Int64 // unix nanoseconds
+}
+
+// begin starts tracking an upload of size bytes as name, returning a
+// reader counting what is read from r towards it and the function that
+// ends the tracking
+func (u *uploads) begin(name string, size int64, r io.Reader) (io.Reader, func()) {
+	a := &activeUpload{name: name, size: size}
+	a.lastData.Store(time.Now().UnixNano())
+	u.mu.Lock()
+	if u.active == nil {
+		u.active = make(map[uint64]*activeUpload)
+	}
+	u.nextID++
+	id := u.nextID
+	u.active[id] = a
+	u.mu.Unlock()
+	return &uploadReader{r: r, a: a}, func() {
+		u.mu.Lock()
+		delete(u.active, id)
+		u.mu.Unlock()
+	}
+}
+
+// list describes the uploads being received as partial entries. Two
+// uploads of the same name are both listed.
+func (u *uploads) list() []protocol.FileEntry {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	entries := make([]protocol.FileEntry, 0, len(u.active))
+	for _, a := range u.active {
+		entries = append(entries, protocol.FileEntry{
+			Name:     a.name,
+			Size:     a.size,
+			ModTime:  a.lastData.Load(),
+			Partial:  true,
+			Received: a.received.Load(),
+		})
+	}
+	return entries
+}
+
+type uploadReader struct {
+	r io.Reader
+	a *activeUpload
+}
+
+func (u *uploadReader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	if n > 0 {
+		u.a.received.Add(int64(n))
+		u.a.lastData.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
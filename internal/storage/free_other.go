@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd || dragonfly)
+
+package storage
+
+import "errors"
+
+// FreeBytes is not implemented on this platform
+func FreeBytes(root string) (uint64, error) {
+	return 0, errors.New("free space not supported on this platform")
+}
@@ -0,0 +1,20 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package storage
+
+import "syscall"
+
+// FreeBytes returns the space available to unprivileged users on the
+// filesystem holding root
+func FreeBytes(root string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(root, &st); err != nil {
+		return 0, err
+	}
+	// The field types differ between platforms; on the BSDs Bavail is
+	// signed and goes negative once the reserved blocks are in use
+	if st.Bavail <= 0 {
+		return 0, nil
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
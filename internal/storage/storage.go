@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+)
+
+// ErrQuotaExceeded is returned when an upload would push the storage root past its quota
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// UsedBytes returns the total size of all regular files under root.
+// A missing root counts as empty.
+func UsedBytes(root string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			// Removed between listing and stat
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	return total, err
+}
+
+// QuotaExceeded reports whether storing incoming more bytes under root would
+// exceed quota. A quota of zero or less means unlimited.
+func QuotaExceeded(root string, quota, incoming int64) (bool, error) {
+	if quota <= 0 {
+		return false, nil
+	}
+	used, err := UsedBytes(root)
+	if err != nil {
+		return false, err
+	}
+	return used+incoming > quota, nil
+}
@@ -0,0 +1,375 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopher-fs/internal/security"
+)
+
+// ObjectsDir is the directory under the store root holding content blobs.
+// It starts with a dot so it can't collide with a room ID.
+const ObjectsDir = ".objects"
+
+// Store is a content-addressed blob store. Each distinct file is kept once
+// under <root>/.objects/<sha256>, and rooms reference it with symlinks, so
+// the same file uploaded to several rooms only uses its size once on disk.
+// A per-blob reference count decides when the blob itself can go.
+type Store struct {
+	root string
+	key  []byte // encrypts blobs at rest when set
+	mu   sync.Mutex
+}
+
+// New returns a Store rooted at root (the directory containing the rooms)
+func New(root string) *Store {
+	return &Store{root: root}
+}
+
+// NewEncrypted returns a Store like New whose blobs are encrypted under key
+// (see security.NewEncryptWriter). Blobs are still named by the SHA-256 of
+// their plaintext, and Open decrypts them.
+func NewEncrypted(root string, key []byte) *Store {
+	return &Store{root: root, key: key}
+}
+
+func (s *Store) objectPath(hash [32]byte) string {
+	return filepath.Join(s.root, ObjectsDir, hex.EncodeToString(hash[:]))
+}
+
+func (s *Store) refsPath(hash [32]byte) string {
+	return s.objectPath(hash) + ".refs"
+}
+
+// Put stores the content of r under hash. If the blob already exists r is
+// not read. The content is verified against hash before it becomes visible,
+// and encrypted on the way to disk if the store has a key.
+func (s *Store) Put(hash [32]byte, r io.Reader) error {
+	s.mu.Lock()
+	_, err := os.Stat(s.objectPath(hash))
+	s.mu.Unlock()
+	if err == nil {
+		return nil
+	}
+
+	tmp, err := s.write(hash, r)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // no-op once renamed
+	// Under the lock, so it can't land between addRef deciding a blob is
+	// unreferenced and removing it
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return os.Rename(tmp, s.objectPath(hash))
+}
+
+// PutLink stores the content of r under hash like Put and links it into
+// the room like Link. The lock is held from finding the blob stored to
+// counting the room's reference, so another room dropping its last
+// reference meanwhile can't remove the blob in between.
+func (s *Store) PutLink(roomID, name string, hash [32]byte, r io.Reader) error {
+	s.mu.Lock()
+	if _, err := os.Stat(s.objectPath(hash)); err == nil {
+		defer s.mu.Unlock()
+		return s.linkLocked(roomID, name, hash)
+	}
+	s.mu.Unlock()
+
+	tmp, err := s.write(hash, r)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // no-op once renamed
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Rename(tmp, s.objectPath(hash)); err != nil {
+		return err
+	}
+	return s.linkLocked(roomID, name, hash)
+}
+
+// write copies r into a temporary file beside the blobs, encrypted if the
+// store has a key, and returns its path once its content is verified
+// against hash. The caller renames it into place or removes it.
+func (s *Store) write(hash [32]byte, r io.Reader) (string, error) {
+	dir := filepath.Dir(s.objectPath(hash))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(dir, "put-*")
+	if err != nil {
+		return "", err
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	var w io.Writer = tmp
+	var enc *security.EncryptWriter
+	if s.key != nil {
+		if enc, err = security.NewEncryptWriter(tmp, s.key); err != nil {
+			tmp.Close()
+			return "", err
+		}
+		w = enc
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, hasher), r); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if enc != nil {
+		if err := enc.Close(); err != nil {
+			tmp.Close()
+			return "", err
+		}
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	var got [32]byte
+	copy(got[:], hasher.Sum(nil))
+	if got != hash {
+		return "", fmt.Errorf("content hash %x does not match %x", got, hash)
+	}
+	ok = true
+	return tmp.Name(), nil
+}
+
+// Seal returns a writer for data staged on disk on its way into the
+// store, e.g. a partial upload, that encrypts it onto w like a blob if the
+// store has a key, so it is never on disk in the clear. Close finishes the
+// data but doesn't close w. Without a key the data goes to w as it is.
+func (s *Store) Seal(w io.Writer) (io.WriteCloser, error) {
+	if s.key == nil {
+		return nopWriteCloser{w}, nil
+	}
+	return security.NewEncryptWriter(w, s.key)
+}
+
+// SealedSize is the length of size bytes written through Seal
+func (s *Store) SealedSize(size int64) int64 {
+	if s.key == nil {
+		return size
+	}
+	return security.EncryptedSize(size)
+}
+
+// Unseal returns a reader for the data written through Seal that r holds.
+// Data that doesn't decrypt fails with security.ErrDecrypt.
+func (s *Store) Unseal(r io.ReadSeeker) (io.Reader, error) {
+	if s.key == nil {
+		return r, nil
+	}
+	return security.NewDecryptReader(r, s.key)
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Link makes the blob for hash appear as name inside the room, replacing
+// any existing entry with that name. A blob stored with Put can be removed
+// before Link counts its reference if nothing else holds one; PutLink
+// stores and links in one step.
+func (s *Store) Link(roomID, name string, hash [32]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.linkLocked(roomID, name, hash)
+}
+
+func (s *Store) linkLocked(roomID, name string, hash [32]byte) error {
+	if _, err := os.Stat(s.objectPath(hash)); err != nil {
+		return fmt.Errorf("no object for %x: %w", hash, err)
+	}
+
+	roomDir := filepath.Join(s.root, roomID)
+	if err := os.MkdirAll(roomDir, 0755); err != nil {
+		return err
+	}
+	if old, ok := s.Hash(roomID, name); ok && old == hash {
+		return nil // already linked
+	}
+	// The new reference is counted before the old entry goes, so replacing
+	// a link can't drop the blob's count to zero on the way
+	if err := s.addRef(hash, 1); err != nil {
+		return err
+	}
+	if err := s.unlinkLocked(roomID, name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		s.addRef(hash, -1)
+		return err
+	}
+
+	target := filepath.Join("..", ObjectsDir, hex.EncodeToString(hash[:]))
+	if err := os.Symlink(target, filepath.Join(roomDir, name)); err != nil {
+		s.addRef(hash, -1)
+		return err
+	}
+	return nil
+}
+
+// Open opens name in the room for reading, following its link to the blob.
+// Anything but a regular file is reported as fs.ErrNotExist. In an
+// encrypted store the file is decrypted as it is read and info reports the
+// size of the plaintext; content that doesn't decrypt fails with
+// security.ErrDecrypt.
+func (s *Store) Open(roomID, name string) (io.ReadSeekCloser, fs.FileInfo, error) {
+	f, err := os.Open(filepath.Join(s.root, roomID, name))
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if !info.Mode().IsRegular() {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s: not a regular file: %w", name, fs.ErrNotExist)
+	}
+	if s.key == nil {
+		return f, info, nil
+	}
+	dr, err := security.NewDecryptReader(f, s.key)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return decryptingFile{dr, f}, plainInfo{info, dr.Size()}, nil
+}
+
+// decryptingFile reads an encrypted blob through its DecryptReader
+type decryptingFile struct {
+	*security.DecryptReader
+	f *os.File
+}
+
+func (d decryptingFile) Close() error {
+	return d.f.Close()
+}
+
+// plainInfo describes an encrypted blob with the size of its plaintext
+type plainInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (i plainInfo) Size() int64 {
+	return i.size
+}
+
+// Hash returns the content hash of name in the room, read from its link to
+// the blob. ok is false for anything that isn't one of the store's links.
+func (s *Store) Hash(roomID, name string) (hash [32]byte, ok bool) {
+	target, err := os.Readlink(filepath.Join(s.root, roomID, name))
+	if err != nil || filepath.Base(filepath.Dir(target)) != ObjectsDir {
+		return hash, false
+	}
+	return parseHash(filepath.Base(target))
+}
+
+// Unlink removes name from the room. When the last room reference to a
+// blob goes away the blob is deleted too. Plain files are just removed.
+func (s *Store) Unlink(roomID, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.unlinkLocked(roomID, name)
+}
+
+func (s *Store) unlinkLocked(roomID, name string) error {
+	path := filepath.Join(s.root, roomID, name)
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&fs.ModeSymlink == 0 {
+		return os.Remove(path)
+	}
+
+	target, err := os.Readlink(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+
+	hash, ok := parseHash(filepath.Base(target))
+	if !ok {
+		return nil // not one of ours
+	}
+	return s.addRef(hash, -1)
+}
+
+// RemoveRoom deletes a room directory and everything in it, releasing the
+// room's references to blobs
+func (s *Store) RemoveRoom(roomID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	roomDir := filepath.Join(s.root, roomID)
+	entries, err := os.ReadDir(roomDir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue // removed with the room below, holds no store links
+		}
+		if err := s.unlinkLocked(roomID, e.Name()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return os.RemoveAll(roomDir)
+}
+
+// addRef adjusts the reference count for hash, deleting the blob at zero
+func (s *Store) addRef(hash [32]byte, delta int) error {
+	refs := 0
+	data, err := os.ReadFile(s.refsPath(hash))
+	if err == nil {
+		refs, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	refs += delta
+	if refs <= 0 {
+		if err := os.Remove(s.objectPath(hash)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err := os.Remove(s.refsPath(hash)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	return os.WriteFile(s.refsPath(hash), []byte(strconv.Itoa(refs)), 0644)
+}
+
+func parseHash(s string) ([32]byte, bool) {
+	var hash [32]byte
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(hash) {
+		return hash, false
+	}
+	copy(hash[:], b)
+	return hash, true
+}
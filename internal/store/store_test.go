@@ -0,0 +1,185 @@
+package store
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// put stores data in s and returns its hash
+func put(t *testing.T, s *Store, data string) [32]byte {
+	t.Helper()
+	hash := sha256.Sum256([]byte(data))
+	if err := s.Put(hash, strings.NewReader(data)); err != nil {
+		t.Fatalf("Put %q: %v", data, err)
+	}
+	return hash
+}
+
+// refs returns the reference count recorded for hash, 0 when there is none
+func refs(t *testing.T, s *Store, hash [32]byte) int {
+	t.Helper()
+	data, err := os.ReadFile(s.refsPath(hash))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// read returns the content of name in the room
+func read(t *testing.T, s *Store, roomID, name string) string {
+	t.Helper()
+	f, _, err := s.Open(roomID, name)
+	if err != nil {
+		t.Fatalf("Open %s/%s: %v", roomID, name, err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("reading %s/%s: %v", roomID, name, err)
+	}
+	return string(data)
+}
+
+// blobExists reports whether the blob for hash is on disk
+func blobExists(s *Store, hash [32]byte) bool {
+	_, err := os.Stat(s.objectPath(hash))
+	return err == nil
+}
+
+func TestLinkSameHashKeepsBlob(t *testing.T) {
+	s := New(t.TempDir())
+	hash := put(t, s, "hello")
+	for i := 0; i < 2; i++ {
+		if err := s.Link("room", "a.txt", hash); err != nil {
+			t.Fatalf("Link #%d: %v", i+1, err)
+		}
+	}
+	if got := read(t, s, "room", "a.txt"); got != "hello" {
+		t.Errorf("a.txt after relinking = %q, want hello", got)
+	}
+	if n := refs(t, s, hash); n != 1 {
+		t.Errorf("refs = %d, want 1", n)
+	}
+}
+
+func TestLinkDifferentHash(t *testing.T) {
+	s := New(t.TempDir())
+	first := put(t, s, "first")
+	second := put(t, s, "second")
+	if err := s.Link("room", "a.txt", first); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Link("other", "a.txt", first); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Link("room", "a.txt", second); err != nil {
+		t.Fatalf("relinking to another hash: %v", err)
+	}
+	if got := read(t, s, "room", "a.txt"); got != "second" {
+		t.Errorf("a.txt = %q, want second", got)
+	}
+	if n := refs(t, s, first); n != 1 || !blobExists(s, first) {
+		t.Errorf("first blob has %d refs, exists %v; want 1 and still there for the other room", n, blobExists(s, first))
+	}
+	if n := refs(t, s, second); n != 1 {
+		t.Errorf("second blob has %d refs, want 1", n)
+	}
+
+	// The last reference going drops the blob
+	if err := s.Link("other", "a.txt", second); err != nil {
+		t.Fatal(err)
+	}
+	if blobExists(s, first) {
+		t.Error("first blob kept after its last link was replaced")
+	}
+	if n := refs(t, s, second); n != 2 {
+		t.Errorf("second blob has %d refs, want 2", n)
+	}
+}
+
+func TestRemoveRoom(t *testing.T) {
+	s := New(t.TempDir())
+	shared := put(t, s, "shared")
+	own := put(t, s, "own")
+	for _, l := range []struct {
+		room, name string
+		hash       [32]byte
+	}{
+		{"gone", "a.txt", shared},
+		{"gone", "b.txt", own},
+		{"kept", "a.txt", shared},
+	} {
+		if err := s.Link(l.room, l.name, l.hash); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.RemoveRoom("gone"); err != nil {
+		t.Fatalf("RemoveRoom: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(s.root, "gone")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("room directory still there: %v", err)
+	}
+	if blobExists(s, own) || refs(t, s, own) != 0 {
+		t.Error("blob only the removed room used is still stored")
+	}
+	if n := refs(t, s, shared); n != 1 {
+		t.Errorf("shared blob has %d refs, want 1", n)
+	}
+	if got := read(t, s, "kept", "a.txt"); got != "shared" {
+		t.Errorf("other room's file = %q, want shared", got)
+	}
+}
+
+// A blob another room lets go of while PutLink stores it again stays for
+// the new link
+func TestPutLinkRacingUnlink(t *testing.T) {
+	s := New(t.TempDir())
+	hash := sha256.Sum256([]byte("shared"))
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		// Another room keeps taking and dropping the only other reference
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if s.PutLink("old", "a.txt", hash, strings.NewReader("shared")) == nil {
+				s.Unlink("old", "a.txt")
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	for i := 0; i < 1000; i++ {
+		if err := s.PutLink("new", "a.txt", hash, strings.NewReader("shared")); err != nil {
+			t.Fatalf("PutLink #%d: %v", i+1, err)
+		}
+		if got := read(t, s, "new", "a.txt"); got != "shared" {
+			t.Fatalf("new/a.txt = %q", got)
+		}
+		if err := s.Unlink("new", "a.txt"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package ui
+
+import (
+	"io"
+	"sync"
+)
+
+// Pauser holds transfers in place without closing their connections:
+// while it is paused, reads and writes through its Reader and Writer wait
+// for Resume. The zero value is running, and a nil *Pauser never pauses.
+type Pauser struct {
+	mu      sync.Mutex
+	resumed chan struct{} // non-nil while paused, closed by Resume
+}
+
+// Pause holds every transfer going through p until Resume
+func (p *Pauser) Pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resumed == nil {
+		p.resumed = make(chan struct{})
+	}
+}
+
+// Resume lets held transfers continue
+func (p *Pauser) Resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resumed != nil {
+		close(p.resumed)
+		p.resumed = nil
+	}
+}
+
+// Toggle pauses a running p or resumes a paused one, and reports whether
+// p is now paused
+func (p *Pauser) Toggle() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resumed != nil {
+		close(p.resumed)
+		p.resumed = nil
+		return false
+	}
+	p.resumed = make(chan struct{})
+	return true
+}
+
+// Paused reports whether p is paused
+func (p *Pauser) Paused() bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.resumed != nil
+}
+
+// Wait blocks while p is paused
+func (p *Pauser) Wait() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	resumed := p.resumed
+	p.mu.Unlock()
+	if resumed != nil {
+		<-resumed
+	}
+}
+
+// Reader returns r with every Read held while p is paused
+func (p *Pauser) Reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return pausedReader{p, r}
+}
+
+// Writer returns w with every Write held while p is paused
+func (p *Pauser) Writer(w io.Writer) io.Writer {
+	if p == nil {
+		return w
+	}
+	return pausedWriter{p, w}
+}
+
+type pausedReader struct {
+	p *Pauser
+	r io.Reader
+}
+
+func (r pausedReader) Read(b []byte) (int, error) {
+	r.p.Wait()
+	return r.r.Read(b)
+}
+
+type pausedWriter struct {
+	p *Pauser
+	w io.Writer
+}
+
+func (w pausedWriter) Write(b []byte) (int, error) {
+	w.p.Wait()
+	return w.w.Write(b)
+}
@@ -0,0 +1,70 @@
+package ui
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPauserHoldsReads(t *testing.T) {
+	var p Pauser
+	r := p.Reader(strings.NewReader("data"))
+	if !p.Toggle() || !p.Paused() {
+		t.Fatal("Toggle on a running Pauser didn't pause it")
+	}
+
+	done := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		done <- string(b)
+	}()
+	select {
+	case <-done:
+		t.Fatal("read went through while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if p.Toggle() {
+		t.Fatal("Toggle on a paused Pauser didn't resume it")
+	}
+	select {
+	case got := <-done:
+		if got != "data" {
+			t.Errorf("read %q after resuming, want data", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read still held after resuming")
+	}
+
+	var none *Pauser
+	if none.Paused() || none.Reader(r) != r {
+		t.Error("a nil Pauser pauses")
+	}
+}
+
+func TestProgressShowsPause(t *testing.T) {
+	var out strings.Builder
+	var p Pauser
+	pr := NewProgressReaderOpts(8, strings.NewReader("12345678"), ProgressOptions{Out: &out})
+	pr.display.plain = false
+	pr.Pause = &p
+
+	p.Pause()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		p.Resume()
+	}()
+	if _, err := io.ReadAll(pr); err != nil {
+		t.Fatal(err)
+	}
+
+	got := out.String()
+	paused := strings.Index(got, pausedLabel)
+	if paused < 0 {
+		t.Fatalf("no paused state drawn in %q", got)
+	}
+	if !strings.Contains(got[paused:], "Downloading...") || !strings.Contains(got, "100.0%") {
+		t.Errorf("transfer didn't carry on after the pause: %q", got)
+	}
+}
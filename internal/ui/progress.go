@@ -3,28 +3,60 @@ package ui
 import (
 	"fmt"
 	"io"
+	"os"
 	"strings"
 	"time"
+	"unicode/utf8"
+
+	"golang.org/x/term"
 )
 
+// ProgressOptions controls how a progress bar is rendered
+type ProgressOptions struct {
+	// Out receives the progress output. Defaults to os.Stdout.
+	Out io.Writer
+	// ForcePlain emits periodic log lines instead of redrawing a bar,
+	// even when Out is a terminal.
+	ForcePlain bool
+	// Sparkline draws the recent transfer speed history after the bar, so
+	// a stable connection can be told from a degrading one. Plain output
+	// has no bar and skips it.
+	Sparkline bool
+}
+
 // ProgressWriter tracks the number of bytes written and updates a progress bar
 type ProgressWriter struct {
-	Total      int64
-	Current    int64
-	Writer     io.Writer
-	startTime  time.Time
-	lastUpdate time.Time
+	Total   int64
+	Current int64
+	Writer  io.Writer
+	display progressDisplay
+
+	// OnProgress is called after every write with the bytes transferred so
+	// far. It defaults to the built-in bar; replace it to drive another UI.
+	OnProgress func(current, total int64)
+
+	// Pause, if set, holds writes while it is paused, with the bar showing
+	// it
+	Pause *Pauser
 }
 
 func NewProgressWriter(total int64, w io.Writer) *ProgressWriter {
-	return &ProgressWriter{
-		Total:     total,
-		Writer:    w,
-		startTime: time.Now(),
+	return NewProgressWriterOpts(total, w, ProgressOptions{})
+}
+
+// NewProgressWriterOpts is NewProgressWriter with explicit rendering options
+func NewProgressWriterOpts(total int64, w io.Writer, opts ProgressOptions) *ProgressWriter {
+	pw := &ProgressWriter{
+		Total:   total,
+		Writer:  w,
+		display: newProgressDisplay(opts, "⬆️  Uploading...  ", "Uploaded"),
 	}
+	pw.OnProgress = pw.display.render
+	return pw
 }
 
 func (pw *ProgressWriter) Write(p []byte) (int, error) {
+	pw.display.holdWhilePaused(pw.Pause, pw.printProgress)
 	n, err := pw.Writer.Write(p)
 	pw.Current += int64(n)
 	pw.printProgress()
@@ -33,73 +65,309 @@ func (pw *ProgressWriter) Write(p []byte) (int, error) {
 
 // ProgressReader tracks the number of bytes read and updates a progress bar
 type ProgressReader struct {
-	Total      int64
-	Current    int64
-	Reader     io.Reader
-	startTime  time.Time
-	lastUpdate time.Time
+	Total   int64
+	Current int64
+	Reader  io.Reader
+	display progressDisplay
+
+	// OnProgress is called after every read with the bytes transferred so
+	// far. It defaults to the built-in bar; replace it to drive another UI.
+	OnProgress func(current, total int64)
+
+	// Pause, if set, holds reads (and Add) while it is paused, with the
+	// bar showing it
+	Pause *Pauser
 }
 
 func NewProgressReader(total int64, r io.Reader) *ProgressReader {
-	return &ProgressReader{
-		Total:     total,
-		Reader:    r,
-		startTime: time.Now(),
+	return NewProgressReaderOpts(total, r, ProgressOptions{})
+}
+
+// NewProgressReaderOpts is NewProgressReader with explicit rendering options
+func NewProgressReaderOpts(total int64, r io.Reader, opts ProgressOptions) *ProgressReader {
+	pr := &ProgressReader{
+		Total:   total,
+		Reader:  r,
+		display: newProgressDisplay(opts, "⬇️  Downloading...", "Downloaded"),
 	}
+	pr.OnProgress = pr.display.render
+	return pr
 }
 
 func (pr *ProgressReader) Read(p []byte) (int, error) {
+	pr.display.holdWhilePaused(pr.Pause, pr.printProgress)
 	n, err := pr.Reader.Read(p)
 	pr.Current += int64(n)
 	pr.printProgress()
 	return n, err
 }
 
+// Add counts n bytes that were transferred without going through Read,
+// e.g. by several connections fetching parts of one file. It is not safe
+// for concurrent use.
+func (pr *ProgressReader) Add(n int64) {
+	pr.display.holdWhilePaused(pr.Pause, pr.printProgress)
+	pr.Current += n
+	pr.printProgress()
+}
+
+// Refresh reports the progress so far again. A zero-byte transfer never
+// reads or writes, so calling it is what draws its finished bar.
+func (pr *ProgressReader) Refresh() {
+	pr.printProgress()
+}
+
+// Refresh is ProgressReader.Refresh for writes
+func (pw *ProgressWriter) Refresh() {
+	pw.printProgress()
+}
+
 func (pr *ProgressReader) printProgress() {
-	// Only update every 100ms or if complete to avoid flashing
-	if pr.Current < pr.Total && time.Since(pr.lastUpdate) < 100*time.Millisecond {
+	if pr.OnProgress != nil {
+		pr.OnProgress(pr.Current, pr.Total)
+	}
+}
+
+func (pw *ProgressWriter) printProgress() {
+	if pw.OnProgress != nil {
+		pw.OnProgress(pw.Current, pw.Total)
+	}
+}
+
+// progressDisplay renders progress either as a redrawn terminal bar or, when
+// the output isn't a terminal, as plain log lines at most once per second
+type progressDisplay struct {
+	out        io.Writer
+	plain      bool
+	barLabel   string // e.g. "⬇️  Downloading..."
+	plainLabel string // e.g. "Downloaded"
+	startTime  time.Time
+	lastUpdate time.Time
+	speed      speedTracker
+	history    *speedHistory // nil unless ProgressOptions.Sparkline
+	paused     bool
+}
+
+// pausedLabel replaces the bar label while a transfer is paused, padded to
+// the same width
+const pausedLabel = "⏸️  Paused...     "
+
+// holdWhilePaused waits out a pause of pause, calling redraw as it starts
+// and ends so the bar shows it
+func (d *progressDisplay) holdWhilePaused(pause *Pauser, redraw func()) {
+	if !pause.Paused() {
 		return
 	}
-	pr.lastUpdate = time.Now()
+	d.paused, d.lastUpdate = true, time.Time{}
+	redraw()
+	pause.Wait()
+	// The pause says nothing about the connection's speed
+	d.paused, d.lastUpdate, d.speed.lastTime = false, time.Time{}, time.Time{}
+	redraw()
+}
 
-	percent := float64(pr.Current) / float64(pr.Total) * 100
-	width := 40
-	completed := int(float64(width) * (float64(pr.Current) / float64(pr.Total)))
-	
-	bar := strings.Repeat("█", completed) + strings.Repeat("░", width-completed)
-	
-	// Speed calcs
-	duration := time.Since(pr.startTime).Seconds()
-	if duration == 0 { duration = 0.0001 } // Prevent division by zero
-	speed := float64(pr.Current) / (1024 * 1024) / duration // MB/s
-	
-	barStr := string(bar)
-	fmt.Printf("\r⬇️  Downloading... [%s] %.1f%% (%.2f MB/s)", barStr, percent, speed)
-	if pr.Current == pr.Total {
-		fmt.Println() // New line on finish
+func newProgressDisplay(opts ProgressOptions, barLabel, plainLabel string) progressDisplay {
+	out := opts.Out
+	if out == nil {
+		out = os.Stdout
+	}
+	d := progressDisplay{
+		out:        out,
+		plain:      opts.ForcePlain || !isTerminal(out),
+		barLabel:   barLabel,
+		plainLabel: plainLabel,
+		startTime:  time.Now(),
+	}
+	if opts.Sparkline && !d.plain {
+		d.history = &speedHistory{}
 	}
+	return d
 }
 
-func (pw *ProgressWriter) printProgress() {
-	// Only update every 100ms or if complete
-	if pw.Current < pw.Total && time.Since(pw.lastUpdate) < 100*time.Millisecond {
+// isTerminal reports whether w is a file attached to a terminal
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && term.IsTerminal(int(f.Fd()))
+}
+
+// terminalWidth returns the column count of the terminal w is attached
+// to, or 0 if it can't be told
+func terminalWidth(w io.Writer) int {
+	f, ok := w.(*os.File)
+	if !ok {
+		return 0
+	}
+	width, _, err := term.GetSize(int(f.Fd()))
+	if err != nil {
+		return 0
+	}
+	return width
+}
+
+func (d *progressDisplay) render(current, total int64) {
+	// Only update every 100ms (1s for plain logs) or if complete to avoid flashing
+	interval := 100 * time.Millisecond
+	if d.plain {
+		interval = time.Second
+	}
+	if current < total && time.Since(d.lastUpdate) < interval {
 		return
 	}
-	pw.lastUpdate = time.Now()
+	d.lastUpdate = time.Now()
+
+	// An empty transfer is complete from the start
+	done := 1.0
+	if total > 0 {
+		done = min(float64(current)/float64(total), 1)
+	}
+	percent := done * 100
 
-	percent := float64(pw.Current) / float64(pw.Total) * 100
-	width := 40
-	completed := int(float64(width) * (float64(pw.Current) / float64(pw.Total)))
-	
-	bar := strings.Repeat("█", completed) + strings.Repeat("░", width-completed)
-	
 	// Speed calcs
-	duration := time.Since(pw.startTime).Seconds()
+	duration := time.Since(d.startTime).Seconds()
 	if duration == 0 { duration = 0.0001 } // Prevent division by zero
-	speed := float64(pw.Current) / (1024 * 1024) / duration // MB/s
-	
-	fmt.Printf("\r⬆️  Uploading...   [%s] %.1f%% (%.2f MB/s)", bar, percent, speed)
-	if pw.Current == pw.Total {
-		fmt.Println() 
+	speed := float64(current) / (1024 * 1024) / duration // MB/s
+	d.speed.update(current, d.lastUpdate)
+
+	if d.plain {
+		if d.paused {
+			fmt.Fprintf(d.out, "%s %.0f%% (paused)\n", d.plainLabel, percent)
+			return
+		}
+		fmt.Fprintf(d.out, "%s %.0f%% (%.1fMB/s)\n", d.plainLabel, percent, speed)
+		return
+	}
+
+	width := 40
+	completed := int(float64(width) * done)
+	bar := strings.Repeat("█", completed) + strings.Repeat("░", width-completed)
+
+	label, eta := d.barLabel, etaSuffix(current, total, d.speed.rate)
+	if d.paused {
+		label, eta = pausedLabel, ""
+	}
+	line := fmt.Sprintf("%s [%s] %.1f%% (%.2f MB/s)%-14s", label, bar, percent, speed, eta)
+	if d.history != nil {
+		d.history.sample(current, d.lastUpdate)
+		// Only when it fits, leaving the last column free so the cursor
+		// doesn't wrap
+		spark := " " + d.history.sparkline()
+		if w := terminalWidth(d.out); w == 0 || displayWidth(line)+displayWidth(spark) < w {
+			line += spark
+		}
+	}
+	fmt.Fprint(d.out, "\r"+line)
+	if current == total {
+		fmt.Fprintln(d.out) // New line on finish
+	}
+}
+
+// speedSmoothing weights the newest sample in the rolling speed estimate.
+// Higher values react faster to slowdowns but jitter more.
+const speedSmoothing = 0.3
+
+// speedTracker keeps an exponentially smoothed transfer rate so the ETA
+// follows recent throughput rather than the whole-transfer average
+type speedTracker struct {
+	lastBytes int64
+	lastTime  time.Time
+	rate      float64 // bytes per second
+}
+
+func (s *speedTracker) update(current int64, now time.Time) {
+	if s.lastTime.IsZero() {
+		s.lastBytes, s.lastTime = current, now
+		return
+	}
+	elapsed := now.Sub(s.lastTime).Seconds()
+	if elapsed <= 0 {
+		return
 	}
+	instant := float64(current-s.lastBytes) / elapsed
+	if s.rate == 0 {
+		s.rate = instant
+	} else {
+		s.rate = speedSmoothing*instant + (1-speedSmoothing)*s.rate
+	}
+	s.lastBytes, s.lastTime = current, now
+}
+
+// etaSuffix renders " ETA mm:ss" for an in-flight transfer, " ETA --:--"
+// while the speed is unknown or stalled, and nothing once complete
+func etaSuffix(current, total int64, rate float64) string {
+	if current >= total {
+		return ""
+	}
+	if rate < 1 {
+		return " ETA --:--"
+	}
+	secs := int64(float64(total-current) / rate)
+	if secs >= 100*60 {
+		return fmt.Sprintf(" ETA %d:%02d:%02d", secs/3600, (secs/60)%60, secs%60)
+	}
+	return fmt.Sprintf(" ETA %02d:%02d", secs/60, secs%60)
+}
+
+// Sparkline geometry: one character per sample, a sample per half second,
+// so the line shows the last 10s
+const (
+	sparklineLen      = 20
+	sparklineInterval = 500 * time.Millisecond
+)
+
+// sparkBars are the sparkline's levels, lowest first
+var sparkBars = []rune("▁▂▃▄▅▆▇█")
+
+// speedHistory is a ring buffer of the transfer rates over the most
+// recent sampling intervals
+type speedHistory struct {
+	rates     [sparklineLen]float64 // bytes per second
+	n, next   int                   // samples held, slot for the next
+	lastBytes int64
+	lastTime  time.Time
+}
+
+// sample records the rate since the previous sample once at least
+// sparklineInterval has passed, so render's update rate doesn't skew it
+func (h *speedHistory) sample(current int64, now time.Time) {
+	if h.lastTime.IsZero() {
+		h.lastBytes, h.lastTime = current, now
+		return
+	}
+	elapsed := now.Sub(h.lastTime)
+	if elapsed < sparklineInterval {
+		return
+	}
+	h.rates[h.next] = float64(current-h.lastBytes) / elapsed.Seconds()
+	h.next = (h.next + 1) % sparklineLen
+	if h.n < sparklineLen {
+		h.n++
+	}
+	h.lastBytes, h.lastTime = current, now
+}
+
+// sparkline renders the samples oldest first, scaled to the fastest, and
+// padded to sparklineLen so the line's width doesn't change as it fills
+func (h *speedHistory) sparkline() string {
+	var peak float64
+	for i := 0; i < h.n; i++ {
+		peak = max(peak, h.rates[i])
+	}
+	var b strings.Builder
+	b.WriteString(strings.Repeat(" ", sparklineLen-h.n))
+	for i := 0; i < h.n; i++ {
+		rate := h.rates[(h.next-h.n+i+sparklineLen)%sparklineLen]
+		level := 0
+		if peak > 0 {
+			level = int(rate / peak * float64(len(sparkBars)-1))
+		}
+		b.WriteRune(sparkBars[level])
+	}
+	return b.String()
+}
+
+// displayWidth estimates the terminal columns s takes. Counting runes
+// gets the bar labels right too: the emoji variation selector (U+FE0F)
+// after their arrows stands in for the arrow's second column.
+func displayWidth(s string) int {
+	return utf8.RuneCountInString(s)
 }
@@ -0,0 +1,78 @@
+package ui
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestSpeedHistorySparkline(t *testing.T) {
+	var h speedHistory
+	start := time.Now()
+	h.sample(0, start)
+	if got := h.sparkline(); got != strings.Repeat(" ", sparklineLen) {
+		t.Fatalf("empty sparkline = %q, want blanks", got)
+	}
+
+	// Renders closer together than the interval don't make samples
+	h.sample(100, start.Add(sparklineInterval/2))
+	if h.n != 0 {
+		t.Fatalf("%d samples after half an interval, want 0", h.n)
+	}
+
+	// 1000, 500, then nothing per interval: a falling line
+	now := start
+	current := int64(0)
+	for _, bytes := range []int64{1000, 500, 0} {
+		now = now.Add(sparklineInterval)
+		current += bytes
+		h.sample(current, now)
+	}
+	want := strings.Repeat(" ", sparklineLen-3) + "█▄▁"
+	if got := h.sparkline(); got != want {
+		t.Errorf("sparkline = %q, want %q", got, want)
+	}
+
+	// Once full, the oldest samples scroll off the left
+	for i := 0; i < sparklineLen; i++ {
+		now = now.Add(sparklineInterval)
+		current += 100
+		h.sample(current, now)
+	}
+	if got := h.sparkline(); got != strings.Repeat("█", sparklineLen) {
+		t.Errorf("steady sparkline = %q, want all full", got)
+	}
+	if n := utf8.RuneCountInString(h.sparkline()); n != sparklineLen {
+		t.Errorf("sparkline is %d wide, want %d", n, sparklineLen)
+	}
+}
+
+func TestSparklineOnlyOnBar(t *testing.T) {
+	var out strings.Builder
+	plain := newProgressDisplay(ProgressOptions{Out: &out, Sparkline: true}, "", "")
+	if plain.history != nil {
+		t.Error("plain output keeps a speed history")
+	}
+}
+
+func TestEmptyTransferRendersComplete(t *testing.T) {
+	for _, plain := range []bool{false, true} {
+		var out strings.Builder
+		d := newProgressDisplay(ProgressOptions{Out: &out}, "⬇️  Downloading...", "Downloaded")
+		d.plain = plain
+		d.render(0, 0)
+
+		got := out.String()
+		if strings.Contains(got, "NaN") || strings.Contains(got, "░") {
+			t.Errorf("plain=%v: empty transfer drawn as %q", plain, got)
+		}
+		want := "100.0%"
+		if plain {
+			want = "100%"
+		}
+		if !strings.Contains(got, want) {
+			t.Errorf("plain=%v: empty transfer drawn as %q, want %s", plain, got, want)
+		}
+	}
+}
@@ -1,12 +1,7 @@
 package handler
 
 import (
-	"fmt"
-	"html/template"
-	"io"
 	"net/http"
-	"os"
-	"path/filepath"
     "embed"
 )
 